@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newAdminTestServer starts a server with auth on and returns a function
+// making requests to it as the admin, through basic auth like a browser.
+func newAdminTestServer(t *testing.T, cache Cache) (*Server, *httptest.Server, func(method, path, body string) (*http.Response, CacheResponse)) {
+	t.Helper()
+	server := NewServer(cache, nil)
+	server.SetAuth(newTestAuthStore(t), nil)
+	ts := httptest.NewServer(server.setupRoutes())
+	t.Cleanup(ts.Close)
+
+	request := func(method, path, body string) (*http.Response, CacheResponse) {
+		t.Helper()
+		req, _ := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.SetBasicAuth("ops", "admin-secret")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		defer resp.Body.Close()
+		var decoded CacheResponse
+		json.NewDecoder(resp.Body).Decode(&decoded)
+		return resp, decoded
+	}
+	return server, ts, request
+}
+
+func TestAdmin_Dashboard(t *testing.T) {
+	_, ts, _ := newAdminTestServer(t, NewSimpleCache())
+
+	get := func(path, password string) (*http.Response, string) {
+		req, _ := http.NewRequest(http.MethodGet, ts.URL+path, nil)
+		if password != "" {
+			req.SetBasicAuth("ops", password)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp, string(body)
+	}
+
+	resp, _ := get("/admin/", "")
+	if resp.StatusCode != http.StatusUnauthorized || !strings.HasPrefix(resp.Header.Get("WWW-Authenticate"), "Basic ") {
+		t.Errorf("Expected 401 with a basic auth challenge, got %d %q", resp.StatusCode, resp.Header.Get("WWW-Authenticate"))
+	}
+	if resp, _ := get("/admin/api/entries", "reader-secret"); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("Expected a read-only key to be refused, got %d", resp.StatusCode)
+	}
+
+	resp, body := get("/admin/", "admin-secret")
+	if resp.StatusCode != http.StatusOK || !strings.Contains(body, `src="admin.js"`) {
+		t.Fatalf("Expected the dashboard, got %d", resp.StatusCode)
+	}
+	for _, asset := range []string{"admin.js", "admin.css"} {
+		resp, body := get("/admin/"+asset, "admin-secret")
+		if resp.StatusCode != http.StatusOK || body == "" {
+			t.Errorf("Expected %s to be served, got %d", asset, resp.StatusCode)
+		}
+		if strings.Contains(body, "http://") || strings.Contains(body, "https://") {
+			t.Errorf("Expected %s to load nothing from elsewhere", asset)
+		}
+	}
+}
+
+func TestAdmin_Entries(t *testing.T) {
+	cache, _ := NewTTLCache(time.Hour)
+	defer cache.Close()
+	for _, key := range []string{"user:3", "user:1", "session:a", "USER:2", "session:b"} {
+		cache.Set(key, "value")
+	}
+	cache.Set("doc", map[string]interface{}{"n": 1.0})
+	_, _, request := newAdminTestServer(t, cache)
+
+	type page struct {
+		Total   int          `json:"total"`
+		Entries []adminEntry `json:"entries"`
+		Next    string       `json:"next"`
+	}
+	list := func(query string) page {
+		t.Helper()
+		resp, body := request(http.MethodGet, "/admin/api/entries?"+query, "")
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("Expected a page, got %d: %s", resp.StatusCode, body.Error)
+		}
+		var p page
+		data, _ := json.Marshal(body.Data)
+		json.Unmarshal(data, &p)
+		return p
+	}
+	keys := func(p page) string {
+		var names []string
+		for _, e := range p.Entries {
+			names = append(names, e.Key)
+		}
+		return strings.Join(names, ",")
+	}
+
+	first := list("q=user&limit=2")
+	if first.Total != 3 || keys(first) != "USER:2,user:1" || first.Next != "user:1" {
+		t.Fatalf("Unexpected first page: %+v", first)
+	}
+	second := list("q=user&limit=2&after=" + first.Next)
+	if keys(second) != "user:3" || second.Next != "" {
+		t.Errorf("Unexpected second page: %+v", second)
+	}
+
+	all := list("")
+	if all.Total != 6 {
+		t.Fatalf("Expected every key, got %+v", all)
+	}
+	// Upper case sorts first.
+	e := all.Entries[1]
+	if e.Key != "doc" || e.Type != "json" || e.Size != len(`{"n":1}`) || e.TTL < 3599 || e.Expires == nil {
+		t.Errorf("Unexpected entry %+v", e)
+	}
+
+	if resp, _ := request(http.MethodGet, "/admin/api/entries?limit=0", ""); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a bad limit, got %d", resp.StatusCode)
+	}
+}
+
+func TestAdmin_EditEntry(t *testing.T) {
+	cache, _ := NewTTLCache(time.Hour)
+	defer cache.Close()
+	_, _, request := newAdminTestServer(t, cache)
+
+	if resp, _ := request(http.MethodPut, "/admin/api/entries/a%2Fb?ttl=1m", `{"n": 1}`); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("Expected the key to be created, got %d", resp.StatusCode)
+	}
+	resp, body := request(http.MethodGet, "/admin/api/entries/a%2Fb", "")
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("ETag") == "" {
+		t.Fatalf("Expected the value with its ETag, got %d", resp.StatusCode)
+	}
+	if got, _ := json.Marshal(body.Data); string(got) != `{"n":1}` {
+		t.Errorf("Expected the stored value, got %s", got)
+	}
+
+	resp, body = request(http.MethodPatch, "/admin/api/entries/a%2Fb?ttl=2h", "")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected the TTL to change, got %d: %s", resp.StatusCode, body.Error)
+	}
+	if entry, _, _ := cache.GetEntry("a/b"); entry.TTL(time.Now()) < time.Hour || entry.Value == nil {
+		t.Errorf("Expected the value kept with a 2h TTL, got %+v", entry)
+	}
+	if resp, _ := request(http.MethodPatch, "/admin/api/entries/a%2Fb", ""); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected 400 without a TTL, got %d", resp.StatusCode)
+	}
+	if resp, _ := request(http.MethodPatch, "/admin/api/entries/missing?ttl=1m", ""); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected 404 for a missing key, got %d", resp.StatusCode)
+	}
+
+	if resp, _ := request(http.MethodDelete, "/admin/api/entries/a%2Fb", ""); resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected the key to be deleted, got %d", resp.StatusCode)
+	}
+	if resp, _ := request(http.MethodPost, "/admin/api/entries/a%2Fb", ""); resp.StatusCode != http.StatusMethodNotAllowed || resp.Header.Get("Allow") != adminEntryMethods {
+		t.Errorf("Expected 405 with Allow, got %d %q", resp.StatusCode, resp.Header.Get("Allow"))
+	}
+}
+
+func TestAdmin_Events(t *testing.T) {
+	cache := NewSimpleCache()
+	cache.Set("a", "1")
+	server, ts, request := newAdminTestServer(t, cache)
+
+	read := func(path string) {
+		req, _ := http.NewRequest(http.MethodGet, ts.URL+path, nil)
+		req.Header.Set(apiKeyHeader, "reader-secret")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		resp.Body.Close()
+	}
+	read("/api/v2/keys/a")
+	read("/api/cache/get?key=b")
+	read("/health")
+	request(http.MethodGet, "/admin/api/entries", "")
+
+	if resp, _ := request(http.MethodGet, "/admin/api/events?interval=1ms", ""); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected 400 for too short an interval, got %d", resp.StatusCode)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, ts.URL+"/admin/api/events?interval=250ms", nil)
+	req.SetBasicAuth("", "admin-secret")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("Expected an event stream, got %q", resp.Header.Get("Content-Type"))
+	}
+
+	// Requests are counted once their handler returns, which may be just
+	// after the client has its response, so wait for a sample counting them.
+	lines := bufio.NewScanner(resp.Body)
+	until := func(requests uint64) adminStats {
+		t.Helper()
+		var event string
+		for lines.Scan() {
+			line := lines.Text()
+			if name, ok := strings.CutPrefix(line, "event: "); ok {
+				event = name
+			}
+			if data, ok := strings.CutPrefix(line, "data: "); ok && event == "stats" {
+				var stats adminStats
+				if err := json.Unmarshal([]byte(data), &stats); err != nil {
+					t.Fatalf("Invalid event data %q: %v", data, err)
+				}
+				if stats.Requests >= requests {
+					return stats
+				}
+			}
+		}
+		t.Fatalf("Stream ended: %v", lines.Err())
+		return adminStats{}
+	}
+
+	// Health checks and the dashboard's own requests are not counted.
+	stats := until(2)
+	if stats.Requests != 2 || stats.Hits != 1 || stats.Misses != 1 || stats.Keys != 1 || stats.HeapBytes == 0 {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+	read("/api/v2/keys/a")
+	if stats := until(3); stats.Requests != 3 || stats.Hits != 2 {
+		t.Errorf("Expected the next sample to count the new hit, got %+v", stats)
+	}
+
+	// Shutdown ends the stream instead of waiting for the client.
+	server.closeStreams()
+	for lines.Scan() {
+	}
+	if ctx.Err() != nil {
+		t.Error("Expected the stream to end on shutdown")
+	}
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrUnknownAPIKey = errors.New("unknown API key")
+
+// Access is the permission level of a grant. Each level includes the ones
+// below it.
+type Access int
+
+const (
+	AccessNone Access = iota
+	AccessRead
+	AccessWrite
+	AccessAdmin
+)
+
+var accessNames = map[Access]string{
+	AccessNone:  "none",
+	AccessRead:  "read",
+	AccessWrite: "write",
+	AccessAdmin: "admin",
+}
+
+func (a Access) String() string {
+	if name, ok := accessNames[a]; ok {
+		return name
+	}
+	return fmt.Sprintf("Access(%d)", int(a))
+}
+
+func (a Access) MarshalText() ([]byte, error) {
+	return []byte(a.String()), nil
+}
+
+func (a *Access) UnmarshalText(text []byte) error {
+	for access, name := range accessNames {
+		if access != AccessNone && name == string(text) {
+			*a = access
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown access %q, want read, write or admin", text)
+}
+
+// Grant gives access to every cache key starting with Prefix. An empty
+// prefix covers all keys and the endpoints that are not about one key.
+type Grant struct {
+	Prefix string `json:"prefix"`
+	Access Access `json:"access"`
+}
+
+// APIKey is one entry of the keys file. Secret may be given in plain text;
+// rotation replaces it with SecretSHA256 so the file stops holding it.
+// ReadLimit and WriteLimit override the server's rate limits for this key.
+type APIKey struct {
+	ID           string     `json:"id"`
+	Secret       string     `json:"secret,omitempty"`
+	SecretSHA256 string     `json:"secret_sha256,omitempty"`
+	Grants       []Grant    `json:"grants"`
+	ReadLimit    *RateLimit `json:"read_limit,omitempty"`
+	WriteLimit   *RateLimit `json:"write_limit,omitempty"`
+}
+
+// Allows reports whether the key has at least need on key.
+func (k APIKey) Allows(need Access, key string) bool {
+	for _, g := range k.Grants {
+		if g.Access >= need && strings.HasPrefix(key, g.Prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+type authFile struct {
+	Keys []APIKey `json:"keys"`
+}
+
+// AuthStore holds the API keys loaded from a JSON file of the form
+// {"keys": [{"id": ..., "secret": ..., "grants": [...]}]}.
+type AuthStore struct {
+	path string
+
+	mu      sync.RWMutex
+	keys    []APIKey
+	byHash  map[[sha256.Size]byte]int
+	modTime time.Time
+}
+
+func LoadAuthStore(path string) (*AuthStore, error) {
+	a := &AuthStore{path: path}
+	if err := a.Reload(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// Reload re-reads the keys file. On error the current keys stay in force.
+func (a *AuthStore) Reload() error {
+	info, err := os.Stat(a.path)
+	if err != nil {
+		return fmt.Errorf("auth: %w", err)
+	}
+	data, err := os.ReadFile(a.path)
+	if err != nil {
+		return fmt.Errorf("auth: %w", err)
+	}
+
+	var file authFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return fmt.Errorf("auth: %s: %w", a.path, err)
+	}
+	byHash, err := indexAPIKeys(file.Keys)
+	if err != nil {
+		return fmt.Errorf("auth: %s: %w", a.path, err)
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.keys = file.Keys
+	a.byHash = byHash
+	a.modTime = info.ModTime()
+	return nil
+}
+
+func indexAPIKeys(keys []APIKey) (map[[sha256.Size]byte]int, error) {
+	byHash := make(map[[sha256.Size]byte]int, len(keys))
+	ids := make(map[string]bool, len(keys))
+	for i, k := range keys {
+		if k.ID == "" {
+			return nil, fmt.Errorf("key %d has no id", i)
+		}
+		if ids[k.ID] {
+			return nil, fmt.Errorf("duplicate key id %q", k.ID)
+		}
+		ids[k.ID] = true
+
+		hash, err := secretHash(k)
+		if err != nil {
+			return nil, fmt.Errorf("key %q: %w", k.ID, err)
+		}
+		if _, dup := byHash[hash]; dup {
+			return nil, fmt.Errorf("key %q reuses another key's secret", k.ID)
+		}
+		byHash[hash] = i
+	}
+	return byHash, nil
+}
+
+func secretHash(k APIKey) ([sha256.Size]byte, error) {
+	var hash [sha256.Size]byte
+	switch {
+	case k.Secret != "" && k.SecretSHA256 != "":
+		return hash, errors.New("set either secret or secret_sha256, not both")
+	case k.Secret != "":
+		return sha256.Sum256([]byte(k.Secret)), nil
+	case k.SecretSHA256 != "":
+		raw, err := hex.DecodeString(k.SecretSHA256)
+		if err != nil || len(raw) != sha256.Size {
+			return hash, errors.New("secret_sha256 must be 64 hex digits")
+		}
+		copy(hash[:], raw)
+		return hash, nil
+	}
+	return hash, errors.New("missing secret")
+}
+
+// reloadIfChanged reloads the file when its modification time moved.
+func (a *AuthStore) reloadIfChanged() (bool, error) {
+	info, err := os.Stat(a.path)
+	if err != nil {
+		return false, fmt.Errorf("auth: %w", err)
+	}
+	a.mu.RLock()
+	unchanged := info.ModTime().Equal(a.modTime)
+	a.mu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+	return true, a.Reload()
+}
+
+// Watch reloads the keys file whenever it changes, checking every interval,
+// until stop is called. Failed reloads are passed to onError.
+func (a *AuthStore) Watch(interval time.Duration, onError func(error)) (stop func()) {
+	ticker := time.NewTicker(interval)
+	done := make(chan struct{})
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if _, err := a.reloadIfChanged(); err != nil && onError != nil {
+					onError(err)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	var once sync.Once
+	return func() { once.Do(func() { close(done) }) }
+}
+
+// Authenticate returns the key whose secret is token. Only hashes are
+// compared, so lookup time does not depend on how much of a secret matched.
+func (a *AuthStore) Authenticate(token string) (APIKey, bool) {
+	if token == "" {
+		return APIKey{}, false
+	}
+	hash := sha256.Sum256([]byte(token))
+
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	i, ok := a.byHash[hash]
+	if !ok {
+		return APIKey{}, false
+	}
+	return a.keys[i], true
+}
+
+// Keys lists the configured keys without their secrets.
+func (a *AuthStore) Keys() []APIKey {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	keys := make([]APIKey, len(a.keys))
+	for i, k := range a.keys {
+		keys[i] = APIKey{ID: k.ID, Grants: k.Grants, ReadLimit: k.ReadLimit, WriteLimit: k.WriteLimit}
+	}
+	return keys
+}
+
+// Rotate gives key id a new random secret, which is returned once. The old
+// secret stops working immediately and the file is rewritten with only the
+// new secret's hash.
+func (a *AuthStore) Rotate(id string) (string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	secret := hex.EncodeToString(raw)
+	sum := sha256.Sum256([]byte(secret))
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	i := -1
+	for j, k := range a.keys {
+		if k.ID == id {
+			i = j
+		}
+	}
+	if i < 0 {
+		return "", fmt.Errorf("%w: %q", ErrUnknownAPIKey, id)
+	}
+
+	keys := make([]APIKey, len(a.keys))
+	copy(keys, a.keys)
+	keys[i].Secret = ""
+	keys[i].SecretSHA256 = hex.EncodeToString(sum[:])
+	byHash, err := indexAPIKeys(keys)
+	if err != nil {
+		return "", err
+	}
+
+	data, err := json.MarshalIndent(authFile{Keys: keys}, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	if err := writeFileAtomic(a.path, append(data, '\n')); err != nil {
+		return "", fmt.Errorf("auth: saving %s: %w", a.path, err)
+	}
+	if info, err := os.Stat(a.path); err == nil {
+		a.modTime = info.ModTime()
+	}
+	a.keys = keys
+	a.byHash = byHash
+	return secret, nil
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testKeysFile = `{"keys": [
+	{"id": "admin", "secret": "admin-secret", "grants": [{"prefix": "", "access": "admin"}]},
+	{"id": "users-rw", "secret": "users-secret", "grants": [{"prefix": "users/", "access": "write"}]},
+	{"id": "reader", "secret": "reader-secret", "grants": [{"prefix": "", "access": "read"}]}
+]}`
+
+func newTestAuthStore(t *testing.T) *AuthStore {
+	t.Helper()
+	store, err := LoadAuthStore(writeConfigFile(t, "keys.json", testKeysFile))
+	if err != nil {
+		t.Fatalf("Failed to load keys: %v", err)
+	}
+	return store
+}
+
+func TestAuthStore_Grants(t *testing.T) {
+	store := newTestAuthStore(t)
+
+	if _, ok := store.Authenticate("wrong"); ok {
+		t.Error("Expected an unknown secret to be rejected")
+	}
+	users, ok := store.Authenticate("users-secret")
+	if !ok || users.ID != "users-rw" {
+		t.Fatalf("Expected users-rw, got %+v", users)
+	}
+
+	tests := []struct {
+		key    APIKey
+		need   Access
+		target string
+		want   bool
+	}{
+		{users, AccessRead, "users/42", true},
+		{users, AccessWrite, "users/42", true},
+		{users, AccessAdmin, "users/42", false},
+		{users, AccessRead, "orders/1", false},
+		{users, AccessRead, "", false},
+	}
+	for _, tt := range tests {
+		if got := tt.key.Allows(tt.need, tt.target); got != tt.want {
+			t.Errorf("%s Allows(%s, %q) = %v, want %v", tt.key.ID, tt.need, tt.target, got, tt.want)
+		}
+	}
+}
+
+func TestAuthStore_InvalidFiles(t *testing.T) {
+	tests := map[string]string{
+		"duplicate id":   `{"keys": [{"id": "a", "secret": "x"}, {"id": "a", "secret": "y"}]}`,
+		"missing secret": `{"keys": [{"id": "a"}]}`,
+		"shared secret":  `{"keys": [{"id": "a", "secret": "x"}, {"id": "b", "secret": "x"}]}`,
+		"bad hash":       `{"keys": [{"id": "a", "secret_sha256": "abc"}]}`,
+		"bad access":     `{"keys": [{"id": "a", "secret": "x", "grants": [{"access": "root"}]}]}`,
+	}
+	for name, content := range tests {
+		if _, err := LoadAuthStore(writeConfigFile(t, "keys.json", content)); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestAuthStore_RotateAndReload(t *testing.T) {
+	store := newTestAuthStore(t)
+
+	secret, err := store.Rotate("users-rw")
+	if err != nil {
+		t.Fatalf("Rotate failed: %v", err)
+	}
+	if _, ok := store.Authenticate("users-secret"); ok {
+		t.Error("Expected the old secret to stop working")
+	}
+	if k, ok := store.Authenticate(secret); !ok || k.ID != "users-rw" {
+		t.Errorf("Expected the new secret to authenticate users-rw, got %+v", k)
+	}
+
+	data, _ := os.ReadFile(store.path)
+	if strings.Contains(string(data), "users-secret") || strings.Contains(string(data), secret) {
+		t.Error("Expected the rewritten file to hold only a hash of the new secret")
+	}
+	if _, err := store.Rotate("nobody"); err == nil {
+		t.Error("Expected rotating an unknown key to fail")
+	}
+
+	// Editing the file by hand is picked up by the watcher's check.
+	edited := strings.Replace(string(data), `"reader"`, `"viewer"`, 1)
+	os.WriteFile(store.path, []byte(edited), 0o600)
+	os.Chtimes(store.path, time.Now(), time.Now().Add(time.Second))
+	if changed, err := store.reloadIfChanged(); !changed || err != nil {
+		t.Fatalf("Expected a reload, got changed=%v, err=%v", changed, err)
+	}
+	if k, _ := store.Authenticate("reader-secret"); k.ID != "viewer" {
+		t.Errorf("Expected the renamed key after reload, got %+v", k)
+	}
+
+	os.WriteFile(store.path, []byte("{not json"), 0o600)
+	os.Chtimes(store.path, time.Now(), time.Now().Add(2*time.Second))
+	if _, err := store.reloadIfChanged(); err == nil {
+		t.Error("Expected a broken file to fail to reload")
+	}
+	if _, ok := store.Authenticate(secret); !ok {
+		t.Error("Expected a failed reload to keep the current keys")
+	}
+}
+
+func TestServer_Auth(t *testing.T) {
+	var audit bytes.Buffer
+	server := NewServer(NewSimpleCache(), nil)
+	server.SetAuth(newTestAuthStore(t), slog.New(slog.NewJSONHandler(&audit, nil)))
+	ts := httptest.NewServer(server.setupRoutes())
+	defer ts.Close()
+
+	request := func(method, path, token, body string) *http.Response {
+		req, _ := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	resp := request(http.MethodGet, "/api/v2/keys/users%2F1", "", "")
+	if resp.StatusCode != http.StatusUnauthorized || resp.Header.Get("WWW-Authenticate") == "" {
+		t.Errorf("Expected 401 with WWW-Authenticate, got %d", resp.StatusCode)
+	}
+	if resp := request(http.MethodPut, "/api/v2/keys/users%2F1", "users-secret", `"a"`); resp.StatusCode != http.StatusCreated {
+		t.Errorf("Expected a write inside the prefix to succeed, got %d", resp.StatusCode)
+	}
+	if resp := request(http.MethodPut, "/api/v2/keys/orders%2F1", "users-secret", `"a"`); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("Expected 403 outside the prefix, got %d", resp.StatusCode)
+	}
+	if resp := request(http.MethodDelete, "/api/cache/delete?key=users/1", "reader-secret", ""); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("Expected 403 for a delete with read access, got %d", resp.StatusCode)
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, ts.URL+"/api/cache/get?key=users/1", nil)
+	req.Header.Set(apiKeyHeader, "reader-secret")
+	if resp, err := http.DefaultClient.Do(req); err != nil || resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected X-API-Key to authenticate, got %v %v", resp, err)
+	}
+
+	if resp := request(http.MethodGet, "/health", "", ""); resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected /health to stay public, got %d", resp.StatusCode)
+	}
+	if resp := request(http.MethodGet, "/api/admin/keys", "reader-secret", ""); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("Expected admin endpoints to need admin access, got %d", resp.StatusCode)
+	}
+	if resp := request(http.MethodGet, "/api/admin/keys", "admin-secret", ""); resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected the admin key to list keys, got %d", resp.StatusCode)
+	}
+
+	logged := audit.String()
+	if strings.Count(logged, `"msg":"access denied"`) != 4 {
+		t.Errorf("Expected four audited denials, got:\n%s", logged)
+	}
+	if !strings.Contains(logged, `"api_key":"users-rw"`) || !strings.Contains(logged, `"key":"orders/1"`) {
+		t.Errorf("Expected the audit log to name the key and target, got:\n%s", logged)
+	}
+	if strings.Contains(logged, "secret") {
+		t.Error("Expected the audit log not to contain secrets")
+	}
+}
+
+func TestNewAuthFromConfig_AuditLogSealed(t *testing.T) {
+	keys := "k1:" + base64.StdEncoding.EncodeToString(make([]byte, 32))
+	keyring, _ := ParseKeyring(keys)
+	cfg := ServerConfig{
+		AuthKeysFile: writeConfigFile(t, "keys.json", testKeysFile),
+		AuditLog:     filepath.Join(t.TempDir(), "audit.log"),
+	}
+	_, audit, err := newAuthFromConfig(cfg, keyring)
+	if err != nil {
+		t.Fatalf("newAuthFromConfig failed: %v", err)
+	}
+	audit.Warn("access denied", "api_key", "reader")
+	audit.Warn("access denied", "api_key", "writer")
+
+	data, _ := os.ReadFile(cfg.AuditLog)
+	if bytes.Contains(data, []byte("reader")) || bytes.Count(data, []byte("\n")) != 2 {
+		t.Fatalf("Expected two sealed lines, got %q", data)
+	}
+
+	// A torn last line is skipped, the records before it still read.
+	os.WriteFile(cfg.AuditLog, append(data, "Q0VOQwE"...), 0o600)
+	t.Setenv("CACHE_ENCRYPTION_KEYS", keys)
+	var stdout, stderr bytes.Buffer
+	if code := runAudit([]string{cfg.AuditLog}, nil, &stdout, &stderr); code != exitOK {
+		t.Fatalf("Expected audit to succeed, got %d: %s", code, stderr.String())
+	}
+	var ids []string
+	for _, line := range strings.Split(strings.TrimSpace(stdout.String()), "\n") {
+		var record map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatalf("Expected JSON records, got %q", stdout.String())
+		}
+		ids = append(ids, record["api_key"].(string))
+	}
+	if strings.Join(ids, ",") != "reader,writer" {
+		t.Errorf("Expected the records of reader and writer, got %v", ids)
+	}
+
+	t.Setenv("CACHE_ENCRYPTION_KEYS", "")
+	if code := runAudit([]string{cfg.AuditLog}, nil, &stdout, &stderr); code != exitError {
+		t.Errorf("Expected audit without keys to fail, got %d", code)
+	}
+}
+
+func TestServer_AuditLogRedactsKeys(t *testing.T) {
+	cfg := ServerConfig{
+		AuthKeysFile:  writeConfigFile(t, "keys.json", testKeysFile),
+		AuditLog:      filepath.Join(t.TempDir(), "audit.log"),
+		LogRedactKeys: []string{"orders/*"},
+	}
+	store, audit, err := newAuthFromConfig(cfg, nil)
+	if err != nil {
+		t.Fatalf("newAuthFromConfig failed: %v", err)
+	}
+	server := NewServer(NewSimpleCache(), nil)
+	server.SetAuth(store, audit)
+	ts := httptest.NewServer(server.setupRoutes())
+	defer ts.Close()
+
+	for path, method := range map[string]string{"/api/v2/keys/orders%2F1": http.MethodPut, "/api/cache/set?key=orders/2": http.MethodPost} {
+		req, _ := http.NewRequest(method, ts.URL+path, strings.NewReader(`"a"`))
+		req.Header.Set(apiKeyHeader, "reader-secret")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		resp.Body.Close()
+	}
+
+	data, _ := os.ReadFile(cfg.AuditLog)
+	logged := string(data)
+	if strings.Count(logged, `"key":"[REDACTED]"`) != 2 || strings.Contains(logged, "orders") {
+		t.Errorf("Expected both denials with their keys redacted, got:\n%s", logged)
+	}
+}
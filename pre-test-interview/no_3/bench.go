@@ -0,0 +1,502 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"math/bits"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+)
+
+const benchUsage = `Usage: go run . bench [flags]
+
+Runs a load test against -server, or against a server started in this
+process when -server is empty, and reports throughput, latency percentiles
+and the hit ratio of reads.
+
+Flags:
+`
+
+// benchConfig is one load test, echoed in the JSON report so runs can be
+// compared.
+type benchConfig struct {
+	Target       string        `json:"target"`
+	Concurrency  int           `json:"concurrency"`
+	Duration     time.Duration `json:"duration"`
+	ReadRatio    float64       `json:"read_ratio"`
+	Keys         int           `json:"keys"`
+	Distribution string        `json:"distribution"`
+	ZipfS        float64       `json:"zipf_s,omitempty"`
+	ValueMin     int           `json:"value_min"`
+	ValueMax     int           `json:"value_max"`
+	KeyPrefix    string        `json:"key_prefix"`
+	Prefill      bool          `json:"prefill"`
+}
+
+// runBench runs `go run . bench` and returns its exit code.
+func runBench(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("bench", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	server := fs.String("server", "", "base URL of the server; empty to start one in this process")
+	apiKey := fs.String("api-key", os.Getenv("CACHE_API_KEY"), "API key sent as X-API-Key (env CACHE_API_KEY)")
+	cacheType := fs.String("type", cacheTypeTTL, "cache type of the in-process server, ttl or simple")
+	ttl := fs.Duration("ttl", 5*time.Minute, "entry lifetime of the in-process ttl cache")
+	concurrency := fs.Int("c", 16, "number of concurrent workers")
+	duration := fs.Duration("d", 10*time.Second, "how long to run")
+	reads := fs.Float64("reads", 0.9, "fraction of requests that are reads, 0 to 1")
+	keys := fs.Int("keys", 10000, "number of distinct keys")
+	dist := fs.String("dist", "uniform", "key distribution, uniform or zipf")
+	zipfS := fs.Float64("zipf-s", 1.1, "skew of the zipf distribution, above 1")
+	valueSize := fs.String("value-size", "256", "value size in bytes, N or MIN-MAX")
+	prefix := fs.String("prefix", "bench:", "prefix of the keys used")
+	prefill := fs.Bool("prefill", true, "write every key once before the run")
+	output := fs.String("o", "table", "output format, table or json")
+	fs.Usage = func() {
+		fmt.Fprint(stderr, benchUsage)
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return exitOK
+		}
+		return exitError
+	}
+
+	cfg := benchConfig{
+		Target:       *server,
+		Concurrency:  *concurrency,
+		Duration:     *duration,
+		ReadRatio:    *reads,
+		Keys:         *keys,
+		Distribution: *dist,
+		KeyPrefix:    *prefix,
+		Prefill:      *prefill,
+	}
+	if cfg.Distribution == "zipf" {
+		cfg.ZipfS = *zipfS
+	}
+	var err error
+	if cfg.ValueMin, cfg.ValueMax, err = parseValueSize(*valueSize); err != nil {
+		fmt.Fprintln(stderr, "error:", err)
+		return exitError
+	}
+	if err := cfg.validate(); err != nil {
+		fmt.Fprintln(stderr, "error:", err)
+		return exitError
+	}
+	if *output != "table" && *output != "json" {
+		fmt.Fprintln(stderr, "error: -o must be table or json")
+		return exitError
+	}
+
+	if cfg.Target == "" {
+		base, stop, err := startBenchServer(*cacheType, *ttl)
+		if err != nil {
+			fmt.Fprintln(stderr, "error:", err)
+			return exitError
+		}
+		defer stop()
+		*server = base
+		cfg.Target = "in-process " + *cacheType + " cache"
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	client := &cacheClient{
+		base:   strings.TrimSuffix(*server, "/"),
+		apiKey: *apiKey,
+		http: &http.Client{
+			Timeout:       10 * time.Second,
+			Transport:     &http.Transport{MaxIdleConnsPerHost: cfg.Concurrency},
+			CheckRedirect: keepKeyOnSameHost,
+		},
+	}
+	report, err := runLoad(ctx, client, cfg)
+	if err != nil {
+		fmt.Fprintln(stderr, "error:", err)
+		return exitError
+	}
+
+	if *output == "json" {
+		enc := json.NewEncoder(stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(report)
+	} else {
+		report.print(stdout)
+	}
+	if report.Errors > 0 && report.Errors == report.Requests {
+		return exitError
+	}
+	return exitOK
+}
+
+func (cfg benchConfig) validate() error {
+	switch {
+	case cfg.Concurrency < 1:
+		return errors.New("-c must be at least 1")
+	case cfg.Duration <= 0:
+		return errors.New("-d must be positive")
+	case cfg.ReadRatio < 0 || cfg.ReadRatio > 1:
+		return errors.New("-reads must be between 0 and 1")
+	case cfg.Keys < 1:
+		return errors.New("-keys must be at least 1")
+	case cfg.Distribution != "uniform" && cfg.Distribution != "zipf":
+		return errors.New("-dist must be uniform or zipf")
+	case cfg.Distribution == "zipf" && cfg.ZipfS <= 1:
+		return errors.New("-zipf-s must be above 1")
+	}
+	return nil
+}
+
+// parseValueSize reads "N" or "MIN-MAX".
+func parseValueSize(s string) (min, max int, err error) {
+	lo, hi, isRange := strings.Cut(s, "-")
+	if min, err = strconv.Atoi(lo); err == nil && isRange {
+		max, err = strconv.Atoi(hi)
+	} else {
+		max = min
+	}
+	if err != nil || min < 1 || max < min {
+		return 0, 0, fmt.Errorf("invalid -value-size %q, want N or MIN-MAX with 1 <= MIN <= MAX", s)
+	}
+	return min, max, nil
+}
+
+// startBenchServer serves a fresh cache on a loopback port and returns its
+// URL.
+func startBenchServer(cacheType string, ttl time.Duration) (string, func(), error) {
+	cfg := defaultServerConfig()
+	cfg.CacheType, cfg.TTL = cacheType, ttl
+	cache, closer, err := newCacheFromConfig(cfg)
+	if err != nil {
+		return "", nil, err
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", nil, err
+	}
+	httpServer := &http.Server{Handler: NewServer(cache, closer).setupRoutes()}
+	go httpServer.Serve(ln)
+	return "http://" + ln.Addr().String(), func() {
+		httpServer.Close()
+		if closer != nil {
+			closer.Close()
+		}
+	}, nil
+}
+
+// benchWorker holds what one worker records, merged once the run is over.
+type benchWorker struct {
+	reads, writes        histogram
+	hits, misses, errors uint64
+	firstErr             error
+}
+
+func runLoad(ctx context.Context, client *cacheClient, cfg benchConfig) (*benchReport, error) {
+	value := make([]byte, cfg.ValueMax)
+	rand.New(rand.NewSource(1)).Read(value)
+
+	if cfg.Prefill {
+		if err := prefill(ctx, client, cfg, value); err != nil {
+			return nil, fmt.Errorf("prefill failed: %w", err)
+		}
+	}
+
+	runCtx, cancel := context.WithTimeout(ctx, cfg.Duration)
+	defer cancel()
+	workers := make([]benchWorker, cfg.Concurrency)
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i := range workers {
+		wg.Add(1)
+		go func(w *benchWorker, seed int64) {
+			defer wg.Done()
+			w.run(runCtx, client, cfg, value, seed)
+		}(&workers[i], time.Now().UnixNano()+int64(i))
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	report := &benchReport{Config: cfg, Elapsed: elapsed.Seconds()}
+	var reads, writes histogram
+	for i := range workers {
+		w := &workers[i]
+		reads.merge(&w.reads)
+		writes.merge(&w.writes)
+		report.Hits += w.hits
+		report.Misses += w.misses
+		report.Errors += w.errors
+		if report.FirstError == "" && w.firstErr != nil {
+			report.FirstError = w.firstErr.Error()
+		}
+	}
+	report.Reads, report.Writes = reads.count, writes.count
+	report.Requests = reads.count + writes.count + report.Errors
+	report.Throughput = float64(reads.count+writes.count) / elapsed.Seconds()
+	if n := report.Hits + report.Misses; n > 0 {
+		report.HitRatio = float64(report.Hits) / float64(n)
+	}
+	all := reads
+	all.merge(&writes)
+	report.Latency = map[string]latencySummary{"all": all.summary()}
+	if reads.count > 0 {
+		report.Latency["read"] = reads.summary()
+	}
+	if writes.count > 0 {
+		report.Latency["write"] = writes.summary()
+	}
+	return report, nil
+}
+
+// prefill writes every key once, spread over the workers.
+func prefill(ctx context.Context, client *cacheClient, cfg benchConfig, value []byte) error {
+	next := int64(-1)
+	errs := make(chan error, cfg.Concurrency)
+	var wg sync.WaitGroup
+	for w := 0; w < cfg.Concurrency; w++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			r := rand.New(rand.NewSource(seed))
+			for {
+				i := atomic.AddInt64(&next, 1)
+				if i >= int64(cfg.Keys) || ctx.Err() != nil {
+					return
+				}
+				if _, err := client.put(ctx, benchKey(cfg, int(i)), benchValue(r, cfg, value), "application/octet-stream", 0); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(int64(w))
+	}
+	wg.Wait()
+	close(errs)
+	if err := <-errs; err != nil {
+		return err
+	}
+	return ctx.Err()
+}
+
+func (w *benchWorker) run(ctx context.Context, client *cacheClient, cfg benchConfig, value []byte, seed int64) {
+	r := rand.New(rand.NewSource(seed))
+	nextKey := func() int { return r.Intn(cfg.Keys) }
+	if cfg.Distribution == "zipf" {
+		zipf := rand.NewZipf(r, cfg.ZipfS, 1, uint64(cfg.Keys-1))
+		nextKey = func() int { return int(zipf.Uint64()) }
+	}
+
+	for ctx.Err() == nil {
+		key := benchKey(cfg, nextKey())
+		read := r.Float64() < cfg.ReadRatio
+		start := time.Now()
+		var status int
+		var err error
+		if read {
+			_, status, err = client.fetch(ctx, key, "")
+		} else {
+			_, err = client.put(ctx, key, benchValue(r, cfg, value), "application/octet-stream", 0)
+		}
+		took := time.Since(start)
+
+		switch {
+		case err != nil:
+			// Requests cut off by the end of the run are not failures.
+			if ctx.Err() != nil {
+				return
+			}
+			w.errors++
+			if w.firstErr == nil {
+				w.firstErr = err
+			}
+		case read:
+			w.reads.record(took)
+			if status == http.StatusOK {
+				w.hits++
+			} else {
+				w.misses++
+			}
+		default:
+			w.writes.record(took)
+		}
+	}
+}
+
+func benchKey(cfg benchConfig, i int) string {
+	return cfg.KeyPrefix + strconv.Itoa(i)
+}
+
+func benchValue(r *rand.Rand, cfg benchConfig, value []byte) []byte {
+	return value[:cfg.ValueMin+r.Intn(cfg.ValueMax-cfg.ValueMin+1)]
+}
+
+// benchReport is the outcome of a run. Latencies are in milliseconds.
+type benchReport struct {
+	Config     benchConfig               `json:"config"`
+	Elapsed    float64                   `json:"elapsed_seconds"`
+	Requests   uint64                    `json:"requests"`
+	Reads      uint64                    `json:"reads"`
+	Writes     uint64                    `json:"writes"`
+	Errors     uint64                    `json:"errors"`
+	FirstError string                    `json:"first_error,omitempty"`
+	Throughput float64                   `json:"requests_per_second"`
+	Hits       uint64                    `json:"hits"`
+	Misses     uint64                    `json:"misses"`
+	HitRatio   float64                   `json:"hit_ratio"`
+	Latency    map[string]latencySummary `json:"latency_ms"`
+}
+
+type latencySummary struct {
+	Min  float64 `json:"min"`
+	Mean float64 `json:"mean"`
+	P50  float64 `json:"p50"`
+	P90  float64 `json:"p90"`
+	P99  float64 `json:"p99"`
+	P999 float64 `json:"p99.9"`
+	Max  float64 `json:"max"`
+}
+
+func (r *benchReport) print(w io.Writer) {
+	cfg := r.Config
+	keys := fmt.Sprintf("%d keys, %s", cfg.Keys, cfg.Distribution)
+	if cfg.Distribution == "zipf" {
+		keys += fmt.Sprintf(" s=%.2f", cfg.ZipfS)
+	}
+	size := strconv.Itoa(cfg.ValueMin)
+	if cfg.ValueMax != cfg.ValueMin {
+		size += "-" + strconv.Itoa(cfg.ValueMax)
+	}
+	fmt.Fprintf(w, "Target:     %s\n", cfg.Target)
+	fmt.Fprintf(w, "Workload:   %d workers, %.0f%% reads, %s, %s byte values, %v\n",
+		cfg.Concurrency, cfg.ReadRatio*100, keys, size, time.Duration(r.Elapsed*float64(time.Second)).Round(time.Millisecond))
+	fmt.Fprintf(w, "Requests:   %d (%.1f/s), %d reads, %d writes, %d errors\n", r.Requests, r.Throughput, r.Reads, r.Writes, r.Errors)
+	if r.FirstError != "" {
+		fmt.Fprintf(w, "            first error: %s\n", r.FirstError)
+	}
+	fmt.Fprintf(w, "Hit ratio:  %.1f%% (%d hits, %d misses)\n\n", r.HitRatio*100, r.Hits, r.Misses)
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "LATENCY (ms)\tMIN\tMEAN\tP50\tP90\tP99\tP99.9\tMAX\t")
+	for _, op := range []string{"read", "write", "all"} {
+		if s, ok := r.Latency[op]; ok {
+			fmt.Fprintf(tw, "%s\t%.3f\t%.3f\t%.3f\t%.3f\t%.3f\t%.3f\t%.3f\t\n", op, s.Min, s.Mean, s.P50, s.P90, s.P99, s.P999, s.Max)
+		}
+	}
+	tw.Flush()
+}
+
+// histSubBits sets the precision of a histogram: each power of two is split
+// into 2^histSubBits buckets, so a recorded duration is off by under 1/64.
+const histSubBits = 6
+
+// histogram counts durations in log-linear buckets, the way HdrHistogram
+// does, so percentiles stay accurate from microseconds to seconds in a
+// fixed few kilobytes.
+type histogram struct {
+	counts   [(65 - histSubBits) << histSubBits]uint64
+	count    uint64
+	sum      time.Duration
+	min, max time.Duration
+}
+
+func histBucket(ns uint64) int {
+	if ns < 2<<histSubBits {
+		return int(ns)
+	}
+	shift := bits.Len64(ns) - histSubBits - 1
+	return shift<<histSubBits + int(ns>>shift)
+}
+
+// histUpper is the largest duration that falls into bucket i.
+func histUpper(i int) time.Duration {
+	if i < 2<<histSubBits {
+		return time.Duration(i)
+	}
+	shift := i>>histSubBits - 1
+	sub := i&(1<<histSubBits-1) + 1<<histSubBits
+	return time.Duration((sub+1)<<shift - 1)
+}
+
+func (h *histogram) record(d time.Duration) {
+	if d < 0 {
+		d = 0
+	}
+	h.counts[histBucket(uint64(d))]++
+	if h.count == 0 || d < h.min {
+		h.min = d
+	}
+	if d > h.max {
+		h.max = d
+	}
+	h.count++
+	h.sum += d
+}
+
+func (h *histogram) merge(o *histogram) {
+	if o.count == 0 {
+		return
+	}
+	for i, n := range o.counts {
+		h.counts[i] += n
+	}
+	if h.count == 0 || o.min < h.min {
+		h.min = o.min
+	}
+	if o.max > h.max {
+		h.max = o.max
+	}
+	h.count += o.count
+	h.sum += o.sum
+}
+
+// percentile returns the duration p percent of the recordings are at or
+// under.
+func (h *histogram) percentile(p float64) time.Duration {
+	if h.count == 0 {
+		return 0
+	}
+	rank := uint64(math.Ceil(p / 100 * float64(h.count)))
+	if rank == 0 {
+		rank = 1
+	}
+	var seen uint64
+	for i, n := range h.counts {
+		if seen += n; seen >= rank {
+			if d := histUpper(i); d < h.max {
+				return d
+			}
+			return h.max
+		}
+	}
+	return h.max
+}
+
+func (h *histogram) summary() latencySummary {
+	ms := func(d time.Duration) float64 { return float64(d) / float64(time.Millisecond) }
+	s := latencySummary{
+		Min:  ms(h.min),
+		P50:  ms(h.percentile(50)),
+		P90:  ms(h.percentile(90)),
+		P99:  ms(h.percentile(99)),
+		P999: ms(h.percentile(99.9)),
+		Max:  ms(h.max),
+	}
+	if h.count > 0 {
+		s.Mean = ms(h.sum / time.Duration(h.count))
+	}
+	return s
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestHistogram_Percentiles(t *testing.T) {
+	var h histogram
+	for i := 1; i <= 10000; i++ {
+		h.record(time.Duration(i) * time.Microsecond)
+	}
+
+	for _, tt := range []struct {
+		p    float64
+		want time.Duration
+	}{
+		{50, 5 * time.Millisecond},
+		{90, 9 * time.Millisecond},
+		{99, 9900 * time.Microsecond},
+		{99.9, 9990 * time.Microsecond},
+		{100, 10 * time.Millisecond},
+	} {
+		got := h.percentile(tt.p)
+		if got < tt.want || float64(got-tt.want) > float64(tt.want)/64 {
+			t.Errorf("Expected p%v within 1/64 above %v, got %v", tt.p, tt.want, got)
+		}
+	}
+
+	var merged histogram
+	merged.merge(&h)
+	merged.record(time.Hour)
+	if merged.count != 10001 || merged.min != time.Microsecond || merged.max != time.Hour || merged.percentile(100) != time.Hour {
+		t.Errorf("Expected the merge to keep the counts and bounds, got %d [%v, %v]", merged.count, merged.min, merged.max)
+	}
+	if got := histUpper(histBucket(math.MaxInt64)); got < math.MaxInt64 {
+		t.Errorf("Expected the largest duration to have a bucket, got %v", got)
+	}
+}
+
+func TestBench_Report(t *testing.T) {
+	ts := newTestServer(t, NewSimpleCache())
+
+	var stdout, stderr bytes.Buffer
+	code := runBench([]string{"-server", ts.URL, "-d", "200ms", "-c", "4", "-keys", "50", "-dist", "zipf", "-value-size", "10-100", "-o", "json"}, &stdout, &stderr)
+	if code != exitOK {
+		t.Fatalf("Expected the run to succeed, got %d: %s", code, stderr.String())
+	}
+	var report benchReport
+	if err := json.Unmarshal(stdout.Bytes(), &report); err != nil {
+		t.Fatalf("Expected a JSON report, got %q", stdout.String())
+	}
+	if report.Requests == 0 || report.Errors != 0 || report.Reads+report.Writes != report.Requests {
+		t.Errorf("Expected error-free requests, got %+v", report)
+	}
+	if report.HitRatio != 1 {
+		t.Errorf("Expected every read to hit after the prefill, got %v", report.HitRatio)
+	}
+	if all := report.Latency["all"]; all.P50 <= 0 || all.P50 > all.P99 || all.P99 > all.Max {
+		t.Errorf("Expected ordered percentiles, got %+v", all)
+	}
+
+	if code := runBench([]string{"-dist", "pareto"}, &stdout, &stderr); code != exitError {
+		t.Errorf("Expected exit %d for a bad flag, got %d", exitError, code)
+	}
+}
@@ -1,7 +1,11 @@
 package main
 
 import (
+	"context"
 	"errors"
+	"log/slog"
+	"math"
+	"math/rand"
 	"sync"
 	"time"
 )
@@ -11,6 +15,24 @@ var (
 	ErrInvalidKey  = errors.New("invalid key: cannot be empty")
 	ErrInvalidTTL  = errors.New("invalid TTL: must be positive duration")
 	ErrCacheClosed = errors.New("cache is closed")
+
+	ErrPreconditionFailed = errors.New("precondition failed")
+
+	// ErrNoChange is returned by an UpdateFunc to leave the entry unchanged.
+	ErrNoChange = errors.New("no change")
+	// ErrUpdatesUnsupported is returned for atomic updates to a cache that is
+	// not an Updater.
+	ErrUpdatesUnsupported = errors.New("cache does not support atomic updates")
+	// ErrTTLUnsupported is returned for a write with its own TTL to a cache
+	// that is not an ExpiringWriter.
+	ErrTTLUnsupported = errors.New("cache does not support per-key TTLs")
+	// ErrConditionalUnsupported is returned for a write with a precondition
+	// to a cache that cannot check it atomically with the write everywhere,
+	// such as a ReplicatedCache.
+	ErrConditionalUnsupported = errors.New("cache does not support conditional writes")
+	// ErrRestoreUnsupported is returned by a cache wrapper restoring an
+	// entry into a cache that is not an EntryRestorer.
+	ErrRestoreUnsupported = errors.New("cache cannot restore entries")
 )
 
 type Cache interface {
@@ -19,18 +41,76 @@ type Cache interface {
 	Delete(key string) error
 }
 
+// ContextCache is the context-aware form of Cache. An operation whose
+// context is already done fails with the context's error; caches that wait,
+// such as ReplicatedCache, give up when it is cancelled or its deadline
+// passes.
+type ContextCache interface {
+	Cache
+	SetContext(ctx context.Context, key string, value interface{}) error
+	GetContext(ctx context.Context, key string) (interface{}, bool, error)
+	DeleteContext(ctx context.Context, key string) error
+}
+
 type Closer interface {
 	Close() error
 }
 
+type KeyLister interface {
+	Keys() []string
+}
+
+// Upserter reports whether a write created a new entry or replaced a live one.
+type Upserter interface {
+	Upsert(key string, value interface{}) (created bool, err error)
+}
+
+// Remover reports whether a delete removed a live entry.
+type Remover interface {
+	Remove(key string) (existed bool, err error)
+}
+
+// Resizer is implemented by caches whose entry limit can change at runtime.
+type Resizer interface {
+	SetCapacity(maxEntries int)
+}
+
+// TTLSetter is implemented by caches whose entry lifetime can change at
+// runtime.
+type TTLSetter interface {
+	SetTTL(ttl time.Duration) error
+}
+
+// ExpiringWriter is implemented by caches that accept a lifetime for a
+// single write in place of their TTL. It is UpsertIf with ttl.
+type ExpiringWriter interface {
+	UpsertWithTTL(ctx context.Context, key string, value interface{}, ttl time.Duration, cond Precondition) (entry Entry, created bool, err error)
+}
+
 type SimpleCache struct {
-	data map[string]interface{}
-	mu   sync.RWMutex
+	data       map[string]Entry
+	mu         sync.RWMutex
+	versions   versionCounter
+	order      *writeOrder
+	maxEntries int
+}
+
+// SimpleCacheConfig bounds a SimpleCache. With MaxEntries set, writing a new
+// key to a full cache evicts the least recently written one.
+type SimpleCacheConfig struct {
+	MaxEntries int
 }
 
 func NewSimpleCache() *SimpleCache {
+	return NewSimpleCacheWithConfig(SimpleCacheConfig{})
+}
+
+func NewSimpleCacheWithConfig(config SimpleCacheConfig) *SimpleCache {
 	return &SimpleCache{
-		data: make(map[string]interface{}),
+		data:       make(map[string]Entry),
+		versions:   newVersionCounter(),
+		order:      newWriteOrder(),
+		maxEntries: config.MaxEntries,
 	}
 }
 
@@ -42,41 +122,202 @@ func validateKey(key string) error {
 }
 
 func (c *SimpleCache) Set(key string, value interface{}) error {
+	_, err := c.Upsert(key, value)
+	return err
+}
+
+func (c *SimpleCache) Upsert(key string, value interface{}) (bool, error) {
+	_, created, err := c.UpsertIf(key, value, nil)
+	return created, err
+}
+
+func (c *SimpleCache) UpsertIf(key string, value interface{}, cond Precondition) (Entry, bool, error) {
 	if err := validateKey(key); err != nil {
-		return err
+		return Entry{}, false, err
 	}
 
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	c.data[key] = value
-	return nil
+	current, exists := c.data[key]
+	if cond != nil && !cond(current, exists) {
+		return current, false, ErrPreconditionFailed
+	}
+	return c.store(key, value, exists), !exists, nil
+}
+
+// store writes value to key, evicting first if the key is new and the cache
+// is full. Callers must hold c.mu.
+func (c *SimpleCache) store(key string, value interface{}, exists bool) Entry {
+	if !exists && c.maxEntries > 0 {
+		c.evictTo(c.maxEntries - 1)
+	}
+	entry := Entry{Value: value, Version: c.versions.next(), Modified: time.Now()}
+	c.data[key] = entry
+	c.order.touch(key)
+	return entry
+}
+
+// RestoreEntry stores e as it is, without its expiry, since a SimpleCache
+// never expires entries.
+func (c *SimpleCache) RestoreEntry(key string, e Entry) (bool, error) {
+	if err := validateKey(key); err != nil {
+		return false, err
+	}
+	if !e.Expires.IsZero() && !time.Now().Before(e.Expires) {
+		return false, nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	current, exists := c.data[key]
+	if exists && e.Version != 0 && current.Version >= e.Version {
+		return false, nil
+	}
+	if !exists && c.maxEntries > 0 {
+		c.evictTo(c.maxEntries - 1)
+	}
+	version := e.Version
+	if version == 0 {
+		version = c.versions.next()
+	}
+	c.versions.observe(version)
+	c.data[key] = Entry{Value: e.Value, Version: version, Modified: restoredModified(e, time.Now())}
+	c.order.touch(key)
+	return true, nil
+}
+
+func (c *SimpleCache) Update(key string, fn UpdateFunc) (Entry, bool, error) {
+	if err := validateKey(key); err != nil {
+		return Entry{}, false, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	current, exists := c.data[key]
+	value, err := fn(current.Value, exists)
+	switch {
+	case errors.Is(err, ErrNoChange):
+		return current, exists, nil
+	case err != nil:
+		return Entry{}, false, err
+	case value == nil:
+		delete(c.data, key)
+		c.order.remove(key)
+		return Entry{}, false, nil
+	}
+	return c.store(key, value, exists), true, nil
 }
 
 func (c *SimpleCache) Get(key string) (interface{}, bool, error) {
+	entry, exists, err := c.GetEntry(key)
+	return entry.Value, exists, err
+}
+
+func (c *SimpleCache) GetEntry(key string) (Entry, bool, error) {
 	if err := validateKey(key); err != nil {
-		return nil, false, err
+		return Entry{}, false, err
 	}
 
 	c.mu.RLock()
 	defer c.mu.RUnlock()
-	value, exists := c.data[key]
-	return value, exists, nil
+	entry, exists := c.data[key]
+	return entry, exists, nil
 }
 
 func (c *SimpleCache) Delete(key string) error {
+	_, err := c.Remove(key)
+	return err
+}
+
+func (c *SimpleCache) Remove(key string) (bool, error) {
+	return c.RemoveIf(key, nil)
+}
+
+func (c *SimpleCache) RemoveIf(key string, cond Precondition) (bool, error) {
 	if err := validateKey(key); err != nil {
-		return err
+		return false, err
 	}
 
 	c.mu.Lock()
 	defer c.mu.Unlock()
+	current, exists := c.data[key]
+	if cond != nil && !cond(current, exists) {
+		return false, ErrPreconditionFailed
+	}
 	delete(c.data, key)
-	return nil
+	c.order.remove(key)
+	return exists, nil
+}
+
+// evictTo drops the oldest writes until at most n entries remain. Callers
+// must hold c.mu.
+func (c *SimpleCache) evictTo(n int) {
+	for len(c.data) > n {
+		oldest, ok := c.order.oldest()
+		if !ok {
+			return
+		}
+		delete(c.data, oldest)
+		c.order.remove(oldest)
+		slog.Debug("Evicted entry", "key", oldest, "reason", "capacity")
+	}
+}
+
+func (c *SimpleCache) SetContext(ctx context.Context, key string, value interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return c.Set(key, value)
+}
+
+func (c *SimpleCache) GetContext(ctx context.Context, key string) (interface{}, bool, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, false, err
+	}
+	return c.Get(key)
+}
+
+func (c *SimpleCache) DeleteContext(ctx context.Context, key string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return c.Delete(key)
+}
+
+// SetCapacity changes MaxEntries, evicting the oldest writes if the cache is
+// now over it. Zero removes the limit.
+func (c *SimpleCache) SetCapacity(maxEntries int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.maxEntries = maxEntries
+	if maxEntries > 0 {
+		c.evictTo(maxEntries)
+	}
+}
+
+func (c *SimpleCache) Keys() []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	keys := make([]string, 0, len(c.data))
+	for key := range c.data {
+		keys = append(keys, key)
+	}
+	return keys
 }
 
 type cacheItem struct {
-	value   interface{}
-	expires time.Time
+	value    interface{}
+	expires  time.Time
+	version  uint64
+	modified time.Time
+	// delta is how long the Loader took to produce value, zero if it was
+	// written directly.
+	delta time.Duration
+}
+
+func (item cacheItem) entry() Entry {
+	return Entry{Value: item.value, Version: item.version, Modified: item.modified, Expires: item.expires}
 }
 
 type TTLCache struct {
@@ -84,14 +325,47 @@ type TTLCache struct {
 	mu              sync.RWMutex
 	ttl             time.Duration
 	cleanupInterval time.Duration
-	ticker          *time.Ticker
+	ticker          Ticker
+	clock           Clock
 	done            chan struct{}
-	closed          bool
+	life            *lifecycle
+	versions        versionCounter
+	order           *writeOrder
+	maxEntries      int
+	staleTTL        time.Duration
+	jitter          float64
+	earlyRefresh    float64
+	loader          Loader
+	loading         map[string]*loadCall
+	refreshCtx      context.Context
+	stopRefresh     context.CancelFunc
 }
 
+// TTLCacheConfig configures a TTLCache. With MaxEntries set, writing a new
+// key to a full cache evicts the least recently written one, expired or not.
 type TTLCacheConfig struct {
 	TTL             time.Duration
 	CleanupInterval time.Duration
+	MaxEntries      int
+	// StaleTTL is a grace window after TTL (the soft TTL) during which Get
+	// still returns an entry, marked stale, until TTL+StaleTTL (the hard
+	// TTL). With a Loader, the first stale read refreshes the entry in the
+	// background; if that fails, the stale value is served until the hard
+	// TTL and the next stale read tries again. The server sets no Loader,
+	// so there its stale entries wait for a client to rewrite them.
+	StaleTTL time.Duration
+	// TTLJitter spreads each write's lifetime randomly by up to this
+	// fraction of TTL either way, e.g. 0.1 for ±10%, so keys written
+	// together do not all expire together.
+	TTLJitter float64
+	// EarlyRefresh is the beta of XFetch: Fetch reloads a fresh entry early
+	// with a probability that rises as it nears expiry and with how long it
+	// took to load. 1 is the usual choice; zero disables it. It needs a
+	// Loader and callers of Fetch, so the server has no setting for it.
+	EarlyRefresh float64
+	Loader       Loader
+	// Clock defaults to the system clock.
+	Clock Clock
 }
 
 func NewTTLCache(ttl time.Duration) (*TTLCache, error) {
@@ -102,10 +376,15 @@ func NewTTLCache(ttl time.Duration) (*TTLCache, error) {
 }
 
 func NewTTLCacheWithConfig(config TTLCacheConfig) (*TTLCache, error) {
-	if config.TTL <= 0 {
+	if config.TTL <= 0 || config.StaleTTL < 0 || config.TTLJitter < 0 || config.TTLJitter >= 1 || config.EarlyRefresh < 0 {
 		return nil, ErrInvalidTTL
 	}
 
+	clock := config.Clock
+	if clock == nil {
+		clock = systemClock{}
+	}
+
 	cleanupInterval := config.CleanupInterval
 	if cleanupInterval <= 0 {
 		cleanupInterval = config.TTL / 2
@@ -118,10 +397,20 @@ func NewTTLCacheWithConfig(config TTLCacheConfig) (*TTLCache, error) {
 		data:            make(map[string]cacheItem),
 		ttl:             config.TTL,
 		cleanupInterval: cleanupInterval,
-		ticker:          time.NewTicker(cleanupInterval),
+		ticker:          clock.NewTicker(cleanupInterval),
+		clock:           clock,
 		done:            make(chan struct{}),
-		closed:          false,
+		life:            newLifecycle(),
+		versions:        newVersionCounter(),
+		order:           newWriteOrder(),
+		maxEntries:      config.MaxEntries,
+		staleTTL:        config.StaleTTL,
+		jitter:          config.TTLJitter,
+		earlyRefresh:    config.EarlyRefresh,
+		loader:          config.Loader,
+		loading:         make(map[string]*loadCall),
 	}
+	cache.refreshCtx, cache.stopRefresh = context.WithCancel(context.Background())
 
 	go cache.cleanup()
 
@@ -129,62 +418,440 @@ func NewTTLCacheWithConfig(config TTLCacheConfig) (*TTLCache, error) {
 }
 
 func (c *TTLCache) Set(key string, value interface{}) error {
-	if c.closed {
-		return ErrCacheClosed
+	_, err := c.Upsert(key, value)
+	return err
+}
+
+func (c *TTLCache) Upsert(key string, value interface{}) (bool, error) {
+	_, created, err := c.UpsertIf(key, value, nil)
+	return created, err
+}
+
+func (c *TTLCache) SetContext(ctx context.Context, key string, value interface{}) error {
+	_, _, err := c.upsertIf(ctx, key, value, 0, nil)
+	return err
+}
+
+// RestoreEntry stores e with its own expiry, or the cache's TTL if it has
+// none.
+func (c *TTLCache) RestoreEntry(key string, e Entry) (bool, error) {
+	if err := c.life.enter(context.Background()); err != nil {
+		return false, err
 	}
+	defer c.life.exit()
 
 	if err := validateKey(key); err != nil {
-		return err
+		return false, err
 	}
 
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	c.data[key] = cacheItem{
-		value:   value,
-		expires: time.Now().Add(c.ttl),
+	now := c.clock.Now()
+	if !e.Expires.IsZero() && !now.Before(e.Expires) {
+		return false, nil
 	}
-	return nil
+	current, exists := c.liveItem(key, now)
+	if exists && e.Version != 0 && current.version >= e.Version {
+		return false, nil
+	}
+	item := c.store(key, e.Value, now, 0)
+	if !e.Expires.IsZero() {
+		item.expires = e.Expires
+	}
+	if e.Version != 0 {
+		c.versions.observe(e.Version)
+		item.version = e.Version
+	}
+	item.modified = restoredModified(e, now)
+	c.data[key] = item
+	return true, nil
+}
+
+func (c *TTLCache) UpsertIf(key string, value interface{}, cond Precondition) (Entry, bool, error) {
+	return c.upsertIf(context.Background(), key, value, 0, cond)
+}
+
+// UpsertWithTTL is UpsertIf with the entry living for ttl, exactly, rather
+// than the cache's jittered TTL.
+func (c *TTLCache) UpsertWithTTL(ctx context.Context, key string, value interface{}, ttl time.Duration, cond Precondition) (Entry, bool, error) {
+	if ttl <= 0 {
+		return Entry{}, false, ErrInvalidTTL
+	}
+	return c.upsertIf(ctx, key, value, ttl, cond)
+}
+
+func (c *TTLCache) upsertIf(ctx context.Context, key string, value interface{}, ttl time.Duration, cond Precondition) (Entry, bool, error) {
+	if err := c.life.enter(ctx); err != nil {
+		return Entry{}, false, err
+	}
+	defer c.life.exit()
+
+	if err := validateKey(key); err != nil {
+		return Entry{}, false, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.clock.Now()
+	current, exists := c.liveItem(key, now)
+	if cond != nil && !cond(current.entry(), exists) {
+		return current.entry(), false, ErrPreconditionFailed
+	}
+	return c.store(key, value, now, ttl).entry(), !exists, nil
+}
+
+// store writes value to key with a fresh lifetime of ttl, or the cache's if
+// it is zero, evicting first if the key is new and the cache is full.
+// Callers must hold c.mu.
+func (c *TTLCache) store(key string, value interface{}, now time.Time, ttl time.Duration) cacheItem {
+	if _, stored := c.data[key]; !stored && c.maxEntries > 0 {
+		c.evictTo(c.maxEntries - 1)
+	}
+	if ttl == 0 {
+		ttl = c.lifetime()
+	}
+	item := cacheItem{
+		value:    value,
+		expires:  now.Add(ttl),
+		version:  c.versions.next(),
+		modified: now,
+	}
+	c.data[key] = item
+	c.order.touch(key)
+	return item
+}
+
+// lifetime is the TTL for a write, jittered if configured. Callers must
+// hold c.mu.
+func (c *TTLCache) lifetime() time.Duration {
+	if c.jitter == 0 {
+		return c.ttl
+	}
+	return c.ttl + time.Duration(float64(c.ttl)*c.jitter*(2*rand.Float64()-1))
+}
+
+// Update stores fn's result under a new version but keeps the entry's
+// expiry, so collection operations such as LPUSH do not extend its life. An
+// expired entry is passed to fn as missing, and its replacement gets a
+// fresh lifetime.
+func (c *TTLCache) Update(key string, fn UpdateFunc) (Entry, bool, error) {
+	if err := c.life.enter(context.Background()); err != nil {
+		return Entry{}, false, err
+	}
+	defer c.life.exit()
+
+	if err := validateKey(key); err != nil {
+		return Entry{}, false, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.clock.Now()
+	current, exists := c.liveItem(key, now)
+	value, err := fn(current.value, exists)
+	switch {
+	case errors.Is(err, ErrNoChange):
+		return current.entry(), exists, nil
+	case err != nil:
+		return Entry{}, false, err
+	case value == nil:
+		delete(c.data, key)
+		c.order.remove(key)
+		return Entry{}, false, nil
+	}
+	item := c.store(key, value, now, 0)
+	if exists {
+		item.expires = current.expires
+		c.data[key] = item
+	}
+	return item.entry(), true, nil
 }
 
 func (c *TTLCache) Get(key string) (interface{}, bool, error) {
-	if c.closed {
-		return nil, false, ErrCacheClosed
+	entry, exists, err := c.GetEntry(key)
+	return entry.Value, exists, err
+}
+
+func (c *TTLCache) GetContext(ctx context.Context, key string) (interface{}, bool, error) {
+	entry, exists, err := c.getEntry(ctx, key)
+	return entry.Value, exists, err
+}
+
+func (c *TTLCache) GetEntry(key string) (Entry, bool, error) {
+	return c.getEntry(context.Background(), key)
+}
+
+func (c *TTLCache) getEntry(ctx context.Context, key string) (Entry, bool, error) {
+	if err := c.life.enter(ctx); err != nil {
+		return Entry{}, false, err
 	}
+	defer c.life.exit()
 
 	if err := validateKey(key); err != nil {
-		return nil, false, err
+		return Entry{}, false, err
 	}
 
 	c.mu.RLock()
-	defer c.mu.RUnlock()
-
+	now := c.clock.Now()
 	item, exists := c.data[key]
-	if !exists {
-		return nil, false, nil
+	staleTTL := c.staleTTL
+	c.mu.RUnlock()
+
+	switch {
+	case !exists || now.After(item.expires.Add(staleTTL)):
+		return Entry{}, false, nil
+	case now.After(item.expires):
+		c.refresh(key, item.version)
+		entry := item.entry()
+		entry.Stale = true
+		return entry, true, nil
+	}
+	return item.entry(), true, nil
+}
+
+// Fetch is the read-through form of GetEntry: a missing or expired key is
+// loaded through the Loader and stored, with concurrent misses sharing one
+// load. Stale entries are served as by GetEntry, and with EarlyRefresh set
+// a fresh entry may be reloaded before it expires. Without a Loader, Fetch
+// is GetEntry.
+func (c *TTLCache) Fetch(ctx context.Context, key string) (Entry, bool, error) {
+	if c.loader == nil {
+		return c.getEntry(ctx, key)
+	}
+	if err := c.life.enter(ctx); err != nil {
+		return Entry{}, false, err
+	}
+	defer c.life.exit()
+
+	if err := validateKey(key); err != nil {
+		return Entry{}, false, err
+	}
+
+	c.mu.RLock()
+	now := c.clock.Now()
+	item, stored := c.data[key]
+	staleTTL := c.staleTTL
+	c.mu.RUnlock()
+
+	fresh := stored && !now.After(item.expires)
+	switch {
+	case fresh && !c.expiresEarly(item, now):
+		return item.entry(), true, nil
+	case stored && !fresh && !now.After(item.expires.Add(staleTTL)):
+		c.refresh(key, item.version)
+		entry := item.entry()
+		entry.Stale = true
+		return entry, true, nil
 	}
 
-	if time.Now().After(item.expires) {
-		return nil, false, nil
+	var version uint64
+	if stored {
+		version = item.version
 	}
+	c.mu.Lock()
+	call, started := c.startLoad(key)
+	c.mu.Unlock()
+	if started {
+		c.load(ctx, key, version, call)
+	} else if fresh {
+		return item.entry(), true, nil
+	}
+	select {
+	case <-call.done:
+		return call.entry, call.exists, call.err
+	case <-ctx.Done():
+		return Entry{}, false, ctx.Err()
+	}
+}
+
+// expiresEarly decides whether a read reloads a fresh item ahead of its
+// expiry, as in XFetch (Vattani et al., "Optimal Probabilistic Cache
+// Stampede Prevention"). One read in many does so, more often the closer
+// the expiry and the slower the load, so a popular key is reloaded once
+// before it expires rather than by every reader after.
+func (c *TTLCache) expiresEarly(item cacheItem, now time.Time) bool {
+	if c.earlyRefresh == 0 || item.delta == 0 {
+		return false
+	}
+	gap := -float64(item.delta) * c.earlyRefresh * math.Log(1-rand.Float64())
+	return !now.Add(time.Duration(gap)).Before(item.expires)
+}
 
-	return item.value, true, nil
+// loadCall is a load of one key in progress.
+type loadCall struct {
+	done   chan struct{}
+	entry  Entry
+	exists bool
+	err    error
+}
+
+// startLoad returns the running load of key, or registers a new one that
+// the caller must run with load. Callers must hold c.mu.
+func (c *TTLCache) startLoad(key string) (call *loadCall, started bool) {
+	if call, running := c.loading[key]; running {
+		return call, false
+	}
+	call = &loadCall{done: make(chan struct{})}
+	c.loading[key] = call
+	return call, true
+}
+
+// load runs the Loader for key and completes call. The value is stored
+// only if the key still holds version (zero if it held nothing), so a load
+// never overwrites a newer write; the newer entry is returned instead.
+func (c *TTLCache) load(ctx context.Context, key string, version uint64, call *loadCall) {
+	start := c.clock.Now()
+	value, err := c.loader(ctx, key)
+	if err != nil {
+		slog.Debug("Load failed", "key", key, "error", err)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	defer close(call.done)
+	delete(c.loading, key)
+
+	now := c.clock.Now()
+	current, exists := c.data[key]
+	switch {
+	case err != nil:
+		call.err = err
+	case !c.life.isOpen():
+		call.err = ErrCacheClosed
+	case exists && current.version != version:
+		call.entry, call.exists = current.entry(), !now.After(current.expires)
+	case !exists && version != 0:
+		call.entry, call.exists = Entry{Value: value}, value != nil
+	case value == nil:
+		delete(c.data, key)
+		c.order.remove(key)
+	default:
+		item := c.store(key, value, now, 0)
+		item.delta = now.Sub(start)
+		c.data[key] = item
+		call.entry, call.exists = item.entry(), true
+	}
+}
+
+// refresh reloads a stale key in the background unless a load of it is
+// already running.
+func (c *TTLCache) refresh(key string, version uint64) {
+	if c.loader == nil {
+		return
+	}
+	c.mu.Lock()
+	call, started := c.startLoad(key)
+	c.mu.Unlock()
+	if started {
+		go c.load(c.refreshCtx, key, version, call)
+	}
 }
 
 func (c *TTLCache) Delete(key string) error {
-	if c.closed {
-		return ErrCacheClosed
+	_, err := c.Remove(key)
+	return err
+}
+
+func (c *TTLCache) Remove(key string) (bool, error) {
+	return c.RemoveIf(key, nil)
+}
+
+func (c *TTLCache) DeleteContext(ctx context.Context, key string) error {
+	_, err := c.removeIf(ctx, key, nil)
+	return err
+}
+
+func (c *TTLCache) RemoveIf(key string, cond Precondition) (bool, error) {
+	return c.removeIf(context.Background(), key, cond)
+}
+
+func (c *TTLCache) removeIf(ctx context.Context, key string, cond Precondition) (bool, error) {
+	if err := c.life.enter(ctx); err != nil {
+		return false, err
 	}
+	defer c.life.exit()
 
 	if err := validateKey(key); err != nil {
-		return err
+		return false, err
 	}
 
 	c.mu.Lock()
 	defer c.mu.Unlock()
+	current, exists := c.liveItem(key, c.clock.Now())
+	if cond != nil && !cond(current.entry(), exists) {
+		return false, ErrPreconditionFailed
+	}
 	delete(c.data, key)
+	c.order.remove(key)
+	return exists, nil
+}
+
+// evictTo drops the oldest writes until at most n entries remain. Callers
+// must hold c.mu.
+func (c *TTLCache) evictTo(n int) {
+	for len(c.data) > n {
+		oldest, ok := c.order.oldest()
+		if !ok {
+			return
+		}
+		delete(c.data, oldest)
+		c.order.remove(oldest)
+		slog.Debug("Evicted entry", "key", oldest, "reason", "capacity")
+	}
+}
+
+// SetTTL changes the lifetime given to later writes; existing entries keep
+// their expiry.
+func (c *TTLCache) SetTTL(ttl time.Duration) error {
+	if ttl <= 0 {
+		return ErrInvalidTTL
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ttl = ttl
 	return nil
 }
 
+// SetCapacity changes MaxEntries, evicting the oldest writes if the cache is
+// now over it. Zero removes the limit.
+func (c *TTLCache) SetCapacity(maxEntries int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.maxEntries = maxEntries
+	if maxEntries > 0 {
+		c.evictTo(maxEntries)
+	}
+}
+
+// liveItem returns the item for key unless it is missing or expired. Writes
+// and Keys treat a stale item as expired. Callers must hold c.mu.
+func (c *TTLCache) liveItem(key string, now time.Time) (cacheItem, bool) {
+	item, exists := c.data[key]
+	if !exists || now.After(item.expires) {
+		return cacheItem{}, false
+	}
+	return item, true
+}
+
+func (c *TTLCache) Keys() []string {
+	if c.life.enter(context.Background()) != nil {
+		return nil
+	}
+	defer c.life.exit()
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	now := c.clock.Now()
+	keys := make([]string, 0, len(c.data))
+	for key, item := range c.data {
+		if !now.After(item.expires) {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
 func (c *TTLCache) cleanup() {
 	defer func() {
 		if r := recover(); r != nil {
@@ -193,7 +860,7 @@ func (c *TTLCache) cleanup() {
 
 	for {
 		select {
-		case <-c.ticker.C:
+		case <-c.ticker.C():
 			c.performCleanup()
 		case <-c.done:
 			c.ticker.Stop()
@@ -203,27 +870,40 @@ func (c *TTLCache) cleanup() {
 }
 
 func (c *TTLCache) performCleanup() {
+	start := time.Now()
 	c.mu.Lock()
-	defer c.mu.Unlock()
-
-	now := time.Now()
+	now := c.clock.Now()
+	removed := 0
 	for key, item := range c.data {
-		if now.After(item.expires) {
+		if now.After(item.expires.Add(c.staleTTL)) {
 			delete(c.data, key)
+			c.order.remove(key)
+			removed++
 		}
 	}
+	remaining := len(c.data)
+	c.mu.Unlock()
+	slog.Debug("Cleanup finished", "removed", removed, "remaining", remaining, "took", time.Since(start))
 }
 
+// Close stops new operations, waits for running ones to finish and stops
+// the cleanup goroutine. Operations started afterwards fail with
+// ErrCacheClosed.
 func (c *TTLCache) Close() error {
-	if c.closed {
-		return nil
-	}
+	return c.CloseContext(context.Background())
+}
 
-	c.closed = true
-	close(c.done)
-	return nil
+// CloseContext is Close with a bound on the wait for running operations.
+// The cache is closed to new operations even if ctx expires first.
+func (c *TTLCache) CloseContext(ctx context.Context) error {
+	c.stopRefresh()
+	first, err := c.life.close(ctx)
+	if first {
+		close(c.done)
+	}
+	return err
 }
 
 func (c *TTLCache) IsClosed() bool {
-	return c.closed
+	return !c.life.isOpen()
 }
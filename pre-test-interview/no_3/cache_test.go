@@ -1,7 +1,15 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"runtime"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -100,13 +108,9 @@ func TestTTLCache_SetAndGet(t *testing.T) {
 
 // expired entries test cases
 func TestTTLCache_Expiration(t *testing.T) {
-	cache, err := NewTTLCache(50 * time.Millisecond)
-	if err != nil {
-		t.Fatalf("Failed to create TTLCache: %v", err)
-	}
-	defer cache.Close()
+	cache, clock := newFakeClockTTLCache(t, 50*time.Millisecond)
 
-	err = cache.Set("key1", "value1")
+	err := cache.Set("key1", "value1")
 	if err != nil {
 		t.Fatalf("Unexpected error: %v", err)
 	}
@@ -115,8 +119,12 @@ func TestTTLCache_Expiration(t *testing.T) {
 		t.Errorf("Expected key1 to exist immediately after setting, got exists=%v, err=%v", exists, err)
 	}
 
-	time.Sleep(60 * time.Millisecond)
+	clock.Advance(50 * time.Millisecond)
+	if _, exists, err := cache.Get("key1"); err != nil || !exists {
+		t.Errorf("Expected key1 to live until its expiry instant, got exists=%v, err=%v", exists, err)
+	}
 
+	clock.Advance(time.Millisecond)
 	if _, exists, err := cache.Get("key1"); err != nil || exists {
 		t.Errorf("Expected key1 to be expired, got exists=%v, err=%v", exists, err)
 	}
@@ -145,39 +153,37 @@ func TestTTLCache_Delete(t *testing.T) {
 }
 
 func TestTTLCache_UpdateTTL(t *testing.T) {
-	cache, err := NewTTLCache(50 * time.Millisecond)
-	if err != nil {
-		t.Fatalf("Failed to create TTLCache: %v", err)
-	}
-	defer cache.Close()
+	cache, clock := newFakeClockTTLCache(t, 50*time.Millisecond)
 
-	err = cache.Set("key1", "value1")
+	err := cache.Set("key1", "value1")
 	if err != nil {
 		t.Fatalf("Unexpected error: %v", err)
 	}
 
-	time.Sleep(30 * time.Millisecond)
+	clock.Advance(30 * time.Millisecond)
 
 	err = cache.Set("key1", "value2")
 	if err != nil {
 		t.Fatalf("Unexpected error: %v", err)
 	}
 
-	time.Sleep(30 * time.Millisecond)
+	clock.Advance(30 * time.Millisecond)
 
 	if value, exists, err := cache.Get("key1"); err != nil || !exists || value != "value2" {
 		t.Errorf("Expected value2, got %v, exists=%v, err=%v", value, exists, err)
 	}
+
+	clock.Advance(21 * time.Millisecond)
+
+	if _, exists, err := cache.Get("key1"); err != nil || exists {
+		t.Errorf("Expected key1 to expire 50ms after the update, got exists=%v, err=%v", exists, err)
+	}
 }
 
 func TestTTLCache_Cleanup(t *testing.T) {
-	cache, err := NewTTLCache(50 * time.Millisecond)
-	if err != nil {
-		t.Fatalf("Failed to create TTLCache: %v", err)
-	}
-	defer cache.Close()
+	cache, clock := newFakeClockTTLCache(t, time.Minute)
 
-	err = cache.Set("key1", "value1")
+	err := cache.Set("key1", "value1")
 	if err != nil {
 		t.Fatalf("Unexpected error: %v", err)
 	}
@@ -185,20 +191,257 @@ func TestTTLCache_Cleanup(t *testing.T) {
 	if err != nil {
 		t.Fatalf("Unexpected error: %v", err)
 	}
+
+	// Cleanup runs every 30s. Advance returns once the 120s tick has been
+	// taken, so the cleanup at 90s, the first after expiry, has finished.
+	clock.Advance(45 * time.Second)
 	err = cache.Set("key3", "value3")
 	if err != nil {
 		t.Fatalf("Unexpected error: %v", err)
 	}
+	clock.Advance(75 * time.Second)
+
+	cache.mu.RLock()
+	_, key1Stored := cache.data["key1"]
+	_, key3Stored := cache.data["key3"]
+	stored := len(cache.data)
+	cache.mu.RUnlock()
+
+	if key1Stored || stored != 1 {
+		t.Errorf("Expected expired entries to be removed by cleanup, %d stored", stored)
+	}
+	if !key3Stored {
+		t.Error("Expected cleanup to keep the live entry")
+	}
+}
 
-	time.Sleep(60 * time.Millisecond)
+func TestTTLCache_StaleWhileRevalidate(t *testing.T) {
+	clock := NewFakeClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	var loads atomic.Int32
+	release := make(chan struct{})
+	cache, err := NewTTLCacheWithConfig(TTLCacheConfig{
+		TTL:      time.Minute,
+		StaleTTL: time.Minute,
+		Clock:    clock,
+		Loader: func(ctx context.Context, key string) (interface{}, error) {
+			loads.Add(1)
+			<-release
+			return "fresh", nil
+		},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create TTLCache: %v", err)
+	}
+	t.Cleanup(func() { cache.Close() })
 
-	time.Sleep(30 * time.Millisecond)
+	cache.Set("key", "old")
+	clock.Advance(90 * time.Second)
+	for i := 0; i < 5; i++ {
+		entry, exists, err := cache.GetEntry("key")
+		if err != nil || !exists || entry.Value != "old" || !entry.Stale {
+			t.Fatalf("Expected the stale value during the grace window, got %+v, %v, %v", entry, exists, err)
+		}
+	}
+	close(release)
 
-	if _, exists, err := cache.Get("key1"); err != nil || exists {
-		t.Errorf("Expected key1 to be cleaned up, got exists=%v, err=%v", exists, err)
+	deadline := time.Now().Add(time.Second)
+	for {
+		entry, _, _ := cache.GetEntry("key")
+		if entry.Value == "fresh" && !entry.Stale {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the refreshed value, got %+v", entry)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if n := loads.Load(); n != 1 {
+		t.Errorf("Expected one refresh for concurrent stale reads, got %d", n)
+	}
+}
+
+func TestTTLCache_StaleIfError(t *testing.T) {
+	clock := NewFakeClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	var loads atomic.Int32
+	cache, err := NewTTLCacheWithConfig(TTLCacheConfig{
+		TTL:      time.Minute,
+		StaleTTL: time.Minute,
+		Clock:    clock,
+		Loader: func(ctx context.Context, key string) (interface{}, error) {
+			loads.Add(1)
+			return nil, errors.New("origin down")
+		},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create TTLCache: %v", err)
+	}
+	t.Cleanup(func() { cache.Close() })
+	ts := newTestServer(t, cache)
+
+	cache.Set("key", "old")
+	clock.Advance(70 * time.Second)
+	cache.Get("key")
+	deadline := time.Now().Add(time.Second)
+	for loads.Load() == 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	// Cleanup has run past the soft TTL and kept the entry.
+	clock.Advance(40 * time.Second)
+	resp, body := doRequest(t, http.MethodGet, ts.URL+"/api/v2/keys/key", "", "")
+	if resp.StatusCode != http.StatusOK || body.Data != "old" {
+		t.Fatalf("Expected the stale value after a failed refresh, got %d %+v", resp.StatusCode, body)
+	}
+	if status := resp.Header.Get("Cache-Status"); !strings.Contains(status, "ttl=-") {
+		t.Errorf("Expected a Cache-Status header marking the response stale, got %q", status)
+	}
+
+	clock.Advance(11 * time.Second)
+	if _, exists, _ := cache.Get("key"); exists {
+		t.Error("Expected the entry to be gone after the hard TTL")
+	}
+	if err := cache.Set("key", "new"); err != nil {
+		t.Fatal(err)
+	}
+	if entry, _, _ := cache.GetEntry("key"); entry.Stale {
+		t.Error("Expected a new write to be fresh")
+	}
+}
+
+func TestTTLCache_Fetch(t *testing.T) {
+	var loads atomic.Int32
+	release := make(chan struct{})
+	cache, err := NewTTLCacheWithConfig(TTLCacheConfig{
+		TTL: time.Minute,
+		Loader: func(ctx context.Context, key string) (interface{}, error) {
+			loads.Add(1)
+			switch key {
+			case "gone":
+				return nil, nil
+			case "broken":
+				return nil, errors.New("origin down")
+			}
+			<-release
+			return "loaded " + key, nil
+		},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create TTLCache: %v", err)
+	}
+	defer cache.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			entry, exists, err := cache.Fetch(context.Background(), "key")
+			if err != nil || !exists || entry.Value != "loaded key" {
+				t.Errorf("Expected the loaded value, got %+v, %v, %v", entry, exists, err)
+			}
+		}()
+	}
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	if n := loads.Load(); n != 1 {
+		t.Errorf("Expected concurrent misses to share one load, got %d", n)
+	}
+	if value, _, _ := cache.Get("key"); value != "loaded key" {
+		t.Errorf("Expected the loaded value to be stored, got %v", value)
+	}
+
+	if _, exists, err := cache.Fetch(context.Background(), "gone"); exists || err != nil {
+		t.Errorf("Expected a nil load to be a miss, got %v, %v", exists, err)
+	}
+	if _, _, err := cache.Fetch(context.Background(), "broken"); err == nil {
+		t.Error("Expected the loader's error")
+	}
+}
+
+func TestTTLCache_TTLJitter(t *testing.T) {
+	clock := NewFakeClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	cache, err := NewTTLCacheWithConfig(TTLCacheConfig{TTL: time.Minute, TTLJitter: 0.1, Clock: clock})
+	if err != nil {
+		t.Fatalf("Failed to create TTLCache: %v", err)
+	}
+	defer cache.Close()
+
+	expiries := make(map[time.Time]bool)
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("key%d", i)
+		cache.Set(key, i)
+		entry, _, _ := cache.GetEntry(key)
+		if ttl := entry.TTL(clock.Now()); ttl < 54*time.Second || ttl > 66*time.Second {
+			t.Fatalf("Expected a TTL within 10%% of a minute, got %v", ttl)
+		}
+		expiries[entry.Expires] = true
+	}
+	if len(expiries) < 50 {
+		t.Errorf("Expected jittered expiries, got %d distinct of 100", len(expiries))
+	}
+	if _, err := NewTTLCacheWithConfig(TTLCacheConfig{TTL: time.Minute, TTLJitter: 1}); err == nil {
+		t.Error("Expected jitter of 100% to be rejected")
 	}
 }
 
+func TestTTLCache_EarlyRefresh(t *testing.T) {
+	clock := NewFakeClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	var loads atomic.Int32
+	cache, err := NewTTLCacheWithConfig(TTLCacheConfig{
+		TTL:          time.Minute,
+		EarlyRefresh: 10,
+		Clock:        clock,
+		Loader: func(ctx context.Context, key string) (interface{}, error) {
+			clock.Advance(time.Second)
+			return int(loads.Add(1)), nil
+		},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create TTLCache: %v", err)
+	}
+	defer cache.Close()
+
+	ctx := context.Background()
+	if entry, _, _ := cache.Fetch(ctx, "key"); entry.Value != 1 {
+		t.Fatalf("Expected the first load, got %+v", entry)
+	}
+	// A second before expiry, with a one second load and beta 10, about
+	// nine reads in ten reload early.
+	clock.Advance(59 * time.Second)
+	for i := 0; i < 100 && loads.Load() == 1; i++ {
+		if entry, exists, _ := cache.Fetch(ctx, "key"); !exists || entry.Stale {
+			t.Fatalf("Expected a fresh entry, got %+v, %v", entry, exists)
+		}
+	}
+	if loads.Load() != 2 {
+		t.Fatal("Expected a read to reload the entry before it expired")
+	}
+	if entry, _, _ := cache.GetEntry("key"); entry.Value != 2 || entry.TTL(clock.Now()) < 59*time.Second {
+		t.Errorf("Expected the reloaded entry with a new lifetime, got %+v", entry)
+	}
+
+	cache.Set("written", "value")
+	clock.Advance(59 * time.Second)
+	for i := 0; i < 100; i++ {
+		cache.Fetch(ctx, "written")
+	}
+	if loads.Load() != 2 {
+		t.Error("Expected written entries, with no load time, never to reload early")
+	}
+}
+
+func newFakeClockTTLCache(t *testing.T, ttl time.Duration) (*TTLCache, *FakeClock) {
+	t.Helper()
+	clock := NewFakeClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	cache, err := NewTTLCacheWithConfig(TTLCacheConfig{TTL: ttl, Clock: clock})
+	if err != nil {
+		t.Fatalf("Failed to create TTLCache: %v", err)
+	}
+	t.Cleanup(func() { cache.Close() })
+	return cache, clock
+}
+
 // concurrent access test cases
 func TestSimpleCache_ConcurrentAccess(t *testing.T) {
 	cache := NewSimpleCache()
@@ -271,14 +514,10 @@ func TestTTLCache_ConcurrentAccess(t *testing.T) {
 }
 
 func TestTTLCache_ConcurrentExpiration(t *testing.T) {
-	cache, err := NewTTLCache(10 * time.Millisecond)
-	if err != nil {
-		t.Fatalf("Failed to create TTLCache: %v", err)
-	}
-	defer cache.Close()
+	cache, clock := newFakeClockTTLCache(t, 10*time.Millisecond)
 	var wg sync.WaitGroup
 
-	err = cache.Set("shared_key", "shared_value")
+	err := cache.Set("shared_key", "shared_value")
 	if err != nil {
 		t.Fatalf("Unexpected error: %v", err)
 	}
@@ -293,7 +532,7 @@ func TestTTLCache_ConcurrentExpiration(t *testing.T) {
 		}()
 	}
 
-	time.Sleep(5 * time.Millisecond)
+	clock.Advance(5 * time.Millisecond)
 
 	err = cache.Set("shared_key", "new_value")
 	if err != nil {
@@ -378,3 +617,288 @@ func BenchmarkTTLCache_Get(b *testing.B) {
 		cache.Get("key")
 	}
 }
+
+// simClock gives each simulated request its own time: the simulation sets
+// it before a read and the loader moves it on by the load's cost.
+type simClock struct {
+	*FakeClock
+	now time.Time
+}
+
+func (c *simClock) Now() time.Time {
+	return c.now
+}
+
+// BenchmarkTTLCache_ExpiryStampede simulates 1000 keys loaded together and
+// each read once a second for ten minutes, with loads costing a second. It
+// reports the origin loads in the busiest second after the initial fill:
+// with a fixed TTL every key reloads in the same second each cycle.
+func BenchmarkTTLCache_ExpiryStampede(b *testing.B) {
+	for _, bc := range []struct {
+		name   string
+		jitter float64
+		beta   float64
+	}{
+		{"fixed", 0, 0},
+		{"jitter", 0.1, 0},
+		{"xfetch", 0, 1},
+		{"jitter+xfetch", 0.1, 1},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			var peak, total int
+			for i := 0; i < b.N; i++ {
+				peak, total = simulateExpiryStampede(b, bc.jitter, bc.beta)
+			}
+			b.ReportMetric(float64(peak), "peak-loads/s")
+			b.ReportMetric(float64(total), "loads")
+		})
+	}
+}
+
+func simulateExpiryStampede(b *testing.B, jitter, beta float64) (peak, total int) {
+	const keys, seconds, cost = 1000, 600, time.Second
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := &simClock{FakeClock: NewFakeClock(start), now: start}
+	perSecond := make([]int, seconds+1)
+	cache, err := NewTTLCacheWithConfig(TTLCacheConfig{
+		TTL:          time.Minute,
+		TTLJitter:    jitter,
+		EarlyRefresh: beta,
+		Clock:        clock,
+		Loader: func(ctx context.Context, key string) (interface{}, error) {
+			perSecond[clock.now.Sub(start)/time.Second]++
+			clock.now = clock.now.Add(cost)
+			return key, nil
+		},
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer cache.Close()
+
+	ctx := context.Background()
+	for second := 0; second < seconds; second++ {
+		for k := 0; k < keys; k++ {
+			clock.now = start.Add(time.Duration(second) * time.Second)
+			cache.Fetch(ctx, "key"+strconv.Itoa(k))
+		}
+	}
+	for second, n := range perSecond {
+		total += n
+		if second > 0 && n > peak {
+			peak = n
+		}
+	}
+	return peak, total
+}
+
+func TestTTLCache_EntryVersions(t *testing.T) {
+	cache, err := NewTTLCache(time.Minute)
+	if err != nil {
+		t.Fatalf("Failed to create TTLCache: %v", err)
+	}
+	defer cache.Close()
+
+	first, created, err := cache.UpsertIf("key1", "value1", nil)
+	if err != nil || !created {
+		t.Fatalf("Expected key1 to be created, got created=%v, err=%v", created, err)
+	}
+	second, created, err := cache.UpsertIf("key1", "value2", nil)
+	if err != nil || created {
+		t.Fatalf("Expected key1 to be replaced, got created=%v, err=%v", created, err)
+	}
+	if second.Version <= first.Version {
+		t.Errorf("Expected version to increase, got %d then %d", first.Version, second.Version)
+	}
+
+	stale := func(current Entry, exists bool) bool { return exists && current.Version == first.Version }
+	if _, _, err := cache.UpsertIf("key1", "value3", stale); err != ErrPreconditionFailed {
+		t.Errorf("Expected ErrPreconditionFailed, got %v", err)
+	}
+	if entry, _, _ := cache.GetEntry("key1"); entry.Value != "value2" || entry.Expires.IsZero() {
+		t.Errorf("Expected value2 with an expiry, got %+v", entry)
+	}
+}
+
+func TestTTLCache_RestoreEntry(t *testing.T) {
+	cache, clock := newFakeClockTTLCache(t, time.Hour)
+	now := clock.Now()
+
+	restored, err := cache.RestoreEntry("key1", Entry{Value: "value1", Version: 40, Expires: now.Add(2 * time.Minute)})
+	if err != nil || !restored {
+		t.Fatalf("Expected key1 to be restored, got restored=%v, err=%v", restored, err)
+	}
+	if entry, _, _ := cache.GetEntry("key1"); entry.Version != 40 || !entry.Expires.Equal(now.Add(2*time.Minute)) {
+		t.Errorf("Expected version 40 expiring in 2m, got %+v", entry)
+	}
+	if entry, _, _ := cache.UpsertIf("key2", "value2", nil); entry.Version <= 40 {
+		t.Errorf("Expected later writes to get later versions, got %d", entry.Version)
+	}
+
+	if restored, _ := cache.RestoreEntry("key1", Entry{Value: "older", Version: 39}); restored {
+		t.Error("Expected an older version not to replace key1")
+	}
+	if restored, _ := cache.RestoreEntry("key3", Entry{Value: "gone", Version: 1, Expires: now.Add(-time.Second)}); restored {
+		t.Error("Expected an expired entry not to be restored")
+	}
+	if _, exists, _ := cache.Get("key3"); exists {
+		t.Error("Expected key3 not to exist")
+	}
+}
+
+func TestCache_CapacityEvictsOldestWrite(t *testing.T) {
+	ttlCache, err := NewTTLCacheWithConfig(TTLCacheConfig{TTL: time.Minute, MaxEntries: 2})
+	if err != nil {
+		t.Fatalf("Failed to create TTLCache: %v", err)
+	}
+	defer ttlCache.Close()
+
+	caches := map[string]Cache{
+		"SimpleCache": NewSimpleCacheWithConfig(SimpleCacheConfig{MaxEntries: 2}),
+		"TTLCache":    ttlCache,
+	}
+	for name, cache := range caches {
+		t.Run(name, func(t *testing.T) {
+			cache.Set("a", 1)
+			cache.Set("b", 2)
+			cache.Set("a", 3) // rewriting a makes b the oldest write
+			cache.Set("c", 4)
+
+			if _, exists, _ := cache.Get("b"); exists {
+				t.Error("Expected b to be evicted")
+			}
+			for _, key := range []string{"a", "c"} {
+				if _, exists, _ := cache.Get(key); !exists {
+					t.Errorf("Expected %s to remain", key)
+				}
+			}
+		})
+	}
+}
+
+// blockingUpsert starts an UpsertIf that stays in flight until release is
+// closed.
+func blockingUpsert(cache *TTLCache, key string) (started, release chan struct{}, result chan error) {
+	started, release, result = make(chan struct{}), make(chan struct{}), make(chan error, 1)
+	go func() {
+		_, _, err := cache.UpsertIf(key, "value", func(Entry, bool) bool {
+			close(started)
+			<-release
+			return true
+		})
+		result <- err
+	}()
+	return started, release, result
+}
+
+func TestTTLCache_CloseWaitsForInflight(t *testing.T) {
+	cache, err := NewTTLCache(time.Minute)
+	if err != nil {
+		t.Fatalf("Failed to create TTLCache: %v", err)
+	}
+
+	started, release, result := blockingUpsert(cache, "slow")
+	<-started
+
+	closed := make(chan error, 1)
+	go func() { closed <- cache.Close() }()
+
+	for !cache.IsClosed() {
+		runtime.Gosched()
+	}
+	if err := cache.Set("new", "value"); err != ErrCacheClosed {
+		t.Errorf("Expected ErrCacheClosed while closing, got %v", err)
+	}
+	select {
+	case <-closed:
+		t.Fatal("Expected Close to wait for the in-flight write")
+	default:
+	}
+
+	close(release)
+	if err := <-result; err != nil {
+		t.Errorf("Expected the in-flight write to succeed, got %v", err)
+	}
+	if err := <-closed; err != nil {
+		t.Errorf("Unexpected Close error: %v", err)
+	}
+	if _, _, err := cache.Get("slow"); err != ErrCacheClosed {
+		t.Errorf("Expected ErrCacheClosed after Close, got %v", err)
+	}
+	if err := cache.Close(); err != nil {
+		t.Errorf("Expected a second Close to succeed, got %v", err)
+	}
+}
+
+func TestTTLCache_CloseContextDeadline(t *testing.T) {
+	cache, err := NewTTLCache(time.Minute)
+	if err != nil {
+		t.Fatalf("Failed to create TTLCache: %v", err)
+	}
+
+	started, release, result := blockingUpsert(cache, "slow")
+	<-started
+	defer func() {
+		close(release)
+		<-result
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := cache.CloseContext(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Expected DeadlineExceeded, got %v", err)
+	}
+	if err := cache.Set("new", "value"); err != ErrCacheClosed {
+		t.Errorf("Expected the cache to stay closed to new writes, got %v", err)
+	}
+}
+
+func TestTTLCache_ConcurrentSetAndClose(t *testing.T) {
+	cache, err := NewTTLCache(time.Minute)
+	if err != nil {
+		t.Fatalf("Failed to create TTLCache: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				if err := cache.Set(fmt.Sprintf("key_%d_%d", i, j), j); err != nil && err != ErrCacheClosed {
+					t.Errorf("Unexpected error: %v", err)
+				}
+			}
+		}(i)
+	}
+	cache.Close()
+	wg.Wait()
+}
+
+func TestContextCache_CancelledContext(t *testing.T) {
+	ttlCache, err := NewTTLCache(time.Minute)
+	if err != nil {
+		t.Fatalf("Failed to create TTLCache: %v", err)
+	}
+	defer ttlCache.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	for name, cache := range map[string]ContextCache{"SimpleCache": NewSimpleCache(), "TTLCache": ttlCache} {
+		t.Run(name, func(t *testing.T) {
+			if err := cache.SetContext(ctx, "key", "value"); err != context.Canceled {
+				t.Errorf("Expected Canceled from SetContext, got %v", err)
+			}
+			if _, _, err := cache.GetContext(ctx, "key"); err != context.Canceled {
+				t.Errorf("Expected Canceled from GetContext, got %v", err)
+			}
+			if err := cache.DeleteContext(ctx, "key"); err != context.Canceled {
+				t.Errorf("Expected Canceled from DeleteContext, got %v", err)
+			}
+			if err := cache.SetContext(context.Background(), "key", "value"); err != nil {
+				t.Errorf("Unexpected error: %v", err)
+			}
+		})
+	}
+}
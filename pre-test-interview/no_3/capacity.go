@@ -0,0 +1,41 @@
+package main
+
+import "container/list"
+
+// writeOrder tracks keys from oldest to newest write so a cache at capacity
+// can find its eviction victim in constant time. Callers provide locking.
+type writeOrder struct {
+	keys  *list.List
+	elems map[string]*list.Element
+}
+
+func newWriteOrder() *writeOrder {
+	return &writeOrder{keys: list.New(), elems: make(map[string]*list.Element)}
+}
+
+func (o *writeOrder) touch(key string) {
+	if elem, ok := o.elems[key]; ok {
+		o.keys.MoveToBack(elem)
+		return
+	}
+	o.elems[key] = o.keys.PushBack(key)
+}
+
+func (o *writeOrder) remove(key string) {
+	if elem, ok := o.elems[key]; ok {
+		o.keys.Remove(elem)
+		delete(o.elems, key)
+	}
+}
+
+func (o *writeOrder) oldest() (string, bool) {
+	front := o.keys.Front()
+	if front == nil {
+		return "", false
+	}
+	return front.Value.(string), true
+}
+
+func (o *writeOrder) len() int {
+	return o.keys.Len()
+}
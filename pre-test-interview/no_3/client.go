@@ -0,0 +1,611 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+	"unicode/utf8"
+)
+
+// Exit codes of `go run . client`, so scripts can tell a miss from a failure.
+const (
+	exitOK    = 0
+	exitMiss  = 1
+	exitError = 2
+)
+
+const clientUsage = `Usage: go run . client [flags] <command> [arguments]
+
+Commands:
+  get KEY                  print a value; exits 1 if the key is missing
+  set [flags] KEY [VALUE]  store VALUE, or stdin if it is - or left out
+      -ttl 10m             lifetime of this value (ttl cache only)
+      -file PATH           read the value from a file
+      -type TYPE           Content-Type to store it with (default JSON if the
+                           value parses as JSON, otherwise guessed or text)
+  del KEY                  delete a key; exits 1 if it is missing
+  keys [-prefix P]         list the keys held by the server, sorted
+  stats                    show the server's statistics
+  watch [-interval 1s] [-count N] KEY
+                           print the value each time it changes, until
+                           interrupted or N changes have been printed
+
+Other failures exit 2.
+
+Flags:
+`
+
+// runClient runs `go run . client` and returns its exit code.
+func runClient(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("client", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	server := fs.String("server", envOr("CACHE_SERVER", "http://localhost:8080"), "base URL of the server (env CACHE_SERVER)")
+	apiKey := fs.String("api-key", os.Getenv("CACHE_API_KEY"), "API key sent as X-API-Key (env CACHE_API_KEY)")
+	output := fs.String("o", "table", "output format, table or json")
+	timeout := fs.Duration("timeout", 10*time.Second, "timeout of each request")
+	fs.Usage = func() {
+		fmt.Fprint(stderr, clientUsage)
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return exitOK
+		}
+		return exitError
+	}
+	if *output != "table" && *output != "json" {
+		fmt.Fprintln(stderr, "error: -o must be table or json")
+		return exitError
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return exitError
+	}
+
+	c := &cacheClient{
+		base:   strings.TrimSuffix(*server, "/"),
+		apiKey: *apiKey,
+		http:   &http.Client{Timeout: *timeout, CheckRedirect: keepKeyOnSameHost},
+		stdin:  stdin,
+		out:    stdout,
+		json:   *output == "json",
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	command, rest := fs.Arg(0), fs.Args()[1:]
+	var err error
+	switch command {
+	case "get":
+		err = c.get(ctx, rest)
+	case "set":
+		err = c.set(ctx, rest)
+	case "del":
+		err = c.del(ctx, rest)
+	case "keys":
+		err = c.keys(ctx, rest)
+	case "stats":
+		err = c.stats(ctx, rest)
+	case "watch":
+		err = c.watch(ctx, rest)
+	default:
+		err = fmt.Errorf("unknown command %q; run with -h for the list", command)
+	}
+
+	switch {
+	case err == nil:
+		return exitOK
+	case errors.Is(err, ErrKeyNotFound):
+		fmt.Fprintln(stderr, err)
+		return exitMiss
+	}
+	fmt.Fprintln(stderr, "error:", err)
+	return exitError
+}
+
+func envOr(name, def string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return def
+}
+
+// keepKeyOnSameHost is the CheckRedirect of the command-line clients. A
+// gossip node redirects requests to the key's owner, which the client only
+// knows from the cluster, so the API key is not sent on to another host.
+// net/http drops Authorization itself but not X-API-Key.
+func keepKeyOnSameHost(req *http.Request, via []*http.Request) error {
+	if len(via) >= 10 {
+		return errors.New("stopped after 10 redirects")
+	}
+	if req.URL.Host != via[0].URL.Host {
+		req.Header.Del(apiKeyHeader)
+	}
+	return nil
+}
+
+type cacheClient struct {
+	base   string
+	apiKey string
+	http   *http.Client
+	stdin  io.Reader
+	out    io.Writer
+	json   bool
+}
+
+// clientEntry is a key as printed with -o json. Raw values that are not
+// UTF-8 text are given in base64.
+type clientEntry struct {
+	Key         string      `json:"key"`
+	Value       interface{} `json:"value,omitempty"`
+	Encoding    string      `json:"encoding,omitempty"`
+	ContentType string      `json:"content_type,omitempty"`
+	ETag        string      `json:"etag,omitempty"`
+	Expires     string      `json:"expires,omitempty"`
+	Stale       bool        `json:"stale,omitempty"`
+	Created     bool        `json:"created,omitempty"`
+	Deleted     bool        `json:"deleted,omitempty"`
+}
+
+func (c *cacheClient) request(ctx context.Context, method, path string, body []byte, header http.Header) (*http.Response, []byte, error) {
+	req, err := http.NewRequestWithContext(ctx, method, c.base+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	if c.apiKey != "" {
+		req.Header.Set(apiKeyHeader, c.apiKey)
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	return resp, data, err
+}
+
+// responseError turns a failed response into an error carrying the
+// server's message.
+func responseError(resp *http.Response, body []byte) error {
+	var envelope CacheResponse
+	if json.Unmarshal(body, &envelope) == nil && envelope.Error != "" {
+		return fmt.Errorf("%s: %s", resp.Status, envelope.Error)
+	}
+	return errors.New(resp.Status)
+}
+
+// responseData decodes the data of a JSON response.
+func responseData(body []byte) (interface{}, error) {
+	var envelope CacheResponse
+	if err := json.Unmarshal(body, &envelope); err != nil {
+		return nil, fmt.Errorf("invalid response from server: %w", err)
+	}
+	return envelope.Data, nil
+}
+
+func keyPath(key string) string {
+	return "/api/v2/keys/" + url.PathEscape(key)
+}
+
+// responseEntry reads a GET of a key. Raw values come back as []byte. A
+// JSON value the server kept compressed is sent as the bare document rather
+// than in the envelope, and net/http has decompressed it.
+func responseEntry(key string, resp *http.Response, body []byte) (clientEntry, error) {
+	entry := clientEntry{
+		Key:     key,
+		ETag:    resp.Header.Get("ETag"),
+		Expires: resp.Header.Get("Expires"),
+		Stale:   strings.Contains(resp.Header.Get("Cache-Status"), "ttl=-"),
+	}
+	if mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); mediaType == "application/json" {
+		if resp.Uncompressed {
+			err := json.Unmarshal(body, &entry.Value)
+			return entry, err
+		}
+		value, err := responseData(body)
+		entry.Value = value
+		return entry, err
+	}
+	entry.Value = body
+	entry.ContentType = resp.Header.Get("Content-Type")
+	return entry, nil
+}
+
+// formatValue renders a value for table output: text as it is, anything
+// else as compact JSON.
+func formatValue(value interface{}) string {
+	switch v := value.(type) {
+	case []byte:
+		return string(v)
+	case string:
+		return v
+	}
+	data, _ := json.Marshal(value)
+	return string(data)
+}
+
+// printable replaces a raw value with its text, or base64 if it is binary.
+func (e clientEntry) printable() clientEntry {
+	if raw, ok := e.Value.([]byte); ok {
+		if utf8.Valid(raw) {
+			e.Value = string(raw)
+		} else {
+			e.Value, e.Encoding = base64.StdEncoding.EncodeToString(raw), "base64"
+		}
+	}
+	return e
+}
+
+func (c *cacheClient) printJSON(v interface{}) error {
+	if e, ok := v.(clientEntry); ok {
+		v = e.printable()
+	}
+	enc := json.NewEncoder(c.out)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// parseArgs parses a command's flags and checks it got between min and max
+// arguments.
+func parseArgs(fs *flag.FlagSet, args []string, min, max int, usage string) error {
+	fs.SetOutput(io.Discard)
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return fmt.Errorf("usage: %s", usage)
+		}
+		return err
+	}
+	if n := fs.NArg(); n < min || n > max {
+		return fmt.Errorf("usage: %s", usage)
+	}
+	return nil
+}
+
+// fetch reads key, answering with status 200, 304 when etag is given and
+// still matches, or 404. Any other status is an error.
+func (c *cacheClient) fetch(ctx context.Context, key, etag string) (clientEntry, int, error) {
+	header := http.Header{}
+	if etag != "" {
+		header.Set("If-None-Match", etag)
+	}
+	resp, body, err := c.request(ctx, http.MethodGet, keyPath(key), nil, header)
+	if err != nil {
+		return clientEntry{}, 0, err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		entry, err := responseEntry(key, resp, body)
+		return entry, resp.StatusCode, err
+	case http.StatusNotModified, http.StatusNotFound:
+		return clientEntry{Key: key}, resp.StatusCode, nil
+	}
+	return clientEntry{}, resp.StatusCode, responseError(resp, body)
+}
+
+// put stores data as key's value, with its own ttl unless it is zero.
+func (c *cacheClient) put(ctx context.Context, key string, data []byte, contentType string, ttl time.Duration) (clientEntry, error) {
+	path := keyPath(key)
+	if ttl > 0 {
+		path += "?ttl=" + url.QueryEscape(ttl.String())
+	}
+	resp, body, err := c.request(ctx, http.MethodPut, path, data, http.Header{"Content-Type": {contentType}})
+	if err != nil {
+		return clientEntry{}, err
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		return clientEntry{}, responseError(resp, body)
+	}
+	return clientEntry{
+		Key:     key,
+		ETag:    resp.Header.Get("ETag"),
+		Expires: resp.Header.Get("Expires"),
+		Created: resp.StatusCode == http.StatusCreated,
+	}, nil
+}
+
+// remove deletes key, reporting whether it existed.
+func (c *cacheClient) remove(ctx context.Context, key string) (bool, error) {
+	resp, body, err := c.request(ctx, http.MethodDelete, keyPath(key), nil, nil)
+	if err != nil {
+		return false, err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	}
+	return false, responseError(resp, body)
+}
+
+func (c *cacheClient) listKeys(ctx context.Context, prefix string) ([]string, error) {
+	resp, body, err := c.request(ctx, http.MethodGet, "/api/v2/keys?prefix="+url.QueryEscape(prefix), nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, responseError(resp, body)
+	}
+	var envelope struct {
+		Data []string `json:"data"`
+	}
+	if err := json.Unmarshal(body, &envelope); err != nil {
+		return nil, fmt.Errorf("invalid response from server: %w", err)
+	}
+	if envelope.Data == nil {
+		envelope.Data = []string{}
+	}
+	return envelope.Data, nil
+}
+
+func (c *cacheClient) serverStats(ctx context.Context) (interface{}, error) {
+	resp, body, err := c.request(ctx, http.MethodGet, "/api/cache/stats", nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, responseError(resp, body)
+	}
+	return responseData(body)
+}
+
+// guessContentType picks the type a value is stored with when none is
+// given: JSON if it parses as JSON, otherwise text.
+func guessContentType(data []byte) string {
+	if json.Valid(data) {
+		return "application/json"
+	}
+	return "text/plain; charset=utf-8"
+}
+
+func (c *cacheClient) get(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("get", flag.ContinueOnError)
+	if err := parseArgs(fs, args, 1, 1, "get KEY"); err != nil {
+		return err
+	}
+	key := fs.Arg(0)
+
+	entry, status, err := c.fetch(ctx, key, "")
+	if err != nil {
+		return err
+	}
+	if status == http.StatusNotFound {
+		return fmt.Errorf("%w: '%s'", ErrKeyNotFound, key)
+	}
+	if c.json {
+		return c.printJSON(entry)
+	}
+	if raw, ok := entry.Value.([]byte); ok {
+		_, err := c.out.Write(raw)
+		return err
+	}
+	_, err = fmt.Fprintln(c.out, formatValue(entry.Value))
+	return err
+}
+
+func (c *cacheClient) set(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("set", flag.ContinueOnError)
+	ttl := fs.Duration("ttl", 0, "")
+	file := fs.String("file", "", "")
+	contentType := fs.String("type", "", "")
+	if err := parseArgs(fs, args, 1, 2, "set [-ttl D] [-file PATH] [-type TYPE] KEY [VALUE]"); err != nil {
+		return err
+	}
+	key := fs.Arg(0)
+
+	var data []byte
+	var err error
+	switch {
+	case *file != "":
+		data, err = os.ReadFile(*file)
+	case fs.NArg() == 2 && fs.Arg(1) != "-":
+		data = []byte(fs.Arg(1))
+	default:
+		data, err = io.ReadAll(c.stdin)
+	}
+	if err != nil {
+		return err
+	}
+
+	if *contentType == "" {
+		if *file != "" {
+			*contentType = mime.TypeByExtension(filepath.Ext(*file))
+			if *contentType == "" {
+				*contentType = http.DetectContentType(data)
+			}
+		} else {
+			*contentType = guessContentType(data)
+		}
+	}
+
+	entry, err := c.put(ctx, key, data, *contentType, *ttl)
+	if err != nil {
+		return err
+	}
+	if c.json {
+		return c.printJSON(entry)
+	}
+	if entry.Created {
+		_, err = fmt.Fprintf(c.out, "Created key '%s'\n", key)
+	} else {
+		_, err = fmt.Fprintf(c.out, "Replaced key '%s'\n", key)
+	}
+	return err
+}
+
+func (c *cacheClient) del(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("del", flag.ContinueOnError)
+	if err := parseArgs(fs, args, 1, 1, "del KEY"); err != nil {
+		return err
+	}
+	key := fs.Arg(0)
+
+	existed, err := c.remove(ctx, key)
+	if err != nil {
+		return err
+	}
+	if !existed {
+		return fmt.Errorf("%w: '%s'", ErrKeyNotFound, key)
+	}
+	if c.json {
+		return c.printJSON(clientEntry{Key: key, Deleted: true})
+	}
+	_, err = fmt.Fprintf(c.out, "Deleted key '%s'\n", key)
+	return err
+}
+
+func (c *cacheClient) keys(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("keys", flag.ContinueOnError)
+	prefix := fs.String("prefix", "", "")
+	if err := parseArgs(fs, args, 0, 0, "keys [-prefix P]"); err != nil {
+		return err
+	}
+
+	keys, err := c.listKeys(ctx, *prefix)
+	if err != nil {
+		return err
+	}
+	if c.json {
+		return c.printJSON(keys)
+	}
+	for _, key := range keys {
+		if _, err := fmt.Fprintln(c.out, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *cacheClient) stats(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("stats", flag.ContinueOnError)
+	if err := parseArgs(fs, args, 0, 0, "stats"); err != nil {
+		return err
+	}
+
+	data, err := c.serverStats(ctx)
+	if err != nil {
+		return err
+	}
+	if c.json {
+		return c.printJSON(data)
+	}
+	return printStatsTable(c.out, data)
+}
+
+// printStatsTable prints statistics as a NAME/VALUE table, nested ones
+// named with dotted paths.
+func printStatsTable(w io.Writer, data interface{}) error {
+	rows := map[string]string{}
+	flattenStats("", data, rows)
+	names := make([]string, 0, len(rows))
+	for name := range rows {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tVALUE")
+	for _, name := range names {
+		fmt.Fprintf(tw, "%s\t%s\n", name, rows[name])
+	}
+	return tw.Flush()
+}
+
+func flattenStats(prefix string, v interface{}, rows map[string]string) {
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		rows[prefix] = formatValue(v)
+		return
+	}
+	for name, child := range m {
+		if prefix != "" {
+			name = prefix + "." + name
+		}
+		flattenStats(name, child, rows)
+	}
+}
+
+// watch polls a key with If-None-Match, so unchanged polls cost the server
+// a 304, and prints each new value or the key going missing.
+func (c *cacheClient) watch(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("watch", flag.ContinueOnError)
+	interval := fs.Duration("interval", time.Second, "")
+	count := fs.Int("count", 0, "")
+	if err := parseArgs(fs, args, 1, 1, "watch [-interval 1s] [-count N] KEY"); err != nil {
+		return err
+	}
+	if *interval <= 0 {
+		return errors.New("-interval must be positive")
+	}
+	key := fs.Arg(0)
+
+	var etag string
+	printed, missing := 0, false
+	for {
+		entry, status, err := c.fetch(ctx, key, etag)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case status == http.StatusOK:
+			etag, missing = entry.ETag, false
+			if err := c.printChange(entry); err != nil {
+				return err
+			}
+			printed++
+		case status == http.StatusNotFound && !missing:
+			etag, missing = "", true
+			entry.Deleted = true
+			if err := c.printChange(entry); err != nil {
+				return err
+			}
+			printed++
+		}
+		if *count > 0 && printed >= *count {
+			return nil
+		}
+
+		timer := time.NewTimer(*interval)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil
+		}
+	}
+}
+
+// printChange prints one line per change: a JSON object with -o json.
+func (c *cacheClient) printChange(entry clientEntry) error {
+	if c.json {
+		return json.NewEncoder(c.out).Encode(entry.printable())
+	}
+	now := time.Now().Format(time.TimeOnly)
+	if entry.Deleted {
+		_, err := fmt.Fprintf(c.out, "%s  %s  (missing)\n", now, entry.Key)
+		return err
+	}
+	_, err := fmt.Fprintf(c.out, "%s  %s  %s\n", now, entry.Key, formatValue(entry.Value))
+	return err
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// runTestClient runs the client against ts and returns its exit code and
+// output.
+func runTestClient(t *testing.T, url, stdin string, args ...string) (int, string, string) {
+	t.Helper()
+	var stdout, stderr bytes.Buffer
+	code := runClient(append([]string{"-server", url}, args...), strings.NewReader(stdin), &stdout, &stderr)
+	return code, stdout.String(), stderr.String()
+}
+
+func TestClient_Commands(t *testing.T) {
+	cache, err := NewTTLCache(time.Minute)
+	if err != nil {
+		t.Fatalf("Failed to create TTLCache: %v", err)
+	}
+	defer cache.Close()
+	ts := newTestServer(t, cache)
+
+	if code, out, _ := runTestClient(t, ts.URL, "", "set", "user:1", "Ada"); code != exitOK || !strings.Contains(out, "Created") {
+		t.Fatalf("Expected set to create the key, got %d %q", code, out)
+	}
+	if code, out, _ := runTestClient(t, ts.URL, "", "get", "user:1"); code != exitOK || out != "Ada" {
+		t.Errorf("Expected the raw text back, got %d %q", code, out)
+	}
+	if code, _, _ := runTestClient(t, ts.URL, `{"n": 1}`, "set", "-ttl", "5m", "user:2"); code != exitOK {
+		t.Fatalf("Expected set from stdin with a TTL to succeed, got %d", code)
+	}
+	if entry, _, _ := cache.GetEntry("user:2"); entry.TTL(time.Now()) < 4*time.Minute {
+		t.Errorf("Expected the per-key TTL of 5m, got %v", entry.TTL(time.Now()))
+	}
+
+	code, out, _ := runTestClient(t, ts.URL, "", "-o", "json", "get", "user:2")
+	var entry clientEntry
+	if err := json.Unmarshal([]byte(out), &entry); code != exitOK || err != nil || entry.ETag == "" {
+		t.Fatalf("Expected a JSON entry, got %d %q", code, out)
+	}
+	if value, _ := entry.Value.(map[string]interface{}); value["n"] != 1.0 {
+		t.Errorf("Expected the value stored as JSON, got %#v", entry.Value)
+	}
+
+	runTestClient(t, ts.URL, "", "set", "other", "1")
+	if code, out, _ := runTestClient(t, ts.URL, "", "keys", "-prefix", "user:"); code != exitOK || out != "user:1\nuser:2\n" {
+		t.Errorf("Expected the sorted user keys, got %d %q", code, out)
+	}
+	if code, out, _ := runTestClient(t, ts.URL, "", "stats"); code != exitOK || !strings.HasPrefix(out, "NAME") {
+		t.Errorf("Expected a stats table, got %d %q", code, out)
+	}
+
+	if code, _, _ := runTestClient(t, ts.URL, "", "del", "user:1"); code != exitOK {
+		t.Errorf("Expected del to succeed, got %d", code)
+	}
+	if code, _, errOut := runTestClient(t, ts.URL, "", "get", "user:1"); code != exitMiss || errOut == "" {
+		t.Errorf("Expected exit %d for a miss, got %d", exitMiss, code)
+	}
+	if code, _, _ := runTestClient(t, ts.URL, "", "del", "user:1"); code != exitMiss {
+		t.Errorf("Expected exit %d deleting a missing key, got %d", exitMiss, code)
+	}
+	if code, _, _ := runTestClient(t, "http://127.0.0.1:1", "", "get", "user:1"); code != exitError {
+		t.Errorf("Expected exit %d when the server is unreachable, got %d", exitError, code)
+	}
+	if code, _, _ := runTestClient(t, ts.URL, "", "get"); code != exitError {
+		t.Errorf("Expected exit %d for a usage error, got %d", exitError, code)
+	}
+
+	simple := newTestServer(t, NewSimpleCache())
+	if code, _, errOut := runTestClient(t, simple.URL, "", "set", "-ttl", "1m", "k", "v"); code != exitError || !strings.Contains(errOut, "501") {
+		t.Errorf("Expected a per-key TTL on the simple cache to fail with 501, got %d %q", code, errOut)
+	}
+}
+
+func TestClient_Watch(t *testing.T) {
+	cache := NewSimpleCache()
+	ts := newTestServer(t, cache)
+	cache.Set("status", "starting")
+
+	done := make(chan string, 1)
+	go func() {
+		_, out, _ := runTestClient(t, ts.URL, "", "-o", "json", "watch", "-interval", "10ms", "-count", "3", "status")
+		done <- out
+	}()
+	time.Sleep(50 * time.Millisecond)
+	cache.Set("status", "ready")
+	time.Sleep(50 * time.Millisecond)
+	cache.Delete("status")
+
+	select {
+	case out := <-done:
+		lines := strings.Split(strings.TrimSpace(out), "\n")
+		if len(lines) != 3 || !strings.Contains(lines[0], "starting") || !strings.Contains(lines[1], "ready") || !strings.Contains(lines[2], `"deleted":true`) {
+			t.Errorf("Expected three changes, got %q", out)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("Expected watch to stop after three changes")
+	}
+}
+
+func TestClient_RedirectDropsAPIKey(t *testing.T) {
+	var keys []string
+	owner := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		keys = append(keys, r.Header.Get(apiKeyHeader))
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte("Ada"))
+	}))
+	defer owner.Close()
+	node := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		keys = append(keys, r.Header.Get(apiKeyHeader))
+		http.Redirect(w, r, owner.URL+r.URL.RequestURI(), http.StatusTemporaryRedirect)
+	}))
+	defer node.Close()
+
+	if code, out, _ := runTestClient(t, node.URL, "", "-api-key", "user-secret", "get", "user:1"); code != exitOK || out != "Ada" {
+		t.Fatalf("Expected the redirect to be followed, got %d %q", code, out)
+	}
+	if len(keys) != 2 || keys[0] != "user-secret" || keys[1] != "" {
+		t.Errorf("Expected the API key only on the first host, got %q", keys)
+	}
+}
+
+func TestClient_GetCompressedJSON(t *testing.T) {
+	ts := newTestServer(t, NewCompressedCache(NewSimpleCache(), CompressedCacheConfig{Compressor: gzipCompressor{}}))
+	doc := `{"name": "` + strings.Repeat("Ada", 400) + `"}`
+	if code, _, _ := runTestClient(t, ts.URL, doc, "set", "doc"); code != exitOK {
+		t.Fatalf("Expected set to succeed, got %d", code)
+	}
+
+	// The server sends the document gzipped and bare; net/http unpacks it.
+	code, out, _ := runTestClient(t, ts.URL, "", "-o", "json", "get", "doc")
+	var entry clientEntry
+	if err := json.Unmarshal([]byte(out), &entry); code != exitOK || err != nil {
+		t.Fatalf("Expected a JSON entry, got %d %q", code, out)
+	}
+	if value, _ := entry.Value.(map[string]interface{}); value["name"] != strings.Repeat("Ada", 400) {
+		t.Errorf("Expected the JSON document, got %.60v", entry.Value)
+	}
+}
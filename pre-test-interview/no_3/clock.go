@@ -0,0 +1,150 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock is the source of time for TTLCache, so expiry can be driven by a
+// FakeClock in tests and demos.
+type Clock interface {
+	Now() time.Time
+	NewTicker(d time.Duration) Ticker
+}
+
+// Ticker is the part of *time.Ticker that TTLCache uses.
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+	Reset(d time.Duration)
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) NewTicker(d time.Duration) Ticker {
+	return systemTicker{time.NewTicker(d)}
+}
+
+type systemTicker struct {
+	*time.Ticker
+}
+
+func (t systemTicker) C() <-chan time.Time {
+	return t.Ticker.C
+}
+
+// FakeClock is a Clock that only moves when told to. Its tickers fire from
+// Advance, which hands each due tick to the ticker's receiver before moving
+// on.
+type FakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	tickers []*fakeTicker
+}
+
+func NewFakeClock(start time.Time) *FakeClock {
+	return &FakeClock{now: start}
+}
+
+func (c *FakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *FakeClock) NewTicker(d time.Duration) Ticker {
+	if d <= 0 {
+		panic("non-positive interval for FakeClock.NewTicker")
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &fakeTicker{
+		clock:  c,
+		ch:     make(chan time.Time),
+		stop:   make(chan struct{}),
+		period: d,
+		next:   c.now.Add(d),
+	}
+	c.tickers = append(c.tickers, t)
+	return t
+}
+
+// Advance moves the clock forward by d, firing every tick that falls due on
+// the way in time order. Each tick blocks until its ticker's receiver takes
+// it or the ticker is stopped, so nothing is dropped.
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	target := c.now.Add(d)
+	c.mu.Unlock()
+
+	for {
+		c.mu.Lock()
+		t := c.nextDue(target)
+		if t == nil {
+			c.now = target
+			c.mu.Unlock()
+			return
+		}
+		at, stop := t.next, t.stop
+		c.now = at
+		t.next = at.Add(t.period)
+		c.mu.Unlock()
+
+		select {
+		case t.ch <- at:
+		case <-stop:
+		}
+	}
+}
+
+// nextDue returns the running ticker with the earliest tick no later than
+// target. Callers must hold c.mu.
+func (c *FakeClock) nextDue(target time.Time) *fakeTicker {
+	var due *fakeTicker
+	for _, t := range c.tickers {
+		if t.stopped || t.next.After(target) {
+			continue
+		}
+		if due == nil || t.next.Before(due.next) {
+			due = t
+		}
+	}
+	return due
+}
+
+type fakeTicker struct {
+	clock   *FakeClock
+	ch      chan time.Time
+	stop    chan struct{}
+	period  time.Duration
+	next    time.Time
+	stopped bool
+}
+
+func (t *fakeTicker) C() <-chan time.Time {
+	return t.ch
+}
+
+func (t *fakeTicker) Stop() {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	if !t.stopped {
+		t.stopped = true
+		close(t.stop)
+	}
+}
+
+func (t *fakeTicker) Reset(d time.Duration) {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	t.period = d
+	t.next = t.clock.now.Add(d)
+	if t.stopped {
+		t.stopped = false
+		t.stop = make(chan struct{})
+	}
+}
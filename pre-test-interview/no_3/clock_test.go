@@ -0,0 +1,55 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFakeClock_FiresTicksInOrder(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := NewFakeClock(start)
+	fast := clock.NewTicker(time.Second)
+	slow := clock.NewTicker(3 * time.Second)
+
+	var got []string
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for len(got) < 4 {
+			select {
+			case at := <-fast.C():
+				got = append(got, "fast@"+at.Sub(start).String())
+			case at := <-slow.C():
+				got = append(got, "slow@"+at.Sub(start).String())
+			}
+		}
+	}()
+
+	clock.Advance(3500 * time.Millisecond)
+	<-done
+
+	// The two ticks due at 3s may arrive in either order.
+	if len(got) != 4 || got[0] != "fast@1s" || got[1] != "fast@2s" ||
+		!(got[2] == "fast@3s" && got[3] == "slow@3s" || got[2] == "slow@3s" && got[3] == "fast@3s") {
+		t.Errorf("Expected ticks at 1s, 2s and 3s plus the slow tick at 3s, got %v", got)
+	}
+	if now := clock.Now(); !now.Equal(start.Add(3500 * time.Millisecond)) {
+		t.Errorf("Expected the clock at 3.5s, got %v", now.Sub(start))
+	}
+}
+
+func TestFakeClock_StoppedTickerDoesNotBlock(t *testing.T) {
+	clock := NewFakeClock(time.Unix(0, 0))
+	ticker := clock.NewTicker(time.Second)
+	ticker.Stop()
+
+	clock.Advance(time.Minute)
+
+	ticker.Reset(time.Second)
+	go clock.Advance(time.Second)
+	select {
+	case <-ticker.C():
+	case <-time.After(time.Second):
+		t.Fatal("Expected a tick after Reset")
+	}
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// GossipCluster shards keys over the members discovered by gossip and moves
+// keys to their new owner whenever membership changes.
+type GossipCluster struct {
+	gossip *Gossip
+	cache  Cache
+	client *http.Client
+	apiKey string
+
+	rebalanceCh chan struct{}
+	stopCh      chan struct{}
+	wg          sync.WaitGroup
+	closeOnce   sync.Once
+}
+
+func NewGossipCluster(cache Cache, cfg GossipConfig) (*GossipCluster, error) {
+	if _, ok := cache.(KeyLister); !ok {
+		return nil, errors.New("gossip: cache must be able to list its keys")
+	}
+	if cfg.APIAddr == "" {
+		return nil, errors.New("gossip: API address is required")
+	}
+	if cfg.HandoffAPIKey != "" && len(cfg.SecretKey) == 0 {
+		return nil, errors.New("gossip: a handoff API key requires a secret key, or it would be sent to unverified members")
+	}
+
+	c := &GossipCluster{
+		cache: cache,
+		// Handoff goes to the member itself, never where it redirects.
+		client: &http.Client{
+			Timeout:       5 * time.Second,
+			CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+		},
+		apiKey:      cfg.HandoffAPIKey,
+		rebalanceCh: make(chan struct{}, 1),
+		stopCh:      make(chan struct{}),
+	}
+
+	onChange := cfg.OnChange
+	cfg.OnChange = func(members []Member) {
+		if onChange != nil {
+			onChange(members)
+		}
+		c.scheduleRebalance()
+	}
+
+	g, err := NewGossip(cfg)
+	if err != nil {
+		return nil, err
+	}
+	c.gossip = g
+
+	c.wg.Add(1)
+	go c.rebalanceLoop()
+
+	return c, nil
+}
+
+func (c *GossipCluster) Gossip() *Gossip {
+	return c.gossip
+}
+
+// Owner returns the member that owns key and whether that is this node.
+func (c *GossipCluster) Owner(key string) (Member, bool) {
+	owner, ok := c.gossip.Owner(key)
+	if !ok {
+		return c.gossip.LocalMember(), true
+	}
+	return owner, owner.Name == c.gossip.LocalMember().Name
+}
+
+func (c *GossipCluster) scheduleRebalance() {
+	select {
+	case c.rebalanceCh <- struct{}{}:
+	default:
+	}
+}
+
+func (c *GossipCluster) rebalanceLoop() {
+	defer c.wg.Done()
+
+	for {
+		select {
+		case <-c.rebalanceCh:
+			c.Rebalance()
+		case <-c.stopCh:
+			return
+		}
+	}
+}
+
+// Rebalance hands every local key that this node no longer owns to its
+// owner, deleting the local copy once the owner has accepted it.
+func (c *GossipCluster) Rebalance() (int, error) {
+	moved := 0
+	var errs []error
+
+	for _, key := range c.cache.(KeyLister).Keys() {
+		owner, local := c.Owner(key)
+		if local || owner.APIAddr == "" {
+			continue
+		}
+
+		entry, exists, err := c.getEntry(key)
+		if err != nil || !exists {
+			continue
+		}
+		if err := c.handoff(owner, key, entry); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if err := c.cache.Delete(key); err == nil {
+			moved++
+		}
+	}
+	return moved, errors.Join(errs...)
+}
+
+// getEntry reads key with the metadata handoff passes on, if the cache
+// keeps any.
+func (c *GossipCluster) getEntry(key string) (Entry, bool, error) {
+	if eg, ok := c.cache.(EntryGetter); ok {
+		return eg.GetEntry(key)
+	}
+	value, exists, err := c.cache.Get(key)
+	return Entry{Value: value}, exists, err
+}
+
+// handoff sends an entry to owner with its expiry and version, as a
+// snapshot entry, so it lives no longer there than it would have here and
+// keeps its ETag.
+func (c *GossipCluster) handoff(owner Member, key string, entry Entry) error {
+	e, err := encodeSnapshotEntry(key, entry)
+	if err != nil {
+		return fmt.Errorf("handoff '%s': %w", key, err)
+	}
+	body, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("handoff '%s': %w", key, err)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, owner.APIAddr+"/api/cluster/handoff", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if c.apiKey != "" {
+		req.Header.Set(apiKeyHeader, c.apiKey)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("handoff '%s' to %s: %w", key, owner.Name, err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("handoff '%s' to %s: %s", key, owner.Name, resp.Status)
+	}
+	return nil
+}
+
+// drain hands every local key to the member that will own it once this node
+// is gone.
+func (c *GossipCluster) drain() error {
+	self := c.gossip.LocalMember().Name
+	byName := make(map[string]Member)
+	var names []string
+	for _, m := range c.gossip.Members() {
+		if m.Name != self && (m.State == MemberAlive || m.State == MemberSuspect) {
+			byName[m.Name] = m
+			names = append(names, m.Name)
+		}
+	}
+	if len(names) == 0 {
+		return nil
+	}
+	ring := NewHashRing(defaultRingReplicas, names)
+
+	var errs []error
+	for _, key := range c.cache.(KeyLister).Keys() {
+		entry, exists, err := c.getEntry(key)
+		if err != nil || !exists {
+			continue
+		}
+		if err := c.handoff(byName[ring.Owner(key)], key, entry); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Close hands this node's keys to their next owners and leaves the cluster,
+// so peers take over without waiting for the failure detector.
+func (c *GossipCluster) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		close(c.stopCh)
+		c.wg.Wait()
+		err = errors.Join(c.drain(), c.gossip.Leave(time.Second))
+	})
+	return err
+}
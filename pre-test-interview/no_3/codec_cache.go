@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// codecCache stores values in the inner cache in an encoded form and
+// decodes them on the way out. It forwards every optional interface the
+// server uses, falling back like the server does when the inner cache lacks
+// one. CompressedCache and EncryptedCache are built on it.
+type codecCache struct {
+	inner  Cache
+	encode func(key string, value interface{}) (interface{}, error)
+	decode func(key string, value interface{}) (interface{}, error)
+}
+
+func (c *codecCache) Set(key string, value interface{}) error {
+	stored, err := c.encode(key, value)
+	if err != nil {
+		return err
+	}
+	return c.inner.Set(key, stored)
+}
+
+func (c *codecCache) SetContext(ctx context.Context, key string, value interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	stored, err := c.encode(key, value)
+	if err != nil {
+		return err
+	}
+	if cc, ok := c.inner.(ContextCache); ok {
+		return cc.SetContext(ctx, key, stored)
+	}
+	return c.inner.Set(key, stored)
+}
+
+func (c *codecCache) Upsert(key string, value interface{}) (bool, error) {
+	stored, err := c.encode(key, value)
+	if err != nil {
+		return false, err
+	}
+	if u, ok := c.inner.(Upserter); ok {
+		return u.Upsert(key, stored)
+	}
+	_, exists, err := c.inner.Get(key)
+	if err != nil {
+		return false, err
+	}
+	return !exists, c.inner.Set(key, stored)
+}
+
+// UpsertIf hands cond the decoded current entry. The returned entry holds
+// value as given.
+func (c *codecCache) UpsertIf(key string, value interface{}, cond Precondition) (Entry, bool, error) {
+	cw, ok := c.inner.(ConditionalWriter)
+	if !ok {
+		current, exists, err := c.GetEntry(key)
+		if err != nil {
+			return Entry{}, false, err
+		}
+		if cond != nil && !cond(current, exists) {
+			return current, false, ErrPreconditionFailed
+		}
+		created, err := c.Upsert(key, value)
+		if err != nil {
+			return Entry{}, false, err
+		}
+		entry, _, err := c.GetEntry(key)
+		return entry, created, err
+	}
+
+	stored, err := c.encode(key, value)
+	if err != nil {
+		return Entry{}, false, err
+	}
+	entry, created, err := cw.UpsertIf(key, stored, c.decodingCond(key, cond))
+	if err == nil {
+		entry.Value = value
+	} else if v, derr := c.decode(key, entry.Value); derr == nil {
+		entry.Value = v
+	}
+	return entry, created, err
+}
+
+// UpsertWithTTL is UpsertIf with a lifetime for this write; the inner
+// cache must be an ExpiringWriter.
+func (c *codecCache) UpsertWithTTL(ctx context.Context, key string, value interface{}, ttl time.Duration, cond Precondition) (Entry, bool, error) {
+	ew, ok := c.inner.(ExpiringWriter)
+	if !ok {
+		return Entry{}, false, ErrTTLUnsupported
+	}
+	stored, err := c.encode(key, value)
+	if err != nil {
+		return Entry{}, false, err
+	}
+	entry, created, err := ew.UpsertWithTTL(ctx, key, stored, ttl, c.decodingCond(key, cond))
+	if err == nil {
+		entry.Value = value
+	} else if v, derr := c.decode(key, entry.Value); derr == nil {
+		entry.Value = v
+	}
+	return entry, created, err
+}
+
+func (c *codecCache) decodingCond(key string, cond Precondition) Precondition {
+	if cond == nil {
+		return nil
+	}
+	return func(current Entry, exists bool) bool {
+		if exists {
+			if v, err := c.decode(key, current.Value); err == nil {
+				current.Value = v
+			}
+		}
+		return cond(current, exists)
+	}
+}
+
+// Update hands fn the decoded value and stores its result encoded. The inner
+// cache must be an Updater.
+func (c *codecCache) Update(key string, fn UpdateFunc) (Entry, bool, error) {
+	u, ok := c.inner.(Updater)
+	if !ok {
+		return Entry{}, false, ErrUpdatesUnsupported
+	}
+	var next interface{}
+	entry, exists, err := u.Update(key, func(current interface{}, exists bool) (interface{}, error) {
+		if exists {
+			v, err := c.decode(key, current)
+			if err != nil {
+				return nil, err
+			}
+			current = v
+		}
+		value, err := fn(current, exists)
+		if err != nil || value == nil {
+			next = current
+			return value, err
+		}
+		next = value
+		return c.encode(key, value)
+	})
+	if err == nil && exists {
+		entry.Value = next
+	}
+	return entry, exists, err
+}
+
+func (c *codecCache) Get(key string) (interface{}, bool, error) {
+	value, exists, err := c.inner.Get(key)
+	if err != nil || !exists {
+		return value, exists, err
+	}
+	value, err = c.decode(key, value)
+	return value, err == nil, err
+}
+
+func (c *codecCache) GetContext(ctx context.Context, key string) (interface{}, bool, error) {
+	cc, ok := c.inner.(ContextCache)
+	if !ok {
+		if err := ctx.Err(); err != nil {
+			return nil, false, err
+		}
+		return c.Get(key)
+	}
+	value, exists, err := cc.GetContext(ctx, key)
+	if err != nil || !exists {
+		return value, exists, err
+	}
+	value, err = c.decode(key, value)
+	return value, err == nil, err
+}
+
+// getStoredEntry returns the entry as the inner cache holds it.
+func (c *codecCache) getStoredEntry(key string) (Entry, bool, error) {
+	if g, ok := c.inner.(EntryGetter); ok {
+		return g.GetEntry(key)
+	}
+	value, exists, err := c.inner.Get(key)
+	return Entry{Value: value}, exists, err
+}
+
+func (c *codecCache) GetEntry(key string) (Entry, bool, error) {
+	entry, exists, err := c.getStoredEntry(key)
+	if err != nil || !exists {
+		return entry, exists, err
+	}
+	entry.Value, err = c.decode(key, entry.Value)
+	return entry, err == nil, err
+}
+
+func (c *codecCache) Delete(key string) error {
+	return c.inner.Delete(key)
+}
+
+func (c *codecCache) DeleteContext(ctx context.Context, key string) error {
+	if cc, ok := c.inner.(ContextCache); ok {
+		return cc.DeleteContext(ctx, key)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return c.inner.Delete(key)
+}
+
+func (c *codecCache) Remove(key string) (bool, error) {
+	if r, ok := c.inner.(Remover); ok {
+		return r.Remove(key)
+	}
+	_, exists, err := c.inner.Get(key)
+	if err != nil {
+		return false, err
+	}
+	return exists, c.inner.Delete(key)
+}
+
+func (c *codecCache) RemoveIf(key string, cond Precondition) (bool, error) {
+	if cw, ok := c.inner.(ConditionalWriter); ok {
+		return cw.RemoveIf(key, c.decodingCond(key, cond))
+	}
+	current, exists, err := c.GetEntry(key)
+	if err != nil {
+		return false, err
+	}
+	if cond != nil && !cond(current, exists) {
+		return false, ErrPreconditionFailed
+	}
+	return c.Remove(key)
+}
+
+func (c *codecCache) Keys() []string {
+	if l, ok := c.inner.(KeyLister); ok {
+		return l.Keys()
+	}
+	return nil
+}
+
+func (c *codecCache) RestoreEntry(key string, e Entry) (bool, error) {
+	er, ok := c.inner.(EntryRestorer)
+	if !ok {
+		return false, ErrRestoreUnsupported
+	}
+	stored, err := c.encode(key, e.Value)
+	if err != nil {
+		return false, err
+	}
+	e.Value = stored
+	return er.RestoreEntry(key, e)
+}
+
+// Snapshot and Restore pass values through in their encoded form.
+func (c *codecCache) Snapshot() ([]byte, error) {
+	s, ok := c.inner.(Snapshotter)
+	if !ok {
+		return nil, fmt.Errorf("%T does not support snapshots", c.inner)
+	}
+	return s.Snapshot()
+}
+
+func (c *codecCache) Restore(data []byte) error {
+	s, ok := c.inner.(Snapshotter)
+	if !ok {
+		return fmt.Errorf("%T does not support snapshots", c.inner)
+	}
+	return s.Restore(data)
+}
+
+func (c *codecCache) Close() error {
+	if closer, ok := c.inner.(Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+// Compressor is a compression format for CompressedCache. Name is the HTTP
+// Content-Encoding token of its output, so values can be served to clients
+// that accept it without being decompressed.
+type Compressor interface {
+	Name() string
+	Compress(data []byte) ([]byte, error)
+	Decompress(data []byte) ([]byte, error)
+}
+
+var (
+	compressorsMu sync.RWMutex
+	compressors   = map[string]Compressor{
+		"gzip":    gzipCompressor{},
+		"deflate": deflateCompressor{},
+	}
+)
+
+// RegisterCompressor makes c available by name, for the compression setting
+// and for reading back values it compressed. It panics if the name is taken.
+func RegisterCompressor(c Compressor) {
+	compressorsMu.Lock()
+	defer compressorsMu.Unlock()
+	if _, dup := compressors[c.Name()]; dup || c.Name() == "" {
+		panic("RegisterCompressor called twice or without a name for " + c.Name())
+	}
+	compressors[c.Name()] = c
+}
+
+func lookupCompressor(name string) (Compressor, bool) {
+	compressorsMu.RLock()
+	defer compressorsMu.RUnlock()
+	c, ok := compressors[name]
+	return c, ok
+}
+
+type gzipCompressor struct{}
+
+func (gzipCompressor) Name() string { return "gzip" }
+
+func (gzipCompressor) Compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gzipCompressor) Decompress(data []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+// deflateCompressor writes the zlib format, which is what HTTP calls deflate.
+type deflateCompressor struct{}
+
+func (deflateCompressor) Name() string { return "deflate" }
+
+func (deflateCompressor) Compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := zlib.NewWriter(&buf)
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (deflateCompressor) Decompress(data []byte) ([]byte, error) {
+	r, err := zlib.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+// Kinds of value a compressedValue holds.
+const (
+	compressedJSON   = ""
+	compressedString = "string"
+	compressedRaw    = "raw"
+)
+
+// compressedValue is how CompressedCache stores a value: JSON values as
+// their encoding, strings and raw bodies as their bytes.
+type compressedValue struct {
+	Encoding    string `json:"encoding"`
+	Kind        string `json:"kind,omitempty"`
+	ContentType string `json:"content_type,omitempty"`
+	Size        int    `json:"size"`
+	Data        []byte `json:"data"`
+}
+
+func (v compressedValue) decompress() (interface{}, error) {
+	c, ok := lookupCompressor(v.Encoding)
+	if !ok {
+		return nil, fmt.Errorf("unknown compression '%s'", v.Encoding)
+	}
+	data, err := c.Decompress(v.Data)
+	if err != nil {
+		return nil, fmt.Errorf("decompressing %s value: %w", v.Encoding, err)
+	}
+
+	switch v.Kind {
+	case compressedString:
+		return string(data), nil
+	case compressedRaw:
+		return RawValue{Data: data, ContentType: v.ContentType}, nil
+	}
+	var value interface{}
+	if err := json.Unmarshal(data, &value); err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+func decompressValue(value interface{}) (interface{}, error) {
+	if v, ok := value.(compressedValue); ok {
+		return v.decompress()
+	}
+	return value, nil
+}
+
+// CompressionStats counts the values compressed since the cache was created.
+// Ratio is bytes_before / bytes_after over those values.
+type CompressionStats struct {
+	Algorithm      string  `json:"algorithm"`
+	Threshold      int     `json:"threshold"`
+	Compressed     int64   `json:"values_compressed"`
+	Incompressible int64   `json:"values_incompressible"`
+	BytesBefore    int64   `json:"bytes_before"`
+	BytesAfter     int64   `json:"bytes_after"`
+	Ratio          float64 `json:"ratio"`
+}
+
+const defaultCompressionThreshold = 1 << 10
+
+type CompressedCacheConfig struct {
+	// Compressor compresses new values; nil stores them as they are, while
+	// values compressed earlier, for example in a snapshot, still read back.
+	Compressor Compressor
+	// Threshold is the size in bytes from which values are compressed.
+	// Zero means 1 KiB.
+	Threshold int
+}
+
+// CompressedCache compresses large values before storing them in the inner
+// cache and decompresses them on the way out. Strings, raw bodies and JSON
+// objects and arrays are compressed; maps and slices come back as
+// encoding/json decodes them, as they do after a snapshot restore.
+type CompressedCache struct {
+	codecCache
+	compressor Compressor
+	threshold  int
+
+	compressed     atomic.Int64
+	incompressible atomic.Int64
+	bytesBefore    atomic.Int64
+	bytesAfter     atomic.Int64
+}
+
+func NewCompressedCache(inner Cache, config CompressedCacheConfig) *CompressedCache {
+	if config.Threshold <= 0 {
+		config.Threshold = defaultCompressionThreshold
+	}
+	c := &CompressedCache{
+		compressor: config.Compressor,
+		threshold:  config.Threshold,
+	}
+	c.codecCache = codecCache{
+		inner:  inner,
+		encode: func(_ string, value interface{}) (interface{}, error) { return c.compress(value) },
+		decode: func(_ string, value interface{}) (interface{}, error) { return decompressValue(value) },
+	}
+	return c
+}
+
+// findCompressedCache returns the CompressedCache in c's stack, if any.
+func findCompressedCache(c Cache) (*CompressedCache, bool) {
+	switch c := c.(type) {
+	case *CompressedCache:
+		return c, true
+	case *ReplicatedCache:
+		return findCompressedCache(c.local)
+	}
+	return nil, false
+}
+
+func (c *CompressedCache) compress(value interface{}) (interface{}, error) {
+	if c.compressor == nil {
+		return value, nil
+	}
+
+	stored := compressedValue{Encoding: c.compressor.Name()}
+	switch v := value.(type) {
+	case string:
+		stored.Kind, stored.Data = compressedString, []byte(v)
+	case map[string]interface{}, []interface{}:
+		data, err := json.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+		stored.Data = data
+	default:
+		raw, ok := asRawValue(value)
+		if !ok || raw.ContentEncoding != "" {
+			return value, nil
+		}
+		stored.Kind, stored.ContentType, stored.Data = compressedRaw, raw.ContentType, raw.Data
+	}
+	if len(stored.Data) < c.threshold {
+		return value, nil
+	}
+
+	packed, err := c.compressor.Compress(stored.Data)
+	if err != nil {
+		return nil, fmt.Errorf("compressing value: %w", err)
+	}
+	if len(packed) >= len(stored.Data) {
+		c.incompressible.Add(1)
+		return value, nil
+	}
+	c.compressed.Add(1)
+	c.bytesBefore.Add(int64(len(stored.Data)))
+	c.bytesAfter.Add(int64(len(packed)))
+	stored.Size, stored.Data = len(stored.Data), packed
+	return stored, nil
+}
+
+func (c *CompressedCache) Stats() CompressionStats {
+	stats := CompressionStats{
+		Algorithm:      "none",
+		Threshold:      c.threshold,
+		Compressed:     c.compressed.Load(),
+		Incompressible: c.incompressible.Load(),
+		BytesBefore:    c.bytesBefore.Load(),
+		BytesAfter:     c.bytesAfter.Load(),
+	}
+	if c.compressor != nil {
+		stats.Algorithm = c.compressor.Name()
+	}
+	if stats.BytesAfter > 0 {
+		stats.Ratio = float64(stats.BytesBefore) / float64(stats.BytesAfter)
+	}
+	return stats
+}
+
+// GetEntryEncoded is GetEntry, except that a raw value compressed with an
+// encoding accepted by accepts comes back as a RawValue still compressed,
+// with encoding naming the format. With bareJSON so does a JSON value, for
+// a route that may send it as the bare document instead of the envelope.
+// Strings are always decompressed, as their stored bytes are not JSON.
+func (c *CompressedCache) GetEntryEncoded(key string, bareJSON bool, accepts func(encoding string) bool) (entry Entry, encoding string, exists bool, err error) {
+	entry, exists, err = c.getStoredEntry(key)
+	if err != nil || !exists {
+		return entry, "", exists, err
+	}
+
+	stored, ok := entry.Value.(compressedValue)
+	if !ok {
+		return entry, "", true, nil
+	}
+	passThrough := stored.Kind == compressedRaw || bareJSON && stored.Kind == compressedJSON
+	if passThrough && accepts != nil && accepts(stored.Encoding) {
+		contentType := stored.ContentType
+		if stored.Kind == compressedJSON {
+			contentType = "application/json"
+		}
+		entry.Value = RawValue{Data: stored.Data, ContentType: contentType, ContentEncoding: stored.Encoding}
+		return entry, stored.Encoding, true, nil
+	}
+	entry.Value, err = stored.decompress()
+	return entry, "", err == nil, err
+}
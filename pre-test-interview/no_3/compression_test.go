@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCompressedCache_RoundTrip(t *testing.T) {
+	inner := NewSimpleCache()
+	cache := NewCompressedCache(inner, CompressedCacheConfig{Compressor: gzipCompressor{}, Threshold: 64})
+
+	doc := map[string]interface{}{"items": []interface{}{strings.Repeat("lorem ipsum ", 50), 42.0, true}}
+	values := map[string]interface{}{
+		"doc":   doc,
+		"text":  strings.Repeat("a", 1000),
+		"raw":   RawValue{Data: bytes.Repeat([]byte("<p>hi</p>"), 100), ContentType: "text/html"},
+		"small": "tiny",
+	}
+	for key, value := range values {
+		if err := cache.Set(key, value); err != nil {
+			t.Fatalf("Set(%s) failed: %v", key, err)
+		}
+	}
+
+	for key, want := range values {
+		got, found, err := cache.Get(key)
+		if err != nil || !found || !reflect.DeepEqual(got, want) {
+			t.Errorf("Get(%s) = %v, %v, %v; want the value as set", key, got, found, err)
+		}
+		stored, _, _ := inner.Get(key)
+		if _, compressed := stored.(compressedValue); compressed != (key != "small") {
+			t.Errorf("Expected %s compressed=%v in the inner cache, got %T", key, key != "small", stored)
+		}
+	}
+
+	stats := cache.Stats()
+	if stats.Algorithm != "gzip" || stats.Compressed != 3 || stats.Ratio <= 1 {
+		t.Errorf("Expected three gzip values with a ratio above 1, got %+v", stats)
+	}
+}
+
+func TestCompressedCache_KeepsIncompressibleValues(t *testing.T) {
+	inner := NewSimpleCache()
+	cache := NewCompressedCache(inner, CompressedCacheConfig{Compressor: deflateCompressor{}})
+
+	noise := make([]byte, 4096)
+	rand.Read(noise)
+	cache.Set("noise", RawValue{Data: noise})
+	cache.Set("encoded", RawValue{Data: bytes.Repeat([]byte("x"), 4096), ContentEncoding: "br"})
+
+	for _, key := range []string{"noise", "encoded"} {
+		if stored, _, _ := inner.Get(key); !isRaw(stored) {
+			t.Errorf("Expected %s to be stored as is, got %T", key, stored)
+		}
+	}
+	if stats := cache.Stats(); stats.Incompressible != 1 || stats.Compressed != 0 {
+		t.Errorf("Expected one incompressible value, got %+v", stats)
+	}
+}
+
+func isRaw(v interface{}) bool {
+	_, ok := asRawValue(v)
+	return ok
+}
+
+func TestCompressedCache_SnapshotReadsBackWithoutCompressor(t *testing.T) {
+	source := NewCompressedCache(NewSimpleCache(), CompressedCacheConfig{Compressor: gzipCompressor{}})
+	text := strings.Repeat("snapshot ", 500)
+	source.Set("text", text)
+
+	data, err := source.Snapshot()
+	if err != nil {
+		t.Fatalf("Snapshot failed: %v", err)
+	}
+	if strings.Contains(string(data), "snapshot snapshot") {
+		t.Error("Expected the snapshot to hold the compressed value")
+	}
+
+	restored := NewCompressedCache(NewSimpleCache(), CompressedCacheConfig{})
+	if err := restored.Restore(data); err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+	if got, found, err := restored.Get("text"); err != nil || !found || got != text {
+		t.Errorf("Expected the value back after restore, got %v, %v, %v", got, found, err)
+	}
+}
+
+func TestAcceptsEncoding(t *testing.T) {
+	tests := []struct {
+		header string
+		want   bool
+	}{
+		{"gzip", true},
+		{"deflate, gzip;q=0.5", true},
+		{"GZIP", true},
+		{"gzip;q=0", false},
+		{"*", true},
+		{"*, gzip;q=0", false},
+		{"br", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := acceptsEncoding(tt.header, "gzip"); got != tt.want {
+			t.Errorf("acceptsEncoding(%q, gzip) = %v, want %v", tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestServer_ServesCompressedBytes(t *testing.T) {
+	cache := NewCompressedCache(NewSimpleCache(), CompressedCacheConfig{Compressor: gzipCompressor{}})
+	ts := newTestServer(t, cache)
+	url := ts.URL + "/api/v2/keys/page"
+	page := strings.Repeat("<li>item</li>", 500)
+
+	if resp, _ := doRequest(t, http.MethodPut, url, "text/html", page); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("Expected 201, got %d", resp.StatusCode)
+	}
+
+	get := func(header http.Header) (*http.Response, []byte) {
+		req, _ := http.NewRequest(http.MethodGet, url, nil)
+		for name, values := range header {
+			req.Header[name] = values
+		}
+		// Setting Accept-Encoding ourselves stops the transport decoding.
+		if req.Header.Get("Accept-Encoding") == "" {
+			req.Header.Set("Accept-Encoding", "identity")
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp, body
+	}
+
+	resp, body := get(http.Header{"Accept-Encoding": {"gzip, deflate"}})
+	if resp.Header.Get("Content-Encoding") != "gzip" || resp.Header.Get("Content-Type") != "text/html" {
+		t.Fatalf("Expected gzip-encoded text/html, got %v", resp.Header)
+	}
+	if len(body) >= len(page) {
+		t.Errorf("Expected the compressed bytes, got %d bytes", len(body))
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("Body is not gzip: %v", err)
+	}
+	if plain, _ := io.ReadAll(zr); string(plain) != page {
+		t.Error("Expected the body to decompress to the stored page")
+	}
+	etag := resp.Header.Get("ETag")
+	if !strings.HasSuffix(etag, `-gzip"`) || !strings.Contains(resp.Header.Get("Vary"), "Accept-Encoding") {
+		t.Errorf("Expected a gzip-specific ETag and Vary: Accept-Encoding, got %v", resp.Header)
+	}
+
+	if resp, _ := get(http.Header{"Accept-Encoding": {"gzip"}, "If-None-Match": {etag}}); resp.StatusCode != http.StatusNotModified {
+		t.Errorf("Expected 304 for the gzip ETag, got %d", resp.StatusCode)
+	}
+
+	resp, body = get(nil)
+	if resp.Header.Get("Content-Encoding") != "" || string(body) != page {
+		t.Errorf("Expected the plain page without Accept-Encoding, got %q", resp.Header.Get("Content-Encoding"))
+	}
+	if strings.HasSuffix(resp.Header.Get("ETag"), `-gzip"`) {
+		t.Error("Expected the plain representation to keep the plain ETag")
+	}
+
+	_, stats := doRequest(t, http.MethodGet, ts.URL+"/api/cache/stats", "", "")
+	compression, _ := stats.Data.(map[string]interface{})["compression"].(map[string]interface{})
+	if ratio, _ := compression["ratio"].(float64); ratio <= 1 {
+		t.Errorf("Expected stats to report a compression ratio above 1, got %v", compression)
+	}
+}
+
+func TestServer_CompressedJSONValue(t *testing.T) {
+	inner := NewSimpleCache()
+	ts := httptest.NewServer(NewServer(NewCompressedCache(inner, CompressedCacheConfig{Compressor: gzipCompressor{}}), nil).setupRoutes())
+	defer ts.Close()
+
+	doc := `{"names": ["` + strings.Repeat("Alice", 400) + `"]}`
+	if resp, _ := doRequest(t, http.MethodPost, ts.URL+"/api/cache/set?key=doc", "application/json", doc); resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", resp.StatusCode)
+	}
+	_, body := doRequest(t, http.MethodGet, ts.URL+"/api/cache/get?key=doc", "", "")
+	names, _ := body.Data.(map[string]interface{})["names"].([]interface{})
+	if len(names) != 1 || names[0] != strings.Repeat("Alice", 400) {
+		t.Errorf("Expected the JSON document back, got %v", body.Data)
+	}
+
+	// A client accepting gzip gets the stored bytes as they are, without
+	// the envelope.
+	stored, _, _ := inner.Get("doc")
+	req, _ := http.NewRequest(http.MethodGet, ts.URL+"/api/v2/keys/doc", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(resp.Body)
+	if resp.Header.Get("Content-Encoding") != "gzip" || resp.Header.Get("Content-Type") != "application/json" ||
+		!strings.HasSuffix(resp.Header.Get("ETag"), `-gzip"`) {
+		t.Errorf("Expected gzipped JSON headers, got %v", resp.Header)
+	}
+	if !bytes.Equal(data, stored.(compressedValue).Data) {
+		t.Errorf("Expected the stored compressed bytes, got %.60q", data)
+	}
+
+	// Without gzip the document is decompressed into the envelope.
+	req.Header.Set("Accept-Encoding", "identity")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	data, _ = io.ReadAll(resp.Body)
+	if resp.Header.Get("Content-Encoding") != "" || !bytes.Contains(data, []byte(`"data":{"names":["AliceAlice`)) {
+		t.Errorf("Expected the JSON envelope, got %v %.60q", resp.Header, data)
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func formatETag(version uint64) string {
+	return `"` + strconv.FormatUint(version, 10) + `"`
+}
+
+// setEncodedETag replaces the entity tag of an entry served compressed by
+// the cache. RFC 9110 §8.8.3 requires each content coding to have its own
+// tag; the version part is shared, so conditional requests match either.
+func setEncodedETag(w http.ResponseWriter, e Entry, encoding string) {
+	if encoding == "" || e.Version == 0 {
+		return
+	}
+	w.Header().Set("ETag", `"`+strconv.FormatUint(e.Version, 10)+"-"+encoding+`"`)
+}
+
+// setEntryHeaders writes the validators and freshness headers for an entry.
+// Entries without a version (from caches that do not track one) get none.
+func setEntryHeaders(w http.ResponseWriter, e Entry, now time.Time) {
+	h := w.Header()
+	if e.Version != 0 {
+		h.Set("ETag", formatETag(e.Version))
+	}
+	if !e.Modified.IsZero() {
+		h.Set("Last-Modified", e.Modified.UTC().Format(http.TimeFormat))
+	}
+	if e.Expires.IsZero() {
+		h.Set("Cache-Control", "no-cache")
+		return
+	}
+	h.Set("Cache-Control", "max-age="+strconv.FormatInt(int64(e.TTL(now)/time.Second), 10))
+	h.Set("Expires", e.Expires.UTC().Format(http.TimeFormat))
+	if e.Stale {
+		// RFC 9211: a negative ttl says the response was served stale.
+		age := int64(now.Sub(e.Expires) / time.Second)
+		h.Set("Cache-Status", "cache-implementation; hit; ttl="+strconv.FormatInt(-age, 10))
+	}
+}
+
+// etagListMatches reports whether header, a comma-separated If-Match or
+// If-None-Match list, matches the entry. Weak comparison ignores W/ prefixes.
+func etagListMatches(header string, e Entry, exists bool, weak bool) bool {
+	if strings.TrimSpace(header) == "*" {
+		return exists
+	}
+	if !exists || e.Version == 0 {
+		return false
+	}
+	etag := formatETag(e.Version)
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if strings.HasPrefix(candidate, "W/") {
+			if !weak {
+				continue
+			}
+			candidate = candidate[2:]
+		}
+		if candidate == etag || strings.HasPrefix(candidate, etag[:len(etag)-1]+"-") && strings.HasSuffix(candidate, `"`) {
+			return true
+		}
+	}
+	return false
+}
+
+// notModified evaluates If-None-Match, or If-Modified-Since when no entity
+// tags were sent, for a read of an existing entry (RFC 9110 §13.2.2).
+func notModified(r *http.Request, e Entry) bool {
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		return etagListMatches(inm, e, true, true)
+	}
+	ims := r.Header.Get("If-Modified-Since")
+	if ims == "" || e.Modified.IsZero() {
+		return false
+	}
+	since, err := http.ParseTime(ims)
+	if err != nil {
+		return false
+	}
+	return !e.Modified.Truncate(time.Second).After(since)
+}
+
+// writePrecondition turns If-Match and If-None-Match on a write into a
+// Precondition, or returns nil when the request is unconditional.
+func writePrecondition(r *http.Request) Precondition {
+	ifMatch := r.Header.Get("If-Match")
+	ifNoneMatch := r.Header.Get("If-None-Match")
+	if ifMatch == "" && ifNoneMatch == "" {
+		return nil
+	}
+	return func(current Entry, exists bool) bool {
+		if ifMatch != "" && !etagListMatches(ifMatch, current, exists, false) {
+			return false
+		}
+		if ifNoneMatch != "" && etagListMatches(ifNoneMatch, current, exists, true) {
+			return false
+		}
+		return true
+	}
+}
@@ -0,0 +1,683 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ServerConfig holds the settings of `go run . server`. They are applied in
+// increasing order of precedence: defaults, the config file, CACHE_*
+// environment variables, then command-line flags.
+type ServerConfig struct {
+	ListenAddr      string
+	CacheType       string
+	TTL             time.Duration
+	CleanupInterval time.Duration
+	StaleTTL        time.Duration
+	TTLJitter       float64
+	Capacity        int
+	MaxValueSize    int64
+	Compression     string
+	CompressionMin  int64
+	SnapshotPath    string
+	LogLevel        slog.Level
+	LogFormat       string
+	LogRedactKeys   []string
+	AccessLog       bool
+	ShutdownTimeout time.Duration
+	RateLimitRead   RateLimit
+	RateLimitWrite  RateLimit
+	KeyStatsWindow  time.Duration
+
+	AuthKeysFile string
+	AuditLog     string
+	PeerAPIKey   string
+
+	EncryptionKeys    string
+	EncryptionKeyFile string
+	EncryptMemory     bool
+
+	RaftID    string
+	RaftAddr  string
+	RaftPeers []RaftServer
+	RaftDir   string
+
+	GossipBind    string
+	GossipName    string
+	GossipAPIAddr string
+	GossipSeeds   []string
+	GossipSecret  string
+}
+
+const (
+	cacheTypeTTL    = "ttl"
+	cacheTypeSimple = "simple"
+
+	compressionNone = "none"
+)
+
+func defaultServerConfig() ServerConfig {
+	return ServerConfig{
+		ListenAddr:      ":8080",
+		CacheType:       cacheTypeTTL,
+		TTL:             30 * time.Second,
+		MaxValueSize:    defaultMaxValueSize,
+		Compression:     compressionNone,
+		CompressionMin:  defaultCompressionThreshold,
+		LogLevel:        slog.LevelInfo,
+		LogFormat:       logFormatText,
+		AccessLog:       true,
+		ShutdownTimeout: 10 * time.Second,
+		KeyStatsWindow:  defaultKeyStatsWindow,
+		RaftAddr:        "http://localhost:8080",
+		GossipAPIAddr:   "http://localhost:8080",
+	}
+}
+
+// configSetting is one configurable value. Its config file key is name, its
+// environment variable CACHE_<NAME> and its flag -name with '_' as '-'.
+type configSetting struct {
+	name  string
+	usage string
+	set   func(c *ServerConfig, value string) error
+}
+
+func (s configSetting) env() string {
+	return "CACHE_" + strings.ToUpper(s.name)
+}
+
+func (s configSetting) flag() string {
+	return strings.ReplaceAll(s.name, "_", "-")
+}
+
+var configSettings = []configSetting{
+	{"listen", "address to listen on (default :8080)", func(c *ServerConfig, v string) error {
+		c.ListenAddr = v
+		return nil
+	}},
+	{"type", "cache type, ttl or simple (default ttl)", func(c *ServerConfig, v string) error {
+		switch v {
+		case cacheTypeTTL, cacheTypeSimple:
+			c.CacheType = v
+			return nil
+		}
+		return errors.New("must be 'ttl' or 'simple'")
+	}},
+	{"ttl", "entry lifetime of the ttl cache, e.g. 30s (default 30s)", func(c *ServerConfig, v string) error {
+		return parsePositiveDuration(v, &c.TTL)
+	}},
+	{"cleanup_interval", "how often expired entries are purged (default half the TTL)", func(c *ServerConfig, v string) error {
+		return parsePositiveDuration(v, &c.CleanupInterval)
+	}},
+	{"stale_ttl", "how long past its TTL an entry is still served, marked stale in Cache-Status; nothing refreshes it, clients must write it again (default 0)", func(c *ServerConfig, v string) error {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			return errors.New("must be a duration such as 30s or 5m, or 0 for none")
+		}
+		c.StaleTTL = d
+		return nil
+	}},
+	{"ttl_jitter", "spread entry lifetimes by up to this percentage either way, e.g. 10% (default 0%)", func(c *ServerConfig, v string) error {
+		pct, err := strconv.ParseFloat(strings.TrimSuffix(v, "%"), 64)
+		if err != nil || pct < 0 || pct >= 100 {
+			return errors.New("must be a percentage from 0% to below 100%")
+		}
+		c.TTLJitter = pct / 100
+		return nil
+	}},
+	{"capacity", "maximum number of entries, 0 for unlimited (default 0)", func(c *ServerConfig, v string) error {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return errors.New("must be a non-negative integer")
+		}
+		c.Capacity = n
+		return nil
+	}},
+	{"max_value_size", "largest accepted request body, e.g. 512KiB (default 1MiB)", func(c *ServerConfig, v string) error {
+		n, err := parseByteSize(v)
+		if err != nil {
+			return err
+		}
+		c.MaxValueSize = n
+		return nil
+	}},
+	{"compression", "compress large values with gzip or deflate (default none); only raw bodies are served without decompressing", func(c *ServerConfig, v string) error {
+		if _, ok := lookupCompressor(v); !ok && v != compressionNone {
+			return errors.New("must be none, gzip or deflate")
+		}
+		c.Compression = v
+		return nil
+	}},
+	{"compression_threshold", "smallest value that is compressed, e.g. 4KiB (default 1KiB)", func(c *ServerConfig, v string) error {
+		n, err := parseByteSize(v)
+		if err != nil {
+			return err
+		}
+		c.CompressionMin = n
+		return nil
+	}},
+	{"snapshot_path", "file the cache is loaded from at startup and saved to on shutdown", func(c *ServerConfig, v string) error {
+		c.SnapshotPath = v
+		return nil
+	}},
+	{"log_level", "debug, info, warn or error (default info)", func(c *ServerConfig, v string) error {
+		if err := c.LogLevel.UnmarshalText([]byte(v)); err != nil {
+			return errors.New("must be debug, info, warn or error")
+		}
+		return nil
+	}},
+	{"log_format", "text or json (default text)", func(c *ServerConfig, v string) error {
+		switch v {
+		case logFormatText, logFormatJSON:
+			c.LogFormat = v
+			return nil
+		}
+		return errors.New("must be 'text' or 'json'")
+	}},
+	{"log_redact_keys", "comma-separated glob patterns of keys to hide in logs, e.g. session:*", func(c *ServerConfig, v string) error {
+		patterns := splitList(v)
+		for _, p := range patterns {
+			if _, err := path.Match(p, ""); err != nil {
+				return fmt.Errorf("pattern %q: %w", p, err)
+			}
+		}
+		c.LogRedactKeys = patterns
+		return nil
+	}},
+	{"access_log", "log every request (default true)", func(c *ServerConfig, v string) error {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return errors.New("must be true or false")
+		}
+		c.AccessLog = b
+		return nil
+	}},
+	{"shutdown_timeout", "how long shutdown waits for in-flight requests (default 10s)", func(c *ServerConfig, v string) error {
+		return parsePositiveDuration(v, &c.ShutdownTimeout)
+	}},
+	{"rate_limit_read", "reads allowed per client, e.g. 100/s or 6000/m (default unlimited)", func(c *ServerConfig, v string) error {
+		return c.RateLimitRead.UnmarshalText([]byte(v))
+	}},
+	{"rate_limit_write", "writes allowed per client, e.g. 20/s (default unlimited)", func(c *ServerConfig, v string) error {
+		return c.RateLimitWrite.UnmarshalText([]byte(v))
+	}},
+	{"key_stats_window", "how far back hot and big key tracking looks, e.g. 15m; 0 turns it off (default 5m)", func(c *ServerConfig, v string) error {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			return errors.New("must be a duration such as 15m, or 0")
+		}
+		c.KeyStatsWindow = d
+		return nil
+	}},
+	{"auth_keys_file", "JSON file of API keys; enables authentication", func(c *ServerConfig, v string) error {
+		c.AuthKeysFile = v
+		return nil
+	}},
+	{"audit_log", "file for the audit log of denied requests (default the server log); sealed per record with encryption keys, read it with 'go run . audit'", func(c *ServerConfig, v string) error {
+		c.AuditLog = v
+		return nil
+	}},
+	{"peer_api_key", "API key sent to Raft peers and gossip members", func(c *ServerConfig, v string) error {
+		c.PeerAPIKey = v
+		return nil
+	}},
+	{"encryption_keys", "AES keys as id:base64,...; the first encrypts snapshots, Raft files and the audit_log file (prefer env CACHE_ENCRYPTION_KEYS)", func(c *ServerConfig, v string) error {
+		if _, err := ParseKeyring(v); err != nil {
+			return errors.New(strings.TrimPrefix(err.Error(), "encryption: "))
+		}
+		c.EncryptionKeys = v
+		return nil
+	}},
+	{"encryption_key_file", "file of AES keys, one id:base64 per line, first one encrypting", func(c *ServerConfig, v string) error {
+		c.EncryptionKeyFile = v
+		return nil
+	}},
+	{"encrypt_memory", "also keep values encrypted in memory (default false)", func(c *ServerConfig, v string) error {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return errors.New("must be true or false")
+		}
+		c.EncryptMemory = b
+		return nil
+	}},
+	{"raft_id", "enable Raft replication with this node ID", func(c *ServerConfig, v string) error {
+		c.RaftID = v
+		return nil
+	}},
+	{"raft_addr", "this node's base URL for Raft peers (default http://localhost:8080)", func(c *ServerConfig, v string) error {
+		c.RaftAddr = v
+		return nil
+	}},
+	{"raft_peers", "founding Raft members as id=url,id=url", func(c *ServerConfig, v string) error {
+		peers, err := parseRaftPeers(v)
+		if err != nil {
+			return err
+		}
+		c.RaftPeers = peers
+		return nil
+	}},
+	{"raft_dir", "directory for the Raft log and snapshots (default in memory)", func(c *ServerConfig, v string) error {
+		c.RaftDir = v
+		return nil
+	}},
+	{"gossip_bind", "enable gossip clustering on this UDP address", func(c *ServerConfig, v string) error {
+		c.GossipBind = v
+		return nil
+	}},
+	{"gossip_name", "this node's gossip name (default the hostname)", func(c *ServerConfig, v string) error {
+		c.GossipName = v
+		return nil
+	}},
+	{"gossip_api_addr", "this node's base URL for redirects and handoff (default http://localhost:8080)", func(c *ServerConfig, v string) error {
+		c.GossipAPIAddr = v
+		return nil
+	}},
+	{"gossip_secret", "shared secret authenticating gossip packets, at least 16 bytes; required with gossip_bind (prefer env CACHE_GOSSIP_SECRET)", func(c *ServerConfig, v string) error {
+		if len(v) < minGossipSecret {
+			return fmt.Errorf("must be at least %d bytes", minGossipSecret)
+		}
+		c.GossipSecret = v
+		return nil
+	}},
+	{"gossip_seeds", "comma-separated UDP addresses of nodes to join", func(c *ServerConfig, v string) error {
+		c.GossipSeeds = splitList(v)
+		return nil
+	}},
+}
+
+// boolSettings can be given as a flag without a value, e.g. -encrypt-memory.
+var boolSettings = map[string]bool{"encrypt_memory": true, "access_log": true}
+
+func lookupSetting(name string) (configSetting, bool) {
+	for _, s := range configSettings {
+		if s.name == name {
+			return s, true
+		}
+	}
+	return configSetting{}, false
+}
+
+// loadServerConfig builds the server configuration from args (without the
+// "server" subcommand) and the environment. The config file is named by
+// -config or CACHE_CONFIG.
+func loadServerConfig(args []string, getenv func(string) string) (ServerConfig, error) {
+	type flagValue struct {
+		setting configSetting
+		value   string
+	}
+	var flagValues []flagValue
+
+	fs := flag.NewFlagSet("server", flag.ContinueOnError)
+	configPath := fs.String("config", "", "YAML or JSON config file (env CACHE_CONFIG)")
+	for _, s := range configSettings {
+		register := fs.Func
+		if boolSettings[s.name] {
+			register = fs.BoolFunc
+		}
+		register(s.flag(), s.usage+" (env "+s.env()+")", func(v string) error {
+			flagValues = append(flagValues, flagValue{s, v})
+			return nil
+		})
+	}
+	if err := fs.Parse(args); err != nil {
+		return ServerConfig{}, err
+	}
+	if fs.NArg() > 0 {
+		return ServerConfig{}, fmt.Errorf("unexpected argument %q", fs.Arg(0))
+	}
+
+	cfg := defaultServerConfig()
+
+	path := *configPath
+	if path == "" {
+		path = getenv("CACHE_CONFIG")
+	}
+	if path != "" {
+		values, err := readConfigFile(path)
+		if err != nil {
+			return ServerConfig{}, err
+		}
+		for _, s := range configSettings {
+			if v, ok := values[s.name]; ok {
+				if err := applySetting(&cfg, s, v, path); err != nil {
+					return ServerConfig{}, err
+				}
+			}
+		}
+	}
+
+	for _, s := range configSettings {
+		if v := getenv(s.env()); v != "" {
+			if err := applySetting(&cfg, s, v, s.env()); err != nil {
+				return ServerConfig{}, err
+			}
+		}
+	}
+
+	for _, f := range flagValues {
+		if err := applySetting(&cfg, f.setting, f.value, "-"+f.setting.flag()); err != nil {
+			return ServerConfig{}, err
+		}
+	}
+
+	if err := cfg.validate(); err != nil {
+		return ServerConfig{}, err
+	}
+	return cfg, nil
+}
+
+func applySetting(cfg *ServerConfig, s configSetting, value, source string) error {
+	if err := s.set(cfg, strings.TrimSpace(value)); err != nil {
+		return fmt.Errorf("invalid %s %q (from %s): %w", s.name, value, source, err)
+	}
+	return nil
+}
+
+// validate checks the settings that depend on each other.
+func (c ServerConfig) validate() error {
+	if _, _, err := net.SplitHostPort(c.ListenAddr); err != nil {
+		return fmt.Errorf("invalid listen %q: %w", c.ListenAddr, err)
+	}
+	if c.SnapshotPath != "" && c.RaftID != "" {
+		return errors.New("snapshot_path cannot be combined with raft_id; use raft_dir to persist a replicated cache")
+	}
+	if c.RaftID == "" && (len(c.RaftPeers) > 0 || c.RaftDir != "") {
+		return errors.New("raft_peers and raft_dir require raft_id")
+	}
+	if c.AuditLog != "" && c.AuthKeysFile == "" {
+		return errors.New("audit_log requires auth_keys_file")
+	}
+	if c.EncryptionKeys != "" && c.EncryptionKeyFile != "" {
+		return errors.New("set either encryption_keys or encryption_key_file, not both")
+	}
+	if c.EncryptMemory && c.EncryptionKeys == "" && c.EncryptionKeyFile == "" {
+		return errors.New("encrypt_memory requires encryption_keys or encryption_key_file")
+	}
+	if c.GossipBind == "" && len(c.GossipSeeds) > 0 {
+		return errors.New("gossip_seeds requires gossip_bind")
+	}
+	if c.GossipBind != "" && c.GossipSecret == "" {
+		return errors.New("gossip_bind requires gossip_secret, so that only nodes sharing it can join")
+	}
+	return nil
+}
+
+// readConfigFile returns the top-level settings of a JSON or YAML file as
+// strings, in the same form they take in the environment.
+func readConfigFile(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("config file: %w", err)
+	}
+
+	var values map[string]string
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		values, err = parseJSONConfig(data)
+	case ".yaml", ".yml":
+		values, err = parseYAMLConfig(data)
+	default:
+		if bytes.HasPrefix(bytes.TrimSpace(data), []byte("{")) {
+			values, err = parseJSONConfig(data)
+		} else {
+			values, err = parseYAMLConfig(data)
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("config file %s: %w", path, err)
+	}
+
+	for name := range values {
+		if _, ok := lookupSetting(name); !ok {
+			return nil, fmt.Errorf("config file %s: unknown setting %q", path, name)
+		}
+	}
+	return values, nil
+}
+
+func parseJSONConfig(data []byte) (map[string]string, error) {
+	var raw map[string]interface{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(&raw); err != nil {
+		return nil, err
+	}
+
+	values := make(map[string]string, len(raw))
+	for name, v := range raw {
+		switch v := v.(type) {
+		case nil:
+		case string:
+			values[name] = v
+		case json.Number, bool:
+			values[name] = fmt.Sprint(v)
+		case []interface{}:
+			items := make([]string, len(v))
+			for i, item := range v {
+				items[i] = fmt.Sprint(item)
+			}
+			values[name] = strings.Join(items, ",")
+		default:
+			return nil, fmt.Errorf("%s: nested objects are not supported", name)
+		}
+	}
+	return values, nil
+}
+
+// parseYAMLConfig reads the flat subset of YAML a config needs: "key: value"
+// lines, comments, quoted strings, and lists written inline or as "- item"
+// lines.
+func parseYAMLConfig(data []byte) (map[string]string, error) {
+	values := make(map[string]string)
+	var listKey string
+	var list []string
+
+	flush := func() {
+		if listKey != "" {
+			values[listKey] = strings.Join(list, ",")
+			listKey, list = "", nil
+		}
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Text()
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") || trimmed == "---" {
+			continue
+		}
+
+		if strings.HasPrefix(trimmed, "- ") || trimmed == "-" {
+			if listKey == "" {
+				return nil, fmt.Errorf("line %d: list item without a key", n)
+			}
+			list = append(list, yamlScalar(strings.TrimPrefix(trimmed, "-")))
+			continue
+		}
+		flush()
+
+		if line[0] == ' ' || line[0] == '\t' {
+			return nil, fmt.Errorf("line %d: nested settings are not supported", n)
+		}
+		name, value, ok := strings.Cut(trimmed, ":")
+		if !ok {
+			return nil, fmt.Errorf("line %d: expected 'key: value'", n)
+		}
+		name = strings.TrimSpace(name)
+		value = strings.TrimSpace(value)
+
+		switch {
+		case value == "" || strings.HasPrefix(value, "#"):
+			listKey = name
+		case strings.HasPrefix(value, "["):
+			end := strings.LastIndex(value, "]")
+			if end < 0 {
+				return nil, fmt.Errorf("line %d: unterminated list", n)
+			}
+			var items []string
+			for _, item := range strings.Split(value[1:end], ",") {
+				if item = yamlScalar(item); item != "" {
+					items = append(items, item)
+				}
+			}
+			values[name] = strings.Join(items, ",")
+		default:
+			values[name] = yamlScalar(value)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	flush()
+	return values, nil
+}
+
+func yamlScalar(s string) string {
+	s = strings.TrimSpace(s)
+	if len(s) >= 2 && (s[0] == '"' || s[0] == '\'') {
+		if end := strings.IndexByte(s[1:], s[0]); end >= 0 {
+			return s[1 : end+1]
+		}
+	}
+	if i := strings.Index(s, " #"); i >= 0 {
+		s = strings.TrimSpace(s[:i])
+	}
+	return s
+}
+
+func parsePositiveDuration(v string, dst *time.Duration) error {
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return errors.New("must be a duration such as 30s or 5m")
+	}
+	if d <= 0 {
+		return errors.New("must be positive")
+	}
+	*dst = d
+	return nil
+}
+
+// parseByteSize accepts a byte count with an optional binary unit suffix:
+// K, M or G, optionally followed by "B" or "iB".
+func parseByteSize(v string) (int64, error) {
+	s := strings.ToUpper(strings.TrimSpace(v))
+	s = strings.TrimSuffix(strings.TrimSuffix(s, "B"), "I")
+
+	multiplier := int64(1)
+	if n := len(s); n > 0 {
+		switch s[n-1] {
+		case 'K':
+			multiplier = 1 << 10
+		case 'M':
+			multiplier = 1 << 20
+		case 'G':
+			multiplier = 1 << 30
+		}
+		if multiplier > 1 {
+			s = strings.TrimSpace(s[:n-1])
+		}
+	}
+
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n <= 0 {
+		return 0, errors.New("must be a positive size such as 1048576 or 1MiB")
+	}
+	return n * multiplier, nil
+}
+
+func parseRaftPeers(v string) ([]RaftServer, error) {
+	var peers []RaftServer
+	for _, p := range splitList(v) {
+		id, addr, ok := strings.Cut(p, "=")
+		if !ok || id == "" || addr == "" {
+			return nil, fmt.Errorf("entry %q, want id=url", p)
+		}
+		peers = append(peers, RaftServer{ID: id, Address: addr})
+	}
+	return peers, nil
+}
+
+func splitList(v string) []string {
+	var items []string
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// reloadServerConfig re-reads the configuration after SIGHUP and applies the
+// settings that can change while running: TTL, capacity and log level.
+// Under Raft TTL and capacity wait for a restart too, as a change to one
+// node's local cache would leave the replicas evicting and expiring
+// differently. Anything else that changed is reported and waits for a
+// restart. It returns the configuration now in effect.
+func reloadServerConfig(args []string, current ServerConfig, cache Cache) ServerConfig {
+	next, err := loadServerConfig(args, os.Getenv)
+	if err != nil {
+		slog.Error("Config reload failed, keeping the current settings", "error", err)
+		return current
+	}
+
+	applied := current
+	if next.LogLevel != current.LogLevel {
+		logLevel.Set(next.LogLevel)
+		applied.LogLevel = next.LogLevel
+		slog.Info("Reloaded log level", "level", next.LogLevel)
+	}
+	replicated := current.RaftID != ""
+	if replicated && (next.TTL != current.TTL || next.Capacity != current.Capacity) {
+		slog.Warn("TTL and capacity are not reloaded under Raft; restart every node with the new settings")
+	}
+	if next.TTL != current.TTL && !replicated {
+		if s, ok := cache.(TTLSetter); ok {
+			if err := s.SetTTL(next.TTL); err != nil {
+				slog.Error("Failed to reload TTL", "error", err)
+			} else {
+				applied.TTL = next.TTL
+				slog.Info("Reloaded TTL", "ttl", next.TTL)
+			}
+		}
+	}
+	if next.Capacity != current.Capacity && !replicated {
+		if r, ok := cache.(Resizer); ok {
+			r.SetCapacity(next.Capacity)
+			applied.Capacity = next.Capacity
+			slog.Info("Reloaded capacity", "capacity", next.Capacity)
+		}
+	}
+
+	next.LogLevel = applied.LogLevel
+	if !replicated {
+		next.TTL, next.Capacity = applied.TTL, applied.Capacity
+	}
+	if pending := changedFields(applied, next); len(pending) > 0 {
+		slog.Warn("Changed settings take effect after a restart", "fields", pending)
+	}
+	return applied
+}
+
+func changedFields(a, b ServerConfig) []string {
+	va, vb := reflect.ValueOf(a), reflect.ValueOf(b)
+	var changed []string
+	for i := 0; i < va.NumField(); i++ {
+		if !reflect.DeepEqual(va.Field(i).Interface(), vb.Field(i).Interface()) {
+			changed = append(changed, va.Type().Field(i).Name)
+		}
+	}
+	return changed
+}
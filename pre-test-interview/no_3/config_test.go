@@ -0,0 +1,208 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func envMap(values map[string]string) func(string) string {
+	return func(name string) string { return values[name] }
+}
+
+func writeConfigFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("Failed to write config file: %v", err)
+	}
+	return path
+}
+
+func TestLoadServerConfig_Defaults(t *testing.T) {
+	cfg, err := loadServerConfig(nil, envMap(nil))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if cfg.ListenAddr != ":8080" || cfg.CacheType != cacheTypeTTL || cfg.TTL != 30*time.Second {
+		t.Errorf("Expected the previous hard-coded defaults, got %+v", cfg)
+	}
+}
+
+func TestLoadServerConfig_Precedence(t *testing.T) {
+	path := writeConfigFile(t, "cache.yaml", `
+# file settings
+listen: ":9000"
+ttl: 1m
+capacity: 100
+cleanup_interval: "5s"  # quoted
+ttl_jitter: 10%
+stale_ttl: 0
+gossip_bind: 127.0.0.1:7946
+gossip_secret: 0123456789abcdef
+gossip_seeds:
+  - 10.0.0.1:7946
+  - 10.0.0.2:7946
+`)
+	env := envMap(map[string]string{
+		"CACHE_CONFIG":   path,
+		"CACHE_TTL":      "2m",
+		"CACHE_CAPACITY": "200",
+	})
+
+	cfg, err := loadServerConfig([]string{"-ttl", "3m"}, env)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if cfg.ListenAddr != ":9000" || cfg.CleanupInterval != 5*time.Second || cfg.TTLJitter != 0.1 {
+		t.Errorf("Expected file settings to apply, got %+v", cfg)
+	}
+	if cfg.Capacity != 200 {
+		t.Errorf("Expected the environment to override the file, got capacity %d", cfg.Capacity)
+	}
+	if cfg.TTL != 3*time.Minute {
+		t.Errorf("Expected the flag to override the environment, got TTL %v", cfg.TTL)
+	}
+	if len(cfg.GossipSeeds) != 2 || cfg.GossipSeeds[1] != "10.0.0.2:7946" {
+		t.Errorf("Expected the YAML list of seeds, got %v", cfg.GossipSeeds)
+	}
+}
+
+func TestLoadServerConfig_JSONFile(t *testing.T) {
+	path := writeConfigFile(t, "cache.json", `{"type": "simple", "capacity": 10, "max_value_size": "64KiB",
+		"raft_id": "n1", "raft_peers": ["n1=http://a:8080", "n2=http://b:8080"]}`)
+
+	cfg, err := loadServerConfig([]string{"-config", path}, envMap(nil))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if cfg.CacheType != cacheTypeSimple || cfg.Capacity != 10 || cfg.MaxValueSize != 64<<10 {
+		t.Errorf("Expected JSON settings to apply, got %+v", cfg)
+	}
+	if len(cfg.RaftPeers) != 2 || cfg.RaftPeers[1].Address != "http://b:8080" {
+		t.Errorf("Expected two Raft peers, got %+v", cfg.RaftPeers)
+	}
+}
+
+func TestLoadServerConfig_InvalidValues(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		env  map[string]string
+		want string
+	}{
+		{"bad duration", nil, map[string]string{"CACHE_TTL": "soon"}, "invalid ttl \"soon\" (from CACHE_TTL)"},
+		{"negative ttl", []string{"-ttl", "-1s"}, nil, "invalid ttl \"-1s\" (from -ttl): must be positive"},
+		{"negative stale ttl", []string{"-stale-ttl", "-1s"}, nil, "invalid stale_ttl \"-1s\" (from -stale-ttl)"},
+		{"bad type", []string{"-type", "lru"}, nil, "must be 'ttl' or 'simple'"},
+		{"bad capacity", nil, map[string]string{"CACHE_CAPACITY": "-5"}, "invalid capacity"},
+		{"bad size", []string{"-max-value-size", "lots"}, nil, "invalid max_value_size"},
+		{"bad listen", []string{"-listen", "8080"}, nil, "invalid listen"},
+		{"bad rate limit", []string{"-rate-limit-write", "10/fortnight"}, nil, "invalid rate_limit_write"},
+		{"bad compression", []string{"-compression", "lz4"}, nil, "invalid compression \"lz4\""},
+		{"bad log format", []string{"-log-format", "xml"}, nil, "must be 'text' or 'json'"},
+		{"bad redact pattern", nil, map[string]string{"CACHE_LOG_REDACT_KEYS": "token:[a"}, "invalid log_redact_keys"},
+		{"bad encryption key", nil, map[string]string{"CACHE_ENCRYPTION_KEYS": "k1:c2hvcnQ="}, "invalid encryption_keys"},
+		{"memory encryption without keys", []string{"-encrypt-memory"}, nil, "encrypt_memory requires"},
+		{"bad peer", []string{"-raft-id", "n1", "-raft-peers", "n2"}, nil, "want id=url"},
+		{"seeds without bind", []string{"-gossip-seeds", "a:1"}, nil, "gossip_seeds requires gossip_bind"},
+		{"gossip without secret", []string{"-gossip-bind", ":7946"}, nil, "gossip_bind requires gossip_secret"},
+		{"short gossip secret", []string{"-gossip-secret", "short"}, nil, "at least 16 bytes"},
+		{"snapshot with raft", []string{"-raft-id", "n1", "-snapshot-path", "x"}, nil, "snapshot_path cannot be combined"},
+		{"missing file", []string{"-config", "/nonexistent/cache.yaml"}, nil, "config file"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := loadServerConfig(tt.args, envMap(tt.env))
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("Expected error containing %q, got %v", tt.want, err)
+			}
+		})
+	}
+}
+
+func TestLoadServerConfig_UnknownFileSetting(t *testing.T) {
+	path := writeConfigFile(t, "cache.yml", "ttl: 1m\nport: 80\n")
+	_, err := loadServerConfig([]string{"-config", path}, envMap(nil))
+	if err == nil || !strings.Contains(err.Error(), `unknown setting "port"`) {
+		t.Errorf("Expected an unknown setting error, got %v", err)
+	}
+}
+
+func TestReloadServerConfig_AppliesTunables(t *testing.T) {
+	path := writeConfigFile(t, "cache.yaml", "ttl: 1m\ncapacity: 3\n")
+	t.Setenv("CACHE_CONFIG", path)
+
+	cfg, err := loadServerConfig(nil, os.Getenv)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	cache, _, err := newCacheFromConfig(cfg)
+	if err != nil {
+		t.Fatalf("Failed to create cache: %v", err)
+	}
+	ttlCache := cache.(*TTLCache)
+	defer ttlCache.Close()
+	for _, key := range []string{"a", "b", "c"} {
+		ttlCache.Set(key, key)
+	}
+
+	os.WriteFile(path, []byte("ttl: 1h\ncapacity: 2\nlog_level: debug\nlisten: :9999\n"), 0o600)
+	applied := reloadServerConfig(nil, cfg, cache)
+	defer logLevel.Set(slog.LevelInfo)
+
+	if applied.TTL != time.Hour || applied.Capacity != 2 || applied.LogLevel != slog.LevelDebug {
+		t.Errorf("Expected TTL, capacity and log level to reload, got %+v", applied)
+	}
+	if applied.ListenAddr != ":8080" {
+		t.Errorf("Expected the listen address to wait for a restart, got %q", applied.ListenAddr)
+	}
+	if _, exists, _ := ttlCache.Get("a"); exists {
+		t.Error("Expected the oldest entry to be evicted by the smaller capacity")
+	}
+	entry, _, _ := ttlCache.UpsertIf("d", "d", nil)
+	if remaining := entry.TTL(time.Now()); remaining < 59*time.Minute {
+		t.Errorf("Expected new writes to use the reloaded TTL, got %v", remaining)
+	}
+
+	os.WriteFile(path, []byte("ttl: never\n"), 0o600)
+	if kept := reloadServerConfig(nil, applied, cache); kept.TTL != time.Hour {
+		t.Errorf("Expected an invalid reload to keep the current settings, got %+v", kept)
+	}
+}
+
+func TestReloadServerConfig_RaftKeepsTTLAndCapacity(t *testing.T) {
+	path := writeConfigFile(t, "cache.yaml", "ttl: 1m\ncapacity: 3\nraft_id: n1\n")
+	t.Setenv("CACHE_CONFIG", path)
+
+	cfg, err := loadServerConfig(nil, os.Getenv)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	cache, _, err := newCacheFromConfig(cfg)
+	if err != nil {
+		t.Fatalf("Failed to create cache: %v", err)
+	}
+	ttlCache := cache.(*TTLCache)
+	defer ttlCache.Close()
+	for _, key := range []string{"a", "b", "c"} {
+		ttlCache.Set(key, key)
+	}
+
+	// Every replica must expire and evict alike, so only a restart of all
+	// of them changes these.
+	os.WriteFile(path, []byte("ttl: 1h\ncapacity: 2\nraft_id: n1\nlog_level: debug\n"), 0o600)
+	applied := reloadServerConfig(nil, cfg, cache)
+	defer logLevel.Set(slog.LevelInfo)
+
+	if applied.TTL != time.Minute || applied.Capacity != 3 || applied.LogLevel != slog.LevelDebug {
+		t.Errorf("Expected only the log level to reload, got %+v", applied)
+	}
+	if _, exists, _ := ttlCache.Get("a"); !exists {
+		t.Error("Expected the local cache to keep its capacity")
+	}
+}
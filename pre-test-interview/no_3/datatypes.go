@@ -0,0 +1,491 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+)
+
+var (
+	// ErrWrongType is returned by list, hash, set and sorted set operations
+	// on a key holding another kind of value.
+	ErrWrongType  = errors.New("wrong type")
+	ErrNotInteger = errors.New("hash value is not an integer")
+	ErrOverflow   = errors.New("increment would overflow")
+)
+
+// ListValue, HashValue, SetValue and SortedSetValue are the collection
+// types. A stored collection is never modified: operations build a new value
+// and store it with Update, so readers can use one without locking.
+type ListValue []string
+
+type HashValue map[string]string
+
+// SetValue encodes as a sorted JSON array of its members.
+type SetValue map[string]struct{}
+
+// ZMember is a sorted set member and its score.
+type ZMember struct {
+	Member string  `json:"member"`
+	Score  float64 `json:"score"`
+}
+
+// SortedSetValue holds members ordered by score, and by member for equal
+// scores. It encodes as a JSON array of ZMember in that order.
+type SortedSetValue struct {
+	members []ZMember
+}
+
+// Range returns the items from start to stop inclusive. Negative indexes
+// count back from the end, so 0 and -1 select the whole list.
+func (l ListValue) Range(start, stop int) []string {
+	from, to := rankRange(len(l), start, stop)
+	return append([]string{}, l[from:to]...)
+}
+
+func (s SetValue) Members() []string {
+	members := make([]string, 0, len(s))
+	for m := range s {
+		members = append(members, m)
+	}
+	sort.Strings(members)
+	return members
+}
+
+func (s SetValue) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.Members())
+}
+
+func (s *SetValue) UnmarshalJSON(data []byte) error {
+	var members []string
+	if err := json.Unmarshal(data, &members); err != nil {
+		return err
+	}
+	*s = make(SetValue, len(members))
+	for _, m := range members {
+		(*s)[m] = struct{}{}
+	}
+	return nil
+}
+
+// Intersect returns the members of s that are in every other set.
+func (s SetValue) Intersect(others ...SetValue) []string {
+	var members []string
+	for _, m := range s.Members() {
+		in := true
+		for _, o := range others {
+			if _, ok := o[m]; !ok {
+				in = false
+				break
+			}
+		}
+		if in {
+			members = append(members, m)
+		}
+	}
+	return members
+}
+
+func (z SortedSetValue) Len() int {
+	return len(z.members)
+}
+
+// Score returns member's score and its rank, counting from the lowest score.
+func (z SortedSetValue) Score(member string) (score float64, rank int, ok bool) {
+	for i, m := range z.members {
+		if m.Member == member {
+			return m.Score, i, true
+		}
+	}
+	return 0, 0, false
+}
+
+// RangeByRank selects members like ListValue.Range.
+func (z SortedSetValue) RangeByRank(start, stop int) []ZMember {
+	from, to := rankRange(len(z.members), start, stop)
+	return append([]ZMember{}, z.members[from:to]...)
+}
+
+// RangeByScore returns the members scoring from min to max inclusive.
+func (z SortedSetValue) RangeByScore(min, max float64) []ZMember {
+	from := sort.Search(len(z.members), func(i int) bool { return z.members[i].Score >= min })
+	to := sort.Search(len(z.members), func(i int) bool { return z.members[i].Score > max })
+	if from >= to {
+		return []ZMember{}
+	}
+	return append([]ZMember{}, z.members[from:to]...)
+}
+
+func (z SortedSetValue) MarshalJSON() ([]byte, error) {
+	if z.members == nil {
+		return []byte("[]"), nil
+	}
+	return json.Marshal(z.members)
+}
+
+func (z *SortedSetValue) UnmarshalJSON(data []byte) error {
+	var members []ZMember
+	if err := json.Unmarshal(data, &members); err != nil {
+		return err
+	}
+	z.members = members
+	sortZMembers(z.members)
+	return nil
+}
+
+func sortZMembers(members []ZMember) {
+	sort.Slice(members, func(i, j int) bool {
+		if members[i].Score != members[j].Score {
+			return members[i].Score < members[j].Score
+		}
+		return members[i].Member < members[j].Member
+	})
+}
+
+// rankRange turns inclusive start and stop indexes, negative ones counting
+// back from the end, into slice bounds for a collection of length n.
+func rankRange(n, start, stop int) (int, int) {
+	if start < 0 {
+		start += n
+	}
+	if stop < 0 {
+		stop += n
+	}
+	if start < 0 {
+		start = 0
+	}
+	if stop >= n {
+		stop = n - 1
+	}
+	if start > stop {
+		return 0, 0
+	}
+	return start, stop + 1
+}
+
+// collectionKind returns the value kind of a collection type.
+func collectionKind(value interface{}) (string, bool) {
+	switch value.(type) {
+	case ListValue:
+		return valueKindList, true
+	case HashValue:
+		return valueKindHash, true
+	case SetValue:
+		return valueKindSet, true
+	case SortedSetValue:
+		return valueKindSortedSet, true
+	}
+	return "", false
+}
+
+func decodeCollection(kind string, raw json.RawMessage) (interface{}, error) {
+	var err error
+	switch kind {
+	case valueKindList:
+		var value ListValue
+		err = json.Unmarshal(raw, &value)
+		return value, err
+	case valueKindHash:
+		var value HashValue
+		err = json.Unmarshal(raw, &value)
+		return value, err
+	case valueKindSet:
+		var value SetValue
+		err = json.Unmarshal(raw, &value)
+		return value, err
+	case valueKindSortedSet:
+		var value SortedSetValue
+		err = json.Unmarshal(raw, &value)
+		return value, err
+	}
+	return nil, fmt.Errorf("unknown collection kind '%s'", kind)
+}
+
+func wrongType(value interface{}, want string) error {
+	held := "a plain value"
+	switch value.(type) {
+	case ListValue:
+		held = "a list"
+	case HashValue:
+		held = "a hash"
+	case SetValue:
+		held = "a set"
+	case SortedSetValue:
+		held = "a sorted set"
+	}
+	return fmt.Errorf("%w: key holds %s, not %s", ErrWrongType, held, want)
+}
+
+// The as* helpers return the collection a key holds, empty if the key does
+// not exist, or ErrWrongType.
+func asList(value interface{}, exists bool) (ListValue, error) {
+	if !exists {
+		return nil, nil
+	}
+	if l, ok := value.(ListValue); ok {
+		return l, nil
+	}
+	return nil, wrongType(value, "a list")
+}
+
+func asHash(value interface{}, exists bool) (HashValue, error) {
+	if !exists {
+		return HashValue{}, nil
+	}
+	if h, ok := value.(HashValue); ok {
+		return h, nil
+	}
+	return nil, wrongType(value, "a hash")
+}
+
+func asSet(value interface{}, exists bool) (SetValue, error) {
+	if !exists {
+		return SetValue{}, nil
+	}
+	if s, ok := value.(SetValue); ok {
+		return s, nil
+	}
+	return nil, wrongType(value, "a set")
+}
+
+func asSortedSet(value interface{}, exists bool) (SortedSetValue, error) {
+	if !exists {
+		return SortedSetValue{}, nil
+	}
+	if z, ok := value.(SortedSetValue); ok {
+		return z, nil
+	}
+	return SortedSetValue{}, wrongType(value, "a sorted set")
+}
+
+// Collection operations, named after their Redis commands.
+const (
+	opLPush   = "lpush"
+	opRPush   = "rpush"
+	opLPop    = "lpop"
+	opRPop    = "rpop"
+	opHSet    = "hset"
+	opHDel    = "hdel"
+	opHIncrBy = "hincrby"
+	opSAdd    = "sadd"
+	opSRem    = "srem"
+	opZAdd    = "zadd"
+	opZRem    = "zrem"
+)
+
+// collectionOp is one atomic change to a collection. It is plain data so
+// that ReplicatedCache can put it in the Raft log, and applying it is
+// deterministic so every node ends up with the same value.
+type collectionOp struct {
+	Op     string             `json:"op"`
+	Values []string           `json:"values,omitempty"`
+	Fields map[string]string  `json:"fields,omitempty"`
+	Scores map[string]float64 `json:"scores,omitempty"`
+	Field  string             `json:"field,omitempty"`
+	By     int64              `json:"by,omitempty"`
+	Count  int                `json:"count,omitempty"`
+}
+
+// applyTo runs op on key through u and returns its result, with the entry
+// as it stands afterwards. The result is the new length for pushes, the
+// removed items for pops (nil if there were none), the new value for
+// hincrby, and for the rest the number of members or fields added or
+// removed.
+func (op collectionOp) applyTo(u Updater, key string) (interface{}, Entry, error) {
+	var result interface{}
+	entry, _, err := u.Update(key, func(current interface{}, exists bool) (interface{}, error) {
+		next, r, err := op.apply(current, exists)
+		result = r
+		return next, err
+	})
+	return result, entry, err
+}
+
+// apply returns the collection after op, nil when it ends up empty (empty
+// collections are removed, as in Redis), and op's result. It returns
+// ErrNoChange when op leaves the collection as it was. current is never
+// modified, as readers may still hold it, so each change copies it.
+func (op collectionOp) apply(current interface{}, exists bool) (interface{}, interface{}, error) {
+	switch op.Op {
+	case opLPush, opRPush:
+		list, err := asList(current, exists)
+		if err != nil {
+			return nil, nil, err
+		}
+		next := make(ListValue, 0, len(list)+len(op.Values))
+		if op.Op == opLPush {
+			// Each value is pushed onto the head in turn, so they end up in
+			// reverse order.
+			for i := len(op.Values) - 1; i >= 0; i-- {
+				next = append(next, op.Values[i])
+			}
+			next = append(next, list...)
+		} else {
+			next = append(append(next, list...), op.Values...)
+		}
+		return next, len(next), nil
+
+	case opLPop, opRPop:
+		list, err := asList(current, exists)
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(list) == 0 {
+			return nil, nil, ErrNoChange
+		}
+		n := op.Count
+		if n <= 0 {
+			n = 1
+		}
+		if n > len(list) {
+			n = len(list)
+		}
+		var popped, rest []string
+		if op.Op == opLPop {
+			popped, rest = list[:n], list[n:]
+			popped = append([]string{}, popped...)
+		} else {
+			rest = list[:len(list)-n]
+			for i := len(list) - 1; i >= len(rest); i-- {
+				popped = append(popped, list[i])
+			}
+		}
+		if len(rest) == 0 {
+			return nil, popped, nil
+		}
+		return append(ListValue{}, rest...), popped, nil
+
+	case opHSet, opHIncrBy:
+		hash, err := asHash(current, exists)
+		if err != nil {
+			return nil, nil, err
+		}
+		next := make(HashValue, len(hash)+len(op.Fields)+1)
+		for f, v := range hash {
+			next[f] = v
+		}
+		if op.Op == opHIncrBy {
+			n, err := incrHashField(next, op.Field, op.By)
+			return next, n, err
+		}
+		created := 0
+		for f, v := range op.Fields {
+			if _, ok := next[f]; !ok {
+				created++
+			}
+			next[f] = v
+		}
+		return next, created, nil
+
+	case opHDel:
+		hash, err := asHash(current, exists)
+		if err != nil {
+			return nil, nil, err
+		}
+		next := make(HashValue, len(hash))
+		for f, v := range hash {
+			next[f] = v
+		}
+		removed := 0
+		for _, f := range op.Values {
+			if _, ok := next[f]; ok {
+				delete(next, f)
+				removed++
+			}
+		}
+		return nonEmpty(next, len(next), removed)
+
+	case opSAdd, opSRem:
+		set, err := asSet(current, exists)
+		if err != nil {
+			return nil, nil, err
+		}
+		next := make(SetValue, len(set)+len(op.Values))
+		for m := range set {
+			next[m] = struct{}{}
+		}
+		changed := 0
+		for _, m := range op.Values {
+			_, in := next[m]
+			switch {
+			case op.Op == opSAdd && !in:
+				next[m] = struct{}{}
+				changed++
+			case op.Op == opSRem && in:
+				delete(next, m)
+				changed++
+			}
+		}
+		return nonEmpty(next, len(next), changed)
+
+	case opZAdd, opZRem:
+		zset, err := asSortedSet(current, exists)
+		if err != nil {
+			return nil, nil, err
+		}
+		scores := make(map[string]float64, len(zset.members)+len(op.Scores))
+		for _, m := range zset.members {
+			scores[m.Member] = m.Score
+		}
+		changed := 0
+		if op.Op == opZAdd {
+			for m, score := range op.Scores {
+				if math.IsNaN(score) || math.IsInf(score, 0) {
+					return nil, nil, fmt.Errorf("score of '%s' must be a finite number", m)
+				}
+				if _, in := scores[m]; !in {
+					changed++
+				}
+				scores[m] = score
+			}
+		} else {
+			for _, m := range op.Values {
+				if _, in := scores[m]; in {
+					delete(scores, m)
+					changed++
+				}
+			}
+		}
+		next := SortedSetValue{members: make([]ZMember, 0, len(scores))}
+		for m, score := range scores {
+			next.members = append(next.members, ZMember{Member: m, Score: score})
+		}
+		sortZMembers(next.members)
+		if op.Op == opZAdd {
+			return next, changed, nil
+		}
+		return nonEmpty(next, len(next.members), changed)
+	}
+	return nil, nil, fmt.Errorf("unknown collection operation '%s'", op.Op)
+}
+
+// nonEmpty finishes a removal: no change if nothing was removed, and nil, so
+// the key is deleted, once the collection is empty.
+func nonEmpty(next interface{}, size, removed int) (interface{}, interface{}, error) {
+	if removed == 0 {
+		return nil, 0, ErrNoChange
+	}
+	if size == 0 {
+		return nil, removed, nil
+	}
+	return next, removed, nil
+}
+
+func incrHashField(hash HashValue, field string, by int64) (int64, error) {
+	var n int64
+	if v, ok := hash[field]; ok {
+		var err error
+		if n, err = strconv.ParseInt(v, 10, 64); err != nil {
+			return 0, fmt.Errorf("%w: field '%s'", ErrNotInteger, field)
+		}
+	}
+	if by > 0 && n > math.MaxInt64-by || by < 0 && n < math.MinInt64-by {
+		return 0, ErrOverflow
+	}
+	n += by
+	hash[field] = strconv.FormatInt(n, 10)
+	return n, nil
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func applyTestOp(t *testing.T, u Updater, key string, op collectionOp) interface{} {
+	t.Helper()
+	result, _, err := op.applyTo(u, key)
+	if err != nil {
+		t.Fatalf("%s on %s failed: %v", op.Op, key, err)
+	}
+	return result
+}
+
+func TestCollectionOps(t *testing.T) {
+	cache := NewSimpleCache()
+
+	applyTestOp(t, cache, "list", collectionOp{Op: opRPush, Values: []string{"b", "c"}})
+	if n := applyTestOp(t, cache, "list", collectionOp{Op: opLPush, Values: []string{"x", "a"}}); n != 4 {
+		t.Errorf("Expected length 4 after pushing, got %v", n)
+	}
+	list, _, _ := cache.Get("list")
+	if want := (ListValue{"a", "x", "b", "c"}); !reflect.DeepEqual(list, want) {
+		t.Errorf("Expected %v, got %v", want, list)
+	}
+	if got := list.(ListValue).Range(1, -2); !reflect.DeepEqual(got, []string{"x", "b"}) {
+		t.Errorf("Expected [x b] for range 1..-2, got %v", got)
+	}
+	if popped := applyTestOp(t, cache, "list", collectionOp{Op: opRPop, Count: 2}); !reflect.DeepEqual(popped, []string{"c", "b"}) {
+		t.Errorf("Expected to pop [c b] from the right, got %v", popped)
+	}
+	applyTestOp(t, cache, "list", collectionOp{Op: opLPop, Count: 5})
+	if _, exists, _ := cache.Get("list"); exists {
+		t.Error("Expected the emptied list to be removed")
+	}
+	if popped := applyTestOp(t, cache, "list", collectionOp{Op: opLPop}); popped != nil {
+		t.Errorf("Expected nothing popped from a missing list, got %v", popped)
+	}
+
+	applyTestOp(t, cache, "hash", collectionOp{Op: opHSet, Fields: map[string]string{"name": "ann", "visits": "41"}})
+	if n := applyTestOp(t, cache, "hash", collectionOp{Op: opHIncrBy, Field: "visits", By: 1}); n != int64(42) {
+		t.Errorf("Expected visits to reach 42, got %v", n)
+	}
+	if _, _, err := (collectionOp{Op: opHIncrBy, Field: "name", By: 1}).applyTo(cache, "hash"); !errors.Is(err, ErrNotInteger) {
+		t.Errorf("Expected ErrNotInteger incrementing a string field, got %v", err)
+	}
+	if n := applyTestOp(t, cache, "hash", collectionOp{Op: opHDel, Values: []string{"name", "missing"}}); n != 1 {
+		t.Errorf("Expected one field removed, got %v", n)
+	}
+
+	applyTestOp(t, cache, "s1", collectionOp{Op: opSAdd, Values: []string{"a", "b", "c"}})
+	applyTestOp(t, cache, "s2", collectionOp{Op: opSAdd, Values: []string{"c", "b", "d"}})
+	if n := applyTestOp(t, cache, "s1", collectionOp{Op: opSAdd, Values: []string{"a"}}); n != 0 {
+		t.Errorf("Expected re-adding a member to add nothing, got %v", n)
+	}
+	s1, _, _ := cache.Get("s1")
+	s2, _, _ := cache.Get("s2")
+	if got := s1.(SetValue).Intersect(s2.(SetValue)); !reflect.DeepEqual(got, []string{"b", "c"}) {
+		t.Errorf("Expected intersection [b c], got %v", got)
+	}
+
+	applyTestOp(t, cache, "board", collectionOp{Op: opZAdd, Scores: map[string]float64{"ann": 120, "bob": 95, "cy": 95, "dee": 300}})
+	board, _, _ := cache.Get("board")
+	z := board.(SortedSetValue)
+	if got := z.RangeByRank(0, 1); !reflect.DeepEqual(got, []ZMember{{"bob", 95}, {"cy", 95}}) {
+		t.Errorf("Expected the two lowest scores, ties by member, got %v", got)
+	}
+	if got := z.RangeByScore(100, 300); len(got) != 2 || got[0].Member != "ann" {
+		t.Errorf("Expected ann and dee for scores 100..300, got %v", got)
+	}
+	if score, rank, ok := z.Score("dee"); !ok || score != 300 || rank != 3 {
+		t.Errorf("Expected dee at rank 3 with 300, got %v %v %v", score, rank, ok)
+	}
+
+	for _, op := range []collectionOp{{Op: opRPush, Values: []string{"x"}}, {Op: opHSet, Fields: map[string]string{"f": "v"}}, {Op: opZRem, Values: []string{"x"}}} {
+		if _, _, err := op.applyTo(cache, "s1"); !errors.Is(err, ErrWrongType) {
+			t.Errorf("Expected ErrWrongType for %s on a set, got %v", op.Op, err)
+		}
+	}
+	cache.Set("plain", "value")
+	if _, _, err := (collectionOp{Op: opSAdd, Values: []string{"x"}}).applyTo(cache, "plain"); !errors.Is(err, ErrWrongType) {
+		t.Errorf("Expected ErrWrongType on a plain value, got %v", err)
+	}
+}
+
+func TestCollections_ExpireWithTTL(t *testing.T) {
+	cache, clock := newFakeClockTTLCache(t, time.Minute)
+
+	applyTestOp(t, cache, "queue", collectionOp{Op: opRPush, Values: []string{"a"}})
+	created, _, _ := cache.GetEntry("queue")
+	clock.Advance(45 * time.Second)
+	applyTestOp(t, cache, "queue", collectionOp{Op: opLPush, Values: []string{"b"}})
+	if entry, _, _ := cache.GetEntry("queue"); !reflect.DeepEqual(entry.Value, ListValue{"b", "a"}) || !entry.Expires.Equal(created.Expires) {
+		t.Fatalf("Expected the push to keep the expiry %s, got %+v", created.Expires, entry)
+	}
+
+	// A TTL set explicitly is kept too.
+	if _, _, err := cache.UpsertWithTTL(context.Background(), "session", ListValue{"x"}, 10*time.Minute, nil); err != nil {
+		t.Fatalf("UpsertWithTTL failed: %v", err)
+	}
+	applyTestOp(t, cache, "session", collectionOp{Op: opLPush, Values: []string{"y"}})
+	if entry, _, _ := cache.GetEntry("session"); entry.TTL(clock.Now()) != 10*time.Minute {
+		t.Errorf("Expected LPUSH to leave the 10m TTL, got %s", entry.TTL(clock.Now()))
+	}
+
+	clock.Advance(30 * time.Second)
+	if _, exists, _ := cache.Get("queue"); exists {
+		t.Fatal("Expected the list to expire a minute after it was created")
+	}
+	if n := applyTestOp(t, cache, "queue", collectionOp{Op: opRPush, Values: []string{"c"}}); n != 1 {
+		t.Errorf("Expected a push onto an expired list to start a new one, got length %v", n)
+	}
+}
+
+func TestCollections_ThroughEncryptionAndSnapshots(t *testing.T) {
+	inner := NewSimpleCache()
+	cache := NewCompressedCache(NewEncryptedCache(inner, testKeyring(t, "k1")), CompressedCacheConfig{Compressor: gzipCompressor{}, Threshold: 1})
+
+	applyTestOp(t, cache, "tags", collectionOp{Op: opSAdd, Values: []string{"go", "cache"}})
+	applyTestOp(t, cache, "board", collectionOp{Op: opZAdd, Scores: map[string]float64{"ann": 1.5}})
+	if stored, _, _ := inner.Get("tags"); !reflect.DeepEqual(reflect.TypeOf(stored), reflect.TypeOf(sealedValue{})) {
+		t.Errorf("Expected the set sealed in the inner cache, got %T", stored)
+	}
+
+	snapshot, err := cache.Snapshot()
+	if err != nil {
+		t.Fatalf("Snapshot failed: %v", err)
+	}
+	restored := NewSimpleCache()
+	if err := restored.Restore(snapshot); err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+	reader := NewEncryptedCache(restored, testKeyring(t, "k1"))
+	if n := applyTestOp(t, reader, "tags", collectionOp{Op: opSAdd, Values: []string{"go", "raft"}}); n != 1 {
+		t.Errorf("Expected one new member after the restore, got %v", n)
+	}
+	tags, _, _ := reader.Get("tags")
+	if want := (SetValue{"go": {}, "cache": {}, "raft": {}}); !reflect.DeepEqual(tags, want) {
+		t.Errorf("Expected %v, got %v", want, tags)
+	}
+	board, _, _ := reader.Get("board")
+	if score, _, _ := board.(SortedSetValue).Score("ann"); score != 1.5 {
+		t.Errorf("Expected ann's score to survive, got %v", score)
+	}
+}
+
+func TestRaft_ReplicatesCollectionOps(t *testing.T) {
+	cluster := newRaftTestCluster(t, 3, 0)
+	leader := cluster.caches[cluster.waitLeader()]
+
+	ctx := context.Background()
+	for i := 0; i < 3; i++ {
+		if _, err := leader.applyOp(ctx, "jobs", collectionOp{Op: opRPush, Values: []string{fmt.Sprint(i)}}); err != nil {
+			t.Fatalf("Push failed: %v", err)
+		}
+	}
+	popped, err := leader.applyOp(ctx, "jobs", collectionOp{Op: opLPop})
+	if err != nil || !reflect.DeepEqual(popped, []string{"0"}) {
+		t.Fatalf("Expected to pop [0], got %v, %v", popped, err)
+	}
+	if _, err := leader.applyOp(ctx, "jobs", collectionOp{Op: opSAdd, Values: []string{"x"}}); !errors.Is(err, ErrWrongType) {
+		t.Errorf("Expected ErrWrongType through Raft, got %v", err)
+	}
+
+	for id, rc := range cluster.caches {
+		deadline := time.Now().Add(3 * time.Second)
+		for {
+			list, _, _ := rc.Get("jobs")
+			if reflect.DeepEqual(list, ListValue{"1", "2"}) {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("Node %s: expected [1 2], got %v", id, list)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
+
+func TestServer_Collections(t *testing.T) {
+	ts := newTestServer(t, NewSimpleCache())
+	api := ts.URL + "/api/v2"
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			doRequest(t, http.MethodPost, api+"/lists/jobs/right", "application/json", fmt.Sprintf(`"job-%d"`, i))
+		}(i)
+	}
+	wg.Wait()
+	resp, body := doRequest(t, http.MethodGet, api+"/lists/jobs?stop=1", "", "")
+	data, _ := body.Data.(map[string]interface{})
+	if resp.StatusCode != http.StatusOK || data["length"] != 20.0 || len(data["items"].([]interface{})) != 2 {
+		t.Fatalf("Expected 20 items from concurrent pushes and a range of 2, got %d %+v", resp.StatusCode, body)
+	}
+	resp, body = doRequest(t, http.MethodDelete, api+"/lists/jobs/left?count=20", "", "")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected 200 popping, got %d %+v", resp.StatusCode, body)
+	}
+	if resp, _ = doRequest(t, http.MethodDelete, api+"/lists/jobs/left", "", ""); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected 404 popping an empty list, got %d", resp.StatusCode)
+	}
+
+	doRequest(t, http.MethodPatch, api+"/hashes/user", "application/json", `{"name":"ann"}`)
+	resp, body = doRequest(t, http.MethodPost, api+"/hashes/user/visits/incr?by=5", "", "")
+	if data, _ := body.Data.(map[string]interface{}); resp.StatusCode != http.StatusOK || data["value"] != 5.0 {
+		t.Errorf("Expected visits=5, got %d %+v", resp.StatusCode, body)
+	}
+	if resp, _ = doRequest(t, http.MethodPost, api+"/hashes/user/name/incr", "", ""); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected 400 incrementing a string, got %d", resp.StatusCode)
+	}
+	resp, body = doRequest(t, http.MethodGet, api+"/hashes/user/name", "", "")
+	if data, _ := body.Data.(map[string]interface{}); resp.StatusCode != http.StatusOK || data["value"] != "ann" {
+		t.Errorf("Expected name=ann, got %d %+v", resp.StatusCode, body)
+	}
+
+	doRequest(t, http.MethodPost, api+"/sets/a", "application/json", `["x","y","z"]`)
+	doRequest(t, http.MethodPut, api+"/sets/b/y", "", "")
+	doRequest(t, http.MethodPut, api+"/sets/b/z", "", "")
+	resp, body = doRequest(t, http.MethodGet, api+"/sets/a?intersect=b", "", "")
+	if data, _ := body.Data.(map[string]interface{}); resp.StatusCode != http.StatusOK || !reflect.DeepEqual(data["members"], []interface{}{"y", "z"}) {
+		t.Errorf("Expected members [y z], got %d %+v", resp.StatusCode, body)
+	}
+	if resp, _ = doRequest(t, http.MethodGet, api+"/sets/b/x", "", ""); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected 404 for a non-member, got %d", resp.StatusCode)
+	}
+
+	doRequest(t, http.MethodPatch, api+"/zsets/board", "application/json", `{"ann":120,"bob":95}`)
+	doRequest(t, http.MethodPut, api+"/zsets/board/cy", "application/json", `300`)
+	resp, body = doRequest(t, http.MethodGet, api+"/zsets/board?min=100&max=+inf", "", "")
+	if data, _ := body.Data.(map[string]interface{}); resp.StatusCode != http.StatusOK || len(data["members"].([]interface{})) != 2 {
+		t.Errorf("Expected two members scoring 100 or more, got %d %+v", resp.StatusCode, body)
+	}
+	resp, body = doRequest(t, http.MethodGet, api+"/zsets/board/bob", "", "")
+	if data, _ := body.Data.(map[string]interface{}); resp.StatusCode != http.StatusOK || data["rank"] != 0.0 {
+		t.Errorf("Expected bob at rank 0, got %d %+v", resp.StatusCode, body)
+	}
+
+	resp, body = doRequest(t, http.MethodPost, api+"/lists/board/right", "application/json", `"x"`)
+	if resp.StatusCode != http.StatusConflict {
+		t.Errorf("Expected 409 pushing onto a sorted set, got %d %+v", resp.StatusCode, body)
+	}
+	if resp, _ = doRequest(t, http.MethodGet, api+"/hashes/board", "", ""); resp.StatusCode != http.StatusConflict {
+		t.Errorf("Expected 409 reading a sorted set as a hash, got %d", resp.StatusCode)
+	}
+	resp, body = doRequest(t, http.MethodGet, api+"/keys/a", "", "")
+	if resp.StatusCode != http.StatusOK || !reflect.DeepEqual(body.Data, []interface{}{"x", "y", "z"}) {
+		t.Errorf("Expected the set as a JSON array from the keys API, got %d %+v", resp.StatusCode, body)
+	}
+	if resp, _ = doRequest(t, http.MethodPut, api+"/lists/jobs", "", ""); resp.StatusCode != http.StatusMethodNotAllowed || resp.Header.Get("Allow") != "GET" {
+		t.Errorf("Expected 405 with Allow: GET, got %d %q", resp.StatusCode, resp.Header.Get("Allow"))
+	}
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+var (
+	// ErrTampered is returned for encrypted data that fails authentication:
+	// it was modified, truncated, or sealed for a different purpose.
+	ErrTampered        = errors.New("encrypted data failed authentication")
+	ErrUnknownKeyID    = errors.New("unknown encryption key id")
+	ErrNotEncrypted    = errors.New("data is not encrypted")
+	ErrNoEncryptionKey = errors.New("data is encrypted but no encryption keys are configured")
+)
+
+// encryptedMagic starts every sealed file or record. Plain snapshots and
+// Raft files are JSON, so they never start with it.
+var encryptedMagic = []byte("CENC\x01")
+
+// Keyring holds AES keys by ID. The first key encrypts; all of them decrypt,
+// so a new key can be put first while data sealed with older ones is still
+// readable. A nil *Keyring leaves data in plain text.
+type Keyring struct {
+	primary string
+	aeads   map[string]cipher.AEAD
+}
+
+// EncryptionKey is an AES-128, -192 or -256 key and the ID recorded with
+// everything it seals.
+type EncryptionKey struct {
+	ID  string
+	Key []byte
+}
+
+func NewKeyring(keys []EncryptionKey) (*Keyring, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("encryption: no keys")
+	}
+	k := &Keyring{primary: keys[0].ID, aeads: make(map[string]cipher.AEAD, len(keys))}
+	for _, key := range keys {
+		if key.ID == "" || len(key.ID) > 255 || strings.ContainsAny(key.ID, ":, \t\r\n") {
+			return nil, fmt.Errorf("encryption: invalid key id %q", key.ID)
+		}
+		if _, dup := k.aeads[key.ID]; dup {
+			return nil, fmt.Errorf("encryption: duplicate key id %q", key.ID)
+		}
+		block, err := aes.NewCipher(key.Key)
+		if err != nil {
+			return nil, fmt.Errorf("encryption: key %q: must be 16, 24 or 32 bytes", key.ID)
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		k.aeads[key.ID] = aead
+	}
+	return k, nil
+}
+
+// ParseKeyring reads keys written as "id:base64-key", separated by commas
+// or newlines. Lines starting with # are comments.
+func ParseKeyring(text string) (*Keyring, error) {
+	var keys []EncryptionKey
+	scanner := bufio.NewScanner(strings.NewReader(text))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		for _, item := range splitList(line) {
+			id, encoded, ok := strings.Cut(item, ":")
+			if !ok {
+				return nil, fmt.Errorf("encryption: key entry must be id:base64-key")
+			}
+			key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+			if err != nil {
+				return nil, fmt.Errorf("encryption: key %q is not valid base64", id)
+			}
+			keys = append(keys, EncryptionKey{ID: strings.TrimSpace(id), Key: key})
+		}
+	}
+	return NewKeyring(keys)
+}
+
+// LoadKeyringFile reads a ParseKeyring file, warning when other users can
+// read it.
+func LoadKeyringFile(path string) (*Keyring, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("encryption: %w", err)
+	}
+	if info.Mode().Perm()&0o077 != 0 {
+		slog.Warn("Encryption key file is readable by other users", "path", path, "mode", info.Mode().Perm().String())
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("encryption: %w", err)
+	}
+	k, err := ParseKeyring(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("%w (in %s)", err, path)
+	}
+	return k, nil
+}
+
+// PrimaryKeyID is the ID of the key new data is sealed with.
+func (k *Keyring) PrimaryKeyID() string {
+	return k.primary
+}
+
+// Seal encrypts plaintext with the primary key. The result records the key
+// ID; purpose is authenticated but not stored, so data sealed for one use
+// (say a snapshot) is rejected when opened as another.
+//
+// Layout: magic, key ID length, key ID, nonce, ciphertext and GCM tag.
+func (k *Keyring) Seal(purpose string, plaintext []byte) ([]byte, error) {
+	if k == nil {
+		return plaintext, nil
+	}
+	aead := k.aeads[k.primary]
+
+	header := append([]byte(nil), encryptedMagic...)
+	header = append(header, byte(len(k.primary)))
+	header = append(header, k.primary...)
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	out := append(header, nonce...)
+	return aead.Seal(out, nonce, plaintext, sealAAD(purpose, header)), nil
+}
+
+// Open reverses Seal. A nil Keyring passes plain data through and refuses
+// sealed data; a Keyring refuses plain data, which could otherwise be
+// swapped in for a sealed file.
+func (k *Keyring) Open(purpose string, data []byte) ([]byte, error) {
+	sealed := bytes.HasPrefix(data, encryptedMagic)
+	if k == nil {
+		if sealed {
+			return nil, ErrNoEncryptionKey
+		}
+		return data, nil
+	}
+	if !sealed {
+		return nil, ErrNotEncrypted
+	}
+
+	rest := data[len(encryptedMagic):]
+	if len(rest) < 1 || len(rest) < 1+int(rest[0]) {
+		return nil, ErrTampered
+	}
+	id := string(rest[1 : 1+int(rest[0])])
+	header := data[:len(encryptedMagic)+1+len(id)]
+	aead, ok := k.aeads[id]
+	if !ok {
+		return nil, fmt.Errorf("%w %q", ErrUnknownKeyID, id)
+	}
+
+	rest = rest[1+len(id):]
+	if len(rest) < aead.NonceSize() {
+		return nil, ErrTampered
+	}
+	plaintext, err := aead.Open(nil, rest[:aead.NonceSize()], rest[aead.NonceSize():], sealAAD(purpose, header))
+	if err != nil {
+		return nil, ErrTampered
+	}
+	return plaintext, nil
+}
+
+func sealAAD(purpose string, header []byte) []byte {
+	aad := append([]byte(purpose), 0)
+	return append(aad, header...)
+}
+
+// sealedValue is how EncryptedCache stores a value: encodeValue's form of
+// it, sealed for the cache key and kind.
+type sealedValue struct {
+	Kind string `json:"kind,omitempty"`
+	Data []byte `json:"data"`
+}
+
+// EncryptedCache keeps values encrypted in the inner cache, so they are
+// not readable in memory dumps, swap or snapshots of the inner cache. Each
+// value is bound to its key and cannot be moved to another. Keys stay in
+// plain text, and values come back as encoding/json decodes them.
+type EncryptedCache struct {
+	codecCache
+	keyring *Keyring
+}
+
+func NewEncryptedCache(inner Cache, keyring *Keyring) *EncryptedCache {
+	c := &EncryptedCache{keyring: keyring}
+	c.codecCache = codecCache{inner: inner, encode: c.seal, decode: c.open}
+	return c
+}
+
+// newDecryptingCache stores new values in plain text but still reads values
+// sealed earlier, for example by a server that ran with encrypt_memory.
+func newDecryptingCache(inner Cache, keyring *Keyring) *EncryptedCache {
+	c := NewEncryptedCache(inner, keyring)
+	c.encode = func(_ string, value interface{}) (interface{}, error) { return value, nil }
+	return c
+}
+
+func valuePurpose(key, kind string) string {
+	return "value\x00" + key + "\x00" + kind
+}
+
+func (c *EncryptedCache) seal(key string, value interface{}) (interface{}, error) {
+	kind, raw, err := encodeValue(value)
+	if err != nil {
+		return nil, fmt.Errorf("encrypting value: %w", err)
+	}
+	data, err := c.keyring.Seal(valuePurpose(key, kind), raw)
+	if err != nil {
+		return nil, err
+	}
+	return sealedValue{Kind: kind, Data: data}, nil
+}
+
+// open decrypts a sealed value. Values stored before encryption was turned
+// on pass through.
+func (c *EncryptedCache) open(key string, value interface{}) (interface{}, error) {
+	sealed, ok := value.(sealedValue)
+	if !ok {
+		return value, nil
+	}
+	raw, err := c.keyring.Open(valuePurpose(key, sealed.Kind), sealed.Data)
+	if err != nil {
+		return nil, fmt.Errorf("decrypting key '%s': %w", key, err)
+	}
+	return decodeValue(sealed.Kind, raw)
+}
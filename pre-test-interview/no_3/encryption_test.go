@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func testKeyring(t *testing.T, ids ...string) *Keyring {
+	t.Helper()
+	var keys []EncryptionKey
+	for _, id := range ids {
+		keys = append(keys, EncryptionKey{ID: id, Key: bytes.Repeat([]byte(id[:1]), 32)})
+	}
+	k, err := NewKeyring(keys)
+	if err != nil {
+		t.Fatalf("Failed to create keyring: %v", err)
+	}
+	return k
+}
+
+func TestKeyring_SealAndOpen(t *testing.T) {
+	k := testKeyring(t, "a")
+	sealed, err := k.Seal("snapshot", []byte("secret data"))
+	if err != nil {
+		t.Fatalf("Seal failed: %v", err)
+	}
+	if bytes.Contains(sealed, []byte("secret")) {
+		t.Error("Expected the sealed data not to contain the plaintext")
+	}
+	if got, err := k.Open("snapshot", sealed); err != nil || string(got) != "secret data" {
+		t.Errorf("Open = %q, %v", got, err)
+	}
+
+	tampered := append([]byte(nil), sealed...)
+	tampered[len(tampered)-1] ^= 1
+	if _, err := k.Open("snapshot", tampered); !errors.Is(err, ErrTampered) {
+		t.Errorf("Expected ErrTampered for a flipped bit, got %v", err)
+	}
+	if _, err := k.Open("snapshot", sealed[:len(sealed)-5]); !errors.Is(err, ErrTampered) {
+		t.Errorf("Expected ErrTampered for a truncated file, got %v", err)
+	}
+	if _, err := k.Open("raft-log", sealed); !errors.Is(err, ErrTampered) {
+		t.Errorf("Expected ErrTampered when opened for another purpose, got %v", err)
+	}
+	if _, err := k.Open("snapshot", []byte(`{"entries": []}`)); !errors.Is(err, ErrNotEncrypted) {
+		t.Errorf("Expected plain data to be refused, got %v", err)
+	}
+
+	var none *Keyring
+	if _, err := none.Open("snapshot", sealed); !errors.Is(err, ErrNoEncryptionKey) {
+		t.Errorf("Expected sealed data to need a key, got %v", err)
+	}
+	if got, err := none.Open("snapshot", []byte("{}")); err != nil || string(got) != "{}" {
+		t.Errorf("Expected a nil keyring to pass plain data through, got %q, %v", got, err)
+	}
+}
+
+func TestKeyring_Rotation(t *testing.T) {
+	old := testKeyring(t, "2023")
+	sealed, _ := old.Seal("snapshot", []byte("v1"))
+
+	rotated := testKeyring(t, "2024", "2023")
+	if got, err := rotated.Open("snapshot", sealed); err != nil || string(got) != "v1" {
+		t.Errorf("Expected the old key to still decrypt, got %q, %v", got, err)
+	}
+	resealed, _ := rotated.Seal("snapshot", []byte("v2"))
+	if !bytes.Contains(resealed[:16], []byte("2024")) {
+		t.Error("Expected new data to record the new key ID")
+	}
+
+	retired := testKeyring(t, "2024")
+	if _, err := retired.Open("snapshot", sealed); !errors.Is(err, ErrUnknownKeyID) {
+		t.Errorf("Expected ErrUnknownKeyID once the old key is removed, got %v", err)
+	}
+}
+
+func TestParseKeyring(t *testing.T) {
+	key := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{7}, 32))
+	k, err := ParseKeyring("# rotated 2024-06\nnew:" + key + "\nold:" + base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 16)) + "\n")
+	if err != nil || k.PrimaryKeyID() != "new" || len(k.aeads) != 2 {
+		t.Fatalf("Expected two keys with 'new' primary, got %v, %v", k, err)
+	}
+
+	for _, bad := range []string{"", "nokey", "a:!!!", "a:" + base64.StdEncoding.EncodeToString([]byte("short")), "a:" + key + ",a:" + key} {
+		if _, err := ParseKeyring(bad); err == nil {
+			t.Errorf("ParseKeyring(%q): expected an error", bad)
+		}
+	}
+}
+
+func TestFileRaftStorage_Encrypted(t *testing.T) {
+	dir := t.TempDir()
+	storage, _ := NewFileRaftStorage(dir)
+	storage.SetKeyring(testKeyring(t, "k1"))
+
+	entries := []RaftLogEntry{
+		{Index: 1, Term: 1, Data: []byte(`{"key":"ssn","value":"123-45-6789"}`)},
+		{Index: 2, Term: 1, Data: []byte(`{"key":"email","value":"alice@example.com"}`)},
+	}
+	if err := storage.SaveState(RaftHardState{Term: 3, VotedFor: "node-a"}); err != nil {
+		t.Fatalf("SaveState failed: %v", err)
+	}
+	if err := storage.AppendLog(entries); err != nil {
+		t.Fatalf("AppendLog failed: %v", err)
+	}
+	if err := storage.SaveSnapshot(&RaftSnapshot{LastIndex: 1, LastTerm: 1, Data: []byte("123-45-6789")}); err != nil {
+		t.Fatalf("SaveSnapshot failed: %v", err)
+	}
+	storage.Close()
+
+	for _, name := range []string{"state.json", "log.jsonl", "snapshot.json"} {
+		data, _ := os.ReadFile(filepath.Join(dir, name))
+		if strings.Contains(string(data), "node-a") || strings.Contains(string(data), "alice") ||
+			strings.Contains(string(data), base64.StdEncoding.EncodeToString([]byte("123-45-6789"))) {
+			t.Errorf("Expected %s to be encrypted, got %q", name, data)
+		}
+	}
+
+	// Reopened with the next key first, as after a rotation.
+	reopened, _ := NewFileRaftStorage(dir)
+	reopened.SetKeyring(testKeyring(t, "k2", "k1"))
+	if state, err := reopened.LoadState(); err != nil || state.VotedFor != "node-a" {
+		t.Errorf("LoadState = %+v, %v", state, err)
+	}
+	if got, err := reopened.LoadLog(); err != nil || !reflect.DeepEqual(got, entries) {
+		t.Errorf("LoadLog = %+v, %v", got, err)
+	}
+	if snap, err := reopened.LoadSnapshot(); err != nil || string(snap.Data) != "123-45-6789" {
+		t.Errorf("LoadSnapshot = %+v, %v", snap, err)
+	}
+
+	// A torn final line is cut off, as without a keyring.
+	logPath := filepath.Join(dir, "log.jsonl")
+	original, _ := os.ReadFile(logPath)
+	os.WriteFile(logPath, append(bytes.Clone(original), "3 Q0VOQwE"...), 0o600)
+	if got, err := reopened.LoadLog(); err != nil || !reflect.DeepEqual(got, entries) {
+		t.Errorf("Expected the torn final line to be dropped, got %+v, %v", got, err)
+	}
+	if data, _ := os.ReadFile(logPath); !bytes.Equal(data, original) {
+		t.Error("Expected the torn line to be truncated")
+	}
+
+	lines := bytes.SplitAfter(original, []byte("\n"))
+	tamper := func(name string, data []byte, want error) {
+		t.Helper()
+		os.WriteFile(logPath, data, 0o600)
+		if _, err := reopened.LoadLog(); !errors.Is(err, want) {
+			t.Errorf("%s: expected %v, got %v", name, want, err)
+		}
+	}
+
+	// A complete line that fails authentication is an error, not a tail.
+	index, encoded, _ := bytes.Cut(bytes.TrimSuffix(lines[0], []byte("\n")), []byte(" "))
+	sealed, _ := base64.StdEncoding.DecodeString(string(encoded))
+	sealed[len(sealed)-1] ^= 1
+	tamper("modified", fmt.Appendf(nil, "%s %s\n%s", index, base64.StdEncoding.EncodeToString(sealed), lines[1]), ErrTampered)
+
+	// Each line is bound to its index, and the indexes must follow on.
+	relabeled := bytes.Replace(lines[1], []byte("2 "), []byte("1 "), 1)
+	tamper("relabeled", relabeled, ErrTampered)
+	tamper("reordered", append(bytes.Clone(lines[1]), lines[0]...), ErrLogGap)
+	tamper("repeated", append(bytes.Clone(original), lines[1]...), ErrLogGap)
+}
+
+func TestFileRaftStorage_RejectsGaps(t *testing.T) {
+	storage, _ := NewFileRaftStorage(t.TempDir())
+	defer storage.Close()
+	storage.AppendLog([]RaftLogEntry{{Index: 4, Term: 1}, {Index: 5, Term: 1}})
+	if got, err := storage.LoadLog(); err != nil || len(got) != 2 {
+		t.Fatalf("LoadLog = %+v, %v", got, err)
+	}
+	storage.AppendLog([]RaftLogEntry{{Index: 7, Term: 1}})
+	if _, err := storage.LoadLog(); !errors.Is(err, ErrLogGap) {
+		t.Errorf("Expected ErrLogGap, got %v", err)
+	}
+}
+
+func TestEncryptedCache(t *testing.T) {
+	inner := NewSimpleCache()
+	keyring := testKeyring(t, "k1")
+	cache := NewCompressedCache(NewEncryptedCache(inner, keyring), CompressedCacheConfig{
+		Compressor: gzipCompressor{},
+		Threshold:  16,
+	})
+
+	values := map[string]interface{}{
+		"name":    "Alice Example",
+		"profile": map[string]interface{}{"ssn": strings.Repeat("123-45-6789 ", 10)},
+		"photo":   RawValue{Data: []byte("\x89PNG..."), ContentType: "image/png"},
+	}
+	for key, value := range values {
+		if err := cache.Set(key, value); err != nil {
+			t.Fatalf("Set(%s) failed: %v", key, err)
+		}
+		stored, _, _ := inner.Get(key)
+		if _, ok := stored.(sealedValue); !ok {
+			t.Errorf("Expected %s to be sealed in memory, got %T", key, stored)
+		}
+		if got, found, err := cache.Get(key); err != nil || !found || !reflect.DeepEqual(got, value) {
+			t.Errorf("Get(%s) = %v, %v, %v", key, got, found, err)
+		}
+	}
+
+	// A sealed value copied to another key does not decrypt.
+	stored, _, _ := inner.Get("name")
+	inner.Set("other", stored)
+	if _, _, err := cache.Get("other"); !errors.Is(err, ErrTampered) {
+		t.Errorf("Expected a moved value to fail authentication, got %v", err)
+	}
+	inner.Delete("other")
+
+	path := filepath.Join(t.TempDir(), "cache.snapshot")
+	if err := saveCacheSnapshot(path, inner, keyring); err != nil {
+		t.Fatalf("saveCacheSnapshot failed: %v", err)
+	}
+	if data, _ := os.ReadFile(path); !bytes.HasPrefix(data, encryptedMagic) {
+		t.Error("Expected the snapshot file to be encrypted")
+	}
+	if err := loadCacheSnapshot(path, NewSimpleCache(), nil); !errors.Is(err, ErrNoEncryptionKey) {
+		t.Errorf("Expected loading without keys to fail, got %v", err)
+	}
+
+	restored := NewSimpleCache()
+	if err := loadCacheSnapshot(path, restored, keyring); err != nil {
+		t.Fatalf("loadCacheSnapshot failed: %v", err)
+	}
+	// Without encrypt_memory, sealed values still read back and new ones
+	// are stored in plain text.
+	reader := NewCompressedCache(newDecryptingCache(restored, keyring), CompressedCacheConfig{})
+	if got, _, err := reader.Get("profile"); err != nil || !reflect.DeepEqual(got, values["profile"]) {
+		t.Errorf("Expected the value back from the encrypted snapshot, got %v, %v", got, err)
+	}
+	reader.Set("plain", "visible")
+	if got, _, _ := restored.Get("plain"); got != "visible" {
+		t.Errorf("Expected a plain value without encrypt_memory, got %T", got)
+	}
+}
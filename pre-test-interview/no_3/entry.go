@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+// Entry is a cached value together with the metadata the HTTP layer needs
+// for validators and caching headers. Expires is zero for entries that never
+// expire. Stale marks an entry served past Expires while it is refreshed.
+type Entry struct {
+	Value    interface{}
+	Version  uint64
+	Modified time.Time
+	Expires  time.Time
+	Stale    bool
+}
+
+// TTL returns the time left before the entry expires, or zero if it never
+// expires.
+func (e Entry) TTL(now time.Time) time.Duration {
+	if e.Expires.IsZero() {
+		return 0
+	}
+	if ttl := e.Expires.Sub(now); ttl > 0 {
+		return ttl
+	}
+	return 0
+}
+
+type EntryGetter interface {
+	GetEntry(key string) (Entry, bool, error)
+}
+
+// Precondition inspects the current entry (exists is false when there is
+// none) and decides whether a conditional write may proceed.
+type Precondition func(current Entry, exists bool) bool
+
+// ConditionalWriter applies writes only if a precondition holds, checked
+// atomically with the write. Writes rejected by the precondition return
+// ErrPreconditionFailed.
+type ConditionalWriter interface {
+	UpsertIf(key string, value interface{}, cond Precondition) (entry Entry, created bool, err error)
+	RemoveIf(key string, cond Precondition) (existed bool, err error)
+}
+
+// EntryRestorer installs an entry copied from another cache, keeping its
+// version and expiry. Nothing is stored if the entry has expired or the
+// cache already holds the same or a later version of the key; restored
+// reports whether it was.
+type EntryRestorer interface {
+	RestoreEntry(key string, e Entry) (restored bool, err error)
+}
+
+func restoredModified(e Entry, now time.Time) time.Time {
+	if e.Modified.IsZero() {
+		return now
+	}
+	return e.Modified
+}
+
+// UpdateFunc computes an entry's new value from its current one (exists is
+// false when there is none). Returning a nil value removes the entry, and
+// returning ErrNoChange leaves it as it is.
+type UpdateFunc func(current interface{}, exists bool) (interface{}, error)
+
+// Updater applies read-modify-write changes atomically: no other write to
+// key happens between fn reading the value and its result being stored. It
+// returns the entry as it stands afterwards.
+type Updater interface {
+	Update(key string, fn UpdateFunc) (entry Entry, exists bool, err error)
+}
+
+// Loader fetches a key's current value from the origin the cache sits in
+// front of. A nil value means the origin no longer has the key.
+type Loader func(ctx context.Context, key string) (interface{}, error)
+
+// versionCounter hands out entry versions. It starts from the wall clock so
+// versions, and the ETags built from them, are not reused after a restart.
+type versionCounter struct {
+	n *atomic.Uint64
+}
+
+func newVersionCounter() versionCounter {
+	n := &atomic.Uint64{}
+	n.Store(uint64(time.Now().UnixNano()))
+	return versionCounter{n: n}
+}
+
+func (v versionCounter) next() uint64 {
+	return v.n.Add(1)
+}
+
+// observe moves the counter past v, so versions restored from elsewhere are
+// never handed out again.
+func (v versionCounter) observe(version uint64) {
+	for {
+		current := v.n.Load()
+		if current >= version || v.n.CompareAndSwap(current, version) {
+			return
+		}
+	}
+}
@@ -0,0 +1,793 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+type MemberState int
+
+const (
+	MemberAlive MemberState = iota
+	MemberSuspect
+	MemberDead
+	MemberLeft
+)
+
+func (s MemberState) String() string {
+	switch s {
+	case MemberAlive:
+		return "alive"
+	case MemberSuspect:
+		return "suspect"
+	case MemberDead:
+		return "dead"
+	case MemberLeft:
+		return "left"
+	}
+	return "unknown"
+}
+
+func (s MemberState) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+func (s *MemberState) UnmarshalText(text []byte) error {
+	for _, state := range []MemberState{MemberAlive, MemberSuspect, MemberDead, MemberLeft} {
+		if state.String() == string(text) {
+			*s = state
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown member state %q", text)
+}
+
+type Member struct {
+	Name        string      `json:"name"`
+	Addr        string      `json:"addr"`
+	APIAddr     string      `json:"api_addr,omitempty"`
+	State       MemberState `json:"state"`
+	Incarnation uint64      `json:"incarnation"`
+	Since       time.Time   `json:"since"`
+}
+
+type GossipConfig struct {
+	Name     string
+	BindAddr string
+	// APIAddr is the HTTP base URL other nodes use to reach this node's
+	// cache API; it is spread with the membership.
+	APIAddr string
+	// HandoffAPIKey is sent when GossipCluster hands keys to members that
+	// require API keys. It needs SecretKey, so only verified members get it.
+	HandoffAPIKey string
+	// SecretKey authenticates every packet with HMAC-SHA256, and packets
+	// without a valid MAC are dropped. Without it anyone who can reach
+	// BindAddr can join and advertise an APIAddr of their choosing.
+	SecretKey []byte
+
+	ProbeInterval    time.Duration
+	ProbeTimeout     time.Duration
+	SuspicionTimeout time.Duration
+	IndirectChecks   int
+	RetransmitMult   int
+	DeadRetention    time.Duration
+
+	// OnChange is called, outside any lock, whenever the set of members
+	// owning keys changes.
+	OnChange func(members []Member)
+}
+
+const (
+	gossipPing    = "ping"
+	gossipPingReq = "ping-req"
+	gossipAck     = "ack"
+	gossipJoin    = "join"
+	gossipSync    = "sync"
+	gossipUpdate  = "gossip"
+
+	maxPiggyback   = 16
+	gossipMaxBytes = 64 * 1024
+
+	// minGossipSecret is the shortest SecretKey accepted, in bytes.
+	minGossipSecret = 16
+)
+
+type gossipMessage struct {
+	Type       string         `json:"type"`
+	Seq        uint64         `json:"seq,omitempty"`
+	From       string         `json:"from"`
+	Target     string         `json:"target,omitempty"`
+	TargetAddr string         `json:"target_addr,omitempty"`
+	Updates    []memberUpdate `json:"updates,omitempty"`
+}
+
+type memberUpdate struct {
+	Name        string      `json:"name"`
+	Addr        string      `json:"addr"`
+	APIAddr     string      `json:"api_addr,omitempty"`
+	State       MemberState `json:"state"`
+	Incarnation uint64      `json:"incarnation"`
+}
+
+type queuedUpdate struct {
+	update    memberUpdate
+	transmits int
+}
+
+// Gossip implements SWIM-style membership: periodic randomised probing with
+// indirect ping-req checks, a suspicion phase that the suspect can refute by
+// raising its incarnation, and piggybacked dissemination of state changes.
+type Gossip struct {
+	cfg  GossipConfig
+	conn *net.UDPConn
+
+	mu         sync.Mutex
+	self       *Member
+	members    map[string]*Member
+	suspicions map[string]*time.Timer
+	probeOrder []string
+	probeIndex int
+	seq        uint64
+	acks       map[uint64]chan struct{}
+	queue      []*queuedUpdate
+	ring       *HashRing
+	rng        *rand.Rand
+	leaving    bool
+
+	stopCh  chan struct{}
+	stopped bool
+	wg      sync.WaitGroup
+}
+
+func NewGossip(cfg GossipConfig) (*Gossip, error) {
+	if cfg.Name == "" {
+		return nil, errors.New("gossip: node name is required")
+	}
+	if cfg.BindAddr == "" {
+		cfg.BindAddr = "127.0.0.1:7946"
+	}
+	if cfg.SecretKey != nil && len(cfg.SecretKey) < minGossipSecret {
+		return nil, fmt.Errorf("gossip: secret key must be at least %d bytes", minGossipSecret)
+	}
+	if cfg.ProbeInterval <= 0 {
+		cfg.ProbeInterval = time.Second
+	}
+	if cfg.ProbeTimeout <= 0 {
+		cfg.ProbeTimeout = cfg.ProbeInterval / 2
+	}
+	if cfg.SuspicionTimeout <= 0 {
+		cfg.SuspicionTimeout = 5 * cfg.ProbeInterval
+	}
+	if cfg.IndirectChecks <= 0 {
+		cfg.IndirectChecks = 3
+	}
+	if cfg.RetransmitMult <= 0 {
+		cfg.RetransmitMult = 4
+	}
+	if cfg.DeadRetention <= 0 {
+		cfg.DeadRetention = 30 * time.Second
+	}
+
+	udpAddr, err := net.ResolveUDPAddr("udp", cfg.BindAddr)
+	if err != nil {
+		return nil, fmt.Errorf("gossip: resolve %s: %w", cfg.BindAddr, err)
+	}
+	conn, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		return nil, fmt.Errorf("gossip: listen %s: %w", cfg.BindAddr, err)
+	}
+
+	self := &Member{
+		Name:    cfg.Name,
+		Addr:    conn.LocalAddr().String(),
+		APIAddr: cfg.APIAddr,
+		State:   MemberAlive,
+		Since:   time.Now(),
+		// Starting from the clock lets a restarted node outrank the dead
+		// record the cluster still holds for its previous life.
+		Incarnation: uint64(time.Now().UnixNano()),
+	}
+
+	g := &Gossip{
+		cfg:        cfg,
+		conn:       conn,
+		self:       self,
+		members:    map[string]*Member{self.Name: self},
+		suspicions: make(map[string]*time.Timer),
+		acks:       make(map[uint64]chan struct{}),
+		rng:        rand.New(rand.NewSource(time.Now().UnixNano())),
+		stopCh:     make(chan struct{}),
+	}
+	g.rebuildRing()
+
+	g.wg.Add(3)
+	go g.receiveLoop()
+	go g.probeLoop()
+	go g.reapLoop()
+
+	return g, nil
+}
+
+func (g *Gossip) LocalMember() Member {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return *g.self
+}
+
+// Members returns every known member, including dead ones that have not been
+// reaped yet, sorted by name.
+func (g *Gossip) Members() []Member {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	members := make([]Member, 0, len(g.members))
+	for _, m := range g.members {
+		members = append(members, *m)
+	}
+	sort.Slice(members, func(i, j int) bool { return members[i].Name < members[j].Name })
+	return members
+}
+
+// Owner returns the member responsible for key. Suspect members keep their
+// keys until they are declared dead.
+func (g *Gossip) Owner(key string) (Member, bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	name := g.ring.Owner(key)
+	if m, ok := g.members[name]; ok {
+		return *m, true
+	}
+	return Member{}, false
+}
+
+// Join contacts the seed nodes and merges their view of the cluster. It
+// succeeds if at least one seed answers.
+func (g *Gossip) Join(seeds []string, timeout time.Duration) error {
+	if len(seeds) == 0 {
+		return nil
+	}
+
+	g.mu.Lock()
+	selfUpdate := g.updateFor(g.self)
+	g.mu.Unlock()
+
+	var lastErr error
+	for _, seed := range seeds {
+		if seed == g.self.Addr {
+			continue
+		}
+		g.mu.Lock()
+		g.seq++
+		seq := g.seq
+		ch := make(chan struct{}, 1)
+		g.acks[seq] = ch
+		g.mu.Unlock()
+
+		msg := gossipMessage{Type: gossipJoin, Seq: seq, Updates: []memberUpdate{selfUpdate}}
+		if err := g.send(seed, msg); err != nil {
+			lastErr = err
+			g.clearAck(seq)
+			continue
+		}
+
+		select {
+		case <-ch:
+			g.clearAck(seq)
+			return nil
+		case <-time.After(timeout):
+			g.clearAck(seq)
+			lastErr = fmt.Errorf("gossip: seed %s did not answer", seed)
+		}
+	}
+	if lastErr == nil {
+		return nil
+	}
+	return lastErr
+}
+
+// Leave announces a graceful departure and stops the node.
+func (g *Gossip) Leave(timeout time.Duration) error {
+	g.mu.Lock()
+	g.leaving = true
+	g.self.Incarnation++
+	g.self.State = MemberLeft
+	update := g.updateFor(g.self)
+	var targets []string
+	for _, m := range g.members {
+		if m.Name != g.self.Name && (m.State == MemberAlive || m.State == MemberSuspect) {
+			targets = append(targets, m.Addr)
+		}
+	}
+	g.mu.Unlock()
+
+	msg := gossipMessage{Type: gossipUpdate, Updates: []memberUpdate{update}}
+	deadline := time.Now().Add(timeout)
+	// UDP may drop a datagram; repeat a few times within the timeout.
+	for i := 0; i < 3 && time.Now().Before(deadline); i++ {
+		for _, addr := range targets {
+			g.send(addr, msg)
+		}
+		time.Sleep(timeout / 4)
+	}
+	return g.Stop()
+}
+
+func (g *Gossip) Stop() error {
+	g.mu.Lock()
+	if g.stopped {
+		g.mu.Unlock()
+		return nil
+	}
+	g.stopped = true
+	close(g.stopCh)
+	for _, t := range g.suspicions {
+		t.Stop()
+	}
+	g.mu.Unlock()
+
+	err := g.conn.Close()
+	g.wg.Wait()
+	return err
+}
+
+func (g *Gossip) receiveLoop() {
+	defer g.wg.Done()
+
+	buf := make([]byte, gossipMaxBytes)
+	for {
+		n, from, err := g.conn.ReadFromUDP(buf)
+		if err != nil {
+			select {
+			case <-g.stopCh:
+				return
+			default:
+				continue
+			}
+		}
+
+		data, ok := g.open(buf[:n])
+		if !ok {
+			continue
+		}
+		var msg gossipMessage
+		if err := json.Unmarshal(data, &msg); err != nil {
+			continue
+		}
+		g.handleMessage(msg, from.String())
+	}
+}
+
+func (g *Gossip) handleMessage(msg gossipMessage, from string) {
+	for _, u := range msg.Updates {
+		g.applyUpdate(u)
+	}
+
+	switch msg.Type {
+	case gossipPing:
+		if msg.Target != "" && msg.Target != g.cfg.Name {
+			return
+		}
+		g.send(from, gossipMessage{Type: gossipAck, Seq: msg.Seq})
+	case gossipPingReq:
+		g.indirectPing(msg, from)
+	case gossipAck:
+		g.mu.Lock()
+		ch, ok := g.acks[msg.Seq]
+		g.mu.Unlock()
+		if ok {
+			select {
+			case ch <- struct{}{}:
+			default:
+			}
+		}
+	case gossipJoin:
+		g.mu.Lock()
+		updates := make([]memberUpdate, 0, len(g.members))
+		for _, m := range g.members {
+			updates = append(updates, g.updateFor(m))
+		}
+		g.mu.Unlock()
+		g.send(from, gossipMessage{Type: gossipSync, Seq: msg.Seq, Updates: updates})
+	case gossipSync:
+		g.mu.Lock()
+		ch, ok := g.acks[msg.Seq]
+		g.mu.Unlock()
+		if ok {
+			select {
+			case ch <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+// indirectPing probes msg.Target on behalf of another node and relays the
+// ack back under the requester's sequence number.
+func (g *Gossip) indirectPing(msg gossipMessage, requester string) {
+	g.mu.Lock()
+	g.seq++
+	seq := g.seq
+	ch := make(chan struct{}, 1)
+	g.acks[seq] = ch
+	g.mu.Unlock()
+
+	if err := g.send(msg.TargetAddr, gossipMessage{Type: gossipPing, Seq: seq, Target: msg.Target}); err != nil {
+		g.clearAck(seq)
+		return
+	}
+
+	g.wg.Add(1)
+	go func() {
+		defer g.wg.Done()
+		defer g.clearAck(seq)
+		select {
+		case <-ch:
+			g.send(requester, gossipMessage{Type: gossipAck, Seq: msg.Seq})
+		case <-time.After(g.cfg.ProbeTimeout):
+		case <-g.stopCh:
+		}
+	}()
+}
+
+func (g *Gossip) probeLoop() {
+	defer g.wg.Done()
+
+	ticker := time.NewTicker(g.cfg.ProbeInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			g.probe()
+		case <-g.stopCh:
+			return
+		}
+	}
+}
+
+func (g *Gossip) probe() {
+	target, ok := g.nextProbeTarget()
+	if !ok {
+		return
+	}
+
+	g.mu.Lock()
+	g.seq++
+	seq := g.seq
+	ch := make(chan struct{}, 1)
+	g.acks[seq] = ch
+	g.mu.Unlock()
+	defer g.clearAck(seq)
+
+	g.send(target.Addr, gossipMessage{Type: gossipPing, Seq: seq, Target: target.Name})
+	select {
+	case <-ch:
+		return
+	case <-time.After(g.cfg.ProbeTimeout):
+	case <-g.stopCh:
+		return
+	}
+
+	for _, helper := range g.randomMembers(g.cfg.IndirectChecks, target.Name) {
+		g.send(helper.Addr, gossipMessage{
+			Type:       gossipPingReq,
+			Seq:        seq,
+			Target:     target.Name,
+			TargetAddr: target.Addr,
+		})
+	}
+
+	wait := g.cfg.ProbeInterval - g.cfg.ProbeTimeout
+	if wait < g.cfg.ProbeTimeout {
+		wait = g.cfg.ProbeTimeout
+	}
+	select {
+	case <-ch:
+		return
+	case <-time.After(wait):
+	case <-g.stopCh:
+		return
+	}
+
+	g.applyUpdate(memberUpdate{
+		Name:        target.Name,
+		Addr:        target.Addr,
+		APIAddr:     target.APIAddr,
+		State:       MemberSuspect,
+		Incarnation: target.Incarnation,
+	})
+}
+
+// nextProbeTarget walks a shuffled member list round-robin, reshuffling after
+// each pass, so every member is probed within a bounded number of rounds.
+func (g *Gossip) nextProbeTarget() (Member, bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	for attempts := 0; attempts < 2; attempts++ {
+		for g.probeIndex < len(g.probeOrder) {
+			name := g.probeOrder[g.probeIndex]
+			g.probeIndex++
+			if m, ok := g.members[name]; ok && m.Name != g.self.Name &&
+				(m.State == MemberAlive || m.State == MemberSuspect) {
+				return *m, true
+			}
+		}
+
+		g.probeOrder = g.probeOrder[:0]
+		for name := range g.members {
+			g.probeOrder = append(g.probeOrder, name)
+		}
+		g.rng.Shuffle(len(g.probeOrder), func(i, j int) {
+			g.probeOrder[i], g.probeOrder[j] = g.probeOrder[j], g.probeOrder[i]
+		})
+		g.probeIndex = 0
+	}
+	return Member{}, false
+}
+
+func (g *Gossip) randomMembers(k int, exclude string) []Member {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	var candidates []Member
+	for _, m := range g.members {
+		if m.Name != g.self.Name && m.Name != exclude && m.State == MemberAlive {
+			candidates = append(candidates, *m)
+		}
+	}
+	g.rng.Shuffle(len(candidates), func(i, j int) {
+		candidates[i], candidates[j] = candidates[j], candidates[i]
+	})
+	if len(candidates) > k {
+		candidates = candidates[:k]
+	}
+	return candidates
+}
+
+// applyUpdate merges a membership update using SWIM's precedence rules:
+// alive needs a strictly newer incarnation, suspect wins over alive at the
+// same incarnation, and dead or left wins over both.
+func (g *Gossip) applyUpdate(u memberUpdate) {
+	g.mu.Lock()
+
+	if u.Name == g.self.Name {
+		if u.State != MemberAlive && !g.leaving && u.Incarnation >= g.self.Incarnation {
+			// Someone suspects us or thinks we are gone: refute.
+			g.self.Incarnation = u.Incarnation + 1
+			g.enqueue(g.updateFor(g.self))
+		}
+		g.mu.Unlock()
+		return
+	}
+
+	m, known := g.members[u.Name]
+	accept := false
+	switch u.State {
+	case MemberAlive:
+		accept = !known || u.Incarnation > m.Incarnation
+	case MemberSuspect:
+		accept = known && ((m.State == MemberAlive && u.Incarnation >= m.Incarnation) ||
+			(m.State == MemberSuspect && u.Incarnation > m.Incarnation))
+	case MemberDead, MemberLeft:
+		accept = known && (m.State == MemberAlive || m.State == MemberSuspect) && u.Incarnation >= m.Incarnation
+	}
+	if !accept {
+		g.mu.Unlock()
+		return
+	}
+
+	if !known {
+		m = &Member{Name: u.Name}
+		g.members[u.Name] = m
+	}
+	wasOwner := known && (m.State == MemberAlive || m.State == MemberSuspect)
+	m.Addr = u.Addr
+	m.APIAddr = u.APIAddr
+	m.Incarnation = u.Incarnation
+	if m.State != u.State || !known {
+		m.Since = time.Now()
+	}
+	m.State = u.State
+
+	if t, ok := g.suspicions[u.Name]; ok {
+		t.Stop()
+		delete(g.suspicions, u.Name)
+	}
+	if u.State == MemberSuspect && !g.stopped {
+		name, inc := u.Name, u.Incarnation
+		g.suspicions[name] = time.AfterFunc(g.cfg.SuspicionTimeout, func() {
+			g.suspicionExpired(name, inc)
+		})
+	}
+
+	g.enqueue(u)
+
+	isOwner := u.State == MemberAlive || u.State == MemberSuspect
+	var changed []Member
+	if wasOwner != isOwner {
+		g.rebuildRing()
+		changed = g.ownersLocked()
+	}
+	g.mu.Unlock()
+
+	if changed != nil && g.cfg.OnChange != nil {
+		g.cfg.OnChange(changed)
+	}
+}
+
+func (g *Gossip) suspicionExpired(name string, incarnation uint64) {
+	g.mu.Lock()
+	m, ok := g.members[name]
+	if !ok || m.State != MemberSuspect || m.Incarnation != incarnation {
+		g.mu.Unlock()
+		return
+	}
+	update := g.updateFor(m)
+	g.mu.Unlock()
+
+	update.State = MemberDead
+	g.applyUpdate(update)
+}
+
+func (g *Gossip) reapLoop() {
+	defer g.wg.Done()
+
+	ticker := time.NewTicker(g.cfg.DeadRetention / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			g.mu.Lock()
+			for name, m := range g.members {
+				if (m.State == MemberDead || m.State == MemberLeft) && time.Since(m.Since) > g.cfg.DeadRetention {
+					delete(g.members, name)
+				}
+			}
+			g.mu.Unlock()
+		case <-g.stopCh:
+			return
+		}
+	}
+}
+
+func (g *Gossip) enqueue(u memberUpdate) {
+	for i, q := range g.queue {
+		if q.update.Name == u.Name {
+			g.queue[i] = &queuedUpdate{update: u}
+			return
+		}
+	}
+	g.queue = append(g.queue, &queuedUpdate{update: u})
+}
+
+// piggyback picks the least-sent updates for the next outgoing message and
+// retires those that have been sent enough times to reach every member with
+// high probability.
+func (g *Gossip) piggyback() []memberUpdate {
+	if len(g.queue) == 0 {
+		return nil
+	}
+
+	limit := g.cfg.RetransmitMult * int(math.Ceil(math.Log10(float64(len(g.members)+1))))
+	if limit < 1 {
+		limit = 1
+	}
+
+	sort.SliceStable(g.queue, func(i, j int) bool { return g.queue[i].transmits < g.queue[j].transmits })
+	var updates []memberUpdate
+	kept := g.queue[:0]
+	for _, q := range g.queue {
+		if len(updates) < maxPiggyback {
+			updates = append(updates, q.update)
+			q.transmits++
+		}
+		if q.transmits < limit {
+			kept = append(kept, q)
+		}
+	}
+	g.queue = kept
+	return updates
+}
+
+func (g *Gossip) send(addr string, msg gossipMessage) error {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return err
+	}
+
+	g.mu.Lock()
+	msg.From = g.self.Name
+	if msg.Type != gossipSync && msg.Type != gossipJoin {
+		msg.Updates = append(msg.Updates, g.piggyback()...)
+	}
+	g.mu.Unlock()
+
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	_, err = g.conn.WriteToUDP(g.seal(data), udpAddr)
+	return err
+}
+
+// Authenticated reports whether packets are authenticated with a secret
+// key, so that members are known to share it.
+func (g *Gossip) Authenticated() bool {
+	return len(g.cfg.SecretKey) > 0
+}
+
+// seal prefixes data with its MAC when there is a secret key.
+func (g *Gossip) seal(data []byte) []byte {
+	if !g.Authenticated() {
+		return data
+	}
+	mac := hmac.New(sha256.New, g.cfg.SecretKey)
+	mac.Write(data)
+	return append(mac.Sum(nil), data...)
+}
+
+// open reverses seal, reporting false for a packet whose MAC is missing or
+// wrong.
+func (g *Gossip) open(packet []byte) ([]byte, bool) {
+	if !g.Authenticated() {
+		return packet, true
+	}
+	if len(packet) < sha256.Size {
+		return nil, false
+	}
+	mac := hmac.New(sha256.New, g.cfg.SecretKey)
+	mac.Write(packet[sha256.Size:])
+	if !hmac.Equal(mac.Sum(nil), packet[:sha256.Size]) {
+		return nil, false
+	}
+	return packet[sha256.Size:], true
+}
+
+func (g *Gossip) clearAck(seq uint64) {
+	g.mu.Lock()
+	delete(g.acks, seq)
+	g.mu.Unlock()
+}
+
+func (g *Gossip) updateFor(m *Member) memberUpdate {
+	return memberUpdate{
+		Name:        m.Name,
+		Addr:        m.Addr,
+		APIAddr:     m.APIAddr,
+		State:       m.State,
+		Incarnation: m.Incarnation,
+	}
+}
+
+func (g *Gossip) rebuildRing() {
+	var names []string
+	for _, m := range g.members {
+		if m.State == MemberAlive || m.State == MemberSuspect {
+			names = append(names, m.Name)
+		}
+	}
+	g.ring = NewHashRing(defaultRingReplicas, names)
+}
+
+func (g *Gossip) ownersLocked() []Member {
+	owners := make([]Member, 0, len(g.members))
+	for _, m := range g.members {
+		if m.State == MemberAlive || m.State == MemberSuspect {
+			owners = append(owners, *m)
+		}
+	}
+	sort.Slice(owners, func(i, j int) bool { return owners[i].Name < owners[j].Name })
+	return owners
+}
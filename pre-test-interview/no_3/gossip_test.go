@@ -0,0 +1,351 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func fastGossipConfig(name string) GossipConfig {
+	return GossipConfig{
+		Name:             name,
+		BindAddr:         "127.0.0.1:0",
+		ProbeInterval:    20 * time.Millisecond,
+		ProbeTimeout:     10 * time.Millisecond,
+		SuspicionTimeout: 100 * time.Millisecond,
+		DeadRetention:    time.Minute,
+	}
+}
+
+func startGossip(t *testing.T, cfg GossipConfig) *Gossip {
+	t.Helper()
+	g, err := NewGossip(cfg)
+	if err != nil {
+		t.Fatalf("Failed to start gossip node %s: %v", cfg.Name, err)
+	}
+	t.Cleanup(func() { g.Stop() })
+	return g
+}
+
+func waitMemberState(t *testing.T, g *Gossip, name string, want MemberState) {
+	t.Helper()
+	deadline := time.Now().Add(3 * time.Second)
+	for time.Now().Before(deadline) {
+		for _, m := range g.Members() {
+			if m.Name == name && m.State == want {
+				return
+			}
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("%s: expected member %s to be %s, got %+v", g.LocalMember().Name, name, want, g.Members())
+}
+
+func TestGossip_JoinConverges(t *testing.T) {
+	a := startGossip(t, fastGossipConfig("a"))
+	b := startGossip(t, fastGossipConfig("b"))
+	c := startGossip(t, fastGossipConfig("c"))
+
+	if err := b.Join([]string{a.LocalMember().Addr}, time.Second); err != nil {
+		t.Fatalf("Join failed: %v", err)
+	}
+	if err := c.Join([]string{a.LocalMember().Addr}, time.Second); err != nil {
+		t.Fatalf("Join failed: %v", err)
+	}
+
+	for _, g := range []*Gossip{a, b, c} {
+		for _, name := range []string{"a", "b", "c"} {
+			waitMemberState(t, g, name, MemberAlive)
+		}
+	}
+}
+
+func TestGossip_JoinUnreachableSeed(t *testing.T) {
+	a := startGossip(t, fastGossipConfig("a"))
+	if err := a.Join([]string{"127.0.0.1:1"}, 50*time.Millisecond); err == nil {
+		t.Error("Expected join through an unreachable seed to fail")
+	}
+}
+
+func TestGossip_SecretKey(t *testing.T) {
+	secret := []byte("0123456789abcdef")
+	cfg := fastGossipConfig("a")
+	cfg.SecretKey = secret
+	a := startGossip(t, cfg)
+	cfg = fastGossipConfig("b")
+	cfg.SecretKey = secret
+	b := startGossip(t, cfg)
+	cfg = fastGossipConfig("intruder")
+	cfg.SecretKey = []byte("not-the-secret!!")
+	intruder := startGossip(t, cfg)
+	plain := startGossip(t, fastGossipConfig("plain"))
+
+	if err := b.Join([]string{a.LocalMember().Addr}, time.Second); err != nil {
+		t.Fatalf("Join with the secret failed: %v", err)
+	}
+	waitMemberState(t, a, "b", MemberAlive)
+	for _, g := range []*Gossip{intruder, plain} {
+		if err := g.Join([]string{a.LocalMember().Addr}, 100*time.Millisecond); err == nil {
+			t.Errorf("Expected %s to be unable to join", g.LocalMember().Name)
+		}
+	}
+	for _, m := range a.Members() {
+		if m.Name == "intruder" || m.Name == "plain" {
+			t.Errorf("Expected only members with the secret, got %+v", a.Members())
+		}
+	}
+
+	if _, err := NewGossip(GossipConfig{Name: "c", BindAddr: "127.0.0.1:0", SecretKey: []byte("short")}); err == nil {
+		t.Error("Expected a short secret to be rejected")
+	}
+}
+
+func TestGossipCluster_HandoffKeyNeedsSecret(t *testing.T) {
+	cfg := fastGossipConfig("a")
+	cfg.APIAddr = "http://127.0.0.1:1"
+	cfg.HandoffAPIKey = "peer-secret"
+	if _, err := NewGossipCluster(NewSimpleCache(), cfg); err == nil {
+		t.Error("Expected a handoff API key without a gossip secret to be rejected")
+	}
+}
+
+func TestGossip_DetectsFailure(t *testing.T) {
+	var mu sync.Mutex
+	var views [][]Member
+	cfg := fastGossipConfig("a")
+	cfg.OnChange = func(members []Member) {
+		mu.Lock()
+		defer mu.Unlock()
+		views = append(views, members)
+	}
+
+	a := startGossip(t, cfg)
+	b := startGossip(t, fastGossipConfig("b"))
+	c := startGossip(t, fastGossipConfig("c"))
+	b.Join([]string{a.LocalMember().Addr}, time.Second)
+	c.Join([]string{a.LocalMember().Addr}, time.Second)
+	waitMemberState(t, a, "c", MemberAlive)
+	waitMemberState(t, b, "c", MemberAlive)
+
+	c.Stop()
+
+	waitMemberState(t, a, "c", MemberDead)
+	waitMemberState(t, b, "c", MemberDead)
+
+	for i := 0; i < 100; i++ {
+		if owner, _ := a.Owner(fmt.Sprintf("key-%d", i)); owner.Name == "c" {
+			t.Fatalf("Dead member still owns key-%d", i)
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(views) == 0 || len(views[len(views)-1]) != 2 {
+		t.Errorf("Expected OnChange to report two owners after failure, got %v", views)
+	}
+}
+
+func TestGossip_SuspectRefutes(t *testing.T) {
+	a := startGossip(t, fastGossipConfig("a"))
+	b := startGossip(t, fastGossipConfig("b"))
+	b.Join([]string{a.LocalMember().Addr}, time.Second)
+	waitMemberState(t, a, "b", MemberAlive)
+
+	before := b.LocalMember().Incarnation
+	var self Member
+	for _, m := range a.Members() {
+		if m.Name == "b" {
+			self = m
+		}
+	}
+	a.applyUpdate(memberUpdate{Name: "b", Addr: self.Addr, State: MemberSuspect, Incarnation: self.Incarnation})
+
+	deadline := time.Now().Add(3 * time.Second)
+	for b.LocalMember().Incarnation == before {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected b to refute the suspicion by raising its incarnation")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	waitMemberState(t, a, "b", MemberAlive)
+}
+
+func TestGossip_Leave(t *testing.T) {
+	a := startGossip(t, fastGossipConfig("a"))
+	b := startGossip(t, fastGossipConfig("b"))
+	b.Join([]string{a.LocalMember().Addr}, time.Second)
+	waitMemberState(t, a, "b", MemberAlive)
+
+	if err := b.Leave(100 * time.Millisecond); err != nil {
+		t.Fatalf("Leave failed: %v", err)
+	}
+	waitMemberState(t, a, "b", MemberLeft)
+}
+
+func TestHashRing_MinimalMovement(t *testing.T) {
+	before := NewHashRing(defaultRingReplicas, []string{"a", "b", "c"})
+	after := NewHashRing(defaultRingReplicas, []string{"a", "b", "c", "d"})
+
+	counts := make(map[string]int)
+	moved := 0
+	const keys = 10000
+	for i := 0; i < keys; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		counts[before.Owner(key)]++
+		if o := after.Owner(key); o != before.Owner(key) && o != "d" {
+			t.Fatalf("Key %s moved between surviving nodes", key)
+		} else if o == "d" {
+			moved++
+		}
+	}
+	for node, n := range counts {
+		if n < keys/6 {
+			t.Errorf("Node %s owns only %d of %d keys", node, n, keys)
+		}
+	}
+	if moved < keys/8 || moved > keys/2 {
+		t.Errorf("Expected roughly a quarter of keys to move to the new node, got %d", moved)
+	}
+}
+
+type gossipTestNode struct {
+	cache   *TTLCache
+	cluster *GossipCluster
+	server  *httptest.Server
+}
+
+func startGossipTestNode(t *testing.T, name string) *gossipTestNode {
+	t.Helper()
+
+	cache, err := NewTTLCache(time.Hour)
+	if err != nil {
+		t.Fatalf("Failed to create cache: %v", err)
+	}
+	t.Cleanup(func() { cache.Close() })
+	node := &gossipTestNode{cache: cache}
+	var handler http.Handler
+	node.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handler.ServeHTTP(w, r)
+	}))
+	t.Cleanup(node.server.Close)
+
+	cfg := fastGossipConfig(name)
+	cfg.APIAddr = node.server.URL
+	cluster, err := NewGossipCluster(node.cache, cfg)
+	if err != nil {
+		t.Fatalf("Failed to start cluster node %s: %v", name, err)
+	}
+	t.Cleanup(func() { cluster.Gossip().Stop() })
+	node.cluster = cluster
+
+	server := NewServer(node.cache, nil)
+	server.SetCluster(cluster)
+	handler = server.setupRoutes()
+	return node
+}
+
+func TestGossipCluster_RebalancesOnJoin(t *testing.T) {
+	a := startGossipTestNode(t, "a")
+	for i := 0; i < 50; i++ {
+		a.cache.Set(fmt.Sprintf("key-%d", i), "value")
+	}
+
+	b := startGossipTestNode(t, "b")
+	if err := b.cluster.Gossip().Join([]string{a.cluster.Gossip().LocalMember().Addr}, time.Second); err != nil {
+		t.Fatalf("Join failed: %v", err)
+	}
+	waitMemberState(t, a.cluster.Gossip(), "b", MemberAlive)
+
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		misplaced := 0
+		for _, key := range a.cache.Keys() {
+			if _, local := a.cluster.Owner(key); !local {
+				misplaced++
+			}
+		}
+		if misplaced == 0 && len(b.cache.Keys()) > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Keys were not handed off: %d still misplaced on a, b has %d", misplaced, len(b.cache.Keys()))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if total := len(a.cache.Keys()) + len(b.cache.Keys()); total != 50 {
+		t.Errorf("Expected 50 keys across the cluster, got %d", total)
+	}
+
+	// Requests for keys owned elsewhere are redirected to the owner.
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	key := b.cache.Keys()[0]
+	resp, err := client.Get(a.server.URL + "/api/cache/get?key=" + key)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusTemporaryRedirect || resp.Header.Get("X-Cache-Owner") != "b" {
+		t.Errorf("Expected redirect to b, got %d owner=%q", resp.StatusCode, resp.Header.Get("X-Cache-Owner"))
+	}
+
+	resp, err = http.Get(a.server.URL + "/api/cluster/members")
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected 200 from members endpoint, got %d", resp.StatusCode)
+	}
+}
+
+func TestGossipCluster_DrainsOnClose(t *testing.T) {
+	a := startGossipTestNode(t, "a")
+	b := startGossipTestNode(t, "b")
+	b.cluster.Gossip().Join([]string{a.cluster.Gossip().LocalMember().Addr}, time.Second)
+	waitMemberState(t, b.cluster.Gossip(), "a", MemberAlive)
+
+	for i := 0; i < 20; i++ {
+		b.cache.Set(fmt.Sprintf("drain-%d", i), "value")
+	}
+	if err := b.cluster.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	for i := 0; i < 20; i++ {
+		if _, exists, _ := a.cache.Get(fmt.Sprintf("drain-%d", i)); !exists {
+			t.Fatalf("Expected drain-%d to be handed to a", i)
+		}
+	}
+	waitMemberState(t, a.cluster.Gossip(), "b", MemberLeft)
+}
+
+func TestGossipCluster_HandoffKeepsExpiryAndVersion(t *testing.T) {
+	a := startGossipTestNode(t, "a")
+	b := startGossipTestNode(t, "b")
+	b.cluster.Gossip().Join([]string{a.cluster.Gossip().LocalMember().Addr}, time.Second)
+	waitMemberState(t, b.cluster.Gossip(), "a", MemberAlive)
+
+	sent, _, err := b.cache.UpsertWithTTL(context.Background(), "session", "value", 2*time.Minute, nil)
+	if err != nil {
+		t.Fatalf("UpsertWithTTL failed: %v", err)
+	}
+	b.cache.Set("list", ListValue{"x", "y"})
+	if err := b.cluster.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	got, exists, _ := a.cache.GetEntry("session")
+	if !exists {
+		t.Fatal("Expected session to be handed to a")
+	}
+	if got.Version != sent.Version || !got.Expires.Equal(sent.Expires) {
+		t.Errorf("Expected version %d expiring %s, got %d expiring %s", sent.Version, sent.Expires, got.Version, got.Expires)
+	}
+	if v, _, _ := a.cache.Get("list"); !reflect.DeepEqual(v, ListValue{"x", "y"}) {
+		t.Errorf("Expected the list to keep its type, got %#v", v)
+	}
+}
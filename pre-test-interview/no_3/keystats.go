@@ -0,0 +1,287 @@
+package main
+
+import (
+	"container/heap"
+	"hash/maphash"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// keyStatsSlices is how many slices a window is split into. Traffic ages
+	// out a slice at a time, and queries round windows up to whole slices.
+	keyStatsSlices = 10
+	// trackedKeys is how many keys each slice keeps as candidates for the
+	// top lists.
+	trackedKeys = 100
+
+	sketchDepth = 4
+	sketchWidth = 1 << 11
+
+	defaultKeyStatsWindow = 5 * time.Minute
+)
+
+// countMinSketch estimates how often each key was seen in fixed memory.
+// Estimates never undercount, and overcount by at most about e/sketchWidth
+// of all the keys seen, with conservative updates keeping them closer.
+type countMinSketch [sketchDepth][sketchWidth]uint32
+
+// cells returns the counter of h in each row, by double hashing.
+func (s *countMinSketch) cells(h uint64) [sketchDepth]uint32 {
+	var idx [sketchDepth]uint32
+	h1, h2 := uint32(h), uint32(h>>32)|1
+	for i := range idx {
+		idx[i] = (h1 + uint32(i)*h2) & (sketchWidth - 1)
+	}
+	return idx
+}
+
+// add counts h once and returns its new estimate.
+func (s *countMinSketch) add(h uint64) uint32 {
+	idx := s.cells(h)
+	n := uint32(math.MaxUint32)
+	for i, j := range idx {
+		n = min(n, s[i][j])
+	}
+	if n < math.MaxUint32 {
+		n++
+	}
+	for i, j := range idx {
+		if s[i][j] < n {
+			s[i][j] = n
+		}
+	}
+	return n
+}
+
+func (s *countMinSketch) estimate(h uint64) uint32 {
+	n := uint32(math.MaxUint32)
+	for i, j := range s.cells(h) {
+		n = min(n, s[i][j])
+	}
+	return n
+}
+
+// topK keeps the keys with the largest values offered, up to limit, in a
+// min-heap so the smallest is the one to replace.
+type topK struct {
+	limit int
+	items []topKItem
+	index map[string]int
+}
+
+type topKItem struct {
+	key   string
+	value uint64
+}
+
+func newTopK(limit int) topK {
+	return topK{limit: limit, index: make(map[string]int, limit)}
+}
+
+func (t *topK) Len() int           { return len(t.items) }
+func (t *topK) Less(i, j int) bool { return t.items[i].value < t.items[j].value }
+
+func (t *topK) Swap(i, j int) {
+	t.items[i], t.items[j] = t.items[j], t.items[i]
+	t.index[t.items[i].key] = i
+	t.index[t.items[j].key] = j
+}
+
+func (t *topK) Push(x interface{}) {
+	item := x.(topKItem)
+	t.index[item.key] = len(t.items)
+	t.items = append(t.items, item)
+}
+
+func (t *topK) Pop() interface{} {
+	item := t.items[len(t.items)-1]
+	t.items = t.items[:len(t.items)-1]
+	delete(t.index, item.key)
+	return item
+}
+
+// offer sets key's value, keeping it if it is among the largest.
+func (t *topK) offer(key string, value uint64) {
+	if i, ok := t.index[key]; ok {
+		t.items[i].value = value
+		heap.Fix(t, i)
+		return
+	}
+	if len(t.items) < t.limit {
+		heap.Push(t, topKItem{key: key, value: value})
+		return
+	}
+	if value <= t.items[0].value {
+		return
+	}
+	delete(t.index, t.items[0].key)
+	t.items[0] = topKItem{key: key, value: value}
+	t.index[key] = 0
+	heap.Fix(t, 0)
+}
+
+func (t *topK) reset() {
+	t.items = t.items[:0]
+	clear(t.index)
+}
+
+// keyStats tracks the most accessed and the largest keys over a sliding
+// window. Recording costs a hash, a few counter updates and a heap fix under
+// one lock, and memory stays fixed however many keys there are.
+type keyStats struct {
+	window time.Duration
+	slice  time.Duration
+	seed   maphash.Seed
+	now    func() time.Time
+
+	mu     sync.Mutex
+	slices [keyStatsSlices]keyStatsSlice
+}
+
+// keyStatsSlice is the traffic of one slice of the window. Hot holds the
+// sketch's estimates of its candidates; big the last size seen of each.
+type keyStatsSlice struct {
+	id       int64
+	accesses uint64
+	sketch   countMinSketch
+	hot      topK
+	big      topK
+}
+
+// hotKey is a key with the estimated number of times it was accessed.
+type hotKey struct {
+	Key   string `json:"key"`
+	Count uint64 `json:"count"`
+}
+
+// bigKey is a key with the size of its value when last seen.
+type bigKey struct {
+	Key   string `json:"key"`
+	Bytes uint64 `json:"bytes"`
+}
+
+func newKeyStats(window time.Duration) *keyStats {
+	k := &keyStats{
+		window: window,
+		slice:  max(window/keyStatsSlices, time.Millisecond),
+		seed:   maphash.MakeSeed(),
+		now:    time.Now,
+	}
+	for i := range k.slices {
+		k.slices[i].id = -1
+		k.slices[i].hot = newTopK(trackedKeys)
+		k.slices[i].big = newTopK(trackedKeys)
+	}
+	return k
+}
+
+// record counts an access to key and, if size is positive, notes the size
+// of its value.
+func (k *keyStats) record(key string, size int64) {
+	h := maphash.String(k.seed, key)
+	now := k.now()
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	s := k.current(now)
+	s.accesses++
+	s.hot.offer(key, uint64(s.sketch.add(h)))
+	if size > 0 {
+		s.big.offer(key, uint64(size))
+	}
+}
+
+func (k *keyStats) sliceID(now time.Time) int64 {
+	return now.UnixNano() / int64(k.slice)
+}
+
+// current returns the slice of now, clearing it if it last held traffic
+// from a window ago.
+func (k *keyStats) current(now time.Time) *keyStatsSlice {
+	id := k.sliceID(now)
+	s := &k.slices[id%keyStatsSlices]
+	if s.id != id {
+		s.id = id
+		s.accesses = 0
+		s.sketch = countMinSketch{}
+		s.hot.reset()
+		s.big.reset()
+	}
+	return s
+}
+
+// recent returns the slices of the last window, oldest first.
+func (k *keyStats) recent(window time.Duration) []*keyStatsSlice {
+	n := int64(min(max((window+k.slice-1)/k.slice, 1), keyStatsSlices))
+	last := k.sliceID(k.now())
+	var slices []*keyStatsSlice
+	for id := last - n + 1; id <= last; id++ {
+		if s := &k.slices[id%keyStatsSlices]; s.id == id {
+			slices = append(slices, s)
+		}
+	}
+	return slices
+}
+
+// hot returns up to limit of the keys accessed most in the last window,
+// and the number of accesses in it. A key is only found if it was among
+// the most accessed in at least one slice.
+func (k *keyStats) hot(window time.Duration, limit int) ([]hotKey, uint64) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	slices := k.recent(window)
+
+	var accesses uint64
+	seen := map[string]bool{}
+	keys := []hotKey{}
+	for _, s := range slices {
+		accesses += s.accesses
+		for _, item := range s.hot.items {
+			if seen[item.key] {
+				continue
+			}
+			seen[item.key] = true
+			h := maphash.String(k.seed, item.key)
+			var count uint64
+			for _, s := range slices {
+				count += uint64(s.sketch.estimate(h))
+			}
+			keys = append(keys, hotKey{Key: item.key, Count: count})
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].Count != keys[j].Count {
+			return keys[i].Count > keys[j].Count
+		}
+		return keys[i].Key < keys[j].Key
+	})
+	return keys[:min(limit, len(keys))], accesses
+}
+
+// big returns up to limit of the keys with the largest values seen in the
+// last window, by the size each had when last seen.
+func (k *keyStats) big(window time.Duration, limit int) []bigKey {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	sizes := map[string]uint64{}
+	for _, s := range k.recent(window) {
+		for _, item := range s.big.items {
+			sizes[item.key] = item.value
+		}
+	}
+	keys := make([]bigKey, 0, len(sizes))
+	for key, size := range sizes {
+		keys = append(keys, bigKey{Key: key, Bytes: size})
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].Bytes != keys[j].Bytes {
+			return keys[i].Bytes > keys[j].Bytes
+		}
+		return keys[i].Key < keys[j].Key
+	})
+	return keys[:min(limit, len(keys))]
+}
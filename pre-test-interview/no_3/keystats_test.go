@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestKeyStats(window time.Duration) (*keyStats, *time.Time) {
+	now := time.Unix(1_700_000_000, 0)
+	k := newKeyStats(window)
+	k.now = func() time.Time { return now }
+	return k, &now
+}
+
+func TestKeyStats_HotKeys(t *testing.T) {
+	k, _ := newTestKeyStats(time.Minute)
+	for i := 0; i < 1000; i++ {
+		k.record("hot", 0)
+		if i%3 == 0 {
+			k.record("warm", 0)
+		}
+		// Far more distinct keys than are tracked, seen once or twice.
+		k.record(fmt.Sprintf("cold:%d", i%700), 0)
+	}
+
+	keys, accesses := k.hot(time.Minute, 2)
+	if accesses != 2334 || len(keys) != 2 {
+		t.Fatalf("Expected 2 keys of 2334 accesses, got %v of %d", keys, accesses)
+	}
+	if keys[0].Key != "hot" || keys[0].Count < 1000 || keys[0].Count > 1010 {
+		t.Errorf("Expected hot first with about 1000, got %+v", keys[0])
+	}
+	if keys[1].Key != "warm" || keys[1].Count < 334 || keys[1].Count > 344 {
+		t.Errorf("Expected warm second with about 334, got %+v", keys[1])
+	}
+}
+
+func TestKeyStats_Window(t *testing.T) {
+	k, now := newTestKeyStats(time.Minute)
+	k.record("old", 5000)
+	*now = now.Add(30 * time.Second)
+	k.record("new", 10)
+	k.record("new", 20)
+	k.record("old", 0)
+
+	if keys, _ := k.hot(time.Minute, 10); len(keys) != 2 || keys[0].Key != "new" || keys[1].Count != 2 {
+		t.Errorf("Expected both keys over the whole window, got %v", keys)
+	}
+	if keys, accesses := k.hot(10*time.Second, 10); accesses != 3 || keys[1].Count != 1 {
+		t.Errorf("Expected only the last slice, got %v of %d", keys, accesses)
+	}
+	big := k.big(time.Minute, 10)
+	if len(big) != 2 || big[0] != (bigKey{"old", 5000}) || big[1] != (bigKey{"new", 20}) {
+		t.Errorf("Expected old then the last size of new, got %v", big)
+	}
+
+	// Traffic ages out a slice at a time.
+	*now = now.Add(45 * time.Second)
+	if keys, _ := k.hot(time.Minute, 10); len(keys) != 2 || keys[1] != (hotKey{"old", 1}) {
+		t.Errorf("Expected only the later traffic, got %v", keys)
+	}
+	if big := k.big(time.Minute, 10); len(big) != 1 || big[0].Key != "new" {
+		t.Errorf("Expected the old size to have aged out, got %v", big)
+	}
+	*now = now.Add(time.Minute)
+	if keys, accesses := k.hot(time.Minute, 10); len(keys) != 0 || accesses != 0 {
+		t.Errorf("Expected nothing after a window, got %v", keys)
+	}
+}
+
+func TestServer_HotAndBigKeys(t *testing.T) {
+	ts := newTestServer(t, NewSimpleCache())
+	big := `"` + strings.Repeat("x", 5000) + `"`
+	doRequest(t, http.MethodPut, ts.URL+"/api/v2/keys/big", "application/json", big)
+	doRequest(t, http.MethodPut, ts.URL+"/api/v2/keys/small", "application/json", `"x"`)
+	for i := 0; i < 5; i++ {
+		doRequest(t, http.MethodGet, ts.URL+"/api/v2/keys/small", "", "")
+	}
+	doRequest(t, http.MethodGet, ts.URL+"/api/cache/get?key=missing", "", "")
+	doRequest(t, http.MethodGet, ts.URL+"/health", "", "")
+
+	resp, body := doRequest(t, http.MethodGet, ts.URL+"/api/cache/hotkeys?window=1m", "", "")
+	var hot struct {
+		Accesses uint64   `json:"accesses"`
+		Keys     []hotKey `json:"keys"`
+	}
+	data, _ := json.Marshal(body.Data)
+	json.Unmarshal(data, &hot)
+	if resp.StatusCode != http.StatusOK || hot.Accesses != 8 || len(hot.Keys) != 3 || hot.Keys[0] != (hotKey{"small", 6}) {
+		t.Errorf("Expected small as the hot key of 8 accesses, got %d %+v", resp.StatusCode, hot)
+	}
+
+	_, body = doRequest(t, http.MethodGet, ts.URL+"/api/cache/bigkeys?limit=1", "", "")
+	var bigKeys struct {
+		Keys []bigKey `json:"keys"`
+	}
+	data, _ = json.Marshal(body.Data)
+	json.Unmarshal(data, &bigKeys)
+	if len(bigKeys.Keys) != 1 || bigKeys.Keys[0] != (bigKey{"big", 5000}) {
+		t.Errorf("Expected big with its size, got %+v", bigKeys)
+	}
+
+	for _, query := range []string{"window=1h", "window=-1s", "limit=0", "limit=101"} {
+		if resp, _ := doRequest(t, http.MethodGet, ts.URL+"/api/cache/hotkeys?"+query, "", ""); resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d", query, resp.StatusCode)
+		}
+	}
+}
+
+func TestServer_KeyStatsOnlyCountServedRequests(t *testing.T) {
+	server := NewServer(NewSimpleCache(), nil)
+	server.SetAuth(newTestAuthStore(t), nil)
+	server.SetRateLimiter(NewRateLimiter(RateLimiterConfig{
+		Read:  RateLimit{Limit: 100, Window: time.Second},
+		Write: RateLimit{Limit: 1, Window: time.Minute},
+	}))
+	ts := httptest.NewServer(server.setupRoutes())
+	defer ts.Close()
+
+	request := func(method, key, token string) int {
+		req, _ := http.NewRequest(method, ts.URL+"/api/v2/keys/"+url.PathEscape(key), strings.NewReader(`"abc"`))
+		req.Header.Set("Content-Type", "application/json")
+		if token != "" {
+			req.Header.Set(apiKeyHeader, token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	for _, tc := range []struct {
+		method, key, token string
+		want               int
+	}{
+		{http.MethodPut, "users/1", "users-secret", http.StatusCreated},
+		{http.MethodPut, "users/1", "users-secret", http.StatusTooManyRequests},
+		{http.MethodGet, "users/2", "", http.StatusUnauthorized},
+		{http.MethodPut, "users/3", "reader-secret", http.StatusForbidden},
+	} {
+		if got := request(tc.method, tc.key, tc.token); got != tc.want {
+			t.Fatalf("%s %s: expected %d, got %d", tc.method, tc.key, tc.want, got)
+		}
+	}
+
+	// The value's size is counted, not the request's or the response's.
+	keys, accesses := server.keyStats.hot(time.Minute, 10)
+	if accesses != 1 || len(keys) != 1 || keys[0] != (hotKey{"users/1", 1}) {
+		t.Errorf("Expected only the write that was served, got %v of %d", keys, accesses)
+	}
+	if big := server.keyStats.big(time.Minute, 10); len(big) != 1 || big[0] != (bigKey{"users/1", 3}) {
+		t.Errorf("Expected the stored value's 3 bytes, got %v", big)
+	}
+}
+
+func BenchmarkKeyStats_Record(b *testing.B) {
+	k := newKeyStats(defaultKeyStatsWindow)
+	keys := make([]string, 10000)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("user:%d", i)
+	}
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			// Skewed so a few keys are hot, as in real traffic.
+			k.record(keys[(i*i)%len(keys)], 256)
+			i++
+		}
+	})
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+type lifecycleState int
+
+const (
+	stateOpen lifecycleState = iota
+	stateClosing
+	stateClosed
+)
+
+// lifecycle guards a cache's open/closing/closed state. Every operation is
+// bracketed by enter and exit; close refuses new operations straight away
+// and then waits for the running ones to finish.
+type lifecycle struct {
+	mu       sync.Mutex
+	state    lifecycleState
+	inflight int
+	drained  chan struct{}
+}
+
+func newLifecycle() *lifecycle {
+	return &lifecycle{drained: make(chan struct{})}
+}
+
+// enter registers an operation, failing with ErrCacheClosed once closing
+// has begun or with ctx's error if it is already done.
+func (l *lifecycle) enter(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.state != stateOpen {
+		return ErrCacheClosed
+	}
+	l.inflight++
+	return nil
+}
+
+func (l *lifecycle) exit() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.inflight--
+	if l.inflight == 0 && l.state == stateClosing {
+		close(l.drained)
+	}
+}
+
+// close stops new operations and waits until running ones have exited or
+// ctx is done. first reports whether this call started the close, so the
+// caller releases its resources exactly once.
+func (l *lifecycle) close(ctx context.Context) (first bool, err error) {
+	l.mu.Lock()
+	if l.state == stateOpen {
+		first = true
+		l.state = stateClosing
+		if l.inflight == 0 {
+			close(l.drained)
+		}
+	}
+	l.mu.Unlock()
+
+	select {
+	case <-l.drained:
+	case <-ctx.Done():
+		return first, ctx.Err()
+	}
+
+	l.mu.Lock()
+	l.state = stateClosed
+	l.mu.Unlock()
+	return first, nil
+}
+
+func (l *lifecycle) isOpen() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.state == stateOpen
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// errInterrupted is returned by ReadLine when the user presses Ctrl-C.
+var errInterrupted = errors.New("interrupted")
+
+const maxHistory = 500
+
+// lineEditor reads lines from a terminal in raw mode, with emacs-style
+// editing keys, arrow keys, history and tab completion. Characters are
+// taken to be one column wide.
+type lineEditor struct {
+	in      *bufio.Reader
+	out     io.Writer
+	history []string
+	// complete returns the candidates for the word ending at the end of
+	// before, the line up to the cursor.
+	complete func(before string) []string
+
+	prompt  string
+	line    []rune
+	pos     int
+	lastTab bool
+}
+
+func newLineEditor(in io.Reader, out io.Writer, complete func(before string) []string) *lineEditor {
+	return &lineEditor{in: bufio.NewReader(in), out: out, complete: complete}
+}
+
+// AddHistory records a line for the up and down keys, skipping blank lines
+// and repeats of the last one.
+func (e *lineEditor) AddHistory(line string) {
+	if strings.TrimSpace(line) == "" || (len(e.history) > 0 && e.history[len(e.history)-1] == line) {
+		return
+	}
+	e.history = append(e.history, line)
+	if len(e.history) > maxHistory {
+		e.history = e.history[len(e.history)-maxHistory:]
+	}
+}
+
+// ReadLine shows prompt and returns the line entered. Ctrl-C abandons the
+// line with errInterrupted; Ctrl-D on an empty line returns io.EOF.
+func (e *lineEditor) ReadLine(prompt string) (string, error) {
+	e.prompt, e.line, e.pos, e.lastTab = prompt, nil, 0, false
+	browsing := len(e.history)
+	var draft []rune
+	fmt.Fprint(e.out, prompt)
+
+	for {
+		r, _, err := e.in.ReadRune()
+		if err != nil {
+			return "", err
+		}
+		tab := false
+
+		switch r {
+		case '\r', '\n':
+			fmt.Fprint(e.out, "\r\n")
+			return string(e.line), nil
+		case 3: // Ctrl-C
+			fmt.Fprint(e.out, "^C\r\n")
+			return "", errInterrupted
+		case 4: // Ctrl-D
+			if len(e.line) == 0 {
+				fmt.Fprint(e.out, "\r\n")
+				return "", io.EOF
+			}
+			e.deleteAt(e.pos)
+		case 127, 8: // Backspace
+			if e.pos > 0 {
+				e.pos--
+				e.deleteAt(e.pos)
+			}
+		case 1: // Ctrl-A
+			e.pos = 0
+		case 5: // Ctrl-E
+			e.pos = len(e.line)
+		case 2: // Ctrl-B
+			e.move(-1)
+		case 6: // Ctrl-F
+			e.move(1)
+		case 11: // Ctrl-K
+			e.line = e.line[:e.pos]
+		case 21: // Ctrl-U
+			e.line = append([]rune(nil), e.line[e.pos:]...)
+			e.pos = 0
+		case 23: // Ctrl-W
+			start := e.pos
+			for start > 0 && unicode.IsSpace(e.line[start-1]) {
+				start--
+			}
+			for start > 0 && !unicode.IsSpace(e.line[start-1]) {
+				start--
+			}
+			e.line = append(e.line[:start], e.line[e.pos:]...)
+			e.pos = start
+		case 12: // Ctrl-L
+			fmt.Fprint(e.out, "\x1b[H\x1b[2J")
+		case 16, 14: // Ctrl-P, Ctrl-N
+			browsing, draft = e.browse(r == 16, browsing, draft)
+		case '\t':
+			tab = true
+			e.completeWord()
+		case 27: // Escape sequences for the arrow, Home, End and Delete keys
+			switch e.readEscape() {
+			case "A":
+				browsing, draft = e.browse(true, browsing, draft)
+			case "B":
+				browsing, draft = e.browse(false, browsing, draft)
+			case "C":
+				e.move(1)
+			case "D":
+				e.move(-1)
+			case "H", "1~", "7~":
+				e.pos = 0
+			case "F", "4~", "8~":
+				e.pos = len(e.line)
+			case "3~":
+				e.deleteAt(e.pos)
+			}
+		default:
+			if unicode.IsPrint(r) {
+				e.line = append(e.line[:e.pos], append([]rune{r}, e.line[e.pos:]...)...)
+				e.pos++
+			}
+		}
+		e.lastTab = tab
+		e.redraw()
+	}
+}
+
+// readEscape reads the rest of an escape sequence after ESC, returning its
+// final part, e.g. "A" for ESC [ A or "3~" for ESC [ 3 ~.
+func (e *lineEditor) readEscape() string {
+	r, _, err := e.in.ReadRune()
+	if err != nil || (r != '[' && r != 'O') {
+		return ""
+	}
+	var seq []rune
+	for {
+		r, _, err := e.in.ReadRune()
+		if err != nil {
+			return ""
+		}
+		seq = append(seq, r)
+		if r < '0' || r > '9' {
+			return string(seq)
+		}
+	}
+}
+
+func (e *lineEditor) move(by int) {
+	if p := e.pos + by; p >= 0 && p <= len(e.line) {
+		e.pos = p
+	}
+}
+
+func (e *lineEditor) deleteAt(i int) {
+	if i < len(e.line) {
+		e.line = append(e.line[:i], e.line[i+1:]...)
+	}
+}
+
+// browse moves through history, keeping the line being typed as draft so
+// moving past the newest entry brings it back.
+func (e *lineEditor) browse(older bool, i int, draft []rune) (int, []rune) {
+	if i == len(e.history) {
+		draft = append([]rune(nil), e.line...)
+	}
+	switch {
+	case older && i > 0:
+		i--
+	case !older && i < len(e.history):
+		i++
+	default:
+		return i, draft
+	}
+	if i == len(e.history) {
+		e.line = append([]rune(nil), draft...)
+	} else {
+		e.line = []rune(e.history[i])
+	}
+	e.pos = len(e.line)
+	return i, draft
+}
+
+// completeWord completes the word before the cursor: fully if there is one
+// candidate, otherwise as far as the candidates agree, listing them when a
+// second Tab cannot get further.
+func (e *lineEditor) completeWord() {
+	if e.complete == nil {
+		return
+	}
+	before := string(e.line[:e.pos])
+	start := strings.LastIndexFunc(before, unicode.IsSpace) + 1
+	word := before[start:]
+	candidates := e.complete(before)
+	if len(candidates) == 0 {
+		return
+	}
+
+	completion := candidates[0]
+	if len(candidates) == 1 {
+		completion += " "
+	} else {
+		for _, c := range candidates[1:] {
+			completion = commonPrefix(completion, c)
+		}
+	}
+	if len(completion) > len(word) {
+		insert := []rune(completion[len(word):])
+		e.line = append(e.line[:e.pos], append(insert, e.line[e.pos:]...)...)
+		e.pos += len(insert)
+		return
+	}
+	if e.lastTab && len(candidates) > 1 {
+		fmt.Fprintf(e.out, "\r\n%s\r\n", strings.Join(candidates, "  "))
+	}
+}
+
+func commonPrefix(a, b string) string {
+	n := 0
+	for n < len(a) && n < len(b) && a[n] == b[n] {
+		n++
+	}
+	for n > 0 && n < len(a) && !utf8.RuneStart(a[n]) {
+		n--
+	}
+	return a[:n]
+}
+
+func (e *lineEditor) redraw() {
+	fmt.Fprintf(e.out, "\r%s%s\x1b[K", e.prompt, string(e.line))
+	if back := len(e.line) - e.pos; back > 0 {
+		fmt.Fprintf(e.out, "\x1b[%dD", back)
+	}
+}
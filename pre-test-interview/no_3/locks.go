@@ -0,0 +1,289 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	ErrLockHeld    = errors.New("lock is held by another owner")
+	ErrLockNotHeld = errors.New("lock is not held by this owner")
+	ErrLocksClosed = errors.New("lock service is closed")
+)
+
+// Lock is a lease on a name. Owner is the secret that renews and releases
+// it, handed out once on acquire. FencingToken grows with every acquire, so
+// a resource guarded by the lock can reject writes carrying an older token
+// from a holder whose lease ran out.
+type Lock struct {
+	Name         string    `json:"name"`
+	Owner        string    `json:"owner,omitempty"`
+	Holder       string    `json:"holder,omitempty"`
+	FencingToken uint64    `json:"fencing_token"`
+	Acquired     time.Time `json:"acquired_at"`
+	Expires      time.Time `json:"expires_at"`
+}
+
+const (
+	lockOpAcquire = "acquire"
+	lockOpRenew   = "renew"
+	lockOpRelease = "release"
+)
+
+// lockCommand is one change to a lockTable. It carries the time it was
+// issued at, so replicas applying the same commands agree on every lease.
+type lockCommand struct {
+	Op     string        `json:"op"`
+	Name   string        `json:"name"`
+	Owner  string        `json:"owner"`
+	Holder string        `json:"holder,omitempty"`
+	TTL    time.Duration `json:"ttl,omitempty"`
+	Now    time.Time     `json:"now"`
+}
+
+// lockTable holds the locks. Expired locks are dropped as commands come in.
+type lockTable struct {
+	mu       sync.Mutex
+	locks    map[string]Lock
+	fence    uint64
+	released chan struct{}
+}
+
+func newLockTable(fence uint64) *lockTable {
+	return &lockTable{locks: make(map[string]Lock), fence: fence, released: make(chan struct{})}
+}
+
+func (t *lockTable) apply(cmd lockCommand) (Lock, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for name, l := range t.locks {
+		if !cmd.Now.Before(l.Expires) {
+			delete(t.locks, name)
+		}
+	}
+	current, held := t.locks[cmd.Name]
+
+	switch cmd.Op {
+	case lockOpAcquire:
+		if held {
+			return Lock{}, ErrLockHeld
+		}
+		t.fence++
+		l := Lock{
+			Name:         cmd.Name,
+			Owner:        cmd.Owner,
+			Holder:       cmd.Holder,
+			FencingToken: t.fence,
+			Acquired:     cmd.Now,
+			Expires:      cmd.Now.Add(cmd.TTL),
+		}
+		t.locks[cmd.Name] = l
+		return l, nil
+	case lockOpRenew:
+		if !held || current.Owner != cmd.Owner {
+			return Lock{}, ErrLockNotHeld
+		}
+		current.Expires = cmd.Now.Add(cmd.TTL)
+		t.locks[cmd.Name] = current
+		return current, nil
+	case lockOpRelease:
+		if !held || current.Owner != cmd.Owner {
+			return Lock{}, ErrLockNotHeld
+		}
+		delete(t.locks, cmd.Name)
+		close(t.released)
+		t.released = make(chan struct{})
+		return current, nil
+	}
+	return Lock{}, fmt.Errorf("unknown lock operation '%s'", cmd.Op)
+}
+
+// get returns name's lock, without its owner, if it is held at now.
+func (t *lockTable) get(name string, now time.Time) (Lock, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	l, held := t.locks[name]
+	if !held || !now.Before(l.Expires) {
+		return Lock{}, false
+	}
+	l.Owner = ""
+	return l, true
+}
+
+// list returns the locks held at now, by name, without their owners.
+func (t *lockTable) list(now time.Time) []Lock {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	locks := make([]Lock, 0, len(t.locks))
+	for _, l := range t.locks {
+		if now.Before(l.Expires) {
+			l.Owner = ""
+			locks = append(locks, l)
+		}
+	}
+	sort.Slice(locks, func(i, j int) bool { return locks[i].Name < locks[j].Name })
+	return locks
+}
+
+// releasedCh returns a channel closed at the next release.
+func (t *lockTable) releasedCh() <-chan struct{} {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.released
+}
+
+type lockTableState struct {
+	Fence uint64 `json:"fence"`
+	Locks []Lock `json:"locks"`
+}
+
+func (t *lockTable) snapshot() ([]byte, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	state := lockTableState{Fence: t.fence, Locks: make([]Lock, 0, len(t.locks))}
+	for _, l := range t.locks {
+		state.Locks = append(state.Locks, l)
+	}
+	return json.Marshal(state)
+}
+
+func (t *lockTable) restore(data []byte) error {
+	var state lockTableState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return fmt.Errorf("invalid lock snapshot: %w", err)
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.fence = state.Fence
+	t.locks = make(map[string]Lock, len(state.Locks))
+	for _, l := range state.Locks {
+		t.locks[l.Name] = l
+	}
+	close(t.released)
+	t.released = make(chan struct{})
+	return nil
+}
+
+// LockService hands out leases on names. NewLockService serves one node;
+// ReplicatedCache.Locks replicates every change through Raft.
+type LockService struct {
+	table     *lockTable
+	clock     Clock
+	submit    func(ctx context.Context, cmd lockCommand) (Lock, error)
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// NewLockService returns a lock service for a single node. Fencing tokens
+// start from the wall clock in microseconds, so they keep growing across
+// restarts and stay exact as JSON numbers, which are doubles to many clients.
+func NewLockService(clock Clock) *LockService {
+	table := newLockTable(uint64(time.Now().UnixMicro()))
+	return newLockService(table, clock, func(_ context.Context, cmd lockCommand) (Lock, error) {
+		return table.apply(cmd)
+	})
+}
+
+func newLockService(table *lockTable, clock Clock, submit func(context.Context, lockCommand) (Lock, error)) *LockService {
+	if clock == nil {
+		clock = systemClock{}
+	}
+	return &LockService{table: table, clock: clock, submit: submit, closed: make(chan struct{})}
+}
+
+func newLockOwner() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Acquire takes name for ttl if it is free, or fails with ErrLockHeld.
+// holder is an optional label shown in listings.
+func (s *LockService) Acquire(ctx context.Context, name, holder string, ttl time.Duration) (Lock, error) {
+	if name == "" {
+		return Lock{}, ErrInvalidKey
+	}
+	if ttl <= 0 {
+		return Lock{}, ErrInvalidTTL
+	}
+	owner, err := newLockOwner()
+	if err != nil {
+		return Lock{}, err
+	}
+	return s.submit(ctx, lockCommand{Op: lockOpAcquire, Name: name, Owner: owner, Holder: holder, TTL: ttl, Now: s.clock.Now()})
+}
+
+// minLockPoll bounds how often AcquireWait retries when the clocks of the
+// leader and this node disagree about a lease.
+const minLockPoll = 10 * time.Millisecond
+
+// AcquireWait is Acquire, but waits for a held lock to be released or to
+// expire until ctx is done.
+func (s *LockService) AcquireWait(ctx context.Context, name, holder string, ttl time.Duration) (Lock, error) {
+	for {
+		released := s.table.releasedCh()
+		l, err := s.Acquire(ctx, name, holder, ttl)
+		if !errors.Is(err, ErrLockHeld) {
+			return l, err
+		}
+
+		wait := minLockPoll
+		if current, held := s.table.get(name, s.clock.Now()); held {
+			if d := current.Expires.Sub(s.clock.Now()); d > wait {
+				wait = d
+			}
+		}
+		ticker := s.clock.NewTicker(wait)
+		select {
+		case <-released:
+		case <-ticker.C():
+		case <-ctx.Done():
+			ticker.Stop()
+			return Lock{}, ctx.Err()
+		case <-s.closed:
+			ticker.Stop()
+			return Lock{}, ErrLocksClosed
+		}
+		ticker.Stop()
+	}
+}
+
+// Renew extends a lock held by owner to ttl from now.
+func (s *LockService) Renew(ctx context.Context, name, owner string, ttl time.Duration) (Lock, error) {
+	if ttl <= 0 {
+		return Lock{}, ErrInvalidTTL
+	}
+	return s.submit(ctx, lockCommand{Op: lockOpRenew, Name: name, Owner: owner, TTL: ttl, Now: s.clock.Now()})
+}
+
+// Release frees a lock held by owner.
+func (s *LockService) Release(ctx context.Context, name, owner string) error {
+	_, err := s.submit(ctx, lockCommand{Op: lockOpRelease, Name: name, Owner: owner, Now: s.clock.Now()})
+	return err
+}
+
+// Get returns the lock on name if it is held, without its owner.
+func (s *LockService) Get(name string) (Lock, bool) {
+	return s.table.get(name, s.clock.Now())
+}
+
+// List returns the held locks, without their owners.
+func (s *LockService) List() []Lock {
+	return s.table.list(s.clock.Now())
+}
+
+// Close wakes every AcquireWait with ErrLocksClosed; the server calls it
+// when it starts shutting down so long polls do not hold up the drain.
+func (s *LockService) Close() {
+	s.closeOnce.Do(func() { close(s.closed) })
+}
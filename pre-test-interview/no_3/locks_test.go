@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestLockService_LeasesAndFencing(t *testing.T) {
+	clock := NewFakeClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	locks := NewLockService(clock)
+	ctx := context.Background()
+
+	first, err := locks.Acquire(ctx, "job", "worker-1", time.Minute)
+	if err != nil || first.Owner == "" {
+		t.Fatalf("Expected to acquire the lock with an owner token, got %+v, %v", first, err)
+	}
+	if _, err := locks.Acquire(ctx, "job", "worker-2", time.Minute); !errors.Is(err, ErrLockHeld) {
+		t.Errorf("Expected ErrLockHeld, got %v", err)
+	}
+	if _, err := locks.Renew(ctx, "job", "not-the-owner", time.Minute); !errors.Is(err, ErrLockNotHeld) {
+		t.Errorf("Expected ErrLockNotHeld renewing with another token, got %v", err)
+	}
+
+	clock.Advance(50 * time.Second)
+	if _, err := locks.Renew(ctx, "job", first.Owner, time.Minute); err != nil {
+		t.Fatalf("Renew failed: %v", err)
+	}
+	clock.Advance(50 * time.Second)
+	if listed := locks.List(); len(listed) != 1 || listed[0].Holder != "worker-1" || listed[0].Owner != "" {
+		t.Errorf("Expected the renewed lock listed without its owner token, got %+v", listed)
+	}
+
+	clock.Advance(11 * time.Second)
+	second, err := locks.Acquire(ctx, "job", "worker-2", time.Minute)
+	if err != nil {
+		t.Fatalf("Expected the expired lock to be free, got %v", err)
+	}
+	if second.FencingToken <= first.FencingToken {
+		t.Errorf("Expected a larger fencing token, got %d after %d", second.FencingToken, first.FencingToken)
+	}
+	if err := locks.Release(ctx, "job", first.Owner); !errors.Is(err, ErrLockNotHeld) {
+		t.Errorf("Expected the expired owner's release to fail, got %v", err)
+	}
+	if err := locks.Release(ctx, "job", second.Owner); err != nil {
+		t.Errorf("Release failed: %v", err)
+	}
+	if len(locks.List()) != 0 {
+		t.Errorf("Expected no locks held, got %+v", locks.List())
+	}
+}
+
+func TestLockService_AcquireWait(t *testing.T) {
+	clock := NewFakeClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	locks := NewLockService(clock)
+	ctx := context.Background()
+
+	held, _ := locks.Acquire(ctx, "job", "", time.Minute)
+	acquired := make(chan Lock, 1)
+	go func() {
+		l, _ := locks.AcquireWait(ctx, "job", "", time.Minute)
+		acquired <- l
+	}()
+	time.Sleep(20 * time.Millisecond)
+	locks.Release(ctx, "job", held.Owner)
+	select {
+	case l := <-acquired:
+		if l.FencingToken != held.FencingToken+1 {
+			t.Errorf("Expected the next fencing token, got %d", l.FencingToken)
+		}
+		held = l
+	case <-time.After(time.Second):
+		t.Fatal("Expected release to wake the waiter")
+	}
+
+	go func() {
+		l, _ := locks.AcquireWait(ctx, "job", "", time.Minute)
+		acquired <- l
+	}()
+	time.Sleep(20 * time.Millisecond)
+	clock.Advance(time.Minute)
+	select {
+	case l := <-acquired:
+		if l.Owner == held.Owner {
+			t.Error("Expected a new owner after the lease expired")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected expiry to wake the waiter")
+	}
+
+	waitCtx, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	if _, err := locks.AcquireWait(waitCtx, "job", "", time.Minute); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected the wait to time out, got %v", err)
+	}
+	locks.Close()
+	if _, err := locks.AcquireWait(ctx, "job", "", time.Minute); !errors.Is(err, ErrLocksClosed) {
+		t.Errorf("Expected ErrLocksClosed after Close, got %v", err)
+	}
+}
+
+func TestRaft_ReplicatesLocks(t *testing.T) {
+	cluster := newRaftTestCluster(t, 3, 5)
+	leader := cluster.waitLeader()
+	locks := cluster.caches[leader].Locks()
+	ctx := context.Background()
+
+	first, err := locks.Acquire(ctx, "job", "worker-1", time.Minute)
+	if err != nil {
+		t.Fatalf("Acquire failed: %v", err)
+	}
+	if err := locks.Release(ctx, "job", first.Owner); err != nil {
+		t.Fatalf("Release failed: %v", err)
+	}
+	// Enough writes to snapshot, so a restarted node restores the lock
+	// table from a snapshot rather than replaying the log.
+	for i := 0; i < 12; i++ {
+		cluster.caches[leader].Set(fmt.Sprintf("k%d", i), "v")
+	}
+	second, err := locks.Acquire(ctx, "job", "worker-2", time.Minute)
+	if err != nil || second.FencingToken != first.FencingToken+1 {
+		t.Fatalf("Expected the next fencing token, got %+v, %v", second, err)
+	}
+
+	var follower string
+	for id := range cluster.caches {
+		if id != leader {
+			follower = id
+			break
+		}
+	}
+	waitForLock := func(id string) {
+		t.Helper()
+		deadline := time.Now().Add(3 * time.Second)
+		for {
+			if l, held := cluster.caches[id].Locks().Get("job"); held && l.FencingToken == second.FencingToken {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("Node %s: expected the lock held with token %d", id, second.FencingToken)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	waitForLock(follower)
+	if _, err := cluster.caches[follower].Locks().Acquire(ctx, "other", "", time.Minute); err == nil {
+		t.Error("Expected a follower to refuse lock changes")
+	}
+
+	cluster.stop(follower)
+	cluster.start(follower, nil, 5)
+	waitForLock(follower)
+}
+
+func TestServer_Locks(t *testing.T) {
+	ts := newTestServer(t, NewSimpleCache())
+	url := ts.URL + "/api/v2/locks/report"
+
+	acquire := func(query string) (*http.Response, Lock) {
+		t.Helper()
+		resp, body := doRequest(t, http.MethodPost, url+query, "", "")
+		var l Lock
+		data, _ := json.Marshal(body.Data)
+		json.Unmarshal(data, &l)
+		return resp, l
+	}
+	withOwner := func(method, owner string) *http.Response {
+		t.Helper()
+		req, _ := http.NewRequest(method, url, nil)
+		req.Header.Set(lockOwnerHeader, owner)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	resp, held := acquire("?ttl=1m&holder=cron")
+	if resp.StatusCode != http.StatusOK || held.Owner == "" || held.FencingToken == 0 {
+		t.Fatalf("Expected to acquire the lock, got %d %+v", resp.StatusCode, held)
+	}
+	resp, _ = acquire("")
+	if resp.StatusCode != http.StatusConflict || resp.Header.Get("Retry-After") == "" {
+		t.Errorf("Expected 409 with Retry-After for a held lock, got %d %v", resp.StatusCode, resp.Header)
+	}
+	if resp := withOwner(http.MethodPatch, "wrong"); resp.StatusCode != http.StatusConflict {
+		t.Errorf("Expected 409 renewing with the wrong owner, got %d", resp.StatusCode)
+	}
+	if resp := withOwner(http.MethodPatch, held.Owner); resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected 200 renewing, got %d", resp.StatusCode)
+	}
+
+	resp, body := doRequest(t, http.MethodGet, ts.URL+"/api/v2/locks", "", "")
+	if listed, _ := body.Data.([]interface{}); resp.StatusCode != http.StatusOK || len(listed) != 1 {
+		t.Errorf("Expected one lock listed, got %d %+v", resp.StatusCode, body)
+	}
+
+	type result struct {
+		resp *http.Response
+		lock Lock
+	}
+	waited := make(chan result, 1)
+	go func() {
+		resp, l := acquire("?wait=5s")
+		waited <- result{resp, l}
+	}()
+	time.Sleep(50 * time.Millisecond)
+	if resp := withOwner(http.MethodDelete, held.Owner); resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected 200 releasing, got %d", resp.StatusCode)
+	}
+	select {
+	case r := <-waited:
+		if r.resp.StatusCode != http.StatusOK || r.lock.FencingToken != held.FencingToken+1 {
+			t.Errorf("Expected the waiting acquire to get the next token, got %d %+v", r.resp.StatusCode, r.lock)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("Expected the release to complete the waiting acquire")
+	}
+
+	start := time.Now()
+	if resp, _ = acquire("?wait=100ms"); resp.StatusCode != http.StatusConflict || time.Since(start) < 100*time.Millisecond {
+		t.Errorf("Expected 409 after waiting out a held lock, got %d after %v", resp.StatusCode, time.Since(start))
+	}
+	if resp := withOwner(http.MethodDelete, ""); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected 400 without an owner token, got %d", resp.StatusCode)
+	}
+}
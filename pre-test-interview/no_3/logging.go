@@ -0,0 +1,49 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"path"
+)
+
+// logLevel is the level of the server log. A config reload changes it in
+// place, so loggers derived from the default one follow.
+var logLevel = new(slog.LevelVar)
+
+const (
+	logFormatText = "text"
+	logFormatJSON = "json"
+
+	redactedKey = "[REDACTED]"
+)
+
+// newLogHandler returns the handler of the server log, writing format to w
+// and redacting the keys matching redact.
+func newLogHandler(w io.Writer, format string, redact []string) slog.Handler {
+	opts := &slog.HandlerOptions{Level: logLevel, ReplaceAttr: redactKeys(redact)}
+	if format == logFormatJSON {
+		return slog.NewJSONHandler(w, opts)
+	}
+	return slog.NewTextHandler(w, opts)
+}
+
+// redactKeys returns a ReplaceAttr function that hides "key" attributes
+// matching one of the glob patterns, as path.Match reads them. Cache keys
+// are always logged as "key", never in a path, so this covers the access,
+// audit and cache logs alike.
+func redactKeys(patterns []string) func(groups []string, a slog.Attr) slog.Attr {
+	if len(patterns) == 0 {
+		return nil
+	}
+	return func(_ []string, a slog.Attr) slog.Attr {
+		if a.Key != "key" || a.Value.Kind() != slog.KindString {
+			return a
+		}
+		for _, p := range patterns {
+			if ok, _ := path.Match(p, a.Value.String()); ok {
+				return slog.String(a.Key, redactedKey)
+			}
+		}
+		return a
+	}
+}
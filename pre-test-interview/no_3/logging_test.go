@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// logLines decodes the JSON log lines in buf.
+func logLines(t *testing.T, buf *bytes.Buffer) []map[string]interface{} {
+	t.Helper()
+	var lines []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		var m map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &m); err != nil {
+			t.Fatalf("Expected a JSON log line, got %q", line)
+		}
+		lines = append(lines, m)
+	}
+	return lines
+}
+
+func TestAccessLog(t *testing.T) {
+	var buf bytes.Buffer
+	server := NewServer(NewSimpleCache(), nil)
+	server.SetAccessLog(slog.New(newLogHandler(&buf, logFormatJSON, []string{"session:*"})))
+	ts := httptest.NewServer(server.setupRoutes())
+	defer ts.Close()
+
+	doRequest(t, http.MethodPut, ts.URL+"/api/v2/keys/user:1", "text/plain", "Ada")
+	doRequest(t, http.MethodGet, ts.URL+"/api/cache/get?key=user:2", "", "")
+	doRequest(t, http.MethodPut, ts.URL+"/api/v2/keys/session:abc", "text/plain", "secret")
+	doRequest(t, http.MethodGet, ts.URL+"/health", "", "")
+
+	lines := logLines(t, &buf)
+	if len(lines) != 3 {
+		t.Fatalf("Expected three lines, health checks being debug only, got %d: %s", len(lines), buf.String())
+	}
+	first := lines[0]
+	if first["msg"] != "request" || first["method"] != "PUT" || first["route"] != "/api/v2/keys/{key}" ||
+		first["key"] != "user:1" || first["status"] != 201.0 || first["client"] != "127.0.0.1" {
+		t.Errorf("Expected the request's method, route, key, status and client, got %v", first)
+	}
+	if first["bytes"].(float64) <= 0 || first["latency"].(float64) <= 0 {
+		t.Errorf("Expected the response size and latency, got %v", first)
+	}
+	if second := lines[1]; second["key"] != "user:2" || second["status"] != 404.0 {
+		t.Errorf("Expected the key of a query-string request and its 404, got %v", second)
+	}
+	if third := lines[2]; third["key"] != redactedKey || strings.Contains(buf.String(), "session:abc") {
+		t.Errorf("Expected the session key to be redacted, got %v", third)
+	}
+}
+
+func TestCacheDebugLogs(t *testing.T) {
+	var buf bytes.Buffer
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(newLogHandler(&buf, logFormatJSON, []string{"secret*"})))
+	logLevel.Set(slog.LevelDebug)
+	defer logLevel.Set(slog.LevelInfo)
+
+	clock := NewFakeClock(time.Now())
+	cache, err := NewTTLCacheWithConfig(TTLCacheConfig{TTL: time.Minute, CleanupInterval: time.Hour, MaxEntries: 1, Clock: clock})
+	if err != nil {
+		t.Fatalf("Failed to create TTLCache: %v", err)
+	}
+	defer cache.Close()
+
+	cache.Set("secret-a", 1)
+	cache.Set("b", 2)
+	clock.Advance(2 * time.Minute)
+	cache.performCleanup()
+
+	lines := logLines(t, &buf)
+	if len(lines) != 2 {
+		t.Fatalf("Expected an eviction and a cleanup, got %s", buf.String())
+	}
+	if lines[0]["msg"] != "Evicted entry" || lines[0]["key"] != redactedKey || lines[0]["level"] != "DEBUG" {
+		t.Errorf("Expected a redacted eviction at debug level, got %v", lines[0])
+	}
+	if lines[1]["msg"] != "Cleanup finished" || lines[1]["removed"] != 1.0 || lines[1]["remaining"] != 0.0 {
+		t.Errorf("Expected the cleanup to report one removal, got %v", lines[1])
+	}
+}
@@ -7,9 +7,22 @@ import (
 )
 
 func main() {
-	if len(os.Args) > 1 && os.Args[1] == "server" {
-		runServer()
-	} else {
+	switch {
+	case len(os.Args) > 1 && os.Args[1] == "server":
+		runServer(os.Args[2:])
+	case len(os.Args) > 1 && os.Args[1] == "client":
+		os.Exit(runClient(os.Args[2:], os.Stdin, os.Stdout, os.Stderr))
+	case len(os.Args) > 1 && os.Args[1] == "shell":
+		runShell(os.Args[2:])
+	case len(os.Args) > 1 && os.Args[1] == "bench":
+		os.Exit(runBench(os.Args[2:], os.Stdout, os.Stderr))
+	case len(os.Args) > 1 && os.Args[1] == "export":
+		os.Exit(runExport(os.Args[2:], os.Stdout, os.Stderr))
+	case len(os.Args) > 1 && os.Args[1] == "import":
+		os.Exit(runImport(os.Args[2:], os.Stdin, os.Stdout, os.Stderr))
+	case len(os.Args) > 1 && os.Args[1] == "audit":
+		os.Exit(runAudit(os.Args[2:], os.Stdin, os.Stdout, os.Stderr))
+	default:
 		runDemo()
 	}
 }
@@ -17,6 +30,13 @@ func main() {
 func runDemo() {
 	fmt.Println("=== Cache Implementation Demo ===")
 	fmt.Println("💡 Tip: Run with 'go run . server' to start the interactive HTTP API server")
+	fmt.Println("   ('go run . server -h' lists its flags and CACHE_* environment variables)")
+	fmt.Println("   and 'go run . client -h' for a command-line client to talk to it")
+	fmt.Println("   ('go run . shell' opens an interactive prompt, in-process or with -server,")
+	fmt.Println("   and 'go run . bench -h' load-tests a server)")
+	fmt.Println("   ('go run . export -h' and 'go run . import -h' move entries in and out of")
+	fmt.Println("   a server or a snapshot file as NDJSON or CSV, and 'go run . audit -h'")
+	fmt.Println("   decrypts an encrypted audit log)")
 	fmt.Println()
 
 	fmt.Println("1. Simple In-Memory Cache:")
@@ -51,7 +71,9 @@ func runDemo() {
 	fmt.Println()
 
 	fmt.Println("2. TTL Cache (with 2 second expiration):")
-	ttlCache, err := NewTTLCache(2 * time.Second)
+	// A fake clock lets the demo skip ahead instead of sleeping.
+	clock := NewFakeClock(time.Now())
+	ttlCache, err := NewTTLCacheWithConfig(TTLCacheConfig{TTL: 2 * time.Second, Clock: clock})
 	if err != nil {
 		fmt.Printf("   Error creating TTLCache: %v\n", err)
 		return
@@ -69,8 +91,8 @@ func runDemo() {
 		fmt.Printf("   Immediately after set: %s\n", value)
 	}
 
-	fmt.Println("   Waiting 3 seconds for expiration...")
-	time.Sleep(3 * time.Second)
+	fmt.Println("   Fast-forwarding 3 seconds for expiration...")
+	clock.Advance(3 * time.Second)
 
 	if _, exists, err := ttlCache.Get("temp_data"); err == nil && !exists {
 		fmt.Println("   After expiration: data no longer exists")
@@ -84,7 +106,7 @@ func runDemo() {
 	}
 	fmt.Println("   Set reset_demo with 2s TTL")
 
-	time.Sleep(1 * time.Second)
+	clock.Advance(1 * time.Second)
 	fmt.Println("   After 1 second, updating value...")
 	err = ttlCache.Set("reset_demo", "Updated value")
 	if err != nil {
@@ -92,7 +114,7 @@ func runDemo() {
 		return
 	}
 
-	time.Sleep(1 * time.Second)
+	clock.Advance(1 * time.Second)
 	if value, exists, err := ttlCache.Get("reset_demo"); err == nil && exists {
 		fmt.Printf("   After another second: %s (TTL was reset)\n", value)
 	}
@@ -0,0 +1,642 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// docsPage renders /openapi.json as interactive documentation.
+//
+//go:embed web/docs.html
+var docsPage []byte
+
+// The OpenAPI 3 types cover only what the server's description uses.
+type openAPIDoc struct {
+	OpenAPI    string                                  `json:"openapi"`
+	Info       openAPIInfo                             `json:"info"`
+	Tags       []openAPITag                            `json:"tags"`
+	Paths      map[string]map[string]*openAPIOperation `json:"paths"`
+	Components openAPIComponents                       `json:"components"`
+	Security   []map[string][]string                   `json:"security"`
+}
+
+type openAPIInfo struct {
+	Title       string `json:"title"`
+	Version     string `json:"version"`
+	Description string `json:"description"`
+}
+
+type openAPITag struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+}
+
+type openAPIOperation struct {
+	Tags        []string                   `json:"tags"`
+	Summary     string                     `json:"summary"`
+	Description string                     `json:"description,omitempty"`
+	Parameters  []openAPIParameter         `json:"parameters,omitempty"`
+	RequestBody *openAPIRequestBody        `json:"requestBody,omitempty"`
+	Responses   map[string]openAPIResponse `json:"responses"`
+}
+
+type openAPIParameter struct {
+	Name        string        `json:"name"`
+	In          string        `json:"in"`
+	Description string        `json:"description,omitempty"`
+	Required    bool          `json:"required,omitempty"`
+	Schema      openAPISchema `json:"schema"`
+}
+
+type openAPIRequestBody struct {
+	Required bool                    `json:"required,omitempty"`
+	Content  map[string]openAPIMedia `json:"content"`
+}
+
+type openAPIMedia struct {
+	Schema  openAPISchema `json:"schema"`
+	Example interface{}   `json:"example,omitempty"`
+}
+
+type openAPIResponse struct {
+	Ref         string                  `json:"$ref,omitempty"`
+	Description string                  `json:"description,omitempty"`
+	Content     map[string]openAPIMedia `json:"content,omitempty"`
+}
+
+type openAPISchema map[string]interface{}
+
+type openAPIComponents struct {
+	Schemas         map[string]openAPISchema   `json:"schemas"`
+	Responses       map[string]openAPIResponse `json:"responses"`
+	SecuritySchemes map[string]openAPISchema   `json:"securitySchemes"`
+}
+
+const (
+	tagKeys        = "Keys"
+	tagCollections = "Collections"
+	tagLocks       = "Locks"
+	tagLegacy      = "Legacy API"
+	tagCluster     = "Cluster"
+	tagTransfer    = "Export and import"
+	tagAdmin       = "Admin"
+	tagServer      = "Server"
+)
+
+var (
+	stringSchema   = openAPISchema{"type": "string"}
+	integerSchema  = openAPISchema{"type": "integer"}
+	numberSchema   = openAPISchema{"type": "number"}
+	anySchema      = openAPISchema{}
+	durationSchema = openAPISchema{"type": "string", "example": "30s"}
+	stringsSchema  = openAPISchema{"type": "array", "items": stringSchema}
+)
+
+func schemaRef(name string) openAPISchema {
+	return openAPISchema{"$ref": "#/components/schemas/" + name}
+}
+
+func objectSchema(properties map[string]openAPISchema) openAPISchema {
+	return openAPISchema{"type": "object", "properties": properties}
+}
+
+func pathParam(name, description string) openAPIParameter {
+	return openAPIParameter{Name: name, In: "path", Description: description, Required: true, Schema: stringSchema}
+}
+
+func queryParam(name, description string, schema openAPISchema) openAPIParameter {
+	return openAPIParameter{Name: name, In: "query", Description: description, Schema: schema}
+}
+
+func headerParam(name, description string) openAPIParameter {
+	return openAPIParameter{Name: name, In: "header", Description: description, Schema: stringSchema}
+}
+
+var (
+	keyParam      = pathParam("key", "The cache key. URL-escape keys containing '/'.")
+	queryKeyParam = openAPIParameter{Name: "key", In: "query", Description: "The cache key.", Required: true, Schema: stringSchema}
+	ifMatchParam  = headerParam("If-Match", "Only write if the value's ETag matches; 412 otherwise, and 501 under Raft.")
+)
+
+func operation(tag, summary, description string) *openAPIOperation {
+	return &openAPIOperation{Tags: []string{tag}, Summary: summary, Description: description, Responses: map[string]openAPIResponse{}}
+}
+
+func (o *openAPIOperation) params(ps ...openAPIParameter) *openAPIOperation {
+	o.Parameters = append(o.Parameters, ps...)
+	return o
+}
+
+// jsonBody takes a JSON request body of schema.
+func (o *openAPIOperation) jsonBody(schema openAPISchema, example interface{}) *openAPIOperation {
+	o.RequestBody = &openAPIRequestBody{Required: true, Content: map[string]openAPIMedia{
+		"application/json": {Schema: schema, Example: example},
+	}}
+	return o
+}
+
+// respond adds a response in the usual JSON envelope, with data of schema
+// if it is given.
+func (o *openAPIOperation) respond(status, description string, data ...openAPISchema) *openAPIOperation {
+	schema := schemaRef("Response")
+	if len(data) > 0 {
+		schema = openAPISchema{"allOf": []openAPISchema{schemaRef("Response"), {
+			"type":       "object",
+			"properties": map[string]openAPISchema{"data": data[0]},
+		}}}
+	}
+	o.Responses[status] = openAPIResponse{
+		Description: description,
+		Content:     map[string]openAPIMedia{"application/json": {Schema: schema}},
+	}
+	return o
+}
+
+// respondEmpty adds a response without a body.
+func (o *openAPIOperation) respondEmpty(status, description string) *openAPIOperation {
+	o.Responses[status] = openAPIResponse{Description: description}
+	return o
+}
+
+var (
+	openAPIOnce sync.Once
+	openAPIJSON []byte
+)
+
+// handleOpenAPI serves the OpenAPI 3 description of every route. Routes of
+// features that are off are included, with a note saying what enables them.
+func (s *Server) handleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		s.sendError(w, "Method not allowed. Use GET", http.StatusMethodNotAllowed)
+		return
+	}
+	openAPIOnce.Do(func() {
+		openAPIJSON, _ = json.MarshalIndent(openAPISpec(), "", "  ")
+	})
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(openAPIJSON)
+}
+
+func openAPISpec() *openAPIDoc {
+	doc := &openAPIDoc{
+		OpenAPI: "3.0.3",
+		Info: openAPIInfo{
+			Title:   "Cache API Server",
+			Version: "2",
+			Description: "An in-memory cache over HTTP. Most endpoints answer with a JSON envelope of " +
+				"`success`, `message`, `data` and `error`.\n\n" +
+				"When the server runs with `-auth-keys-file`, every endpoint except `/health`, `/openapi.json` and " +
+				"the docs page needs an API key in `X-API-Key` or `Authorization: Bearer`. Each key grants read, " +
+				"write or admin access to keys under a prefix; a missing key gets 401 and too little access 403.\n\n" +
+				"With `-rate-limit-read` or `-rate-limit-write` each client, identified by its API key or else its " +
+				"IP address, gets its own quota. Responses carry the `RateLimit-*` headers, and over the limit the " +
+				"server answers 429 with `Retry-After`.\n\n" +
+				"With gossip clustering, requests for a key owned by another node are redirected to it with 307.",
+		},
+		Tags: []openAPITag{
+			{tagKeys, "Values by key, with conditional requests and per-key TTLs."},
+			{tagCollections, "Lists, hashes, sets and sorted sets, changed atomically and, in a Raft cluster, replicated. " +
+				"An operation on a key holding another type gets 409."},
+			{tagLocks, "Leases on names with fencing tokens, replicated through Raft when it is enabled."},
+			{tagLegacy, "The original query-string API, kept for existing clients."},
+			{tagCluster, "Raft and gossip membership, served only when they are enabled."},
+			{tagTransfer, "Whole-cache dumps as NDJSON or CSV, one entry per line with its remaining TTL. " +
+				"`go run . export` and `go run . import` use them, or work on a snapshot file without a server."},
+			{tagAdmin, "API key management and the dashboard at /admin/, served only with -auth-keys-file. " +
+				"The dashboard's endpoints need admin access and also take the API key as a basic auth password."},
+			{tagServer, "Health, statistics and documentation."},
+		},
+		Paths: map[string]map[string]*openAPIOperation{},
+		Components: openAPIComponents{
+			Schemas: map[string]openAPISchema{
+				"Response": {
+					"type": "object",
+					"properties": map[string]openAPISchema{
+						"success": {"type": "boolean"},
+						"message": stringSchema,
+						"data":    anySchema,
+						"error":   stringSchema,
+					},
+					"required": []string{"success"},
+				},
+				"Lock": {
+					"type": "object",
+					"properties": map[string]openAPISchema{
+						"name":          stringSchema,
+						"owner":         {"type": "string", "description": "The secret that renews and releases the lock, returned only on acquire."},
+						"holder":        stringSchema,
+						"fencing_token": integerSchema,
+						"acquired_at":   {"type": "string", "format": "date-time"},
+						"expires_at":    {"type": "string", "format": "date-time"},
+					},
+				},
+				"AdminEntry": {
+					"type": "object",
+					"properties": map[string]openAPISchema{
+						"key":         stringSchema,
+						"type":        {"type": "string", "enum": []string{"json", "string", "raw", "list", "hash", "set", "zset"}},
+						"size":        {"type": "integer", "description": "Estimated bytes held."},
+						"ttl_seconds": {"type": "integer", "description": "Seconds left; absent if the key never expires."},
+						"expires_at":  {"type": "string", "format": "date-time"},
+						"stale":       {"type": "boolean"},
+					},
+				},
+				"TransferRecord": {
+					"type": "object",
+					"properties": map[string]openAPISchema{
+						"key":         stringSchema,
+						"kind":        {"type": "string", "enum": []string{"raw", "list", "hash", "set", "zset"}, "description": "Absent for JSON values."},
+						"value":       {"description": "The value as JSON; raw values as {content_type, data} with data in base64."},
+						"ttl_seconds": {"type": "integer", "description": "Seconds left; absent if the key never expires."},
+					},
+					"required": []string{"key", "value"},
+				},
+				"ImportReport": {
+					"type": "object",
+					"properties": map[string]openAPISchema{
+						"imported": integerSchema,
+						"skipped":  {"type": "integer", "description": "Keys that existed, with on_conflict=skip."},
+						"failed":   integerSchema,
+						"errors": {"type": "array", "description": "The first 100 lines rejected.", "items": objectSchema(map[string]openAPISchema{
+							"line":  integerSchema,
+							"key":   stringSchema,
+							"error": stringSchema,
+						})},
+					},
+				},
+				"HandoffEntry": {
+					"type": "object",
+					"properties": map[string]openAPISchema{
+						"key":         stringSchema,
+						"kind":        {"type": "string", "description": "How value is encoded; absent for JSON values."},
+						"value":       {"description": "The value in its snapshot encoding."},
+						"expires_at":  {"type": "string", "format": "date-time"},
+						"version":     integerSchema,
+						"modified_at": {"type": "string", "format": "date-time"},
+					},
+					"required": []string{"key", "value"},
+				},
+				"RaftServer": {
+					"type": "object",
+					"properties": map[string]openAPISchema{
+						"id":      stringSchema,
+						"address": stringSchema,
+					},
+					"required": []string{"id", "address"},
+				},
+			},
+			Responses: map[string]openAPIResponse{
+				"Unauthorized":    {Description: "Missing or unknown API key, when auth is on."},
+				"Forbidden":       {Description: "The API key lacks the access needed."},
+				"TooManyRequests": {Description: "Over the client's rate limit; see Retry-After."},
+			},
+			SecuritySchemes: map[string]openAPISchema{
+				"apiKey": {"type": "apiKey", "in": "header", "name": apiKeyHeader},
+				"bearer": {"type": "http", "scheme": "bearer"},
+				"basic":  {"type": "http", "scheme": "basic", "description": "The API key is the password; the user name is ignored."},
+			},
+		},
+		// Auth is optional: an empty requirement allows anonymous access.
+		Security: []map[string][]string{{}, {"apiKey": {}}, {"bearer": {}}, {"basic": {}}},
+	}
+	add := func(path, method string, op *openAPIOperation) {
+		if doc.Paths[path] == nil {
+			doc.Paths[path] = map[string]*openAPIOperation{}
+		}
+		if path != "/health" && path != "/" && path != "/openapi.json" {
+			op.Responses["401"] = openAPIResponse{Ref: "#/components/responses/Unauthorized"}
+			op.Responses["403"] = openAPIResponse{Ref: "#/components/responses/Forbidden"}
+			op.Responses["429"] = openAPIResponse{Ref: "#/components/responses/TooManyRequests"}
+		}
+		doc.Paths[path][strings.ToLower(method)] = op
+	}
+
+	// Keys
+	anyValue := map[string]openAPIMedia{"*/*": {Schema: openAPISchema{"type": "string", "format": "binary"}}}
+	getKey := operation(tagKeys, "Read a value",
+		"JSON values come back in the envelope, or as the bare document when the server keeps them compressed "+
+			"in a Content-Encoding the client accepts; raw values with the Content-Type they were stored with. "+
+			"Responses carry ETag, Last-Modified, Cache-Control and Expires, and a stale value served past "+
+			"its TTL is marked by `Cache-Status: ...; ttl=-N`.").
+		params(keyParam,
+			headerParam("If-None-Match", "Answer 304 if the ETag still matches."),
+			headerParam("If-Modified-Since", "Answer 304 if the value has not changed since.")).
+		respond("200", "The value.", anySchema).
+		respondEmpty("304", "Not modified.").
+		respond("404", "No such key.")
+	getKey.Responses["200"].Content["*/*"] = anyValue["*/*"]
+	add("/api/v2/keys/{key}", http.MethodGet, getKey)
+	add("/api/v2/keys/{key}", http.MethodHead, operation(tagKeys, "Check that a key exists",
+		"The headers of GET without the body.").
+		params(keyParam).
+		respondEmpty("200", "The key exists.").
+		respondEmpty("404", "No such key."))
+	putKey := operation(tagKeys, "Create or replace a value",
+		"JSON and form bodies are decoded; any other Content-Type, or a Content-Encoding, is stored as raw "+
+			"bytes and served back unchanged. Bodies over the size limit (1 MiB by default) get 413.").
+		params(keyParam,
+			queryParam("ttl", "Give this value its own lifetime (ttl cache only; 501 otherwise).", durationSchema),
+			ifMatchParam).
+		respond("200", "Replaced.").
+		respond("201", "Created.").
+		respond("400", "Invalid body or TTL.").
+		respond("412", "If-Match did not match.").
+		respond("413", "Body too large.").
+		respond("501", "Per-key TTLs, or conditional writes under Raft, are not supported by this cache.")
+	putKey.RequestBody = &openAPIRequestBody{Required: true, Content: map[string]openAPIMedia{
+		"application/json": {Schema: anySchema, Example: map[string]interface{}{"name": "Ada"}},
+		"text/plain":       {Schema: stringSchema},
+		"*/*":              anyValue["*/*"],
+	}}
+	add("/api/v2/keys/{key}", http.MethodPut, putKey)
+	add("/api/v2/keys/{key}", http.MethodDelete, operation(tagKeys, "Delete a value", "").
+		params(keyParam, ifMatchParam).
+		respond("200", "Deleted.").
+		respond("404", "No such key.").
+		respond("412", "If-Match did not match."))
+	add("/api/v2/keys", http.MethodGet, operation(tagKeys, "List keys",
+		"Lists the keys held by this node, sorted. Listing needs read access to the prefix.").
+		params(queryParam("prefix", "Only keys starting with this.", stringSchema)).
+		respond("200", "The keys.", stringsSchema).
+		respond("501", "This cache cannot list its keys."))
+
+	// Collections
+	endParam := openAPIParameter{Name: "end", In: "path", Required: true, Schema: openAPISchema{"type": "string", "enum": []string{"left", "right"}}}
+	fieldParam := pathParam("field", "The hash field.")
+	memberParam := pathParam("member", "The set member.")
+	add("/api/v2/lists/{key}", http.MethodGet, operation(tagCollections, "Read a range of a list",
+		"Negative indexes count from the end.").
+		params(keyParam,
+			queryParam("start", "First index (default 0).", integerSchema),
+			queryParam("stop", "Last index, inclusive (default -1).", integerSchema)).
+		respond("200", "The list's length and the items in range.", objectSchema(map[string]openAPISchema{"length": integerSchema, "items": stringsSchema})).
+		respond("404", "No such key."))
+	add("/api/v2/lists/{key}/{end}", http.MethodPost, operation(tagCollections, "Push onto a list",
+		"Pushes a string or an array of strings, creating the list if needed.").
+		params(keyParam, endParam).
+		jsonBody(openAPISchema{"oneOf": []openAPISchema{stringSchema, stringsSchema}}, []string{"a", "b"}).
+		respond("200", "The list's new length.", objectSchema(map[string]openAPISchema{"length": integerSchema})))
+	add("/api/v2/lists/{key}/{end}", http.MethodDelete, operation(tagCollections, "Pop off a list", "").
+		params(keyParam, endParam, queryParam("count", "How many items to pop (default 1).", integerSchema)).
+		respond("200", "The items popped.", objectSchema(map[string]openAPISchema{"items": stringsSchema})).
+		respond("404", "No such list."))
+	add("/api/v2/hashes/{key}", http.MethodGet, operation(tagCollections, "Read all fields of a hash", "").
+		params(keyParam).
+		respond("200", "The fields.", openAPISchema{"type": "object", "additionalProperties": stringSchema}).
+		respond("404", "No such key."))
+	add("/api/v2/hashes/{key}", http.MethodPatch, operation(tagCollections, "Set several fields of a hash", "").
+		params(keyParam).
+		jsonBody(openAPISchema{"type": "object", "additionalProperties": stringSchema}, map[string]string{"name": "Ann"}).
+		respond("200", "How many fields were new.", objectSchema(map[string]openAPISchema{"created": integerSchema})))
+	add("/api/v2/hashes/{key}/{field}", http.MethodGet, operation(tagCollections, "Read a hash field", "").
+		params(keyParam, fieldParam).
+		respond("200", "The field's value.", objectSchema(map[string]openAPISchema{"field": stringSchema, "value": stringSchema})).
+		respond("404", "No such key or field."))
+	add("/api/v2/hashes/{key}/{field}", http.MethodPut, operation(tagCollections, "Set a hash field", "").
+		params(keyParam, fieldParam).
+		jsonBody(stringSchema, "Ann").
+		respond("200", "Whether the field was new.", objectSchema(map[string]openAPISchema{"created": integerSchema})))
+	add("/api/v2/hashes/{key}/{field}", http.MethodDelete, operation(tagCollections, "Delete a hash field", "").
+		params(keyParam, fieldParam).
+		respond("200", "The field was deleted.").
+		respond("404", "No such key or field."))
+	add("/api/v2/hashes/{key}/{field}/incr", http.MethodPost, operation(tagCollections, "Add to an integer hash field", "").
+		params(keyParam, fieldParam, queryParam("by", "The amount to add (default 1).", integerSchema)).
+		respond("200", "The new value.", objectSchema(map[string]openAPISchema{"field": stringSchema, "value": integerSchema})))
+	add("/api/v2/sets/{key}", http.MethodGet, operation(tagCollections, "List the members of a set", "").
+		params(keyParam, queryParam("intersect", "Comma-separated keys of sets to intersect with, on the same node.", stringSchema)).
+		respond("200", "The members.", objectSchema(map[string]openAPISchema{"size": integerSchema, "members": stringsSchema})).
+		respond("404", "No such key."))
+	add("/api/v2/sets/{key}", http.MethodPost, operation(tagCollections, "Add members to a set", "").
+		params(keyParam).
+		jsonBody(openAPISchema{"oneOf": []openAPISchema{stringSchema, stringsSchema}}, []string{"go", "cache"}).
+		respond("200", "How many members were new.", objectSchema(map[string]openAPISchema{"added": integerSchema})))
+	add("/api/v2/sets/{key}/{member}", http.MethodGet, operation(tagCollections, "Check set membership", "").
+		params(keyParam, memberParam).
+		respond("200", "A member.").
+		respond("404", "Not a member."))
+	add("/api/v2/sets/{key}/{member}", http.MethodPut, operation(tagCollections, "Add a member to a set", "").
+		params(keyParam, memberParam).
+		respond("200", "Whether the member was new.", objectSchema(map[string]openAPISchema{"added": integerSchema})))
+	add("/api/v2/sets/{key}/{member}", http.MethodDelete, operation(tagCollections, "Remove a member from a set", "").
+		params(keyParam, memberParam).
+		respond("200", "Removed.").
+		respond("404", "Not a member."))
+	add("/api/v2/zsets/{key}", http.MethodGet, operation(tagCollections, "Read a sorted set in score order",
+		"By rank with start and stop, or by score with min and max.").
+		params(keyParam,
+			queryParam("start", "First rank (default 0).", integerSchema),
+			queryParam("stop", "Last rank, inclusive (default -1).", integerSchema),
+			queryParam("min", "Lowest score.", numberSchema),
+			queryParam("max", "Highest score.", numberSchema)).
+		respond("200", "The members with their scores.", objectSchema(map[string]openAPISchema{"size": integerSchema, "members": {"type": "array"}})).
+		respond("404", "No such key."))
+	add("/api/v2/zsets/{key}", http.MethodPatch, operation(tagCollections, "Score several members", "").
+		params(keyParam).
+		jsonBody(openAPISchema{"type": "object", "additionalProperties": numberSchema}, map[string]float64{"ann": 120, "bob": 95}).
+		respond("200", "How many members were new.", objectSchema(map[string]openAPISchema{"added": integerSchema})))
+	add("/api/v2/zsets/{key}/{member}", http.MethodGet, operation(tagCollections, "Read a member's score and rank", "").
+		params(keyParam, memberParam).
+		respond("200", "The score and rank.", objectSchema(map[string]openAPISchema{"member": stringSchema, "score": numberSchema, "rank": integerSchema})).
+		respond("404", "No such key or member."))
+	add("/api/v2/zsets/{key}/{member}", http.MethodPut, operation(tagCollections, "Set a member's score", "").
+		params(keyParam, memberParam).
+		jsonBody(numberSchema, 42).
+		respond("200", "The score was set."))
+	add("/api/v2/zsets/{key}/{member}", http.MethodDelete, operation(tagCollections, "Remove a member", "").
+		params(keyParam, memberParam).
+		respond("200", "Removed.").
+		respond("404", "No such key or member."))
+
+	// Locks
+	nameParam := pathParam("name", "The lock name; names share the access grants of cache keys.")
+	ownerParam := openAPIParameter{Name: lockOwnerHeader, In: "header", Description: "The owner token returned on acquire.", Required: true, Schema: stringSchema}
+	add("/api/v2/locks", http.MethodGet, operation(tagLocks, "List the locks held", "Owner tokens are not included.").
+		respond("200", "The locks.", openAPISchema{"type": "array", "items": schemaRef("Lock")}))
+	add("/api/v2/locks/{name}", http.MethodGet, operation(tagLocks, "Show a lock", "").
+		params(nameParam).
+		respond("200", "The lock, without its owner token.", schemaRef("Lock")).
+		respond("404", "The lock is not held."))
+	add("/api/v2/locks/{name}", http.MethodPost, operation(tagLocks, "Acquire a lock",
+		"Returns the owner token, needed to renew or release the lock, and a fencing token that grows with "+
+			"every acquire. Without wait a held lock gets 409 with Retry-After.").
+		params(nameParam,
+			queryParam("ttl", "Lease length (default 30s).", durationSchema),
+			queryParam("wait", "Wait up to this long, at most a minute, for the lock.", durationSchema),
+			queryParam("holder", "A label shown in listings.", stringSchema)).
+		respond("200", "Acquired.", schemaRef("Lock")).
+		respond("409", "The lock is held."))
+	add("/api/v2/locks/{name}", http.MethodPatch, operation(tagLocks, "Renew a lock", "").
+		params(nameParam, ownerParam, queryParam("ttl", "New lease length from now (default 30s).", durationSchema)).
+		respond("200", "Renewed.", schemaRef("Lock")).
+		respond("409", "The lock is not held by this owner."))
+	add("/api/v2/locks/{name}", http.MethodDelete, operation(tagLocks, "Release a lock", "").
+		params(nameParam, ownerParam).
+		respond("200", "Released.").
+		respond("409", "The lock is not held by this owner."))
+
+	// Legacy API
+	add("/api/cache/set", http.MethodPost, operation(tagLegacy, "Set a value",
+		"Takes the value as a JSON body, or as the form or query field value.").
+		params(queryKeyParam, queryParam("value", "The value as text, instead of a body.", stringSchema), ifMatchParam).
+		jsonBody(anySchema, "John Doe").
+		respond("200", "Stored.").
+		respond("400", "Missing key or value."))
+	add("/api/cache/get", http.MethodGet, operation(tagLegacy, "Get a value", "Answers as GET /api/v2/keys/{key}.").
+		params(queryKeyParam).
+		respond("200", "The value.", anySchema).
+		respond("404", "No such key."))
+	add("/api/cache/delete", http.MethodDelete, operation(tagLegacy, "Delete a value", "").
+		params(queryKeyParam, ifMatchParam).
+		respond("200", "Deleted."))
+	add("/api/cache/stats", http.MethodGet, operation(tagServer, "Show cache statistics", "").
+		respond("200", "The statistics.", openAPISchema{"type": "object"}))
+	keyStatsParams := []openAPIParameter{
+		queryParam("window", "How far back to look, up to -key-stats-window (default all of it). Rounded up to a tenth of it.", durationSchema),
+		queryParam("limit", "Keys to list, at most 100 (default 10).", integerSchema),
+	}
+	add("/api/cache/hotkeys", http.MethodGet, operation(tagServer, "List the most accessed keys",
+		"Requests on a key that reach the cache on this node are counted in a Count-Min Sketch, so counts are estimates that may "+
+			"run slightly high. Served unless -key-stats-window is 0.").
+		params(keyStatsParams...).
+		respond("200", "The keys by count, and the requests counted in the window.", objectSchema(map[string]openAPISchema{
+			"window_seconds": integerSchema,
+			"accesses":       integerSchema,
+			"keys":           {"type": "array", "items": objectSchema(map[string]openAPISchema{"key": stringSchema, "count": integerSchema})},
+		})).
+		respond("400", "Invalid window or limit."))
+	add("/api/cache/bigkeys", http.MethodGet, operation(tagServer, "List the largest values",
+		"Sizes are estimates of the bytes held by the value last read or written on this node, as the admin listing reports them. "+
+			"Served unless -key-stats-window is 0.").
+		params(keyStatsParams...).
+		respond("200", "The keys by size.", objectSchema(map[string]openAPISchema{
+			"window_seconds": integerSchema,
+			"keys":           {"type": "array", "items": objectSchema(map[string]openAPISchema{"key": stringSchema, "bytes": integerSchema})},
+		})).
+		respond("400", "Invalid window or limit."))
+
+	// Export and import
+	formatParam := queryParam("format", "ndjson (the default) or csv.", openAPISchema{"type": "string", "enum": []string{formatNDJSON, formatCSV}})
+	records := map[string]openAPIMedia{
+		"application/x-ndjson": {Schema: schemaRef("TransferRecord")},
+		"text/csv":             {Schema: openAPISchema{"type": "string", "description": "A header row naming the columns key, kind, value and ttl_seconds, then one entry per row with the value as JSON text."}},
+	}
+	export := operation(tagTransfer, "Export every entry",
+		"Streams the live entries held by this node, sorted by key. A response cut short means the export failed.").
+		params(formatParam, queryParam("prefix", "Only keys starting with this; needs read access to it.", stringSchema)).
+		respond("400", "Invalid format.").
+		respond("501", "This cache cannot list its keys.")
+	export.Responses["200"] = openAPIResponse{Description: "One entry per line.", Content: records}
+	add("/api/cache/export", http.MethodGet, export)
+	importOp := operation(tagTransfer, "Import entries",
+		"Stores the entries of an export, line by line, and needs admin access. Invalid lines are skipped and "+
+			"reported; the others are imported. The format is taken from the Content-Type unless format is given.").
+		params(formatParam,
+			queryParam("on_conflict", "What to do with keys that exist: overwrite (the default), skip, or fail, which stops the import there.",
+				openAPISchema{"type": "string", "enum": []string{onConflictOverwrite, onConflictSkip, onConflictFail}})).
+		respond("200", "Every line was imported or skipped.", schemaRef("ImportReport")).
+		respond("400", "Invalid parameters, or the body could not be read; the report says what was imported.", schemaRef("ImportReport")).
+		respond("409", "A key existed, with on_conflict=fail.", schemaRef("ImportReport")).
+		respond("422", "Some lines were rejected.", schemaRef("ImportReport")).
+		respond("501", "on_conflict=skip or fail under Raft, which does not support conditional writes.")
+	importOp.RequestBody = &openAPIRequestBody{Required: true, Content: records}
+	add("/api/cache/import", http.MethodPost, importOp)
+
+	// Cluster
+	add("/api/cluster/raft", http.MethodGet, operation(tagCluster, "Show Raft status", "Only with -raft-id.").
+		respond("200", "The node's view of the cluster.", openAPISchema{"type": "object"}))
+	add("/api/cluster/raft", http.MethodPost, operation(tagCluster, "Add a Raft server", "Needs admin access.").
+		jsonBody(schemaRef("RaftServer"), RaftServer{ID: "n4", Address: "http://n4:8080"}).
+		respond("200", "Added.").
+		respond("503", "This node is not the leader; see X-Raft-Leader."))
+	add("/api/cluster/raft", http.MethodDelete, operation(tagCluster, "Remove a Raft server", "Needs admin access.").
+		params(openAPIParameter{Name: "id", In: "query", Required: true, Schema: stringSchema}).
+		respond("200", "Removed.").
+		respond("503", "This node is not the leader; see X-Raft-Leader."))
+	for _, rpc := range []string{"vote", "append", "snapshot"} {
+		add("/raft/"+rpc, http.MethodPost, operation(tagCluster, "Raft "+rpc+" RPC",
+			"Sent between Raft peers; needs admin access.").
+			respond("200", "The peer's reply."))
+	}
+	add("/api/cluster/members", http.MethodGet, operation(tagCluster, "List gossip members", "Only with -gossip-bind.").
+		params(queryParam("key", "Also report which member owns this key.", stringSchema)).
+		respond("200", "This node, the members and, with key, its owner.", openAPISchema{"type": "object"}))
+	add("/api/cluster/handoff", http.MethodPost, operation(tagCluster, "Hand a key to its owner",
+		"Sent between gossip members; needs write access. The key keeps its expiry and version, and is not stored if it has expired or this node holds a later version.").
+		jsonBody(schemaRef("HandoffEntry"), nil).
+		respond("200", "Whether the key was stored.").
+		respond("400", "The entry could not be decoded."))
+
+	// Admin
+	add("/api/admin/keys", http.MethodGet, operation(tagAdmin, "List API keys", "Secrets are not included.").
+		respond("200", "The keys."))
+	add("/api/admin/keys/rotate", http.MethodPost, operation(tagAdmin, "Rotate an API key's secret",
+		"The new secret is returned once; the old one stops working.").
+		params(openAPIParameter{Name: "id", In: "query", Required: true, Schema: stringSchema}).
+		respond("200", "The new secret.").
+		respond("404", "No such API key."))
+	add("/api/admin/keys/reload", http.MethodPost, operation(tagAdmin, "Re-read the keys file", "").
+		respond("200", "The keys now in effect.").
+		respond("500", "The file could not be read; the current keys are kept."))
+	add("/admin/", http.MethodGet, operation(tagAdmin, "Admin dashboard",
+		"Browse, edit and delete keys and watch live stats. Without credentials the browser is asked for basic auth.").
+		respondEmpty("200", "The dashboard."))
+	add("/admin/", http.MethodHead, operation(tagAdmin, "Admin dashboard headers", "").
+		respondEmpty("200", "The dashboard exists."))
+	add("/admin/api/entries", http.MethodGet, operation(tagAdmin, "Page through keys",
+		"Lists the keys held by this node in sorted order, with their type, size and TTL.").
+		params(queryParam("q", "Only keys containing this, ignoring case.", stringSchema),
+			queryParam("after", "The `next` of the previous page.", stringSchema),
+			queryParam("limit", "Keys per page, at most 500 (default 50).", integerSchema)).
+		respond("200", "A page of keys, the number matching, and the cursor of the next page if there is one.",
+			objectSchema(map[string]openAPISchema{
+				"total":   integerSchema,
+				"entries": {"type": "array", "items": schemaRef("AdminEntry")},
+				"next":    stringSchema,
+			})).
+		respond("400", "Invalid limit.").
+		respond("501", "This cache cannot list its keys."))
+	adminKey := func(method, summary, description string) *openAPIOperation {
+		op := operation(tagAdmin, summary, description).params(keyParam)
+		add("/admin/api/entries/{key}", method, op)
+		return op
+	}
+	adminKey(http.MethodGet, "Read a value", "As GET /api/v2/keys/{key}, served by this node.").
+		respond("200", "The value.", anySchema).
+		respond("404", "No such key.")
+	adminPut := adminKey(http.MethodPut, "Create or replace a value", "As PUT /api/v2/keys/{key}, stored on this node.").
+		params(queryParam("ttl", "The value's lifetime (default the cache's).", durationSchema), ifMatchParam).
+		respond("200", "Replaced.").
+		respond("201", "Created.").
+		respond("412", "If-Match did not match.")
+	adminPut.RequestBody = putKey.RequestBody
+	adminKey(http.MethodPatch, "Set a key's TTL", "Keeps the value and restarts its lifetime.").
+		params(openAPIParameter{Name: "ttl", In: "query", Description: "The new lifetime from now.", Required: true, Schema: durationSchema}).
+		respond("200", "The entry with its new TTL.", schemaRef("AdminEntry")).
+		respond("404", "No such key.").
+		respond("412", "The value changed meanwhile.").
+		respond("501", "Per-key TTLs, or conditional writes under Raft, are not supported by this cache.")
+	adminKey(http.MethodDelete, "Delete a value", "").
+		respond("200", "Deleted.").
+		respond("404", "No such key.")
+	add("/admin/api/events", http.MethodGet, operation(tagAdmin, "Stream live stats",
+		"Server-sent events named `stats`, one per interval, each carrying a JSON sample: `time`, `keys`, "+
+			"`heap_bytes`, `goroutines`, and the counters `requests`, `errors` (5xx), `hits` and `misses` since "+
+			"start. Requests to the dashboard, health checks and Raft traffic are not counted.").
+		params(queryParam("interval", "Time between events, at least 250ms (default 1s).", durationSchema)).
+		respondEmpty("200", "A text/event-stream.").
+		respond("400", "Invalid interval."))
+
+	// Server
+	add("/health", http.MethodGet, operation(tagServer, "Health check", "").
+		respond("200", "The server is up."))
+	add("/openapi.json", http.MethodGet, operation(tagServer, "This API description", "").
+		respondEmpty("200", "The OpenAPI 3 document."))
+	add("/", http.MethodGet, operation(tagServer, "API documentation", "This document, rendered as HTML.").
+		respondEmpty("200", "The documentation page."))
+	return doc
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+)
+
+var openAPIParamRe = regexp.MustCompile(`\{[^}]+\}`)
+
+// concretePath fills in the parameters of an OpenAPI path.
+func concretePath(path string) string {
+	return openAPIParamRe.ReplaceAllStringFunc(path, func(p string) string {
+		if p == "{end}" {
+			return "left"
+		}
+		return "x"
+	})
+}
+
+// TestOpenAPI_CoversEveryRoute fails when a route is added without being
+// described, or the description names a path or method no handler serves.
+func TestOpenAPI_CoversEveryRoute(t *testing.T) {
+	server := NewServer(NewSimpleCache(), nil)
+	server.SetAuth(newTestAuthStore(t), nil)
+	ts := httptest.NewServer(server.setupRoutes())
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/openapi.json")
+	if err != nil {
+		t.Fatalf("Failed to get the spec: %v", err)
+	}
+	defer resp.Body.Close()
+	var spec struct {
+		OpenAPI string                                `json:"openapi"`
+		Paths   map[string]map[string]json.RawMessage `json:"paths"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&spec); err != nil || !strings.HasPrefix(spec.OpenAPI, "3.") {
+		t.Fatalf("Expected an OpenAPI 3 document, got %q, %v", spec.OpenAPI, err)
+	}
+
+	// Every route, including those of features that are off here.
+	all := http.NewServeMux()
+	for _, rt := range server.routes() {
+		all.Handle(rt.pattern, http.NotFoundHandler())
+	}
+	covered := map[string]bool{}
+	for path := range spec.Paths {
+		_, pattern := all.Handler(httptest.NewRequest(http.MethodGet, concretePath(path), nil))
+		if pattern == "/" && path != "/" {
+			t.Errorf("Spec path %s matches no route", path)
+		}
+		covered[pattern] = true
+	}
+	for _, rt := range server.routes() {
+		if covered[rt.pattern] {
+			continue
+		}
+		// A subtree route is covered by the paths under it.
+		described := false
+		for path := range spec.Paths {
+			described = described || (strings.HasSuffix(rt.pattern, "/") && strings.HasPrefix(path, rt.pattern))
+		}
+		if !described {
+			t.Errorf("Route %s is missing from the spec", rt.pattern)
+		}
+	}
+
+	// Handlers that check the method list the ones they take in Allow.
+	for path, ops := range spec.Paths {
+		req, _ := http.NewRequest(http.MethodOptions, ts.URL+concretePath(path), nil)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("OPTIONS %s failed: %v", path, err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusMethodNotAllowed {
+			continue
+		}
+		allowed := strings.Split(resp.Header.Get("Allow"), ", ")
+		var described []string
+		for method := range ops {
+			described = append(described, strings.ToUpper(method))
+		}
+		sort.Strings(allowed)
+		sort.Strings(described)
+		if strings.Join(allowed, ",") != strings.Join(described, ",") {
+			t.Errorf("Expected %s to be described with methods %v, got %v", path, allowed, described)
+		}
+	}
+}
+
+func TestOpenAPI_DocsPage(t *testing.T) {
+	ts := newTestServer(t, NewSimpleCache())
+	resp, err := http.Get(ts.URL + "/")
+	if err != nil {
+		t.Fatalf("Failed to get the docs page: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/html") || !strings.Contains(string(body), `fetch("/openapi.json")`) {
+		t.Errorf("Expected the docs page rendered from the spec, got %q", resp.Header.Get("Content-Type"))
+	}
+}
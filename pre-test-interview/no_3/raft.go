@@ -0,0 +1,1199 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+var (
+	ErrNotLeader           = errors.New("raft: node is not the leader")
+	ErrLeadershipLost      = errors.New("raft: leadership lost before the entry was committed")
+	ErrRaftStopped         = errors.New("raft: node is stopped")
+	ErrConfigChangePending = errors.New("raft: a membership change is already in progress")
+	ErrUnknownServer       = errors.New("raft: server is not a cluster member")
+	ErrLogGap              = errors.New("raft: log indexes are not contiguous")
+)
+
+type NotLeaderError struct {
+	LeaderID      string
+	LeaderAddress string
+}
+
+func (e *NotLeaderError) Error() string {
+	if e.LeaderID == "" {
+		return ErrNotLeader.Error() + " (leader unknown)"
+	}
+	return fmt.Sprintf("%s (leader is %s at %s)", ErrNotLeader, e.LeaderID, e.LeaderAddress)
+}
+
+func (e *NotLeaderError) Is(target error) bool {
+	return target == ErrNotLeader
+}
+
+type RaftRole int
+
+const (
+	RaftFollower RaftRole = iota
+	RaftCandidate
+	RaftLeader
+)
+
+func (r RaftRole) String() string {
+	switch r {
+	case RaftFollower:
+		return "follower"
+	case RaftCandidate:
+		return "candidate"
+	case RaftLeader:
+		return "leader"
+	}
+	return "unknown"
+}
+
+type RaftEntryType int
+
+const (
+	RaftEntryCommand RaftEntryType = iota
+	RaftEntryConfig
+	RaftEntryNoop
+)
+
+type RaftLogEntry struct {
+	Index uint64        `json:"index"`
+	Term  uint64        `json:"term"`
+	Type  RaftEntryType `json:"type"`
+	Data  []byte        `json:"data,omitempty"`
+}
+
+type RaftServer struct {
+	ID      string `json:"id"`
+	Address string `json:"address"`
+}
+
+type RaftSnapshot struct {
+	LastIndex uint64       `json:"last_index"`
+	LastTerm  uint64       `json:"last_term"`
+	Servers   []RaftServer `json:"servers"`
+	Data      []byte       `json:"data"`
+}
+
+type RaftHardState struct {
+	Term     uint64 `json:"term"`
+	VotedFor string `json:"voted_for,omitempty"`
+}
+
+// RaftStateMachine is the replicated application state. Apply is called once
+// per committed command, in log order, on every node.
+type RaftStateMachine interface {
+	Apply(data []byte) interface{}
+	Snapshot() ([]byte, error)
+	Restore(data []byte) error
+}
+
+type RaftConfig struct {
+	ID      string
+	Address string
+
+	// Bootstrap is the initial membership. Every founding node must be given
+	// the same list; nodes joining an existing cluster leave it empty and are
+	// added through AddServer on the leader.
+	Bootstrap []RaftServer
+
+	Transport    RaftTransport
+	Storage      RaftStorage
+	StateMachine RaftStateMachine
+
+	HeartbeatInterval time.Duration
+	ElectionTimeout   time.Duration
+	RPCTimeout        time.Duration
+	SnapshotThreshold uint64
+	MaxAppendEntries  int
+}
+
+type RaftStatus struct {
+	ID            string       `json:"id"`
+	Role          string       `json:"role"`
+	Term          uint64       `json:"term"`
+	LeaderID      string       `json:"leader_id,omitempty"`
+	LeaderAddress string       `json:"leader_address,omitempty"`
+	CommitIndex   uint64       `json:"commit_index"`
+	LastApplied   uint64       `json:"last_applied"`
+	LastLogIndex  uint64       `json:"last_log_index"`
+	SnapshotIndex uint64       `json:"snapshot_index"`
+	Servers       []RaftServer `json:"servers"`
+}
+
+type raftProposal struct {
+	term uint64
+	done chan raftResult
+}
+
+type raftResult struct {
+	value interface{}
+	err   error
+}
+
+type RaftNode struct {
+	cfg       RaftConfig
+	transport RaftTransport
+	storage   RaftStorage
+	fsm       RaftStateMachine
+
+	// applyMu serialises every access to the state machine so that snapshot
+	// installation never races with the apply loop. It is taken before mu.
+	applyMu sync.Mutex
+
+	mu          sync.Mutex
+	role        RaftRole
+	term        uint64
+	votedFor    string
+	leaderID    string
+	log         []RaftLogEntry
+	snapIndex   uint64
+	snapTerm    uint64
+	snapServers []RaftServer
+	servers     []RaftServer
+	configIndex uint64
+	commitIndex uint64
+	lastApplied uint64
+	leaderReady uint64
+
+	nextIndex   map[string]uint64
+	matchIndex  map[string]uint64
+	lastAck     map[string]time.Time
+	replicating map[string]bool
+	votes       map[string]bool
+
+	electionDeadline time.Time
+	lastContact      time.Time
+	waiters          map[uint64]*raftProposal
+	rng              *rand.Rand
+
+	applyCh chan struct{}
+	stopCh  chan struct{}
+	stopped bool
+	wg      sync.WaitGroup
+}
+
+func NewRaftNode(cfg RaftConfig) (*RaftNode, error) {
+	if cfg.ID == "" {
+		return nil, errors.New("raft: node ID is required")
+	}
+	if cfg.Transport == nil {
+		return nil, errors.New("raft: transport is required")
+	}
+	if cfg.StateMachine == nil {
+		return nil, errors.New("raft: state machine is required")
+	}
+	if cfg.Storage == nil {
+		cfg.Storage = NewMemoryRaftStorage()
+	}
+	if cfg.HeartbeatInterval <= 0 {
+		cfg.HeartbeatInterval = 50 * time.Millisecond
+	}
+	if cfg.ElectionTimeout <= 0 {
+		cfg.ElectionTimeout = 10 * cfg.HeartbeatInterval
+	}
+	if cfg.RPCTimeout <= 0 {
+		cfg.RPCTimeout = cfg.ElectionTimeout
+	}
+	if cfg.SnapshotThreshold == 0 {
+		cfg.SnapshotThreshold = 1024
+	}
+	if cfg.MaxAppendEntries <= 0 {
+		cfg.MaxAppendEntries = 256
+	}
+
+	n := &RaftNode{
+		cfg:         cfg,
+		transport:   cfg.Transport,
+		storage:     cfg.Storage,
+		fsm:         cfg.StateMachine,
+		nextIndex:   make(map[string]uint64),
+		matchIndex:  make(map[string]uint64),
+		lastAck:     make(map[string]time.Time),
+		replicating: make(map[string]bool),
+		waiters:     make(map[uint64]*raftProposal),
+		rng:         rand.New(rand.NewSource(time.Now().UnixNano())),
+		applyCh:     make(chan struct{}, 1),
+		stopCh:      make(chan struct{}),
+	}
+
+	if err := n.restore(); err != nil {
+		return nil, err
+	}
+	n.resetElectionTimer()
+
+	n.wg.Add(2)
+	go n.run()
+	go n.applyLoop()
+
+	return n, nil
+}
+
+func (n *RaftNode) restore() error {
+	hs, err := n.storage.LoadState()
+	if err != nil {
+		return fmt.Errorf("raft: load state: %w", err)
+	}
+	n.term = hs.Term
+	n.votedFor = hs.VotedFor
+
+	snap, err := n.storage.LoadSnapshot()
+	if err != nil {
+		return fmt.Errorf("raft: load snapshot: %w", err)
+	}
+	if snap != nil {
+		if err := n.fsm.Restore(snap.Data); err != nil {
+			return fmt.Errorf("raft: restore snapshot: %w", err)
+		}
+		n.snapIndex = snap.LastIndex
+		n.snapTerm = snap.LastTerm
+		n.snapServers = cloneServers(snap.Servers)
+		n.commitIndex = snap.LastIndex
+		n.lastApplied = snap.LastIndex
+	}
+
+	entries, err := n.storage.LoadLog()
+	if err != nil {
+		return fmt.Errorf("raft: load log: %w", err)
+	}
+	for _, e := range entries {
+		if e.Index > n.snapIndex {
+			n.log = append(n.log, e)
+		}
+	}
+	if len(n.log) > 0 && n.log[0].Index != n.snapIndex+1 {
+		return fmt.Errorf("raft: load log: first entry %d does not follow snapshot %d: %w", n.log[0].Index, n.snapIndex, ErrLogGap)
+	}
+
+	if snap == nil && len(n.log) == 0 && len(n.cfg.Bootstrap) > 0 {
+		data, err := encodeServers(n.cfg.Bootstrap)
+		if err != nil {
+			return err
+		}
+		entry := RaftLogEntry{Index: 1, Term: 0, Type: RaftEntryConfig, Data: data}
+		if err := n.storage.AppendLog([]RaftLogEntry{entry}); err != nil {
+			return fmt.Errorf("raft: bootstrap: %w", err)
+		}
+		n.log = append(n.log, entry)
+	}
+
+	n.recomputeConfig()
+	return nil
+}
+
+func (n *RaftNode) ID() string {
+	return n.cfg.ID
+}
+
+func (n *RaftNode) Status() RaftStatus {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	leaderAddr := ""
+	if srv, ok := n.serverByID(n.leaderID); ok {
+		leaderAddr = srv.Address
+	}
+	return RaftStatus{
+		ID:            n.cfg.ID,
+		Role:          n.role.String(),
+		Term:          n.term,
+		LeaderID:      n.leaderID,
+		LeaderAddress: leaderAddr,
+		CommitIndex:   n.commitIndex,
+		LastApplied:   n.lastApplied,
+		LastLogIndex:  n.lastIndex(),
+		SnapshotIndex: n.snapIndex,
+		Servers:       cloneServers(n.servers),
+	}
+}
+
+func (n *RaftNode) IsLeader() bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.role == RaftLeader
+}
+
+// Propose appends a command to the log and blocks until it has been committed
+// and applied locally, returning the state machine's result.
+func (n *RaftNode) Propose(ctx context.Context, data []byte) (interface{}, error) {
+	return n.propose(ctx, RaftEntryCommand, data, nil)
+}
+
+func (n *RaftNode) AddServer(ctx context.Context, srv RaftServer) error {
+	if srv.ID == "" || srv.Address == "" {
+		return errors.New("raft: server ID and address are required")
+	}
+	return n.changeConfig(ctx, func(current []RaftServer) ([]RaftServer, error) {
+		next := make([]RaftServer, 0, len(current)+1)
+		for _, s := range current {
+			if s.ID == srv.ID {
+				if s.Address == srv.Address {
+					return nil, nil
+				}
+				continue
+			}
+			next = append(next, s)
+		}
+		return append(next, srv), nil
+	})
+}
+
+func (n *RaftNode) RemoveServer(ctx context.Context, id string) error {
+	return n.changeConfig(ctx, func(current []RaftServer) ([]RaftServer, error) {
+		next := make([]RaftServer, 0, len(current))
+		found := false
+		for _, s := range current {
+			if s.ID == id {
+				found = true
+				continue
+			}
+			next = append(next, s)
+		}
+		if !found {
+			return nil, ErrUnknownServer
+		}
+		return next, nil
+	})
+}
+
+// changeConfig waits out any membership change still in flight (including a
+// new leader's first commit) before proposing its own.
+func (n *RaftNode) changeConfig(ctx context.Context, change func([]RaftServer) ([]RaftServer, error)) error {
+	for {
+		_, err := n.propose(ctx, RaftEntryConfig, nil, change)
+		if !errors.Is(err, ErrConfigChangePending) {
+			return err
+		}
+		select {
+		case <-time.After(n.cfg.HeartbeatInterval):
+		case <-ctx.Done():
+			return err
+		case <-n.stopCh:
+			return ErrRaftStopped
+		}
+	}
+}
+
+func (n *RaftNode) propose(ctx context.Context, typ RaftEntryType, data []byte, change func([]RaftServer) ([]RaftServer, error)) (interface{}, error) {
+	n.mu.Lock()
+	if n.stopped {
+		n.mu.Unlock()
+		return nil, ErrRaftStopped
+	}
+	if n.role != RaftLeader {
+		err := n.notLeaderError()
+		n.mu.Unlock()
+		return nil, err
+	}
+
+	if typ == RaftEntryConfig {
+		// One membership change at a time, and only once an entry from the
+		// current term has committed (Raft dissertation §4.1).
+		if n.configIndex > n.commitIndex || n.commitIndex < n.leaderReady {
+			n.mu.Unlock()
+			return nil, ErrConfigChangePending
+		}
+		next, err := change(cloneServers(n.servers))
+		if err != nil || next == nil {
+			n.mu.Unlock()
+			return nil, err
+		}
+		if data, err = encodeServers(next); err != nil {
+			n.mu.Unlock()
+			return nil, err
+		}
+	}
+
+	entry := RaftLogEntry{Index: n.lastIndex() + 1, Term: n.term, Type: typ, Data: data}
+	if err := n.appendLocal([]RaftLogEntry{entry}); err != nil {
+		n.mu.Unlock()
+		return nil, err
+	}
+
+	p := &raftProposal{term: n.term, done: make(chan raftResult, 1)}
+	n.waiters[entry.Index] = p
+	n.advanceCommit()
+	n.mu.Unlock()
+
+	n.broadcastAppend()
+
+	select {
+	case res := <-p.done:
+		return res.value, res.err
+	case <-ctx.Done():
+		n.mu.Lock()
+		delete(n.waiters, entry.Index)
+		n.mu.Unlock()
+		return nil, ctx.Err()
+	case <-n.stopCh:
+		return nil, ErrRaftStopped
+	}
+}
+
+func (n *RaftNode) Stop() {
+	n.mu.Lock()
+	if n.stopped {
+		n.mu.Unlock()
+		return
+	}
+	n.stopped = true
+	close(n.stopCh)
+	n.mu.Unlock()
+
+	n.wg.Wait()
+
+	n.mu.Lock()
+	n.failWaiters(0, ErrRaftStopped)
+	n.mu.Unlock()
+}
+
+func (n *RaftNode) run() {
+	defer n.wg.Done()
+
+	ticker := time.NewTicker(n.cfg.HeartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			n.tick()
+		case <-n.stopCh:
+			return
+		}
+	}
+}
+
+func (n *RaftNode) tick() {
+	n.mu.Lock()
+	now := time.Now()
+
+	if n.role == RaftLeader {
+		if !n.hasRecentQuorum(now) {
+			// Check-quorum: a leader cut off from the majority stops accepting
+			// writes instead of letting them time out one by one.
+			n.becomeFollower(n.term, "")
+			n.mu.Unlock()
+			return
+		}
+		n.mu.Unlock()
+		n.broadcastAppend()
+		return
+	}
+
+	if now.After(n.electionDeadline) && n.isVoter(n.cfg.ID) {
+		n.startElection()
+	}
+	n.mu.Unlock()
+}
+
+func (n *RaftNode) startElection() {
+	n.role = RaftCandidate
+	n.term++
+	n.votedFor = n.cfg.ID
+	n.leaderID = ""
+	n.votes = map[string]bool{n.cfg.ID: true}
+	n.resetElectionTimer()
+	if err := n.persistState(); err != nil {
+		n.becomeFollower(n.term, "")
+		return
+	}
+
+	if n.hasVoteQuorum() {
+		n.becomeLeader()
+		return
+	}
+
+	req := &RequestVoteRequest{
+		Term:         n.term,
+		CandidateID:  n.cfg.ID,
+		LastLogIndex: n.lastIndex(),
+		LastLogTerm:  n.lastTerm(),
+	}
+	for _, srv := range n.servers {
+		if srv.ID == n.cfg.ID {
+			continue
+		}
+		go n.requestVote(srv, req)
+	}
+}
+
+func (n *RaftNode) requestVote(srv RaftServer, req *RequestVoteRequest) {
+	ctx, cancel := context.WithTimeout(context.Background(), n.cfg.RPCTimeout)
+	defer cancel()
+
+	resp, err := n.transport.RequestVote(ctx, srv.Address, req)
+	if err != nil {
+		return
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if resp.Term > n.term {
+		n.becomeFollower(resp.Term, "")
+		return
+	}
+	if n.role != RaftCandidate || n.term != req.Term || !resp.VoteGranted {
+		return
+	}
+	n.votes[srv.ID] = true
+	if n.hasVoteQuorum() {
+		n.becomeLeader()
+	}
+}
+
+func (n *RaftNode) becomeLeader() {
+	n.role = RaftLeader
+	n.leaderID = n.cfg.ID
+	now := time.Now()
+	for _, srv := range n.servers {
+		n.nextIndex[srv.ID] = n.lastIndex() + 1
+		n.matchIndex[srv.ID] = 0
+		n.lastAck[srv.ID] = now
+	}
+
+	// Committing a no-op from the new term also commits everything before it.
+	entry := RaftLogEntry{Index: n.lastIndex() + 1, Term: n.term, Type: RaftEntryNoop}
+	if err := n.appendLocal([]RaftLogEntry{entry}); err != nil {
+		n.becomeFollower(n.term, "")
+		return
+	}
+	n.leaderReady = entry.Index
+	n.advanceCommit()
+
+	go n.broadcastAppend()
+}
+
+func (n *RaftNode) becomeFollower(term uint64, leaderID string) {
+	if term > n.term {
+		n.term = term
+		n.votedFor = ""
+		n.persistState()
+	}
+	n.role = RaftFollower
+	n.leaderID = leaderID
+	n.votes = nil
+	n.resetElectionTimer()
+}
+
+func (n *RaftNode) broadcastAppend() {
+	n.mu.Lock()
+	if n.role != RaftLeader {
+		n.mu.Unlock()
+		return
+	}
+	peers := make([]RaftServer, 0, len(n.servers))
+	for _, srv := range n.servers {
+		if srv.ID != n.cfg.ID {
+			peers = append(peers, srv)
+		}
+	}
+	n.mu.Unlock()
+
+	for _, srv := range peers {
+		n.replicateTo(srv)
+	}
+}
+
+func (n *RaftNode) replicateTo(srv RaftServer) {
+	n.mu.Lock()
+	if n.role != RaftLeader || n.stopped || n.replicating[srv.ID] {
+		n.mu.Unlock()
+		return
+	}
+
+	next, ok := n.nextIndex[srv.ID]
+	if !ok {
+		next = n.lastIndex() + 1
+		n.nextIndex[srv.ID] = next
+	}
+
+	if next <= n.snapIndex {
+		snap, err := n.storage.LoadSnapshot()
+		if err != nil || snap == nil {
+			n.mu.Unlock()
+			return
+		}
+		req := &InstallSnapshotRequest{Term: n.term, LeaderID: n.cfg.ID, Snapshot: *snap}
+		n.replicating[srv.ID] = true
+		n.mu.Unlock()
+		go n.sendSnapshot(srv, req)
+		return
+	}
+
+	prevIndex := next - 1
+	prevTerm, _ := n.termAt(prevIndex)
+	var entries []RaftLogEntry
+	if last := n.lastIndex(); next <= last {
+		end := last
+		if end-next+1 > uint64(n.cfg.MaxAppendEntries) {
+			end = next + uint64(n.cfg.MaxAppendEntries) - 1
+		}
+		entries = append(entries, n.log[next-n.snapIndex-1:end-n.snapIndex]...)
+	}
+	req := &AppendEntriesRequest{
+		Term:         n.term,
+		LeaderID:     n.cfg.ID,
+		PrevLogIndex: prevIndex,
+		PrevLogTerm:  prevTerm,
+		Entries:      entries,
+		LeaderCommit: n.commitIndex,
+	}
+	n.replicating[srv.ID] = true
+	n.mu.Unlock()
+
+	go n.sendAppend(srv, req)
+}
+
+func (n *RaftNode) sendAppend(srv RaftServer, req *AppendEntriesRequest) {
+	ctx, cancel := context.WithTimeout(context.Background(), n.cfg.RPCTimeout)
+	defer cancel()
+
+	resp, err := n.transport.AppendEntries(ctx, srv.Address, req)
+
+	n.mu.Lock()
+	n.replicating[srv.ID] = false
+	if err != nil {
+		n.mu.Unlock()
+		return
+	}
+	if resp.Term > n.term {
+		n.becomeFollower(resp.Term, "")
+		n.mu.Unlock()
+		return
+	}
+	if n.role != RaftLeader || n.term != req.Term {
+		n.mu.Unlock()
+		return
+	}
+
+	n.lastAck[srv.ID] = time.Now()
+	more := false
+	if resp.Success {
+		match := req.PrevLogIndex + uint64(len(req.Entries))
+		if match > n.matchIndex[srv.ID] {
+			n.matchIndex[srv.ID] = match
+		}
+		n.nextIndex[srv.ID] = match + 1
+		n.advanceCommit()
+		more = n.nextIndex[srv.ID] <= n.lastIndex()
+	} else {
+		next := req.PrevLogIndex
+		if resp.LastLogIndex+1 < next {
+			next = resp.LastLogIndex + 1
+		}
+		if next < 1 {
+			next = 1
+		}
+		n.nextIndex[srv.ID] = next
+		more = true
+	}
+	n.mu.Unlock()
+
+	if more {
+		n.replicateTo(srv)
+	}
+}
+
+func (n *RaftNode) sendSnapshot(srv RaftServer, req *InstallSnapshotRequest) {
+	ctx, cancel := context.WithTimeout(context.Background(), n.cfg.RPCTimeout)
+	defer cancel()
+
+	resp, err := n.transport.InstallSnapshot(ctx, srv.Address, req)
+
+	n.mu.Lock()
+	n.replicating[srv.ID] = false
+	if err != nil {
+		n.mu.Unlock()
+		return
+	}
+	if resp.Term > n.term {
+		n.becomeFollower(resp.Term, "")
+		n.mu.Unlock()
+		return
+	}
+	if n.role != RaftLeader || n.term != req.Term {
+		n.mu.Unlock()
+		return
+	}
+	n.lastAck[srv.ID] = time.Now()
+	if req.Snapshot.LastIndex > n.matchIndex[srv.ID] {
+		n.matchIndex[srv.ID] = req.Snapshot.LastIndex
+	}
+	n.nextIndex[srv.ID] = req.Snapshot.LastIndex + 1
+	n.advanceCommit()
+	n.mu.Unlock()
+
+	n.replicateTo(srv)
+}
+
+func (n *RaftNode) advanceCommit() {
+	if n.role != RaftLeader {
+		return
+	}
+	for idx := n.lastIndex(); idx > n.commitIndex; idx-- {
+		term, ok := n.termAt(idx)
+		if !ok || term != n.term {
+			// Only entries from the leader's own term are committed by
+			// counting replicas.
+			break
+		}
+		count := 0
+		for _, srv := range n.servers {
+			if srv.ID == n.cfg.ID || n.matchIndex[srv.ID] >= idx {
+				count++
+			}
+		}
+		if count > len(n.servers)/2 {
+			n.commitIndex = idx
+			n.signalApply()
+			return
+		}
+	}
+}
+
+func (n *RaftNode) HandleRequestVote(req *RequestVoteRequest) *RequestVoteResponse {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	resp := &RequestVoteResponse{Term: n.term}
+	if req.Term < n.term {
+		return resp
+	}
+
+	// Ignore candidates while a leader is known to be alive. This keeps
+	// removed servers and nodes returning from a partition from deposing a
+	// healthy leader.
+	if n.role == RaftLeader || (n.leaderID != "" && time.Since(n.lastContact) < n.cfg.ElectionTimeout) {
+		return resp
+	}
+
+	if req.Term > n.term {
+		n.becomeFollower(req.Term, "")
+		resp.Term = n.term
+	}
+
+	upToDate := req.LastLogTerm > n.lastTerm() ||
+		(req.LastLogTerm == n.lastTerm() && req.LastLogIndex >= n.lastIndex())
+	if (n.votedFor == "" || n.votedFor == req.CandidateID) && upToDate {
+		n.votedFor = req.CandidateID
+		if err := n.persistState(); err != nil {
+			return resp
+		}
+		n.resetElectionTimer()
+		resp.VoteGranted = true
+	}
+	return resp
+}
+
+func (n *RaftNode) HandleAppendEntries(req *AppendEntriesRequest) *AppendEntriesResponse {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	resp := &AppendEntriesResponse{Term: n.term, LastLogIndex: n.lastIndex()}
+	if req.Term < n.term {
+		return resp
+	}
+
+	n.becomeFollower(req.Term, req.LeaderID)
+	n.lastContact = time.Now()
+	resp.Term = n.term
+
+	if req.PrevLogIndex > n.lastIndex() {
+		return resp
+	}
+	if req.PrevLogIndex > n.snapIndex {
+		if term, _ := n.termAt(req.PrevLogIndex); term != req.PrevLogTerm {
+			// Skip back over the whole conflicting term in one round trip.
+			hint := req.PrevLogIndex - 1
+			for hint > n.snapIndex {
+				if t, _ := n.termAt(hint); t != term {
+					break
+				}
+				hint--
+			}
+			resp.LastLogIndex = hint
+			return resp
+		}
+	}
+
+	var fresh []RaftLogEntry
+	for i, e := range req.Entries {
+		if e.Index <= n.snapIndex {
+			continue
+		}
+		if e.Index <= n.lastIndex() {
+			if term, _ := n.termAt(e.Index); term == e.Term {
+				continue
+			}
+			if err := n.truncateFrom(e.Index); err != nil {
+				return resp
+			}
+		}
+		fresh = req.Entries[i:]
+		break
+	}
+	if len(fresh) > 0 {
+		if err := n.appendLocal(fresh); err != nil {
+			return resp
+		}
+	}
+
+	if req.LeaderCommit > n.commitIndex {
+		lastNew := req.PrevLogIndex + uint64(len(req.Entries))
+		commit := req.LeaderCommit
+		if lastNew < commit {
+			commit = lastNew
+		}
+		if commit > n.commitIndex {
+			n.commitIndex = commit
+			n.signalApply()
+		}
+	}
+
+	resp.Success = true
+	resp.LastLogIndex = n.lastIndex()
+	return resp
+}
+
+func (n *RaftNode) HandleInstallSnapshot(req *InstallSnapshotRequest) *InstallSnapshotResponse {
+	n.applyMu.Lock()
+	defer n.applyMu.Unlock()
+
+	n.mu.Lock()
+	resp := &InstallSnapshotResponse{Term: n.term}
+	if req.Term < n.term {
+		n.mu.Unlock()
+		return resp
+	}
+	n.becomeFollower(req.Term, req.LeaderID)
+	n.lastContact = time.Now()
+	resp.Term = n.term
+
+	snap := req.Snapshot
+	if snap.LastIndex <= n.snapIndex {
+		n.mu.Unlock()
+		return resp
+	}
+	needRestore := snap.LastIndex > n.lastApplied
+	n.mu.Unlock()
+
+	if needRestore {
+		if err := n.fsm.Restore(snap.Data); err != nil {
+			return resp
+		}
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if err := n.storage.SaveSnapshot(&snap); err != nil {
+		return resp
+	}
+
+	var kept []RaftLogEntry
+	if term, ok := n.termAt(snap.LastIndex); ok && term == snap.LastTerm && snap.LastIndex <= n.lastIndex() {
+		kept = append(kept, n.log[snap.LastIndex-n.snapIndex:]...)
+	}
+	n.log = kept
+	n.snapIndex = snap.LastIndex
+	n.snapTerm = snap.LastTerm
+	n.snapServers = cloneServers(snap.Servers)
+	n.storage.ReplaceLog(n.log)
+	n.recomputeConfig()
+
+	if snap.LastIndex > n.commitIndex {
+		n.commitIndex = snap.LastIndex
+	}
+	if snap.LastIndex > n.lastApplied {
+		n.lastApplied = snap.LastIndex
+	}
+	return resp
+}
+
+func (n *RaftNode) applyLoop() {
+	defer n.wg.Done()
+
+	for {
+		select {
+		case <-n.applyCh:
+		case <-n.stopCh:
+			return
+		}
+		n.applyCommitted()
+	}
+}
+
+func (n *RaftNode) applyCommitted() {
+	n.applyMu.Lock()
+	defer n.applyMu.Unlock()
+
+	for {
+		n.mu.Lock()
+		if n.lastApplied >= n.commitIndex {
+			n.mu.Unlock()
+			break
+		}
+		entry, ok := n.entryAt(n.lastApplied + 1)
+		n.mu.Unlock()
+		if !ok {
+			break
+		}
+
+		var value interface{}
+		if entry.Type == RaftEntryCommand {
+			value = n.fsm.Apply(entry.Data)
+		}
+
+		n.mu.Lock()
+		n.lastApplied = entry.Index
+		if p, ok := n.waiters[entry.Index]; ok {
+			delete(n.waiters, entry.Index)
+			if p.term == entry.Term {
+				p.done <- raftResult{value: value}
+			} else {
+				p.done <- raftResult{err: ErrLeadershipLost}
+			}
+		}
+		if entry.Type == RaftEntryConfig && entry.Index == n.configIndex &&
+			n.role == RaftLeader && !n.isVoter(n.cfg.ID) {
+			// A leader that removed itself hands over once the change commits.
+			n.becomeFollower(n.term, "")
+		}
+		n.mu.Unlock()
+	}
+
+	n.maybeSnapshot()
+}
+
+func (n *RaftNode) maybeSnapshot() {
+	n.mu.Lock()
+	if n.lastApplied-n.snapIndex < n.cfg.SnapshotThreshold {
+		n.mu.Unlock()
+		return
+	}
+	index := n.lastApplied
+	n.mu.Unlock()
+
+	// The apply loop owns the state machine, so it reflects exactly index.
+	data, err := n.fsm.Snapshot()
+	if err != nil {
+		return
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	term, ok := n.termAt(index)
+	if !ok || index <= n.snapIndex {
+		return
+	}
+	snap := &RaftSnapshot{
+		LastIndex: index,
+		LastTerm:  term,
+		Servers:   n.configAt(index),
+		Data:      data,
+	}
+	if err := n.storage.SaveSnapshot(snap); err != nil {
+		return
+	}
+	n.log = append([]RaftLogEntry(nil), n.log[index-n.snapIndex:]...)
+	n.snapIndex = index
+	n.snapTerm = term
+	n.snapServers = snap.Servers
+	n.storage.ReplaceLog(n.log)
+}
+
+func (n *RaftNode) appendLocal(entries []RaftLogEntry) error {
+	if err := n.storage.AppendLog(entries); err != nil {
+		return err
+	}
+	n.log = append(n.log, entries...)
+	for _, e := range entries {
+		if e.Type == RaftEntryConfig {
+			n.recomputeConfig()
+			break
+		}
+	}
+	return nil
+}
+
+func (n *RaftNode) truncateFrom(index uint64) error {
+	n.log = n.log[:index-n.snapIndex-1]
+	if err := n.storage.ReplaceLog(n.log); err != nil {
+		return err
+	}
+	n.failWaiters(index, ErrLeadershipLost)
+	n.recomputeConfig()
+	return nil
+}
+
+func (n *RaftNode) failWaiters(from uint64, err error) {
+	for idx, p := range n.waiters {
+		if idx >= from {
+			delete(n.waiters, idx)
+			p.done <- raftResult{err: err}
+		}
+	}
+}
+
+// recomputeConfig makes the newest configuration in the log effective. New
+// configurations apply as soon as they are appended, not when committed.
+func (n *RaftNode) recomputeConfig() {
+	for i := len(n.log) - 1; i >= 0; i-- {
+		if n.log[i].Type != RaftEntryConfig {
+			continue
+		}
+		servers, err := decodeServers(n.log[i].Data)
+		if err != nil {
+			continue
+		}
+		n.servers = servers
+		n.configIndex = n.log[i].Index
+		n.syncPeerState()
+		return
+	}
+	n.servers = cloneServers(n.snapServers)
+	n.configIndex = n.snapIndex
+	n.syncPeerState()
+}
+
+func (n *RaftNode) syncPeerState() {
+	if n.role != RaftLeader {
+		return
+	}
+	now := time.Now()
+	for _, srv := range n.servers {
+		if _, ok := n.nextIndex[srv.ID]; !ok {
+			n.nextIndex[srv.ID] = n.lastIndex() + 1
+			n.matchIndex[srv.ID] = 0
+			n.lastAck[srv.ID] = now
+		}
+	}
+}
+
+func (n *RaftNode) configAt(index uint64) []RaftServer {
+	for i := len(n.log) - 1; i >= 0; i-- {
+		e := n.log[i]
+		if e.Index > index || e.Type != RaftEntryConfig {
+			continue
+		}
+		if servers, err := decodeServers(e.Data); err == nil {
+			return servers
+		}
+	}
+	return cloneServers(n.snapServers)
+}
+
+func (n *RaftNode) hasVoteQuorum() bool {
+	count := 0
+	for _, srv := range n.servers {
+		if n.votes[srv.ID] {
+			count++
+		}
+	}
+	return len(n.servers) > 0 && count > len(n.servers)/2
+}
+
+func (n *RaftNode) hasRecentQuorum(now time.Time) bool {
+	count := 0
+	for _, srv := range n.servers {
+		if srv.ID == n.cfg.ID || now.Sub(n.lastAck[srv.ID]) < n.cfg.ElectionTimeout {
+			count++
+		}
+	}
+	return count > len(n.servers)/2
+}
+
+func (n *RaftNode) isVoter(id string) bool {
+	_, ok := n.serverByID(id)
+	return ok
+}
+
+func (n *RaftNode) serverByID(id string) (RaftServer, bool) {
+	for _, srv := range n.servers {
+		if srv.ID == id {
+			return srv, true
+		}
+	}
+	return RaftServer{}, false
+}
+
+func (n *RaftNode) notLeaderError() error {
+	err := &NotLeaderError{LeaderID: n.leaderID}
+	if srv, ok := n.serverByID(n.leaderID); ok {
+		err.LeaderAddress = srv.Address
+	}
+	return err
+}
+
+func (n *RaftNode) lastIndex() uint64 {
+	if len(n.log) > 0 {
+		return n.log[len(n.log)-1].Index
+	}
+	return n.snapIndex
+}
+
+func (n *RaftNode) lastTerm() uint64 {
+	if len(n.log) > 0 {
+		return n.log[len(n.log)-1].Term
+	}
+	return n.snapTerm
+}
+
+func (n *RaftNode) termAt(index uint64) (uint64, bool) {
+	if index == n.snapIndex {
+		return n.snapTerm, true
+	}
+	if e, ok := n.entryAt(index); ok {
+		return e.Term, true
+	}
+	return 0, false
+}
+
+func (n *RaftNode) entryAt(index uint64) (RaftLogEntry, bool) {
+	if index <= n.snapIndex || index > n.lastIndex() {
+		return RaftLogEntry{}, false
+	}
+	return n.log[index-n.snapIndex-1], true
+}
+
+func (n *RaftNode) persistState() error {
+	return n.storage.SaveState(RaftHardState{Term: n.term, VotedFor: n.votedFor})
+}
+
+func (n *RaftNode) resetElectionTimer() {
+	timeout := n.cfg.ElectionTimeout + time.Duration(n.rng.Int63n(int64(n.cfg.ElectionTimeout)))
+	n.electionDeadline = time.Now().Add(timeout)
+}
+
+func (n *RaftNode) signalApply() {
+	select {
+	case n.applyCh <- struct{}{}:
+	default:
+	}
+}
+
+func cloneServers(servers []RaftServer) []RaftServer {
+	if servers == nil {
+		return nil
+	}
+	return append([]RaftServer(nil), servers...)
+}
+
+func encodeServers(servers []RaftServer) ([]byte, error) {
+	return json.Marshal(servers)
+}
+
+func decodeServers(data []byte) ([]RaftServer, error) {
+	var servers []RaftServer
+	err := json.Unmarshal(data, &servers)
+	return servers, err
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+type raftCommand struct {
+	Op    string          `json:"op"`
+	Key   string          `json:"key"`
+	Kind  string          `json:"kind,omitempty"`
+	Value json.RawMessage `json:"value,omitempty"`
+	// TTL is a set's own lifetime, replacing the cache's TTL.
+	TTL time.Duration `json:"ttl,omitempty"`
+	// Update is the collection operation of an update command.
+	Update *collectionOp `json:"update,omitempty"`
+	// Lock is the lock service change of a lock command.
+	Lock *lockCommand `json:"lock,omitempty"`
+}
+
+const (
+	raftOpSet    = "set"
+	raftOpDelete = "delete"
+	raftOpUpdate = "update"
+	raftOpLock   = "lock"
+)
+
+// cacheStateMachine applies replicated commands to a local cache. Set and
+// delete report whether the key was created or removed, and update returns
+// the operation's result, so the proposing node can answer with the same
+// detail as a local cache. Lock commands change the lock table replicated
+// alongside the cache.
+type cacheStateMachine struct {
+	cache Cache
+	locks *lockTable
+}
+
+func (m *cacheStateMachine) Apply(data []byte) interface{} {
+	var cmd raftCommand
+	if err := json.Unmarshal(data, &cmd); err != nil {
+		return fmt.Errorf("raft: invalid command: %w", err)
+	}
+
+	switch cmd.Op {
+	case raftOpSet:
+		value, err := decodeValue(cmd.Kind, cmd.Value)
+		if err != nil {
+			return fmt.Errorf("raft: invalid value for key '%s': %w", cmd.Key, err)
+		}
+		if cmd.TTL > 0 {
+			ew, ok := m.cache.(ExpiringWriter)
+			if !ok {
+				return ErrTTLUnsupported
+			}
+			_, created, err := ew.UpsertWithTTL(context.Background(), cmd.Key, value, cmd.TTL, nil)
+			return applyResult(created, err)
+		}
+		if u, ok := m.cache.(Upserter); ok {
+			return applyResult(u.Upsert(cmd.Key, value))
+		}
+		return m.cache.Set(cmd.Key, value)
+	case raftOpDelete:
+		if r, ok := m.cache.(Remover); ok {
+			return applyResult(r.Remove(cmd.Key))
+		}
+		return m.cache.Delete(cmd.Key)
+	case raftOpUpdate:
+		u, ok := m.cache.(Updater)
+		if !ok {
+			return ErrUpdatesUnsupported
+		}
+		if cmd.Update == nil {
+			return fmt.Errorf("raft: update for key '%s' has no operation", cmd.Key)
+		}
+		result, _, err := cmd.Update.applyTo(u, cmd.Key)
+		if err != nil {
+			return err
+		}
+		return result
+	case raftOpLock:
+		if cmd.Lock == nil {
+			return errors.New("raft: lock command has no operation")
+		}
+		l, err := m.locks.apply(*cmd.Lock)
+		if err != nil {
+			return err
+		}
+		return l
+	}
+	return fmt.Errorf("raft: unknown command '%s'", cmd.Op)
+}
+
+func applyResult(ok bool, err error) interface{} {
+	if err != nil {
+		return err
+	}
+	return ok
+}
+
+// stateSnapshot is the state machine's snapshot. Snapshots taken before
+// locks were replicated hold the cache snapshot alone, a JSON array.
+type stateSnapshot struct {
+	Cache json.RawMessage `json:"cache"`
+	Locks json.RawMessage `json:"locks"`
+}
+
+func (m *cacheStateMachine) Snapshot() ([]byte, error) {
+	s, ok := m.cache.(Snapshotter)
+	if !ok {
+		return nil, errors.New("raft: cache does not support snapshots")
+	}
+	cache, err := s.Snapshot()
+	if err != nil {
+		return nil, err
+	}
+	locks, err := m.locks.snapshot()
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(stateSnapshot{Cache: cache, Locks: locks})
+}
+
+func (m *cacheStateMachine) Restore(data []byte) error {
+	s, ok := m.cache.(Snapshotter)
+	if !ok {
+		return errors.New("raft: cache does not support snapshots")
+	}
+	trimmed := bytes.TrimSpace(data)
+	if len(trimmed) == 0 || trimmed[0] != '{' {
+		return s.Restore(data)
+	}
+	var snap stateSnapshot
+	if err := json.Unmarshal(trimmed, &snap); err != nil {
+		return fmt.Errorf("raft: invalid snapshot: %w", err)
+	}
+	if err := s.Restore(snap.Cache); err != nil {
+		return err
+	}
+	return m.locks.restore(snap.Locks)
+}
+
+// ReplicatedCache replicates Set, Delete, collection operations and the lock
+// service through a Raft log so that writes are linearizable across nodes.
+// Reads are served from the local copy. Values are replicated as JSON, so
+// every node sees JSON-decoded values.
+type ReplicatedCache struct {
+	node    *RaftNode
+	local   Cache
+	locks   *LockService
+	timeout time.Duration
+}
+
+func NewReplicatedCache(local Cache, cfg RaftConfig) (*ReplicatedCache, error) {
+	if _, ok := local.(Snapshotter); !ok {
+		return nil, errors.New("raft: local cache must support snapshots")
+	}
+	table := newLockTable(0)
+	cfg.StateMachine = &cacheStateMachine{cache: local, locks: table}
+
+	node, err := NewRaftNode(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	timeout := 5 * time.Second
+	if t := 4 * node.cfg.ElectionTimeout; t > timeout {
+		timeout = t
+	}
+	c := &ReplicatedCache{node: node, local: local, timeout: timeout}
+	c.locks = newLockService(table, nil, c.proposeLock)
+	return c, nil
+}
+
+func (c *ReplicatedCache) Node() *RaftNode {
+	return c.node
+}
+
+// Locks returns the replicated lock service. Changes must be made on the
+// leader; any node can list the locks it has applied.
+func (c *ReplicatedCache) Locks() *LockService {
+	return c.locks
+}
+
+func (c *ReplicatedCache) proposeLock(ctx context.Context, cmd lockCommand) (Lock, error) {
+	result, err := c.proposeResult(ctx, raftCommand{Op: raftOpLock, Key: cmd.Name, Lock: &cmd})
+	if err != nil {
+		return Lock{}, err
+	}
+	l, _ := result.(Lock)
+	return l, nil
+}
+
+func (c *ReplicatedCache) Set(key string, value interface{}) error {
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+	return c.SetContext(ctx, key, value)
+}
+
+func (c *ReplicatedCache) SetContext(ctx context.Context, key string, value interface{}) error {
+	_, err := c.UpsertContext(ctx, key, value)
+	return err
+}
+
+func (c *ReplicatedCache) Upsert(key string, value interface{}) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+	return c.UpsertContext(ctx, key, value)
+}
+
+func (c *ReplicatedCache) UpsertContext(ctx context.Context, key string, value interface{}) (bool, error) {
+	if err := validateKey(key); err != nil {
+		return false, err
+	}
+	kind, raw, err := encodeValue(value)
+	if err != nil {
+		return false, fmt.Errorf("raft: value for key '%s' is not JSON-encodable: %w", key, err)
+	}
+	return c.propose(ctx, raftCommand{Op: raftOpSet, Key: key, Kind: kind, Value: raw})
+}
+
+// UpsertWithTTL replicates a write with its own lifetime. A cond is refused
+// with ErrConditionalUnsupported: it could only be checked against this
+// node's replica, apart from the write and with this node's versions.
+func (c *ReplicatedCache) UpsertWithTTL(ctx context.Context, key string, value interface{}, ttl time.Duration, cond Precondition) (Entry, bool, error) {
+	if err := validateKey(key); err != nil {
+		return Entry{}, false, err
+	}
+	if ttl <= 0 {
+		return Entry{}, false, ErrInvalidTTL
+	}
+	if cond != nil {
+		return Entry{}, false, ErrConditionalUnsupported
+	}
+	kind, raw, err := encodeValue(value)
+	if err != nil {
+		return Entry{}, false, fmt.Errorf("raft: value for key '%s' is not JSON-encodable: %w", key, err)
+	}
+	created, err := c.propose(ctx, raftCommand{Op: raftOpSet, Key: key, Kind: kind, Value: raw, TTL: ttl})
+	if err != nil {
+		return Entry{}, false, err
+	}
+	entry, _, err := c.GetEntry(key)
+	return entry, created, err
+}
+
+// Keys lists the keys of the local replica.
+func (c *ReplicatedCache) Keys() []string {
+	if l, ok := c.local.(KeyLister); ok {
+		return l.Keys()
+	}
+	return nil
+}
+
+func (c *ReplicatedCache) Get(key string) (interface{}, bool, error) {
+	return c.local.Get(key)
+}
+
+// GetContext reads the local replica; ctx is only checked before the read.
+func (c *ReplicatedCache) GetContext(ctx context.Context, key string) (interface{}, bool, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, false, err
+	}
+	if cc, ok := c.local.(ContextCache); ok {
+		return cc.GetContext(ctx, key)
+	}
+	return c.local.Get(key)
+}
+
+// GetEntry exposes the local entry metadata. Versions are assigned by each
+// node when it applies a write, so validators differ between nodes.
+func (c *ReplicatedCache) GetEntry(key string) (Entry, bool, error) {
+	if g, ok := c.local.(EntryGetter); ok {
+		return g.GetEntry(key)
+	}
+	value, exists, err := c.local.Get(key)
+	return Entry{Value: value}, exists, err
+}
+
+func (c *ReplicatedCache) Delete(key string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+	return c.DeleteContext(ctx, key)
+}
+
+func (c *ReplicatedCache) DeleteContext(ctx context.Context, key string) error {
+	_, err := c.RemoveContext(ctx, key)
+	return err
+}
+
+func (c *ReplicatedCache) Remove(key string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+	return c.RemoveContext(ctx, key)
+}
+
+func (c *ReplicatedCache) RemoveContext(ctx context.Context, key string) (bool, error) {
+	if err := validateKey(key); err != nil {
+		return false, err
+	}
+	return c.propose(ctx, raftCommand{Op: raftOpDelete, Key: key})
+}
+
+// applyOp replicates a collection operation and returns its result as
+// applied on this node.
+func (c *ReplicatedCache) applyOp(ctx context.Context, key string, op collectionOp) (interface{}, error) {
+	if err := validateKey(key); err != nil {
+		return nil, err
+	}
+	return c.proposeResult(ctx, raftCommand{Op: raftOpUpdate, Key: key, Update: &op})
+}
+
+func (c *ReplicatedCache) propose(ctx context.Context, cmd raftCommand) (bool, error) {
+	result, err := c.proposeResult(ctx, cmd)
+	if err != nil {
+		return false, err
+	}
+	ok, _ := result.(bool)
+	return ok, nil
+}
+
+func (c *ReplicatedCache) proposeResult(ctx context.Context, cmd raftCommand) (interface{}, error) {
+	data, err := json.Marshal(cmd)
+	if err != nil {
+		return nil, err
+	}
+	result, err := c.node.Propose(ctx, data)
+	if err != nil {
+		return nil, err
+	}
+	if err, ok := result.(error); ok {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (c *ReplicatedCache) Close() error {
+	c.node.Stop()
+	if closer, ok := c.local.(Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+)
+
+type RaftStorage interface {
+	LoadState() (RaftHardState, error)
+	SaveState(state RaftHardState) error
+	LoadLog() ([]RaftLogEntry, error)
+	AppendLog(entries []RaftLogEntry) error
+	// ReplaceLog overwrites the whole log; used after truncation and compaction.
+	ReplaceLog(entries []RaftLogEntry) error
+	LoadSnapshot() (*RaftSnapshot, error)
+	SaveSnapshot(snap *RaftSnapshot) error
+}
+
+type MemoryRaftStorage struct {
+	mu       sync.Mutex
+	state    RaftHardState
+	log      []RaftLogEntry
+	snapshot *RaftSnapshot
+}
+
+func NewMemoryRaftStorage() *MemoryRaftStorage {
+	return &MemoryRaftStorage{}
+}
+
+func (s *MemoryRaftStorage) LoadState() (RaftHardState, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.state, nil
+}
+
+func (s *MemoryRaftStorage) SaveState(state RaftHardState) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.state = state
+	return nil
+}
+
+func (s *MemoryRaftStorage) LoadLog() ([]RaftLogEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]RaftLogEntry(nil), s.log...), nil
+}
+
+func (s *MemoryRaftStorage) AppendLog(entries []RaftLogEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.log = append(s.log, entries...)
+	return nil
+}
+
+func (s *MemoryRaftStorage) ReplaceLog(entries []RaftLogEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.log = append([]RaftLogEntry(nil), entries...)
+	return nil
+}
+
+func (s *MemoryRaftStorage) LoadSnapshot() (*RaftSnapshot, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.snapshot, nil
+}
+
+func (s *MemoryRaftStorage) SaveSnapshot(snap *RaftSnapshot) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.snapshot = snap
+	return nil
+}
+
+// FileRaftStorage keeps Raft state in a directory: state.json for the term
+// and vote, log.jsonl with one entry per line, and snapshot.json. With a
+// keyring, each file and each log line is sealed with AES-GCM.
+type FileRaftStorage struct {
+	dir     string
+	keyring *Keyring
+	mu      sync.Mutex
+	log     *os.File
+}
+
+// Purposes the files are sealed for, so one cannot be passed off as another.
+const (
+	raftStatePurpose    = "raft-state"
+	raftLogPurpose      = "raft-log"
+	raftSnapshotPurpose = "raft-snapshot"
+)
+
+func NewFileRaftStorage(dir string) (*FileRaftStorage, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("raft: create data dir: %w", err)
+	}
+	return &FileRaftStorage{dir: dir}, nil
+}
+
+// SetKeyring encrypts everything written from now on and requires
+// everything read to be encrypted. Call it before the storage is used.
+func (s *FileRaftStorage) SetKeyring(keyring *Keyring) {
+	s.keyring = keyring
+}
+
+func (s *FileRaftStorage) path(name string) string {
+	return filepath.Join(s.dir, name)
+}
+
+// readFile returns the opened contents of name, or nil if it does not exist.
+func (s *FileRaftStorage) readFile(name, purpose string) ([]byte, error) {
+	data, err := os.ReadFile(s.path(name))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	data, err = s.keyring.Open(purpose, data)
+	if err != nil {
+		return nil, fmt.Errorf("raft: %s: %w", name, err)
+	}
+	return data, nil
+}
+
+func (s *FileRaftStorage) writeFile(name, purpose string, data []byte) error {
+	data, err := s.keyring.Seal(purpose, data)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path(name), data)
+}
+
+func (s *FileRaftStorage) LoadState() (RaftHardState, error) {
+	var state RaftHardState
+	data, err := s.readFile("state.json", raftStatePurpose)
+	if err != nil || data == nil {
+		return state, err
+	}
+	return state, json.Unmarshal(data, &state)
+}
+
+func (s *FileRaftStorage) SaveState(state RaftHardState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return s.writeFile("state.json", raftStatePurpose, data)
+}
+
+// encodeLogLine is one line of log.jsonl without its newline: the entry's
+// JSON, or with a keyring its index and its sealed form in base64. The index
+// is sealed into the line, so lines cannot be moved, dropped from the middle
+// or repeated without LoadLog noticing.
+func (s *FileRaftStorage) encodeLogLine(e RaftLogEntry) ([]byte, error) {
+	line, err := json.Marshal(e)
+	if err != nil || s.keyring == nil {
+		return line, err
+	}
+	sealed, err := s.keyring.Seal(raftLogEntryPurpose(e.Index), line)
+	if err != nil {
+		return nil, err
+	}
+	return fmt.Appendf(nil, "%d %s", e.Index, base64.StdEncoding.EncodeToString(sealed)), nil
+}
+
+func (s *FileRaftStorage) decodeLogLine(line []byte) (RaftLogEntry, error) {
+	var e RaftLogEntry
+	if bytes.HasPrefix(line, []byte("{")) {
+		if _, err := s.keyring.Open(raftLogPurpose, line); err != nil {
+			return e, err
+		}
+		return e, json.Unmarshal(line, &e)
+	}
+
+	prefix, encoded, _ := bytes.Cut(line, []byte(" "))
+	index, err := strconv.ParseUint(string(prefix), 10, 64)
+	if err != nil {
+		return e, ErrTampered
+	}
+	sealed, err := base64.StdEncoding.DecodeString(string(encoded))
+	if err != nil {
+		return e, ErrTampered
+	}
+	line, err = s.keyring.Open(raftLogEntryPurpose(index), sealed)
+	if err != nil {
+		return e, err
+	}
+	if err := json.Unmarshal(line, &e); err != nil {
+		return e, err
+	}
+	if e.Index != index {
+		return RaftLogEntry{}, ErrTampered
+	}
+	return e, nil
+}
+
+func raftLogEntryPurpose(index uint64) string {
+	return raftLogPurpose + ":" + strconv.FormatUint(index, 10)
+}
+
+// LoadLog reads the log. A final line without a newline is from a crash
+// mid-append: the entry was never acknowledged, so it is cut off the file
+// before the next append can run into it, with or without a keyring. Any
+// other unreadable line, or an index that does not follow the one before,
+// is an error.
+func (s *FileRaftStorage) LoadLog() ([]RaftLogEntry, error) {
+	data, err := os.ReadFile(s.path("log.jsonl"))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	complete := data[:bytes.LastIndexByte(data, '\n')+1]
+	if len(complete) < len(data) {
+		if err := os.Truncate(s.path("log.jsonl"), int64(len(complete))); err != nil {
+			return nil, err
+		}
+	}
+
+	var entries []RaftLogEntry
+	for n, line := range bytes.Split(bytes.TrimSuffix(complete, []byte("\n")), []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+		e, err := s.decodeLogLine(line)
+		if err != nil {
+			return nil, fmt.Errorf("raft: log.jsonl line %d: %w", n+1, err)
+		}
+		if len(entries) > 0 && e.Index != entries[len(entries)-1].Index+1 {
+			return nil, fmt.Errorf("raft: log.jsonl line %d: index %d after %d: %w", n+1, e.Index, entries[len(entries)-1].Index, ErrLogGap)
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+func (s *FileRaftStorage) AppendLog(entries []RaftLogEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.log == nil {
+		f, err := os.OpenFile(s.path("log.jsonl"), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+		if err != nil {
+			return err
+		}
+		s.log = f
+	}
+
+	w := bufio.NewWriter(s.log)
+	for _, e := range entries {
+		line, err := s.encodeLogLine(e)
+		if err != nil {
+			return err
+		}
+		w.Write(line)
+		w.WriteByte('\n')
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return s.log.Sync()
+}
+
+func (s *FileRaftStorage) ReplaceLog(entries []RaftLogEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.log != nil {
+		s.log.Close()
+		s.log = nil
+	}
+
+	var buf []byte
+	for _, e := range entries {
+		line, err := s.encodeLogLine(e)
+		if err != nil {
+			return err
+		}
+		buf = append(buf, line...)
+		buf = append(buf, '\n')
+	}
+	return writeFileAtomic(s.path("log.jsonl"), buf)
+}
+
+func (s *FileRaftStorage) LoadSnapshot() (*RaftSnapshot, error) {
+	data, err := s.readFile("snapshot.json", raftSnapshotPurpose)
+	if err != nil || data == nil {
+		return nil, err
+	}
+	var snap RaftSnapshot
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return nil, err
+	}
+	return &snap, nil
+}
+
+func (s *FileRaftStorage) SaveSnapshot(snap *RaftSnapshot) error {
+	data, err := json.Marshal(snap)
+	if err != nil {
+		return err
+	}
+	return s.writeFile("snapshot.json", raftSnapshotPurpose, data)
+}
+
+func (s *FileRaftStorage) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.log == nil {
+		return nil
+	}
+	err := s.log.Close()
+	s.log = nil
+	return err
+}
+
+func writeFileAtomic(path string, data []byte) error {
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
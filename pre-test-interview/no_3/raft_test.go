@@ -0,0 +1,386 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+type raftTestCluster struct {
+	t        *testing.T
+	network  *InmemRaftNetwork
+	caches   map[string]*ReplicatedCache
+	storages map[string]RaftStorage
+}
+
+func newRaftTestCluster(t *testing.T, size int, threshold uint64) *raftTestCluster {
+	t.Helper()
+
+	c := &raftTestCluster{
+		t:        t,
+		network:  NewInmemRaftNetwork(),
+		caches:   make(map[string]*ReplicatedCache),
+		storages: make(map[string]RaftStorage),
+	}
+
+	var bootstrap []RaftServer
+	for i := 1; i <= size; i++ {
+		id := fmt.Sprintf("n%d", i)
+		bootstrap = append(bootstrap, RaftServer{ID: id, Address: id})
+	}
+	for _, srv := range bootstrap {
+		c.start(srv.ID, bootstrap, threshold)
+	}
+
+	t.Cleanup(func() {
+		for _, rc := range c.caches {
+			rc.Close()
+		}
+	})
+	return c
+}
+
+func (c *raftTestCluster) start(id string, bootstrap []RaftServer, threshold uint64) *ReplicatedCache {
+	c.t.Helper()
+
+	storage, ok := c.storages[id]
+	if !ok {
+		storage = NewMemoryRaftStorage()
+		c.storages[id] = storage
+	}
+
+	rc, err := NewReplicatedCache(NewSimpleCache(), RaftConfig{
+		ID:                id,
+		Address:           id,
+		Bootstrap:         bootstrap,
+		Transport:         c.network.Transport(id),
+		Storage:           storage,
+		HeartbeatInterval: 10 * time.Millisecond,
+		ElectionTimeout:   50 * time.Millisecond,
+		SnapshotThreshold: threshold,
+	})
+	if err != nil {
+		c.t.Fatalf("Failed to start node %s: %v", id, err)
+	}
+	c.network.Register(id, rc.Node())
+	c.caches[id] = rc
+	return rc
+}
+
+func (c *raftTestCluster) stop(id string) {
+	c.network.Unregister(id)
+	c.caches[id].Close()
+	delete(c.caches, id)
+}
+
+// waitLeader returns the single leader among ids, waiting for one to emerge.
+func (c *raftTestCluster) waitLeader(ids ...string) string {
+	c.t.Helper()
+	if len(ids) == 0 {
+		for id := range c.caches {
+			ids = append(ids, id)
+		}
+	}
+
+	deadline := time.Now().Add(3 * time.Second)
+	for time.Now().Before(deadline) {
+		var leaders []string
+		for _, id := range ids {
+			if c.caches[id].Node().IsLeader() {
+				leaders = append(leaders, id)
+			}
+		}
+		if len(leaders) == 1 {
+			return leaders[0]
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.t.Fatalf("No single leader elected among %v", ids)
+	return ""
+}
+
+func (c *raftTestCluster) waitValue(id, key string, want interface{}) {
+	c.t.Helper()
+	deadline := time.Now().Add(3 * time.Second)
+	for time.Now().Before(deadline) {
+		value, exists, err := c.caches[id].Get(key)
+		if err == nil && exists && value == want {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	value, exists, err := c.caches[id].Get(key)
+	c.t.Fatalf("Node %s: expected %s=%v, got %v, exists=%v, err=%v", id, key, want, value, exists, err)
+}
+
+func TestRaft_ElectsLeaderAndReplicates(t *testing.T) {
+	cluster := newRaftTestCluster(t, 3, 0)
+	leader := cluster.waitLeader()
+
+	if err := cluster.caches[leader].Set("user", "alice"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	for id := range cluster.caches {
+		cluster.waitValue(id, "user", "alice")
+	}
+
+	if err := cluster.caches[leader].Delete("user"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	for id, rc := range cluster.caches {
+		deadline := time.Now().Add(3 * time.Second)
+		for {
+			if _, exists, _ := rc.Get("user"); !exists {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("Node %s still has deleted key", id)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
+
+func TestRaft_FollowerRejectsWrites(t *testing.T) {
+	cluster := newRaftTestCluster(t, 3, 0)
+	leader := cluster.waitLeader()
+
+	for id, rc := range cluster.caches {
+		if id == leader {
+			continue
+		}
+		err := rc.Set("key", "value")
+		if !errors.Is(err, ErrNotLeader) {
+			t.Fatalf("Expected ErrNotLeader from follower %s, got %v", id, err)
+		}
+		var notLeader *NotLeaderError
+		if errors.As(err, &notLeader) && notLeader.LeaderID != "" && notLeader.LeaderID != leader {
+			t.Errorf("Expected leader hint %s, got %s", leader, notLeader.LeaderID)
+		}
+	}
+}
+
+func TestRaft_MinorityPartitionCannotCommit(t *testing.T) {
+	cluster := newRaftTestCluster(t, 5, 0)
+	oldLeader := cluster.waitLeader()
+
+	var majority []string
+	for id := range cluster.caches {
+		if id != oldLeader && len(majority) < 3 {
+			majority = append(majority, id)
+		}
+	}
+	var minority []string
+	for id := range cluster.caches {
+		inMajority := false
+		for _, m := range majority {
+			inMajority = inMajority || m == id
+		}
+		if !inMajority {
+			minority = append(minority, id)
+		}
+	}
+	cluster.network.Partition(minority, majority)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	if err := cluster.caches[oldLeader].SetContext(ctx, "split", "minority"); err == nil {
+		t.Fatal("Expected write on minority side to fail")
+	}
+
+	newLeader := cluster.waitLeader(majority...)
+	if err := cluster.caches[newLeader].Set("split", "majority"); err != nil {
+		t.Fatalf("Unexpected error on majority side: %v", err)
+	}
+
+	cluster.network.Heal()
+	for id := range cluster.caches {
+		cluster.waitValue(id, "split", "majority")
+	}
+}
+
+func TestRaft_LeaderFailover(t *testing.T) {
+	cluster := newRaftTestCluster(t, 3, 0)
+	leader := cluster.waitLeader()
+
+	if err := cluster.caches[leader].Set("before", "crash"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	cluster.network.Isolate(leader)
+
+	var rest []string
+	for id := range cluster.caches {
+		if id != leader {
+			rest = append(rest, id)
+		}
+	}
+	next := cluster.waitLeader(rest...)
+	if next == leader {
+		t.Fatal("Expected a new leader after isolating the old one")
+	}
+	if err := cluster.caches[next].Set("after", "crash"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	cluster.waitValue(next, "before", "crash")
+}
+
+func TestRaft_SnapshotInstallOnLaggingFollower(t *testing.T) {
+	cluster := newRaftTestCluster(t, 3, 20)
+	leader := cluster.waitLeader()
+
+	var lagging string
+	for id := range cluster.caches {
+		if id != leader {
+			lagging = id
+			break
+		}
+	}
+	cluster.network.Isolate(lagging)
+
+	for i := 0; i < 60; i++ {
+		if err := cluster.caches[leader].Set(fmt.Sprintf("k%d", i), float64(i)); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	if status := cluster.caches[leader].Node().Status(); status.SnapshotIndex == 0 {
+		t.Fatalf("Expected the leader to have compacted its log, got %+v", status)
+	}
+
+	cluster.network.Heal()
+	cluster.waitValue(lagging, "k0", float64(0))
+	cluster.waitValue(lagging, "k59", float64(59))
+
+	if status := cluster.caches[lagging].Node().Status(); status.SnapshotIndex == 0 {
+		t.Errorf("Expected lagging follower to have installed a snapshot, got %+v", status)
+	}
+}
+
+func TestRaft_MembershipChanges(t *testing.T) {
+	cluster := newRaftTestCluster(t, 3, 0)
+	leader := cluster.waitLeader()
+
+	if err := cluster.caches[leader].Set("seed", "value"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	joiner := cluster.start("n4", nil, 0)
+	if err := cluster.caches[leader].Node().AddServer(context.Background(), RaftServer{ID: "n4", Address: "n4"}); err != nil {
+		t.Fatalf("AddServer failed: %v", err)
+	}
+	cluster.waitValue("n4", "seed", "value")
+	if got := len(joiner.Node().Status().Servers); got != 4 {
+		t.Errorf("Expected joiner to see 4 servers, got %d", got)
+	}
+
+	var removed string
+	for id := range cluster.caches {
+		if id != leader && id != "n4" {
+			removed = id
+			break
+		}
+	}
+	if err := cluster.caches[leader].Node().RemoveServer(context.Background(), removed); err != nil {
+		t.Fatalf("RemoveServer failed: %v", err)
+	}
+	cluster.stop(removed)
+
+	if err := cluster.caches[leader].Set("after_remove", "ok"); err != nil {
+		t.Fatalf("Unexpected error after removal: %v", err)
+	}
+	cluster.waitValue("n4", "after_remove", "ok")
+
+	if err := cluster.caches[leader].Node().RemoveServer(context.Background(), "missing"); !errors.Is(err, ErrUnknownServer) {
+		t.Errorf("Expected ErrUnknownServer, got %v", err)
+	}
+}
+
+func TestRaft_LeaderRemovesItself(t *testing.T) {
+	cluster := newRaftTestCluster(t, 3, 0)
+	leader := cluster.waitLeader()
+
+	if err := cluster.caches[leader].Node().RemoveServer(context.Background(), leader); err != nil {
+		t.Fatalf("RemoveServer failed: %v", err)
+	}
+	cluster.stop(leader)
+
+	next := cluster.waitLeader()
+	if err := cluster.caches[next].Set("key", "value"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if got := len(cluster.caches[next].Node().Status().Servers); got != 2 {
+		t.Errorf("Expected 2 servers after removal, got %d", got)
+	}
+}
+
+func TestRaft_RestartRecoversState(t *testing.T) {
+	cluster := newRaftTestCluster(t, 3, 5)
+	leader := cluster.waitLeader()
+
+	for i := 0; i < 12; i++ {
+		if err := cluster.caches[leader].Set(fmt.Sprintf("k%d", i), "v"); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+
+	var follower string
+	for id := range cluster.caches {
+		if id != leader {
+			follower = id
+			break
+		}
+	}
+	cluster.waitValue(follower, "k11", "v")
+	cluster.stop(follower)
+
+	restarted := cluster.start(follower, nil, 5)
+	if _, exists, _ := restarted.Get("k0"); !exists {
+		t.Error("Expected restarted node to restore its snapshot before rejoining")
+	}
+	cluster.waitValue(follower, "k11", "v")
+}
+
+func TestRaft_ReplicatesPerKeyTTL(t *testing.T) {
+	local, err := NewTTLCache(time.Minute)
+	if err != nil {
+		t.Fatalf("Failed to create TTLCache: %v", err)
+	}
+	network := NewInmemRaftNetwork()
+	rc, err := NewReplicatedCache(local, RaftConfig{
+		ID:                "n1",
+		Address:           "n1",
+		Bootstrap:         []RaftServer{{ID: "n1", Address: "n1"}},
+		Transport:         network.Transport("n1"),
+		Storage:           NewMemoryRaftStorage(),
+		HeartbeatInterval: 10 * time.Millisecond,
+		ElectionTimeout:   50 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("Failed to start node: %v", err)
+	}
+	network.Register("n1", rc.Node())
+	defer rc.Close()
+
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		_, created, err := rc.UpsertWithTTL(context.Background(), "session", "abc", time.Hour, nil)
+		if err == nil {
+			if !created {
+				t.Error("Expected the write to create the key")
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("UpsertWithTTL failed: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	entry, _, _ := local.GetEntry("session")
+	if ttl := entry.TTL(time.Now()); ttl < 59*time.Minute {
+		t.Errorf("Expected the applied entry to live an hour, got %v", ttl)
+	}
+	if keys := rc.Keys(); len(keys) != 1 || keys[0] != "session" {
+		t.Errorf("Expected the replica's keys, got %v", keys)
+	}
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var ErrPeerUnreachable = errors.New("raft: peer unreachable")
+
+type RequestVoteRequest struct {
+	Term         uint64 `json:"term"`
+	CandidateID  string `json:"candidate_id"`
+	LastLogIndex uint64 `json:"last_log_index"`
+	LastLogTerm  uint64 `json:"last_log_term"`
+}
+
+type RequestVoteResponse struct {
+	Term        uint64 `json:"term"`
+	VoteGranted bool   `json:"vote_granted"`
+}
+
+type AppendEntriesRequest struct {
+	Term         uint64         `json:"term"`
+	LeaderID     string         `json:"leader_id"`
+	PrevLogIndex uint64         `json:"prev_log_index"`
+	PrevLogTerm  uint64         `json:"prev_log_term"`
+	Entries      []RaftLogEntry `json:"entries,omitempty"`
+	LeaderCommit uint64         `json:"leader_commit"`
+}
+
+type AppendEntriesResponse struct {
+	Term         uint64 `json:"term"`
+	Success      bool   `json:"success"`
+	LastLogIndex uint64 `json:"last_log_index"`
+}
+
+type InstallSnapshotRequest struct {
+	Term     uint64       `json:"term"`
+	LeaderID string       `json:"leader_id"`
+	Snapshot RaftSnapshot `json:"snapshot"`
+}
+
+type InstallSnapshotResponse struct {
+	Term uint64 `json:"term"`
+}
+
+type RaftTransport interface {
+	RequestVote(ctx context.Context, addr string, req *RequestVoteRequest) (*RequestVoteResponse, error)
+	AppendEntries(ctx context.Context, addr string, req *AppendEntriesRequest) (*AppendEntriesResponse, error)
+	InstallSnapshot(ctx context.Context, addr string, req *InstallSnapshotRequest) (*InstallSnapshotResponse, error)
+}
+
+// InmemRaftNetwork connects nodes living in the same process. It can cut
+// links between them to simulate network partitions in tests.
+type InmemRaftNetwork struct {
+	mu    sync.RWMutex
+	nodes map[string]*RaftNode
+	group map[string]int
+	down  map[string]bool
+}
+
+func NewInmemRaftNetwork() *InmemRaftNetwork {
+	return &InmemRaftNetwork{
+		nodes: make(map[string]*RaftNode),
+		group: make(map[string]int),
+		down:  make(map[string]bool),
+	}
+}
+
+func (n *InmemRaftNetwork) Register(addr string, node *RaftNode) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.nodes[addr] = node
+}
+
+func (n *InmemRaftNetwork) Unregister(addr string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	delete(n.nodes, addr)
+}
+
+func (n *InmemRaftNetwork) Transport(from string) RaftTransport {
+	return &inmemRaftTransport{network: n, from: from}
+}
+
+// Partition splits the listed addresses into groups that can only reach
+// members of their own group. Addresses not listed stay in group zero.
+func (n *InmemRaftNetwork) Partition(groups ...[]string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.group = make(map[string]int)
+	for i, g := range groups {
+		for _, addr := range g {
+			n.group[addr] = i + 1
+		}
+	}
+}
+
+// Isolate cuts addr off from every other node.
+func (n *InmemRaftNetwork) Isolate(addr string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.down[addr] = true
+}
+
+func (n *InmemRaftNetwork) Heal() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.group = make(map[string]int)
+	n.down = make(map[string]bool)
+}
+
+func (n *InmemRaftNetwork) connected(from, to string) (*RaftNode, bool) {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	if n.down[from] || n.down[to] || n.group[from] != n.group[to] {
+		return nil, false
+	}
+	node, ok := n.nodes[to]
+	return node, ok
+}
+
+type inmemRaftTransport struct {
+	network *InmemRaftNetwork
+	from    string
+}
+
+func (t *inmemRaftTransport) deliver(ctx context.Context, to string, call func(*RaftNode)) error {
+	node, ok := t.network.connected(t.from, to)
+	if !ok {
+		return ErrPeerUnreachable
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	call(node)
+	// A partition that happened while the request was in flight drops the
+	// response as well.
+	if _, ok := t.network.connected(to, t.from); !ok {
+		return ErrPeerUnreachable
+	}
+	return nil
+}
+
+func (t *inmemRaftTransport) RequestVote(ctx context.Context, addr string, req *RequestVoteRequest) (*RequestVoteResponse, error) {
+	var resp *RequestVoteResponse
+	err := t.deliver(ctx, addr, func(node *RaftNode) { resp = node.HandleRequestVote(req) })
+	return resp, err
+}
+
+func (t *inmemRaftTransport) AppendEntries(ctx context.Context, addr string, req *AppendEntriesRequest) (*AppendEntriesResponse, error) {
+	var resp *AppendEntriesResponse
+	err := t.deliver(ctx, addr, func(node *RaftNode) { resp = node.HandleAppendEntries(req) })
+	return resp, err
+}
+
+func (t *inmemRaftTransport) InstallSnapshot(ctx context.Context, addr string, req *InstallSnapshotRequest) (*InstallSnapshotResponse, error) {
+	var resp *InstallSnapshotResponse
+	err := t.deliver(ctx, addr, func(node *RaftNode) { resp = node.HandleInstallSnapshot(req) })
+	return resp, err
+}
+
+// HTTPRaftTransport carries Raft RPCs as JSON over HTTP. Addresses are base
+// URLs of peers serving NewRaftHTTPHandler under /raft/.
+type HTTPRaftTransport struct {
+	client *http.Client
+	apiKey string
+}
+
+func NewHTTPRaftTransport(timeout time.Duration) *HTTPRaftTransport {
+	return &HTTPRaftTransport{client: &http.Client{Timeout: timeout}}
+}
+
+// SetAPIKey sends key with every RPC, for peers that require API keys.
+func (t *HTTPRaftTransport) SetAPIKey(key string) {
+	t.apiKey = key
+}
+
+func (t *HTTPRaftTransport) call(ctx context.Context, url string, req, resp interface{}) error {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	if t.apiKey != "" {
+		httpReq.Header.Set(apiKeyHeader, t.apiKey)
+	}
+
+	httpResp, err := t.client.Do(httpReq)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrPeerUnreachable, err)
+	}
+	defer httpResp.Body.Close()
+
+	if httpResp.StatusCode != http.StatusOK {
+		return fmt.Errorf("raft: %s returned %s", url, httpResp.Status)
+	}
+	return json.NewDecoder(httpResp.Body).Decode(resp)
+}
+
+func (t *HTTPRaftTransport) RequestVote(ctx context.Context, addr string, req *RequestVoteRequest) (*RequestVoteResponse, error) {
+	resp := &RequestVoteResponse{}
+	return resp, t.call(ctx, addr+"/raft/vote", req, resp)
+}
+
+func (t *HTTPRaftTransport) AppendEntries(ctx context.Context, addr string, req *AppendEntriesRequest) (*AppendEntriesResponse, error) {
+	resp := &AppendEntriesResponse{}
+	return resp, t.call(ctx, addr+"/raft/append", req, resp)
+}
+
+func (t *HTTPRaftTransport) InstallSnapshot(ctx context.Context, addr string, req *InstallSnapshotRequest) (*InstallSnapshotResponse, error) {
+	resp := &InstallSnapshotResponse{}
+	return resp, t.call(ctx, addr+"/raft/snapshot", req, resp)
+}
+
+func NewRaftHTTPHandler(node *RaftNode) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /raft/vote", func(w http.ResponseWriter, r *http.Request) {
+		var req RequestVoteRequest
+		serveRaftRPC(w, r, &req, func() interface{} { return node.HandleRequestVote(&req) })
+	})
+	mux.HandleFunc("POST /raft/append", func(w http.ResponseWriter, r *http.Request) {
+		var req AppendEntriesRequest
+		serveRaftRPC(w, r, &req, func() interface{} { return node.HandleAppendEntries(&req) })
+	})
+	mux.HandleFunc("POST /raft/snapshot", func(w http.ResponseWriter, r *http.Request) {
+		var req InstallSnapshotRequest
+		serveRaftRPC(w, r, &req, func() interface{} { return node.HandleInstallSnapshot(&req) })
+	})
+	return mux
+}
+
+func serveRaftRPC(w http.ResponseWriter, r *http.Request, req interface{}, handle func() interface{}) {
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		http.Error(w, "invalid raft request", http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(handle())
+}
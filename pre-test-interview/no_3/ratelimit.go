@@ -0,0 +1,214 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RateLimit allows Limit requests per Window. Tokens refill continuously,
+// so a client that has been quiet may spend the whole quota at once. The
+// zero value is unlimited.
+type RateLimit struct {
+	Limit  int
+	Window time.Duration
+}
+
+func (l RateLimit) unlimited() bool {
+	return l.Limit <= 0 || l.Window <= 0
+}
+
+func (l RateLimit) String() string {
+	if l.unlimited() {
+		return "unlimited"
+	}
+	switch l.Window {
+	case time.Second:
+		return fmt.Sprintf("%d/s", l.Limit)
+	case time.Minute:
+		return fmt.Sprintf("%d/m", l.Limit)
+	case time.Hour:
+		return fmt.Sprintf("%d/h", l.Limit)
+	}
+	return fmt.Sprintf("%d/%s", l.Limit, l.Window)
+}
+
+func (l RateLimit) MarshalText() ([]byte, error) {
+	return []byte(l.String()), nil
+}
+
+func (l *RateLimit) UnmarshalText(text []byte) error {
+	parsed, err := parseRateLimit(string(text))
+	if err != nil {
+		return err
+	}
+	*l = parsed
+	return nil
+}
+
+// parseRateLimit reads "N/s", "N/m", "N/h", "N/<duration>" such as
+// "50/10s", or "unlimited".
+func parseRateLimit(v string) (RateLimit, error) {
+	v = strings.TrimSpace(v)
+	if v == "unlimited" {
+		return RateLimit{}, nil
+	}
+
+	count, window, ok := strings.Cut(v, "/")
+	n, err := strconv.Atoi(count)
+	if !ok || err != nil || n <= 0 {
+		return RateLimit{}, errors.New("must be a rate such as 100/s, 600/m or unlimited")
+	}
+
+	var d time.Duration
+	switch window {
+	case "s":
+		d = time.Second
+	case "m":
+		d = time.Minute
+	case "h":
+		d = time.Hour
+	default:
+		d, err = time.ParseDuration(window)
+		if err != nil || d <= 0 {
+			return RateLimit{}, fmt.Errorf("unknown window %q, want s, m, h or a duration", window)
+		}
+	}
+	return RateLimit{Limit: n, Window: d}, nil
+}
+
+// tokenBucket holds a client's unspent requests for one RateLimit.
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+func (b *tokenBucket) refill(l RateLimit, now time.Time) {
+	if b.updated.IsZero() {
+		b.tokens = float64(l.Limit)
+	} else if elapsed := now.Sub(b.updated); elapsed > 0 {
+		b.tokens += float64(l.Limit) * elapsed.Seconds() / l.Window.Seconds()
+	}
+	b.tokens = math.Min(b.tokens, float64(l.Limit))
+	b.updated = now
+}
+
+// until returns how long the bucket needs to hold n tokens.
+func (b *tokenBucket) until(l RateLimit, n float64) time.Duration {
+	missing := n - b.tokens
+	if missing <= 0 {
+		return 0
+	}
+	return time.Duration(missing / float64(l.Limit) * float64(l.Window))
+}
+
+// rateDecision is the outcome of RateLimiter.Allow, with what the client
+// needs to know to back off.
+type rateDecision struct {
+	allowed    bool
+	limit      RateLimit
+	remaining  int
+	retryAfter time.Duration // until the next request is allowed
+	reset      time.Duration // until the full quota is back
+}
+
+type clientBuckets struct {
+	read, write tokenBucket
+	full        time.Time // when both buckets are full again
+}
+
+// rateLimitSweepInterval is how often Allow drops clients whose buckets
+// have refilled; forgetting them then is the same as keeping them.
+const rateLimitSweepInterval = time.Minute
+
+// RateLimiterConfig sets the per-client limits that apply unless a client
+// has its own, such as an API key's read_limit and write_limit.
+type RateLimiterConfig struct {
+	Read  RateLimit
+	Write RateLimit
+	Clock Clock // defaults to the system clock
+}
+
+// RateLimiter keeps a read and a write token bucket per client.
+type RateLimiter struct {
+	read  RateLimit
+	write RateLimit
+	clock Clock
+
+	mu        sync.Mutex
+	clients   map[string]*clientBuckets
+	lastSweep time.Time
+}
+
+func NewRateLimiter(config RateLimiterConfig) *RateLimiter {
+	clock := config.Clock
+	if clock == nil {
+		clock = systemClock{}
+	}
+	return &RateLimiter{
+		read:      config.Read,
+		write:     config.Write,
+		clock:     clock,
+		clients:   make(map[string]*clientBuckets),
+		lastSweep: clock.Now(),
+	}
+}
+
+// Limits returns the default read and write limits.
+func (l *RateLimiter) Limits() (read, write RateLimit) {
+	return l.read, l.write
+}
+
+// Allow spends one token of client's read or write bucket under limit.
+func (l *RateLimiter) Allow(client string, limit RateLimit, write bool) rateDecision {
+	if limit.unlimited() {
+		return rateDecision{allowed: true, limit: limit}
+	}
+	now := l.clock.Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.sweep(now)
+
+	c, ok := l.clients[client]
+	if !ok {
+		c = &clientBuckets{}
+		l.clients[client] = c
+	}
+	b := &c.read
+	if write {
+		b = &c.write
+	}
+	b.refill(limit, now)
+
+	d := rateDecision{limit: limit}
+	if b.tokens >= 1 {
+		b.tokens--
+		d.allowed = true
+	} else {
+		d.retryAfter = b.until(limit, 1)
+	}
+	d.remaining = int(b.tokens)
+	d.reset = b.until(limit, float64(limit.Limit))
+	if full := now.Add(d.reset); full.After(c.full) {
+		c.full = full
+	}
+	return d
+}
+
+// sweep drops the clients whose buckets are full. Callers must hold l.mu.
+func (l *RateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < rateLimitSweepInterval {
+		return
+	}
+	l.lastSweep = now
+	for client, c := range l.clients {
+		if !now.Before(c.full) {
+			delete(l.clients, client)
+		}
+	}
+}
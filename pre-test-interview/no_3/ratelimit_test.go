@@ -0,0 +1,180 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseRateLimit(t *testing.T) {
+	tests := map[string]RateLimit{
+		"100/s":     {100, time.Second},
+		"600/m":     {600, time.Minute},
+		"50/10s":    {50, 10 * time.Second},
+		"unlimited": {},
+	}
+	for in, want := range tests {
+		got, err := parseRateLimit(in)
+		if err != nil || got != want {
+			t.Errorf("parseRateLimit(%q) = %v, %v; want %v", in, got, err, want)
+		}
+	}
+	for _, in := range []string{"", "10", "0/s", "-1/s", "10/fortnight", "x/s"} {
+		if _, err := parseRateLimit(in); err == nil {
+			t.Errorf("parseRateLimit(%q): expected an error", in)
+		}
+	}
+}
+
+func TestRateLimiter_RefillsAndSeparatesReadsFromWrites(t *testing.T) {
+	clock := NewFakeClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	limit := RateLimit{Limit: 2, Window: time.Second}
+	limiter := NewRateLimiter(RateLimiterConfig{Read: limit, Write: limit, Clock: clock})
+
+	for i := 0; i < 2; i++ {
+		if d := limiter.Allow("a", limit, true); !d.allowed || d.remaining != 1-i {
+			t.Fatalf("Write %d: expected allowed with %d remaining, got %+v", i, 1-i, d)
+		}
+	}
+	d := limiter.Allow("a", limit, true)
+	if d.allowed || d.retryAfter != 500*time.Millisecond || d.reset != time.Second {
+		t.Fatalf("Expected a denial with retry in 500ms and reset in 1s, got %+v", d)
+	}
+	if !limiter.Allow("a", limit, false).allowed {
+		t.Error("Expected reads to have their own bucket")
+	}
+	if !limiter.Allow("b", limit, true).allowed {
+		t.Error("Expected another client to have its own bucket")
+	}
+
+	clock.Advance(500 * time.Millisecond)
+	if !limiter.Allow("a", limit, true).allowed {
+		t.Error("Expected a token to have refilled after 500ms")
+	}
+	if limiter.Allow("a", limit, true).allowed {
+		t.Error("Expected only one token to have refilled")
+	}
+	if !limiter.Allow("a", RateLimit{}, true).allowed {
+		t.Error("Expected an unlimited override to always allow")
+	}
+}
+
+func TestRateLimiter_ForgetsIdleClients(t *testing.T) {
+	clock := NewFakeClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	perHour := RateLimit{Limit: 1, Window: time.Hour}
+	perSecond := RateLimit{Limit: 1, Window: time.Second}
+	limiter := NewRateLimiter(RateLimiterConfig{Clock: clock})
+
+	limiter.Allow("slow", perHour, true)
+	limiter.Allow("fast", perSecond, true)
+
+	clock.Advance(rateLimitSweepInterval)
+	limiter.Allow("other", perSecond, false)
+
+	limiter.mu.Lock()
+	_, slow := limiter.clients["slow"]
+	_, fast := limiter.clients["fast"]
+	limiter.mu.Unlock()
+	if !slow || fast {
+		t.Errorf("Expected only the client whose bucket refilled to be dropped, slow=%v fast=%v", slow, fast)
+	}
+	if limiter.Allow("slow", perHour, true).allowed {
+		t.Error("Expected the remembered client to still be limited")
+	}
+}
+
+func TestServer_RateLimit(t *testing.T) {
+	server := NewServer(NewSimpleCache(), nil)
+	server.SetAuth(newTestAuthStore(t), nil)
+	server.SetRateLimiter(NewRateLimiter(RateLimiterConfig{
+		Read:  RateLimit{Limit: 100, Window: time.Second},
+		Write: RateLimit{Limit: 1, Window: time.Minute},
+	}))
+	ts := httptest.NewServer(server.setupRoutes())
+	defer ts.Close()
+
+	put := func(token string) *http.Response {
+		req, _ := http.NewRequest(http.MethodPut, ts.URL+"/api/v2/keys/users%2F1", strings.NewReader(`"a"`))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set(apiKeyHeader, token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	resp := put("users-secret")
+	if resp.StatusCode != http.StatusCreated || resp.Header.Get("RateLimit-Remaining") != "0" {
+		t.Fatalf("Expected the first write to pass with 0 remaining, got %d %v", resp.StatusCode, resp.Header)
+	}
+	resp = put("users-secret")
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("Expected 429, got %d", resp.StatusCode)
+	}
+	if got := resp.Header.Get("Retry-After"); got != "60" {
+		t.Errorf("Expected Retry-After: 60, got %q", got)
+	}
+	if got := resp.Header.Get("RateLimit-Policy"); got != "1;w=60" {
+		t.Errorf("Expected RateLimit-Policy: 1;w=60, got %q", got)
+	}
+
+	// The admin key counts separately from users-rw.
+	if resp := put("admin-secret"); resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected another API key to have its own quota, got %d", resp.StatusCode)
+	}
+	if resp, _ := doRequest(t, http.MethodGet, ts.URL+"/health", "", ""); resp.Header.Get("RateLimit-Limit") != "" {
+		t.Error("Expected /health not to be rate limited")
+	}
+}
+
+func TestServer_RateLimitPerKeyOverride(t *testing.T) {
+	store, err := LoadAuthStore(writeConfigFile(t, "keys.json", `{"keys": [
+		{"id": "peer", "secret": "peer-secret", "grants": [{"access": "write"}], "write_limit": "unlimited"},
+		{"id": "batch", "secret": "batch-secret", "grants": [{"access": "read"}], "read_limit": "2/h"}
+	]}`))
+	if err != nil {
+		t.Fatalf("Failed to load keys: %v", err)
+	}
+	server := NewServer(NewSimpleCache(), nil)
+	server.SetAuth(store, nil)
+	server.SetRateLimiter(NewRateLimiter(RateLimiterConfig{
+		Read:  RateLimit{Limit: 100, Window: time.Second},
+		Write: RateLimit{Limit: 1, Window: time.Minute},
+	}))
+	ts := httptest.NewServer(server.setupRoutes())
+	defer ts.Close()
+
+	send := func(method, token string) *http.Response {
+		req, _ := http.NewRequest(method, ts.URL+"/api/v2/keys/k", strings.NewReader(`"v"`))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	for i := 0; i < 5; i++ {
+		if resp := send(http.MethodPut, "peer-secret"); resp.StatusCode == http.StatusTooManyRequests {
+			t.Fatalf("Expected an unlimited key never to get 429, got it on write %d", i)
+		}
+	}
+	send(http.MethodGet, "batch-secret")
+	if resp := send(http.MethodGet, "batch-secret"); resp.Header.Get("RateLimit-Limit") != "2" {
+		t.Errorf("Expected the key's own read limit, got RateLimit-Limit %q", resp.Header.Get("RateLimit-Limit"))
+	}
+	if resp := send(http.MethodGet, "batch-secret"); resp.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("Expected the third read to exceed 2/h, got %d", resp.StatusCode)
+	}
+
+	keys := store.Keys()
+	if keys[0].WriteLimit == nil || keys[1].ReadLimit == nil || *keys[1].ReadLimit != (RateLimit{2, time.Hour}) {
+		t.Errorf("Expected Keys to report the overrides, got %+v", keys)
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"hash/fnv"
+	"sort"
+	"strconv"
+)
+
+const defaultRingReplicas = 128
+
+// HashRing assigns keys to nodes by consistent hashing, so that a node
+// joining or leaving only moves the keys adjacent to its virtual nodes.
+type HashRing struct {
+	hashes []uint32
+	owners map[uint32]string
+}
+
+func NewHashRing(replicas int, nodes []string) *HashRing {
+	r := &HashRing{owners: make(map[uint32]string, replicas*len(nodes))}
+
+	sorted := append([]string(nil), nodes...)
+	sort.Strings(sorted)
+	for _, node := range sorted {
+		for i := 0; i < replicas; i++ {
+			h := ringHash(node + "#" + strconv.Itoa(i))
+			if _, taken := r.owners[h]; taken {
+				continue
+			}
+			r.owners[h] = node
+			r.hashes = append(r.hashes, h)
+		}
+	}
+	sort.Slice(r.hashes, func(i, j int) bool { return r.hashes[i] < r.hashes[j] })
+	return r
+}
+
+func (r *HashRing) Owner(key string) string {
+	if len(r.hashes) == 0 {
+		return ""
+	}
+	h := ringHash(key)
+	i := sort.Search(len(r.hashes), func(i int) bool { return r.hashes[i] >= h })
+	if i == len(r.hashes) {
+		i = 0
+	}
+	return r.owners[r.hashes[i]]
+}
+
+func ringHash(s string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(s))
+	// FNV alone clusters similar inputs such as "node#1", "node#2"; the
+	// murmur3 finaliser spreads them around the ring.
+	x := h.Sum32()
+	x ^= x >> 16
+	x *= 0x85ebca6b
+	x ^= x >> 13
+	x *= 0xc2b2ae35
+	x ^= x >> 16
+	return x
+}
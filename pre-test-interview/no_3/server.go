@@ -1,19 +1,43 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"log"
+	"log/slog"
+	"mime"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 )
 
 type Server struct {
-	cache  Cache
-	closer Closer
+	cache        Cache
+	closer       Closer
+	cluster      *GossipCluster
+	maxValueSize int64
+	auth         *AuthStore
+	audit        *slog.Logger
+	limiter      *RateLimiter
+	locks        *LockService
+	accessLog    *slog.Logger
+	metrics      serverMetrics
+	keyStats     *keyStats
+	streamsDone  chan struct{}
+	closeOnce    sync.Once
 }
 
+const defaultMaxValueSize = 1 << 20
+
 type CacheResponse struct {
 	Success bool        `json:"success"`
 	Message string      `json:"message,omitempty"`
@@ -22,14 +46,47 @@ type CacheResponse struct {
 }
 
 func NewServer(cache Cache, closer Closer) *Server {
+	locks := NewLockService(nil)
+	if rc, ok := cache.(*ReplicatedCache); ok {
+		locks = rc.Locks()
+	}
 	return &Server{
-		cache:  cache,
-		closer: closer,
+		cache:        cache,
+		closer:       closer,
+		maxValueSize: defaultMaxValueSize,
+		locks:        locks,
+		keyStats:     newKeyStats(defaultKeyStatsWindow),
+		streamsDone:  make(chan struct{}),
 	}
 }
 
+func (s *Server) SetCluster(cluster *GossipCluster) {
+	s.cluster = cluster
+}
+
+// SetMaxValueSize limits request bodies to n bytes; larger writes get 413.
+func (s *Server) SetMaxValueSize(n int64) {
+	s.maxValueSize = n
+}
+
+// redirectToOwner sends the client to the node owning key when gossip
+// clustering is enabled. It reports whether a redirect was written.
+func (s *Server) redirectToOwner(w http.ResponseWriter, r *http.Request, key string) bool {
+	if s.cluster == nil {
+		return false
+	}
+	owner, local := s.cluster.Owner(key)
+	if local || owner.APIAddr == "" {
+		return false
+	}
+	w.Header().Set("X-Cache-Owner", owner.Name)
+	http.Redirect(w, r, owner.APIAddr+r.URL.RequestURI(), http.StatusTemporaryRedirect)
+	return true
+}
+
 func (s *Server) handleSet(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
 		s.sendError(w, "Method not allowed. Use POST", http.StatusMethodNotAllowed)
 		return
 	}
@@ -39,42 +96,100 @@ func (s *Server) handleSet(w http.ResponseWriter, r *http.Request) {
 		s.sendError(w, "Key parameter is required", http.StatusBadRequest)
 		return
 	}
+	if !s.authorize(w, r, AccessWrite, key) {
+		return
+	}
+	if s.redirectToOwner(w, r, key) {
+		return
+	}
 
-	var value interface{}
+	value, ok := s.readValue(w, r)
+	if !ok {
+		return
+	}
+
+	entry, _, err := s.upsert(r.Context(), key, value, writePrecondition(r))
+	if err != nil {
+		s.sendCacheError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	setEntryHeaders(w, entry, time.Now())
+	s.sendSuccess(w, fmt.Sprintf("Successfully set key '%s'", key), describeValue(value))
+}
+
+// readValue decodes the value to store from the request body. JSON and form
+// bodies are decoded as before; any other content type, or an encoded body,
+// is stored as a RawValue. On failure it writes the error response and returns false.
+func (s *Server) readValue(w http.ResponseWriter, r *http.Request) (interface{}, bool) {
+	r.Body = http.MaxBytesReader(w, r.Body, s.maxValueSize)
 	contentType := r.Header.Get("Content-Type")
+	contentEncoding := r.Header.Get("Content-Encoding")
+
+	if isRawBody(contentType, contentEncoding) {
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			s.sendBodyError(w, err, "Failed to read body")
+			return nil, false
+		}
+		// An empty body keeps the old '?value=' behaviour for plain text.
+		if len(data) > 0 || contentEncoding != "" {
+			return RawValue{Data: data, ContentType: contentType, ContentEncoding: contentEncoding}, true
+		}
+	}
 
 	if strings.Contains(contentType, "application/json") {
 		var jsonValue interface{}
 		if err := json.NewDecoder(r.Body).Decode(&jsonValue); err != nil {
-			s.sendError(w, "Invalid JSON body", http.StatusBadRequest)
-			return
-		}
-		value = jsonValue
-	} else {
-		// Handle form data or plain text
-		if err := r.ParseForm(); err != nil {
-			s.sendError(w, "Invalid form data", http.StatusBadRequest)
-			return
+			s.sendBodyError(w, err, "Invalid JSON body")
+			return nil, false
 		}
-		valueStr := r.FormValue("value")
-		if valueStr == "" {
-			s.sendError(w, "Value parameter is required", http.StatusBadRequest)
-			return
-		}
-		value = valueStr
+		return jsonValue, true
 	}
 
-	err := s.cache.Set(key, value)
+	// Handle form data or a plain-text value in the query
+	if err := r.ParseForm(); err != nil {
+		s.sendBodyError(w, err, "Invalid form data")
+		return nil, false
+	}
+	valueStr := r.FormValue("value")
+	if valueStr == "" {
+		s.sendError(w, "Value parameter is required", http.StatusBadRequest)
+		return nil, false
+	}
+	return valueStr, true
+}
+
+func isRawBody(contentType, contentEncoding string) bool {
+	if contentEncoding != "" && !strings.EqualFold(contentEncoding, "identity") {
+		return true
+	}
+	if contentType == "" {
+		return false
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
 	if err != nil {
-		s.sendError(w, err.Error(), http.StatusBadRequest)
-		return
+		return true
+	}
+	switch mediaType {
+	case "application/json", "application/x-www-form-urlencoded", "multipart/form-data":
+		return false
 	}
+	return true
+}
 
-	s.sendSuccess(w, fmt.Sprintf("Successfully set key '%s'", key), value)
+func (s *Server) sendBodyError(w http.ResponseWriter, err error, message string) {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		s.sendError(w, fmt.Sprintf("Value exceeds the %d byte limit", tooLarge.Limit), http.StatusRequestEntityTooLarge)
+		return
+	}
+	s.sendError(w, message, http.StatusBadRequest)
 }
 
 func (s *Server) handleGet(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
 		s.sendError(w, "Method not allowed. Use GET", http.StatusMethodNotAllowed)
 		return
 	}
@@ -84,23 +199,19 @@ func (s *Server) handleGet(w http.ResponseWriter, r *http.Request) {
 		s.sendError(w, "Key parameter is required", http.StatusBadRequest)
 		return
 	}
-
-	value, exists, err := s.cache.Get(key)
-	if err != nil {
-		s.sendError(w, err.Error(), http.StatusInternalServerError)
+	if !s.authorize(w, r, AccessRead, key) {
 		return
 	}
-
-	if !exists {
-		s.sendError(w, fmt.Sprintf("Key '%s' not found", key), http.StatusNotFound)
+	if s.redirectToOwner(w, r, key) {
 		return
 	}
 
-	s.sendSuccess(w, fmt.Sprintf("Found key '%s'", key), value)
+	s.getKey(w, r, key)
 }
 
 func (s *Server) handleDelete(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodDelete {
+		w.Header().Set("Allow", http.MethodDelete)
 		s.sendError(w, "Method not allowed. Use DELETE", http.StatusMethodNotAllowed)
 		return
 	}
@@ -110,10 +221,16 @@ func (s *Server) handleDelete(w http.ResponseWriter, r *http.Request) {
 		s.sendError(w, "Key parameter is required", http.StatusBadRequest)
 		return
 	}
+	if !s.authorize(w, r, AccessWrite, key) {
+		return
+	}
+	if s.redirectToOwner(w, r, key) {
+		return
+	}
 
-	err := s.cache.Delete(key)
+	_, err := s.remove(r.Context(), key, writePrecondition(r))
 	if err != nil {
-		s.sendError(w, err.Error(), http.StatusBadRequest)
+		s.sendCacheError(w, err, http.StatusBadRequest)
 		return
 	}
 
@@ -122,25 +239,151 @@ func (s *Server) handleDelete(w http.ResponseWriter, r *http.Request) {
 
 func (s *Server) handleStats(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
 		s.sendError(w, "Method not allowed. Use GET", http.StatusMethodNotAllowed)
 		return
 	}
+	if !s.authorize(w, r, AccessRead, "") {
+		return
+	}
 
 	stats := map[string]interface{}{
 		"message": "Cache server is running",
 		"time":    time.Now().Format(time.RFC3339),
 		"type":    fmt.Sprintf("%T", s.cache),
 	}
+	if cc, ok := findCompressedCache(s.cache); ok {
+		stats["compression"] = cc.Stats()
+	}
 
 	s.sendSuccess(w, "Cache stats", stats)
 }
 
+func (s *Server) handleRaft(w http.ResponseWriter, r *http.Request) {
+	rc, ok := s.cache.(*ReplicatedCache)
+	if !ok {
+		s.sendError(w, "Raft is not enabled", http.StatusNotFound)
+		return
+	}
+	node := rc.Node()
+
+	need := AccessAdmin
+	if r.Method == http.MethodGet {
+		need = AccessRead
+	}
+	if !s.authorize(w, r, need, "") {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		s.sendSuccess(w, "Raft status", node.Status())
+	case http.MethodPost:
+		var srv RaftServer
+		if err := json.NewDecoder(r.Body).Decode(&srv); err != nil {
+			s.sendError(w, "Invalid JSON body", http.StatusBadRequest)
+			return
+		}
+		if err := node.AddServer(r.Context(), srv); err != nil {
+			s.sendCacheError(w, err, http.StatusBadRequest)
+			return
+		}
+		s.sendSuccess(w, fmt.Sprintf("Added server '%s'", srv.ID), node.Status())
+	case http.MethodDelete:
+		id := r.URL.Query().Get("id")
+		if id == "" {
+			s.sendError(w, "id parameter is required", http.StatusBadRequest)
+			return
+		}
+		if err := node.RemoveServer(r.Context(), id); err != nil {
+			s.sendCacheError(w, err, http.StatusBadRequest)
+			return
+		}
+		s.sendSuccess(w, fmt.Sprintf("Removed server '%s'", id), node.Status())
+	default:
+		w.Header().Set("Allow", "GET, POST, DELETE")
+		s.sendError(w, "Method not allowed. Use GET, POST or DELETE", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *Server) handleMembers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		s.sendError(w, "Method not allowed. Use GET", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.cluster == nil {
+		s.sendError(w, "Gossip clustering is not enabled", http.StatusNotFound)
+		return
+	}
+	if !s.authorize(w, r, AccessRead, "") {
+		return
+	}
+
+	g := s.cluster.Gossip()
+	view := map[string]interface{}{
+		"self":    g.LocalMember(),
+		"members": g.Members(),
+	}
+	if key := r.URL.Query().Get("key"); key != "" {
+		owner, _ := s.cluster.Owner(key)
+		view["owner"] = owner
+	}
+	s.sendSuccess(w, "Cluster members", view)
+}
+
+// handleHandoff stores a key another member is handing to this node, as a
+// snapshot entry so its expiry and version carry over. It is stored whatever
+// this node's view of the ring, which prevents redirect loops while
+// membership is converging.
+func (s *Server) handleHandoff(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		s.sendError(w, "Method not allowed. Use POST", http.StatusMethodNotAllowed)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, 2*s.maxValueSize+importLineSlack)
+	var e snapshotEntry
+	if err := json.NewDecoder(r.Body).Decode(&e); err != nil {
+		s.sendBodyError(w, err, "Invalid handoff entry")
+		return
+	}
+	if !s.authorize(w, r, AccessWrite, e.Key) {
+		return
+	}
+	value, err := decodeValue(e.Kind, e.Value)
+	if err != nil {
+		s.sendError(w, fmt.Sprintf("Invalid %s value: %v", e.Kind, err), http.StatusBadRequest)
+		return
+	}
+	entry := Entry{Value: value, Version: e.Version}
+	if e.ExpiresAt != nil {
+		entry.Expires = *e.ExpiresAt
+	}
+	if e.ModifiedAt != nil {
+		entry.Modified = *e.ModifiedAt
+	}
+
+	restored, err := s.restoreEntry(r.Context(), e.Key, entry)
+	if err != nil {
+		s.sendCacheError(w, err, http.StatusBadRequest)
+		return
+	}
+	s.sendSuccess(w, fmt.Sprintf("Handed off key '%s'", e.Key), map[string]bool{"restored": restored})
+}
+
 func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
 	s.sendSuccess(w, "OK", map[string]string{"status": "healthy"})
 }
 
 func (s *Server) sendSuccess(w http.ResponseWriter, message string, data interface{}) {
+	s.sendSuccessStatus(w, http.StatusOK, message, data)
+}
+
+func (s *Server) sendSuccessStatus(w http.ResponseWriter, statusCode int, message string, data interface{}) {
 	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
 	response := CacheResponse{
 		Success: true,
 		Message: message,
@@ -159,143 +402,452 @@ func (s *Server) sendError(w http.ResponseWriter, message string, statusCode int
 	json.NewEncoder(w).Encode(response)
 }
 
-func (s *Server) setupRoutes() *http.ServeMux {
-	mux := http.NewServeMux()
+// sendCacheError maps errors that are not the client's fault to a status
+// that tells it whether to retry elsewhere; anything else gets fallback.
+func (s *Server) sendCacheError(w http.ResponseWriter, err error, fallback int) {
+	var notLeader *NotLeaderError
+	switch {
+	case errors.As(err, &notLeader):
+		if notLeader.LeaderAddress != "" {
+			w.Header().Set("X-Raft-Leader", notLeader.LeaderAddress)
+		}
+		s.sendError(w, err.Error(), http.StatusServiceUnavailable)
+	case errors.Is(err, ErrCacheClosed), errors.Is(err, ErrRaftStopped), errors.Is(err, ErrLeadershipLost), errors.Is(err, ErrLocksClosed):
+		s.sendError(w, err.Error(), http.StatusServiceUnavailable)
+	case errors.Is(err, ErrPreconditionFailed):
+		s.sendError(w, err.Error(), http.StatusPreconditionFailed)
+	case errors.Is(err, ErrWrongType), errors.Is(err, ErrLockHeld), errors.Is(err, ErrLockNotHeld):
+		s.sendError(w, err.Error(), http.StatusConflict)
+	case errors.Is(err, ErrUpdatesUnsupported), errors.Is(err, ErrTTLUnsupported), errors.Is(err, ErrConditionalUnsupported):
+		s.sendError(w, err.Error(), http.StatusNotImplemented)
+	case errors.Is(err, context.DeadlineExceeded):
+		s.sendError(w, err.Error(), http.StatusGatewayTimeout)
+	default:
+		s.sendError(w, err.Error(), fallback)
+	}
+}
 
-	// API endpoints
-	mux.HandleFunc("/api/cache/set", s.handleSet)
-	mux.HandleFunc("/api/cache/get", s.handleGet)
-	mux.HandleFunc("/api/cache/delete", s.handleDelete)
-	mux.HandleFunc("/api/cache/stats", s.handleStats)
-	mux.HandleFunc("/health", s.handleHealth)
+// route is one entry of the HTTP API. Routes of features that are off are
+// still listed, but not served, so every route can be checked against the
+// OpenAPI document.
+type route struct {
+	pattern string
+	handler http.Handler
+	enabled bool
+}
+
+func handle(pattern string, h http.HandlerFunc) route {
+	return route{pattern: pattern, handler: h, enabled: true}
+}
+
+func (rt route) when(enabled bool) route {
+	rt.enabled = enabled
+	return rt
+}
 
-	// Root endpoint with usage instructions
-	mux.HandleFunc("/", s.handleRoot)
+// routes lists every route the server can serve.
+func (s *Server) routes() []route {
+	rc, replicated := s.cache.(*ReplicatedCache)
+	var raftRPC http.Handler
+	if replicated {
+		raftRPC = s.requireAccess(AccessAdmin, NewRaftHTTPHandler(rc.Node()))
+	}
 
-	return mux
+	return []route{
+		// API endpoints
+		handle("/api/cache/set", s.handleSet),
+		handle("/api/cache/get", s.handleGet),
+		handle("/api/cache/delete", s.handleDelete),
+		handle("/api/cache/stats", s.handleStats),
+		handle("/api/cache/export", s.handleExport),
+		handle("/api/cache/import", s.handleImport),
+		handle("/api/cache/hotkeys", s.handleHotKeys).when(s.keyStats != nil),
+		handle("/api/cache/bigkeys", s.handleBigKeys).when(s.keyStats != nil),
+		handle("/api/v2/keys", s.handleKeys),
+		handle("/api/v2/keys/{key}", s.handleKey),
+		handle("/api/v2/keys/", s.handleKeyMissing),
+		handle("/api/v2/lists/{key}", s.handleList),
+		handle("/api/v2/lists/{key}/{end}", s.handleListEnd),
+		handle("/api/v2/hashes/{key}", s.handleHash),
+		handle("/api/v2/hashes/{key}/{field}", s.handleHashField),
+		handle("/api/v2/hashes/{key}/{field}/incr", s.handleHashIncr),
+		handle("/api/v2/sets/{key}", s.handleSetMembers),
+		handle("/api/v2/sets/{key}/{member}", s.handleSetMember),
+		handle("/api/v2/zsets/{key}", s.handleSortedSet),
+		handle("/api/v2/zsets/{key}/{member}", s.handleSortedSetMember),
+		handle("/api/v2/locks", s.handleLocks),
+		handle("/api/v2/locks/{name}", s.handleLock),
+		handle("/health", s.handleHealth),
+
+		{pattern: "/raft/", handler: raftRPC, enabled: replicated},
+		handle("/api/cluster/raft", s.handleRaft).when(replicated),
+		handle("/api/cluster/members", s.handleMembers).when(s.cluster != nil),
+		handle("/api/cluster/handoff", s.handleHandoff).when(s.cluster != nil),
+		handle("/api/admin/keys", s.handleAdminKeys).when(s.auth != nil),
+		handle("/api/admin/keys/rotate", s.handleAdminRotate).when(s.auth != nil),
+		handle("/api/admin/keys/reload", s.handleAdminReload).when(s.auth != nil),
+		{pattern: "/admin/", handler: s.requireAccess(AccessAdmin, http.HandlerFunc(s.handleDashboard)), enabled: s.auth != nil},
+		{pattern: "/admin/api/entries", handler: s.requireAccess(AccessAdmin, http.HandlerFunc(s.handleAdminEntries)), enabled: s.auth != nil},
+		{pattern: "/admin/api/entries/{key}", handler: s.requireAccess(AccessAdmin, http.HandlerFunc(s.handleAdminEntry)), enabled: s.auth != nil},
+		{pattern: "/admin/api/events", handler: s.requireAccess(AccessAdmin, http.HandlerFunc(s.handleAdminEvents)), enabled: s.auth != nil},
+
+		// The API description, and the docs page generated from it
+		handle("/openapi.json", s.handleOpenAPI),
+		handle("/", s.handleRoot),
+	}
 }
 
+func (s *Server) setupRoutes() http.Handler {
+	mux := http.NewServeMux()
+	for _, rt := range s.routes() {
+		if rt.enabled {
+			mux.Handle(rt.pattern, rt.handler)
+		}
+	}
+	// countRequests passes on a copy of the request, so it goes first for the
+	// others to see the route the mux matches.
+	return s.countRequests(s.logRequests(s.rateLimit(mux)))
+}
+
+// handleRoot serves the API documentation, rendered in the browser from
+// /openapi.json.
 func (s *Server) handleRoot(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "text/html")
-
-	html := `
-<!DOCTYPE html>
-<html>
-<head>
-    <title>Cache API Server</title>
-    <style>
-        body { font-family: Arial, sans-serif; margin: 40px; }
-        .endpoint { background: #f5f5f5; padding: 10px; margin: 10px 0; border-radius: 5px; }
-        .method { color: #007acc; font-weight: bold; }
-        code { background: #e8e8e8; padding: 2px 4px; border-radius: 3px; }
-        pre { background: #f8f8f8; padding: 15px; border-radius: 5px; overflow-x: auto; }
-    </style>
-</head>
-<body>
-    <h1>Cache API Server</h1>
-    <p>Interactive API for testing the cache implementation</p>
-
-    <h2>Available Endpoints</h2>
-
-    <div class="endpoint">
-        <span class="method">POST</span> <code>/api/cache/set?key={key}</code>
-        <p>Set a value in the cache. Send value in request body.</p>
-        <p><strong>Examples:</strong></p>
-        <pre>curl -X POST "http://localhost:8080/api/cache/set?key=name" \
-     -H "Content-Type: application/json" \
-     -d '"John Doe"'</pre>
-        <pre>curl -X POST "http://localhost:8080/api/cache/set?key=age" \
-     -d "value=25"</pre>
-    </div>
-
-    <div class="endpoint">
-        <span class="method">GET</span> <code>/api/cache/get?key={key}</code>
-        <p>Get a value from the cache.</p>
-        <p><strong>Example:</strong></p>
-        <pre>curl "http://localhost:8080/api/cache/get?key=name"</pre>
-    </div>
-
-    <div class="endpoint">
-        <span class="method">DELETE</span> <code>/api/cache/delete?key={key}</code>
-        <p>Delete a key from the cache.</p>
-        <p><strong>Example:</strong></p>
-        <pre>curl -X DELETE "http://localhost:8080/api/cache/delete?key=name"</pre>
-    </div>
-
-    <div class="endpoint">
-        <span class="method">GET</span> <code>/api/cache/stats</code>
-        <p>Get cache statistics and information.</p>
-        <p><strong>Example:</strong></p>
-        <pre>curl "http://localhost:8080/api/cache/stats"</pre>
-    </div>
-
-    <div class="endpoint">
-        <span class="method">GET</span> <code>/health</code>
-        <p>Health check endpoint.</p>
-        <pre>curl "http://localhost:8080/health"</pre>
-    </div>
-
-    <h2>Quick Test Commands</h2>
-    <p>Copy and paste these commands to test the cache:</p>
-    <pre>
-# Set some values
-curl -X POST "http://localhost:8080/api/cache/set?key=user" -H "Content-Type: application/json" -d '"Alice"'
-curl -X POST "http://localhost:8080/api/cache/set?key=age" -d "value=30"
-
-# Get values
-curl "http://localhost:8080/api/cache/get?key=user"
-curl "http://localhost:8080/api/cache/get?key=age"
-
-# Get stats
-curl "http://localhost:8080/api/cache/stats"
-
-# Delete a key
-curl -X DELETE "http://localhost:8080/api/cache/delete?key=age"
-
-# Try to get deleted key
-curl "http://localhost:8080/api/cache/get?key=age"
-    </pre>
-
-    <p><strong>Server is running with:</strong> ` + fmt.Sprintf("%T", s.cache) + `</p>
-</body>
-</html>`
-
-	w.Write([]byte(html))
-}
-
-func runServer() {
-	var cache Cache
-	var closer Closer
-
-	// You can switch between cache types here
-	useTTL := true
-
-	if useTTL {
-		ttlCache, err := NewTTLCache(30 * time.Second) // 30 second TTL for demo
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(docsPage)
+}
+
+func runServer(args []string) {
+	cfg, err := loadServerConfig(args, os.Getenv)
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	logLevel.Set(cfg.LogLevel)
+	slog.SetDefault(slog.New(newLogHandler(os.Stderr, cfg.LogFormat, cfg.LogRedactKeys)))
+
+	keyring, err := newKeyringFromConfig(cfg)
+	if err != nil {
+		log.Fatalf("Failed to load encryption keys: %v", err)
+	}
+
+	local, closer, err := newCacheFromConfig(cfg)
+	if err != nil {
+		log.Fatalf("Failed to create %s cache: %v", cfg.CacheType, err)
+	}
+	if cfg.SnapshotPath != "" {
+		if err := loadCacheSnapshot(cfg.SnapshotPath, local, keyring); err != nil {
+			log.Fatalf("Failed to load snapshot: %v", err)
+		}
+	}
+
+	// The wrappers stay in place when their setting is off, so values a
+	// snapshot holds compressed or encrypted still read back.
+	cache := local
+	if cfg.EncryptMemory {
+		cache = NewEncryptedCache(local, keyring)
+	} else if keyring != nil {
+		cache = newDecryptingCache(local, keyring)
+	}
+	cache = newCompressedCacheFromConfig(cfg, cache)
+	if cfg.RaftID != "" {
+		replicated, err := newReplicatedCacheFromConfig(cfg, cache, keyring)
 		if err != nil {
-			log.Fatal("Failed to create TTL cache:", err)
+			log.Fatal("Failed to start Raft:", err)
 		}
-		cache = ttlCache
-		closer = ttlCache
+		cache = replicated
+		closer = replicated
+	}
+
+	server := NewServer(cache, closer)
+	server.SetMaxValueSize(cfg.MaxValueSize)
+	server.SetKeyStatsWindow(cfg.KeyStatsWindow)
+	if cfg.AccessLog {
+		server.SetAccessLog(slog.Default().With("log", "access"))
+	}
+	if cfg.RateLimitRead != (RateLimit{}) || cfg.RateLimitWrite != (RateLimit{}) {
+		server.SetRateLimiter(NewRateLimiter(RateLimiterConfig{
+			Read:  cfg.RateLimitRead,
+			Write: cfg.RateLimitWrite,
+		}))
+	}
+
+	stopAuthWatch := func() {}
+	if cfg.AuthKeysFile != "" {
+		store, audit, err := newAuthFromConfig(cfg, keyring)
+		if err != nil {
+			log.Fatalf("Failed to load API keys: %v", err)
+		}
+		server.SetAuth(store, audit)
+		stopAuthWatch = store.Watch(authReloadInterval, func(err error) {
+			slog.Error("API key reload failed, keeping the current keys", "error", err)
+		})
+	}
+
+	if cfg.GossipBind != "" {
+		cluster, err := newGossipClusterFromConfig(cfg, cache)
+		if err != nil {
+			log.Fatal("Failed to start gossip:", err)
+		}
+		server.SetCluster(cluster)
+	}
+
+	httpServer := &http.Server{Addr: cfg.ListenAddr, Handler: server.setupRoutes()}
+	httpServer.RegisterOnShutdown(server.locks.Close)
+	httpServer.RegisterOnShutdown(server.closeStreams)
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- httpServer.ListenAndServe()
+	}()
+
+	base := displayURL(cfg.ListenAddr)
+	if cfg.LogFormat == logFormatJSON {
+		slog.Info("Server starting", "url", base, "cache", cfg.CacheType)
 	} else {
-		simpleCache := NewSimpleCache()
-		cache = simpleCache
-		closer = nil
+		fmt.Printf("🚀 Cache API Server starting on %s (%s cache)\n", base, cfg.CacheType)
+		fmt.Printf("📖 Open %s in your browser for API documentation\n", base)
+		if cfg.AuthKeysFile != "" {
+			fmt.Printf("🔧 Admin dashboard at %s/admin/, sign in with an admin API key as the password\n", base)
+		}
+		fmt.Printf("🛑 Press Ctrl+C to stop the server, or send SIGHUP to reload its config\n\n")
 	}
 
-	if closer != nil {
-		defer closer.Close()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+
+	exitCode := 0
+wait:
+	for {
+		select {
+		case err := <-serveErr:
+			slog.Error("Server failed", "error", err)
+			exitCode = 1
+			break wait
+		case sig := <-signals:
+			if sig == syscall.SIGHUP {
+				cfg = reloadServerConfig(args, cfg, local)
+				if server.auth != nil {
+					if err := server.auth.Reload(); err != nil {
+						slog.Error("API key reload failed, keeping the current keys", "error", err)
+					}
+				}
+				continue
+			}
+			slog.Info("Shutting down", "signal", sig.String())
+			break wait
+		}
 	}
 
-	server := NewServer(cache, closer)
-	mux := server.setupRoutes()
+	// A second interrupt falls through to the default handler and exits.
+	signal.Reset(syscall.SIGINT, syscall.SIGTERM)
+	stopAuthWatch()
+	if err := shutdownServer(httpServer, server, local, cfg, keyring); err != nil {
+		slog.Error("Shutdown finished with errors", "error", err)
+		exitCode = 1
+	}
+	os.Exit(exitCode)
+}
+
+// shutdownServer stops the server in dependency order: stop accepting
+// requests and let in-flight ones finish, hand keys to other gossip members,
+// persist the local cache, then close it.
+func shutdownServer(httpServer *http.Server, server *Server, local Cache, cfg ServerConfig, keyring *Keyring) error {
+	var errs []error
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+	if err := httpServer.Shutdown(ctx); err != nil {
+		errs = append(errs, fmt.Errorf("draining requests: %w", err))
+	}
+
+	if server.cluster != nil {
+		if err := server.cluster.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("leaving the cluster: %w", err))
+		}
+	}
+
+	if cfg.SnapshotPath != "" {
+		if err := saveCacheSnapshot(cfg.SnapshotPath, local, keyring); err != nil {
+			errs = append(errs, fmt.Errorf("saving snapshot: %w", err))
+		} else {
+			slog.Info("Saved snapshot", "path", cfg.SnapshotPath)
+		}
+	}
+
+	if server.closer != nil {
+		if err := server.closer.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("closing cache: %w", err))
+		}
+	}
+	return errors.Join(errs...)
+}
 
-	port := "8080"
-	fmt.Printf("🚀 Cache API Server starting on http://localhost:%s\n", port)
-	fmt.Printf("📖 Open http://localhost:%s in your browser for API documentation\n", port)
-	fmt.Printf("🛑 Press Ctrl+C to stop the server\n\n")
+// newCacheFromConfig builds the local cache. The server has no origin to load
+// values from, so TTLCache gets no Loader: stale entries are served as they
+// are until a client writes them again; background and early refresh
+// (EarlyRefresh) are only for programs that use TTLCache as a library.
+func newCacheFromConfig(cfg ServerConfig) (Cache, Closer, error) {
+	if cfg.CacheType == cacheTypeSimple {
+		return NewSimpleCacheWithConfig(SimpleCacheConfig{MaxEntries: cfg.Capacity}), nil, nil
+	}
+	ttlCache, err := NewTTLCacheWithConfig(TTLCacheConfig{
+		TTL:             cfg.TTL,
+		CleanupInterval: cfg.CleanupInterval,
+		StaleTTL:        cfg.StaleTTL,
+		TTLJitter:       cfg.TTLJitter,
+		MaxEntries:      cfg.Capacity,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return ttlCache, ttlCache, nil
+}
 
-	if err := http.ListenAndServe(":"+port, mux); err != nil {
-		log.Fatal("Server failed to start:", err)
+func newCompressedCacheFromConfig(cfg ServerConfig, cache Cache) *CompressedCache {
+	compressor, _ := lookupCompressor(cfg.Compression)
+	return NewCompressedCache(cache, CompressedCacheConfig{
+		Compressor: compressor,
+		Threshold:  int(cfg.CompressionMin),
+	})
+}
+
+// snapshotPurpose is what snapshot files are sealed for; see Keyring.Seal.
+const snapshotPurpose = "cache-snapshot"
+
+// loadCacheSnapshot restores cache from path; a missing file is not an error.
+// With a keyring the file must be encrypted.
+func loadCacheSnapshot(path string, cache Cache, keyring *Keyring) error {
+	s, ok := cache.(Snapshotter)
+	if !ok {
+		return fmt.Errorf("%T does not support snapshots", cache)
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	data, err = keyring.Open(snapshotPurpose, data)
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return s.Restore(data)
+}
+
+func saveCacheSnapshot(path string, cache Cache, keyring *Keyring) error {
+	s, ok := cache.(Snapshotter)
+	if !ok {
+		return fmt.Errorf("%T does not support snapshots", cache)
+	}
+	data, err := s.Snapshot()
+	if err != nil {
+		return err
+	}
+	data, err = keyring.Seal(snapshotPurpose, data)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data)
+}
+
+// newKeyringFromConfig returns nil when encryption is not configured.
+func newKeyringFromConfig(cfg ServerConfig) (*Keyring, error) {
+	switch {
+	case cfg.EncryptionKeyFile != "":
+		return LoadKeyringFile(cfg.EncryptionKeyFile)
+	case cfg.EncryptionKeys != "":
+		return ParseKeyring(cfg.EncryptionKeys)
+	}
+	return nil, nil
+}
+
+func displayURL(listenAddr string) string {
+	host, port, err := net.SplitHostPort(listenAddr)
+	if err != nil {
+		return "http://" + listenAddr
+	}
+	if host == "" || host == "0.0.0.0" || host == "::" {
+		host = "localhost"
+	}
+	return "http://" + net.JoinHostPort(host, port)
+}
+
+// authReloadInterval is how often the API keys file is checked for changes.
+const authReloadInterval = 2 * time.Second
+
+// newAuthFromConfig loads the API keys and opens the audit log, which goes
+// to the server log unless audit_log names a file. With a keyring each
+// record in the file is sealed; `go run . audit` decrypts them.
+func newAuthFromConfig(cfg ServerConfig, keyring *Keyring) (*AuthStore, *slog.Logger, error) {
+	store, err := LoadAuthStore(cfg.AuthKeysFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	if cfg.AuditLog == "" {
+		return store, slog.Default().With("log", "audit"), nil
+	}
+	f, err := os.OpenFile(cfg.AuditLog, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, nil, err
+	}
+	var w io.Writer = f
+	if keyring != nil {
+		w = &sealedLineWriter{w: f, keyring: keyring, purpose: auditLogPurpose}
+	}
+	return store, slog.New(slog.NewJSONHandler(w, &slog.HandlerOptions{ReplaceAttr: redactKeys(cfg.LogRedactKeys)})), nil
+}
+
+func newReplicatedCacheFromConfig(cfg ServerConfig, cache Cache, keyring *Keyring) (*ReplicatedCache, error) {
+	var storage RaftStorage
+	if cfg.RaftDir != "" {
+		fs, err := NewFileRaftStorage(cfg.RaftDir)
+		if err != nil {
+			return nil, err
+		}
+		fs.SetKeyring(keyring)
+		storage = fs
+	}
+
+	transport := NewHTTPRaftTransport(2 * time.Second)
+	transport.SetAPIKey(cfg.PeerAPIKey)
+
+	return NewReplicatedCache(cache, RaftConfig{
+		ID:        cfg.RaftID,
+		Address:   cfg.RaftAddr,
+		Bootstrap: cfg.RaftPeers,
+		Transport: transport,
+		Storage:   storage,
+	})
+}
+
+func newGossipClusterFromConfig(cfg ServerConfig, cache Cache) (*GossipCluster, error) {
+	name := cfg.GossipName
+	if name == "" {
+		host, err := os.Hostname()
+		if err != nil {
+			return nil, err
+		}
+		name = host
+	}
+
+	cluster, err := NewGossipCluster(cache, GossipConfig{
+		Name:          name,
+		BindAddr:      cfg.GossipBind,
+		APIAddr:       cfg.GossipAPIAddr,
+		HandoffAPIKey: cfg.PeerAPIKey,
+		SecretKey:     []byte(cfg.GossipSecret),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(cfg.GossipSeeds) > 0 {
+		if err := cluster.Gossip().Join(cfg.GossipSeeds, 2*time.Second); err != nil {
+			cluster.Close()
+			return nil, err
+		}
 	}
+	return cluster, nil
 }
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"runtime"
+	"runtime/metrics"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// adminFiles is the dashboard served under /admin/. It loads nothing from
+// other origins, so it works without internet access.
+//
+//go:embed web/admin
+var adminFiles embed.FS
+
+var dashboardFiles = func() http.Handler {
+	sub, err := fs.Sub(adminFiles, "web/admin")
+	if err != nil {
+		panic(err)
+	}
+	return http.StripPrefix("/admin/", http.FileServerFS(sub))
+}()
+
+const (
+	defaultEntriesPage = 50
+	maxEntriesPage     = 500
+	minStatsInterval   = 250 * time.Millisecond
+	adminEntryMethods  = "GET, PUT, PATCH, DELETE"
+)
+
+// serverMetrics counts the requests plotted by the dashboard.
+type serverMetrics struct {
+	requests atomic.Uint64
+	errors   atomic.Uint64
+	hits     atomic.Uint64
+	misses   atomic.Uint64
+}
+
+// countRequests feeds s.metrics and s.keyStats. Reads of single values
+// count as hits or misses. The dashboard's own requests, health checks and
+// Raft traffic are left out so the charts show what clients do.
+func (s *Server) countRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/health" || strings.HasPrefix(r.URL.Path, "/raft/") || strings.HasPrefix(r.URL.Path, "/admin/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		var access *keyAccess
+		if s.keyStats != nil {
+			r, access = withKeyAccess(r)
+		}
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+
+		m := &s.metrics
+		m.requests.Add(1)
+		if rec.status >= http.StatusInternalServerError {
+			m.errors.Add(1)
+		}
+		read := r.Method == http.MethodGet || r.Method == http.MethodHead
+		if read && (r.Pattern == "/api/v2/keys/{key}" || r.Pattern == "/api/cache/get") {
+			switch rec.status {
+			case http.StatusOK, http.StatusNotModified:
+				m.hits.Add(1)
+			case http.StatusNotFound:
+				m.misses.Add(1)
+			}
+		}
+		if s.keyStats != nil {
+			s.trackKey(r, access)
+		}
+	})
+}
+
+// closeStreams ends the event streams, which would otherwise hold up
+// http.Server.Shutdown until it times out.
+func (s *Server) closeStreams() {
+	s.closeOnce.Do(func() { close(s.streamsDone) })
+}
+
+// handleDashboard serves the admin dashboard's files.
+func (s *Server) handleDashboard(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		s.sendError(w, "Method not allowed. Use GET", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Content-Security-Policy", "default-src 'self'; img-src 'self' blob:; frame-ancestors 'none'")
+	dashboardFiles.ServeHTTP(w, r)
+}
+
+// adminEntry describes a key in the dashboard's listing. Size is the
+// estimate of valueSize.
+type adminEntry struct {
+	Key     string     `json:"key"`
+	Type    string     `json:"type"`
+	Size    int        `json:"size"`
+	TTL     int        `json:"ttl_seconds,omitempty"`
+	Expires *time.Time `json:"expires_at,omitempty"`
+	Stale   bool       `json:"stale,omitempty"`
+}
+
+func describeEntry(key string, entry Entry, now time.Time) adminEntry {
+	e := adminEntry{Key: key, Type: valueType(entry.Value), Size: valueSize(entry.Value), Stale: entry.Stale}
+	if !entry.Expires.IsZero() {
+		expires := entry.Expires
+		e.Expires = &expires
+		e.TTL = ceilSeconds(entry.TTL(now))
+	}
+	return e
+}
+
+// handleAdminEntries pages through the keys held by this node in sorted
+// order, those containing ?q= (ignoring case) if given. ?after= is the last
+// key of the previous page, so pages stay put while keys come and go.
+func (s *Server) handleAdminEntries(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		s.sendError(w, "Method not allowed. Use GET", http.StatusMethodNotAllowed)
+		return
+	}
+	limit, err := queryInt(r, "limit", defaultEntriesPage)
+	if err != nil || limit < 1 || limit > maxEntriesPage {
+		s.sendError(w, fmt.Sprintf("'limit' must be between 1 and %d", maxEntriesPage), http.StatusBadRequest)
+		return
+	}
+	l, ok := s.cache.(KeyLister)
+	if !ok {
+		s.sendError(w, "This cache cannot list its keys", http.StatusNotImplemented)
+		return
+	}
+
+	query := strings.ToLower(r.URL.Query().Get("q"))
+	after := r.URL.Query().Get("after")
+	keys := []string{}
+	for _, key := range l.Keys() {
+		if strings.Contains(strings.ToLower(key), query) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	now := time.Now()
+	entries := []adminEntry{}
+	next := ""
+	for _, key := range keys[sort.SearchStrings(keys, after):] {
+		if key == after {
+			continue
+		}
+		if len(entries) == limit {
+			next = entries[limit-1].Key
+			break
+		}
+		entry, exists, err := s.getEntry(r.Context(), key)
+		if err != nil {
+			s.sendCacheError(w, err, http.StatusInternalServerError)
+			return
+		}
+		// Expired since it was listed.
+		if !exists {
+			continue
+		}
+		entries = append(entries, describeEntry(key, entry, now))
+	}
+
+	s.sendSuccess(w, fmt.Sprintf("Found %d keys", len(keys)), map[string]interface{}{
+		"total":   len(keys),
+		"entries": entries,
+		"next":    next,
+	})
+}
+
+// handleAdminEntry lets the dashboard inspect and change a key held by this
+// node. GET, PUT and DELETE work as on /api/v2/keys/{key}, but without the
+// redirect to the owning gossip member; PATCH sets a new TTL.
+func (s *Server) handleAdminEntry(w http.ResponseWriter, r *http.Request) {
+	key := r.PathValue("key")
+
+	switch r.Method {
+	case http.MethodGet:
+		s.getKey(w, r, key)
+	case http.MethodPut:
+		s.putKey(w, r, key)
+	case http.MethodPatch:
+		s.expireKey(w, r, key)
+	case http.MethodDelete:
+		s.deleteKey(w, r, key)
+	default:
+		w.Header().Set("Allow", adminEntryMethods)
+		s.sendError(w, "Method not allowed. Use "+adminEntryMethods, http.StatusMethodNotAllowed)
+	}
+}
+
+// expireKey gives key a lifetime of ?ttl= from now and keeps its value. It
+// fails with 412 if the value changes in the meantime, and with 501 under
+// Raft, which cannot check that.
+func (s *Server) expireKey(w http.ResponseWriter, r *http.Request, key string) {
+	ttl, err := queryDuration(r, "ttl", 0)
+	if err == nil && ttl == 0 {
+		err = fmt.Errorf("'ttl' is required")
+	}
+	if err != nil {
+		s.sendError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	entry, exists, err := s.getEntry(r.Context(), key)
+	if err != nil {
+		s.sendCacheError(w, err, http.StatusInternalServerError)
+		return
+	}
+	if !exists {
+		s.sendError(w, fmt.Sprintf("Key '%s' not found", key), http.StatusNotFound)
+		return
+	}
+	unchanged := func(current Entry, exists bool) bool {
+		return exists && current.Version == entry.Version
+	}
+	updated, _, err := s.upsertWithTTL(r.Context(), key, entry.Value, ttl, unchanged)
+	if err != nil {
+		s.sendCacheError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	now := time.Now()
+	setEntryHeaders(w, updated, now)
+	s.sendSuccess(w, fmt.Sprintf("Key '%s' now expires in %s", key, ttl), describeEntry(key, updated, now))
+}
+
+// adminStats is one sample for the dashboard's charts. The counters only
+// grow; the dashboard plots their rate.
+type adminStats struct {
+	Time       time.Time `json:"time"`
+	Keys       int       `json:"keys"`
+	Requests   uint64    `json:"requests"`
+	Errors     uint64    `json:"errors"`
+	Hits       uint64    `json:"hits"`
+	Misses     uint64    `json:"misses"`
+	HeapBytes  uint64    `json:"heap_bytes"`
+	Goroutines int       `json:"goroutines"`
+}
+
+func (s *Server) sampleStats() adminStats {
+	// Unlike runtime.ReadMemStats, this does not stop the world.
+	heap := []metrics.Sample{{Name: "/memory/classes/heap/objects:bytes"}}
+	metrics.Read(heap)
+
+	stats := adminStats{
+		Time:       time.Now(),
+		Requests:   s.metrics.requests.Load(),
+		Errors:     s.metrics.errors.Load(),
+		Hits:       s.metrics.hits.Load(),
+		Misses:     s.metrics.misses.Load(),
+		Goroutines: runtime.NumGoroutine(),
+	}
+	if heap[0].Value.Kind() == metrics.KindUint64 {
+		stats.HeapBytes = heap[0].Value.Uint64()
+	}
+	if l, ok := s.cache.(KeyLister); ok {
+		stats.Keys = len(l.Keys())
+	}
+	return stats
+}
+
+// handleAdminEvents streams a stats event every ?interval= (1s by default)
+// as server-sent events, until the client goes away or the server shuts
+// down.
+func (s *Server) handleAdminEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		s.sendError(w, "Method not allowed. Use GET", http.StatusMethodNotAllowed)
+		return
+	}
+	interval, err := queryDuration(r, "interval", time.Second)
+	if err == nil && interval < minStatsInterval {
+		err = fmt.Errorf("'interval' must be at least %s", minStatsInterval)
+	}
+	if err != nil {
+		s.sendError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	rc := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		data, err := json.Marshal(s.sampleStats())
+		if err != nil {
+			return
+		}
+		if _, err := fmt.Fprintf(w, "event: stats\ndata: %s\n\n", data); err != nil {
+			return
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+		select {
+		case <-ticker.C:
+		case <-r.Context().Done():
+			return
+		case <-s.streamsDone:
+			return
+		}
+	}
+}
@@ -0,0 +1,578 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// collectionApplier is implemented by caches that apply collection
+// operations themselves, such as ReplicatedCache, which replicates them.
+type collectionApplier interface {
+	applyOp(ctx context.Context, key string, op collectionOp) (interface{}, error)
+}
+
+// applyOp runs op on key. Only caches that apply it through Updater report
+// the collection's new size to the key stats.
+func (s *Server) applyOp(ctx context.Context, key string, op collectionOp) (interface{}, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if a, ok := s.cache.(collectionApplier); ok {
+		result, err := a.applyOp(ctx, key, op)
+		s.noteAccess(ctx, key, nil, err)
+		return result, err
+	}
+	u, ok := s.cache.(Updater)
+	if !ok {
+		return nil, ErrUpdatesUnsupported
+	}
+	result, entry, err := op.applyTo(u, key)
+	s.noteAccess(ctx, key, entry.Value, err)
+	return result, err
+}
+
+// resourceRequest runs the checks every collection and lock endpoint
+// shares: the method, access to key and the cluster owner. It reports
+// whether the handler should go on.
+func (s *Server) resourceRequest(w http.ResponseWriter, r *http.Request, key, allow string) bool {
+	if !methodAllowed(allow, r.Method) {
+		w.Header().Set("Allow", allow)
+		s.sendError(w, "Method not allowed. Use "+allow, http.StatusMethodNotAllowed)
+		return false
+	}
+	need := AccessWrite
+	if r.Method == http.MethodGet {
+		need = AccessRead
+	}
+	return s.authorize(w, r, need, key) && !s.redirectToOwner(w, r, key)
+}
+
+func methodAllowed(allow, method string) bool {
+	for _, m := range strings.Split(allow, ", ") {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+// readCollection looks up key for a collection read, writing 404 or the
+// cache error if there is nothing to return.
+func (s *Server) readCollection(w http.ResponseWriter, r *http.Request, key string) (Entry, bool) {
+	entry, exists, err := s.getEntry(r.Context(), key)
+	if err != nil {
+		s.sendCacheError(w, err, http.StatusInternalServerError)
+		return Entry{}, false
+	}
+	if !exists {
+		s.sendError(w, fmt.Sprintf("Key '%s' not found", key), http.StatusNotFound)
+		return Entry{}, false
+	}
+	setEntryHeaders(w, entry, time.Now())
+	return entry, true
+}
+
+// readJSONBody decodes a JSON request body into v, writing 400 with want in
+// the message if it does not fit.
+func (s *Server) readJSONBody(w http.ResponseWriter, r *http.Request, v interface{}, want string) bool {
+	r.Body = http.MaxBytesReader(w, r.Body, s.maxValueSize)
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		s.sendBodyError(w, err, "Body must be "+want)
+		return false
+	}
+	return true
+}
+
+// readStrings accepts a JSON string or a non-empty array of strings.
+func (s *Server) readStrings(w http.ResponseWriter, r *http.Request) ([]string, bool) {
+	const want = "a JSON string or a non-empty array of strings"
+	var body json.RawMessage
+	if !s.readJSONBody(w, r, &body, want) {
+		return nil, false
+	}
+	var values []string
+	if err := json.Unmarshal(body, &values); err != nil {
+		var value string
+		if err := json.Unmarshal(body, &value); err != nil {
+			s.sendError(w, "Body must be "+want, http.StatusBadRequest)
+			return nil, false
+		}
+		values = []string{value}
+	}
+	if len(values) == 0 {
+		s.sendError(w, "Body must be "+want, http.StatusBadRequest)
+		return nil, false
+	}
+	return values, true
+}
+
+func queryInt(r *http.Request, name string, def int) (int, error) {
+	v := r.URL.Query().Get(name)
+	if v == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, fmt.Errorf("'%s' must be an integer", name)
+	}
+	return n, nil
+}
+
+// rankQuery reads ?start and ?stop, which default to the whole collection.
+func rankQuery(r *http.Request) (int, int, error) {
+	start, err := queryInt(r, "start", 0)
+	if err != nil {
+		return 0, 0, err
+	}
+	stop, err := queryInt(r, "stop", -1)
+	return start, stop, err
+}
+
+func queryFloat(r *http.Request, name string, def float64) (float64, error) {
+	v := r.URL.Query().Get(name)
+	if v == "" {
+		return def, nil
+	}
+	// An unescaped "+inf" arrives as " inf".
+	f, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+	if err != nil {
+		return 0, fmt.Errorf("'%s' must be a number, -inf or +inf", name)
+	}
+	return f, nil
+}
+
+// handleList serves GET /api/v2/lists/{key}?start=0&stop=-1, which returns
+// a range of items.
+func (s *Server) handleList(w http.ResponseWriter, r *http.Request) {
+	key := r.PathValue("key")
+	if !s.resourceRequest(w, r, key, http.MethodGet) {
+		return
+	}
+	start, stop, err := rankQuery(r)
+	if err != nil {
+		s.sendError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	entry, ok := s.readCollection(w, r, key)
+	if !ok {
+		return
+	}
+	list, err := asList(entry.Value, true)
+	if err != nil {
+		s.sendCacheError(w, err, http.StatusBadRequest)
+		return
+	}
+	s.sendSuccess(w, fmt.Sprintf("Found list '%s'", key), map[string]interface{}{
+		"length": len(list),
+		"items":  list.Range(start, stop),
+	})
+}
+
+// handleListEnd pushes onto (POST) or pops from (DELETE, ?count=N) the left
+// or right end of a list.
+func (s *Server) handleListEnd(w http.ResponseWriter, r *http.Request) {
+	key, end := r.PathValue("key"), r.PathValue("end")
+	if end != "left" && end != "right" {
+		s.sendError(w, "List end must be 'left' or 'right'", http.StatusNotFound)
+		return
+	}
+	if !s.resourceRequest(w, r, key, "POST, DELETE") {
+		return
+	}
+
+	if r.Method == http.MethodPost {
+		values, ok := s.readStrings(w, r)
+		if !ok {
+			return
+		}
+		op := collectionOp{Op: opRPush, Values: values}
+		if end == "left" {
+			op.Op = opLPush
+		}
+		result, err := s.applyOp(r.Context(), key, op)
+		if err != nil {
+			s.sendCacheError(w, err, http.StatusBadRequest)
+			return
+		}
+		s.sendSuccess(w, fmt.Sprintf("Pushed %d item(s) onto list '%s'", len(values), key), map[string]interface{}{"length": result})
+		return
+	}
+
+	count, err := queryInt(r, "count", 1)
+	if err != nil || count < 1 {
+		s.sendError(w, "'count' must be a positive integer", http.StatusBadRequest)
+		return
+	}
+	op := collectionOp{Op: opRPop, Count: count}
+	if end == "left" {
+		op.Op = opLPop
+	}
+	result, err := s.applyOp(r.Context(), key, op)
+	if err != nil {
+		s.sendCacheError(w, err, http.StatusBadRequest)
+		return
+	}
+	if result == nil {
+		s.sendError(w, fmt.Sprintf("List '%s' not found", key), http.StatusNotFound)
+		return
+	}
+	s.sendSuccess(w, fmt.Sprintf("Popped from list '%s'", key), map[string]interface{}{"items": result})
+}
+
+// handleHash returns every field (GET) or sets several from a JSON object
+// of strings (PATCH).
+func (s *Server) handleHash(w http.ResponseWriter, r *http.Request) {
+	key := r.PathValue("key")
+	if !s.resourceRequest(w, r, key, "GET, PATCH") {
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		entry, ok := s.readCollection(w, r, key)
+		if !ok {
+			return
+		}
+		hash, err := asHash(entry.Value, true)
+		if err != nil {
+			s.sendCacheError(w, err, http.StatusBadRequest)
+			return
+		}
+		s.sendSuccess(w, fmt.Sprintf("Found hash '%s'", key), hash)
+		return
+	}
+
+	var fields map[string]string
+	if !s.readJSONBody(w, r, &fields, "a JSON object of string fields") {
+		return
+	}
+	if len(fields) == 0 {
+		s.sendError(w, "Body must set at least one field", http.StatusBadRequest)
+		return
+	}
+	s.setHashFields(w, r, key, fields)
+}
+
+func (s *Server) setHashFields(w http.ResponseWriter, r *http.Request, key string, fields map[string]string) {
+	result, err := s.applyOp(r.Context(), key, collectionOp{Op: opHSet, Fields: fields})
+	if err != nil {
+		s.sendCacheError(w, err, http.StatusBadRequest)
+		return
+	}
+	s.sendSuccess(w, fmt.Sprintf("Set %d field(s) of hash '%s'", len(fields), key), map[string]interface{}{"created": result})
+}
+
+// handleHashField reads, sets (a JSON string body) or deletes one field.
+func (s *Server) handleHashField(w http.ResponseWriter, r *http.Request) {
+	key, field := r.PathValue("key"), r.PathValue("field")
+	if !s.resourceRequest(w, r, key, "GET, PUT, DELETE") {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		entry, ok := s.readCollection(w, r, key)
+		if !ok {
+			return
+		}
+		hash, err := asHash(entry.Value, true)
+		if err != nil {
+			s.sendCacheError(w, err, http.StatusBadRequest)
+			return
+		}
+		value, ok := hash[field]
+		if !ok {
+			s.sendError(w, fmt.Sprintf("Field '%s' not found in hash '%s'", field, key), http.StatusNotFound)
+			return
+		}
+		s.sendSuccess(w, fmt.Sprintf("Found field '%s'", field), map[string]string{"field": field, "value": value})
+	case http.MethodPut:
+		var value string
+		if !s.readJSONBody(w, r, &value, "a JSON string") {
+			return
+		}
+		s.setHashFields(w, r, key, map[string]string{field: value})
+	case http.MethodDelete:
+		result, err := s.applyOp(r.Context(), key, collectionOp{Op: opHDel, Values: []string{field}})
+		if err != nil {
+			s.sendCacheError(w, err, http.StatusBadRequest)
+			return
+		}
+		if result == 0 {
+			s.sendError(w, fmt.Sprintf("Field '%s' not found in hash '%s'", field, key), http.StatusNotFound)
+			return
+		}
+		s.sendSuccess(w, fmt.Sprintf("Deleted field '%s' of hash '%s'", field, key), nil)
+	}
+}
+
+// handleHashIncr adds ?by=N (default 1) to an integer field, starting from
+// zero if it is not set.
+func (s *Server) handleHashIncr(w http.ResponseWriter, r *http.Request) {
+	key, field := r.PathValue("key"), r.PathValue("field")
+	if !s.resourceRequest(w, r, key, http.MethodPost) {
+		return
+	}
+	by := int64(1)
+	if v := r.URL.Query().Get("by"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			s.sendError(w, "'by' must be an integer", http.StatusBadRequest)
+			return
+		}
+		by = n
+	}
+
+	result, err := s.applyOp(r.Context(), key, collectionOp{Op: opHIncrBy, Field: field, By: by})
+	if err != nil {
+		s.sendCacheError(w, err, http.StatusBadRequest)
+		return
+	}
+	s.sendSuccess(w, fmt.Sprintf("Incremented field '%s' of hash '%s'", field, key), map[string]interface{}{"field": field, "value": result})
+}
+
+// handleSetMembers returns the members (GET, ?intersect=k1,k2 to intersect with
+// other sets) or adds members (POST).
+func (s *Server) handleSetMembers(w http.ResponseWriter, r *http.Request) {
+	key := r.PathValue("key")
+	if !s.resourceRequest(w, r, key, "GET, POST") {
+		return
+	}
+
+	if r.Method == http.MethodPost {
+		members, ok := s.readStrings(w, r)
+		if !ok {
+			return
+		}
+		result, err := s.applyOp(r.Context(), key, collectionOp{Op: opSAdd, Values: members})
+		if err != nil {
+			s.sendCacheError(w, err, http.StatusBadRequest)
+			return
+		}
+		s.sendSuccess(w, fmt.Sprintf("Added to set '%s'", key), map[string]interface{}{"added": result})
+		return
+	}
+
+	var others []SetValue
+	if list := r.URL.Query().Get("intersect"); list != "" {
+		for _, other := range strings.Split(list, ",") {
+			set, ok := s.readOtherSet(w, r, strings.TrimSpace(other))
+			if !ok {
+				return
+			}
+			others = append(others, set)
+		}
+	}
+	entry, ok := s.readCollection(w, r, key)
+	if !ok {
+		return
+	}
+	set, err := asSet(entry.Value, true)
+	if err != nil {
+		s.sendCacheError(w, err, http.StatusBadRequest)
+		return
+	}
+	members := set.Intersect(others...)
+	if members == nil {
+		members = []string{}
+	}
+	s.sendSuccess(w, fmt.Sprintf("Found set '%s'", key), map[string]interface{}{"size": len(members), "members": members})
+}
+
+// readOtherSet reads a set named in ?intersect. A missing key is an empty
+// set. With gossip clustering every key must be owned by this node.
+func (s *Server) readOtherSet(w http.ResponseWriter, r *http.Request, key string) (SetValue, bool) {
+	if key == "" {
+		s.sendError(w, "'intersect' must list set keys separated by commas", http.StatusBadRequest)
+		return nil, false
+	}
+	if !s.authorize(w, r, AccessRead, key) {
+		return nil, false
+	}
+	if s.cluster != nil {
+		if _, local := s.cluster.Owner(key); !local {
+			s.sendError(w, fmt.Sprintf("Key '%s' is owned by another node; intersected sets must live on the same node", key), http.StatusBadRequest)
+			return nil, false
+		}
+	}
+	entry, exists, err := s.getEntry(r.Context(), key)
+	if err == nil {
+		var set SetValue
+		if set, err = asSet(entry.Value, exists); err == nil {
+			return set, true
+		}
+	}
+	s.sendCacheError(w, err, http.StatusBadRequest)
+	return nil, false
+}
+
+// handleSetMember checks (GET), adds (PUT) or removes (DELETE) one member.
+func (s *Server) handleSetMember(w http.ResponseWriter, r *http.Request) {
+	key, member := r.PathValue("key"), r.PathValue("member")
+	if !s.resourceRequest(w, r, key, "GET, PUT, DELETE") {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		entry, ok := s.readCollection(w, r, key)
+		if !ok {
+			return
+		}
+		set, err := asSet(entry.Value, true)
+		if err != nil {
+			s.sendCacheError(w, err, http.StatusBadRequest)
+			return
+		}
+		if _, in := set[member]; !in {
+			s.sendError(w, fmt.Sprintf("'%s' is not a member of set '%s'", member, key), http.StatusNotFound)
+			return
+		}
+		s.sendSuccess(w, fmt.Sprintf("'%s' is a member of set '%s'", member, key), nil)
+	case http.MethodPut:
+		result, err := s.applyOp(r.Context(), key, collectionOp{Op: opSAdd, Values: []string{member}})
+		if err != nil {
+			s.sendCacheError(w, err, http.StatusBadRequest)
+			return
+		}
+		s.sendSuccess(w, fmt.Sprintf("Added '%s' to set '%s'", member, key), map[string]interface{}{"added": result})
+	case http.MethodDelete:
+		result, err := s.applyOp(r.Context(), key, collectionOp{Op: opSRem, Values: []string{member}})
+		if err != nil {
+			s.sendCacheError(w, err, http.StatusBadRequest)
+			return
+		}
+		if result == 0 {
+			s.sendError(w, fmt.Sprintf("'%s' is not a member of set '%s'", member, key), http.StatusNotFound)
+			return
+		}
+		s.sendSuccess(w, fmt.Sprintf("Removed '%s' from set '%s'", member, key), nil)
+	}
+}
+
+// handleSortedSet returns a range of members (GET) by rank with ?start and
+// ?stop, or by score with ?min and ?max, or adds members from a JSON object
+// of scores (PATCH).
+func (s *Server) handleSortedSet(w http.ResponseWriter, r *http.Request) {
+	key := r.PathValue("key")
+	if !s.resourceRequest(w, r, key, "GET, PATCH") {
+		return
+	}
+
+	if r.Method == http.MethodPatch {
+		var scores map[string]float64
+		if !s.readJSONBody(w, r, &scores, "a JSON object of member scores") {
+			return
+		}
+		if len(scores) == 0 {
+			s.sendError(w, "Body must score at least one member", http.StatusBadRequest)
+			return
+		}
+		s.addScores(w, r, key, scores)
+		return
+	}
+
+	q := r.URL.Query()
+	byScore := q.Has("min") || q.Has("max")
+	if byScore && (q.Has("start") || q.Has("stop")) {
+		s.sendError(w, "Use either start and stop or min and max", http.StatusBadRequest)
+		return
+	}
+	var rangeOf func(SortedSetValue) []ZMember
+	if byScore {
+		min, max, err := scoreQuery(r)
+		if err != nil {
+			s.sendError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		rangeOf = func(z SortedSetValue) []ZMember { return z.RangeByScore(min, max) }
+	} else {
+		start, stop, err := rankQuery(r)
+		if err != nil {
+			s.sendError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		rangeOf = func(z SortedSetValue) []ZMember { return z.RangeByRank(start, stop) }
+	}
+
+	entry, ok := s.readCollection(w, r, key)
+	if !ok {
+		return
+	}
+	zset, err := asSortedSet(entry.Value, true)
+	if err != nil {
+		s.sendCacheError(w, err, http.StatusBadRequest)
+		return
+	}
+	s.sendSuccess(w, fmt.Sprintf("Found sorted set '%s'", key), map[string]interface{}{"size": zset.Len(), "members": rangeOf(zset)})
+}
+
+// scoreQuery reads ?min and ?max, which default to -inf and +inf.
+func scoreQuery(r *http.Request) (float64, float64, error) {
+	min, err := queryFloat(r, "min", math.Inf(-1))
+	if err != nil {
+		return 0, 0, err
+	}
+	max, err := queryFloat(r, "max", math.Inf(1))
+	return min, max, err
+}
+
+func (s *Server) addScores(w http.ResponseWriter, r *http.Request, key string, scores map[string]float64) {
+	result, err := s.applyOp(r.Context(), key, collectionOp{Op: opZAdd, Scores: scores})
+	if err != nil {
+		s.sendCacheError(w, err, http.StatusBadRequest)
+		return
+	}
+	s.sendSuccess(w, fmt.Sprintf("Scored %d member(s) of sorted set '%s'", len(scores), key), map[string]interface{}{"added": result})
+}
+
+// handleSortedSetMember returns a member's score and rank (GET), sets its
+// score from a JSON number (PUT) or removes it (DELETE).
+func (s *Server) handleSortedSetMember(w http.ResponseWriter, r *http.Request) {
+	key, member := r.PathValue("key"), r.PathValue("member")
+	if !s.resourceRequest(w, r, key, "GET, PUT, DELETE") {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		entry, ok := s.readCollection(w, r, key)
+		if !ok {
+			return
+		}
+		zset, err := asSortedSet(entry.Value, true)
+		if err != nil {
+			s.sendCacheError(w, err, http.StatusBadRequest)
+			return
+		}
+		score, rank, ok := zset.Score(member)
+		if !ok {
+			s.sendError(w, fmt.Sprintf("'%s' is not a member of sorted set '%s'", member, key), http.StatusNotFound)
+			return
+		}
+		s.sendSuccess(w, fmt.Sprintf("Found '%s' in sorted set '%s'", member, key), map[string]interface{}{"member": member, "score": score, "rank": rank})
+	case http.MethodPut:
+		var score float64
+		if !s.readJSONBody(w, r, &score, "a JSON number") {
+			return
+		}
+		s.addScores(w, r, key, map[string]float64{member: score})
+	case http.MethodDelete:
+		result, err := s.applyOp(r.Context(), key, collectionOp{Op: opZRem, Values: []string{member}})
+		if err != nil {
+			s.sendCacheError(w, err, http.StatusBadRequest)
+			return
+		}
+		if result == 0 {
+			s.sendError(w, fmt.Sprintf("'%s' is not a member of sorted set '%s'", member, key), http.StatusNotFound)
+			return
+		}
+		s.sendSuccess(w, fmt.Sprintf("Removed '%s' from sorted set '%s'", member, key), nil)
+	}
+}
@@ -0,0 +1,399 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const keyMethods = "GET, HEAD, PUT, DELETE"
+
+// handleKey serves the resource-style API under /api/v2/keys/{key}. Keys are
+// a single path segment, so keys containing '/' must be sent URL-escaped.
+func (s *Server) handleKey(w http.ResponseWriter, r *http.Request) {
+	key := r.PathValue("key")
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodPut, http.MethodDelete:
+	default:
+		w.Header().Set("Allow", keyMethods)
+		s.sendError(w, "Method not allowed. Use "+keyMethods, http.StatusMethodNotAllowed)
+		return
+	}
+
+	need := AccessWrite
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		need = AccessRead
+	}
+	if !s.authorize(w, r, need, key) {
+		return
+	}
+	if s.redirectToOwner(w, r, key) {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		s.getKey(w, r, key)
+	case http.MethodHead:
+		s.headKey(w, r, key)
+	case http.MethodPut:
+		s.putKey(w, r, key)
+	case http.MethodDelete:
+		s.deleteKey(w, r, key)
+	}
+}
+
+// handleKeys lists the keys held by this node, sorted, only those starting
+// with ?prefix= if given. Listing needs read access to the prefix.
+func (s *Server) handleKeys(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		s.sendError(w, "Method not allowed. Use GET", http.StatusMethodNotAllowed)
+		return
+	}
+	prefix := r.URL.Query().Get("prefix")
+	if !s.authorize(w, r, AccessRead, prefix) {
+		return
+	}
+	l, ok := s.cache.(KeyLister)
+	if !ok {
+		s.sendError(w, "This cache cannot list its keys", http.StatusNotImplemented)
+		return
+	}
+
+	keys := []string{}
+	for _, key := range l.Keys() {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	s.sendSuccess(w, fmt.Sprintf("Found %d keys", len(keys)), keys)
+}
+
+func (s *Server) handleKeyMissing(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/api/v2/keys/" {
+		s.sendError(w, "Key is required in the path", http.StatusBadRequest)
+		return
+	}
+	s.sendError(w, "Key must be a single path segment; URL-escape '/' as %2F", http.StatusNotFound)
+}
+
+func (s *Server) getKey(w http.ResponseWriter, r *http.Request, key string) {
+	entry, encoding, exists, err := s.readEntry(w, r, key)
+	if err != nil {
+		s.sendCacheError(w, err, http.StatusInternalServerError)
+		return
+	}
+	if !exists {
+		s.sendError(w, fmt.Sprintf("Key '%s' not found", key), http.StatusNotFound)
+		return
+	}
+
+	setEntryHeaders(w, entry, time.Now())
+	setEncodedETag(w, entry, encoding)
+	if notModified(r, entry) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	if raw, ok := asRawValue(entry.Value); ok {
+		setRawHeaders(w, raw)
+		w.WriteHeader(http.StatusOK)
+		w.Write(raw.Data)
+		return
+	}
+	s.sendSuccess(w, fmt.Sprintf("Found key '%s'", key), entry.Value)
+}
+
+// setRawHeaders restores the headers a raw value was stored with. An unset
+// Content-Type stays unset rather than being sniffed by net/http.
+func setRawHeaders(w http.ResponseWriter, raw RawValue) {
+	if raw.ContentType != "" {
+		w.Header().Set("Content-Type", raw.ContentType)
+	} else {
+		w.Header()["Content-Type"] = nil
+	}
+	if raw.ContentEncoding != "" {
+		w.Header().Set("Content-Encoding", raw.ContentEncoding)
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(raw.Data)))
+}
+
+// readEntry is getEntry for GET and HEAD. When the cache keeps a raw value
+// compressed in an encoding the client accepts, the entry holds the
+// compressed bytes as a RawValue and encoding names the format; on the v2
+// route so does a JSON value, which the legacy route keeps in the envelope.
+func (s *Server) readEntry(w http.ResponseWriter, r *http.Request, key string) (Entry, string, bool, error) {
+	cc, ok := findCompressedCache(s.cache)
+	if !ok {
+		entry, exists, err := s.getEntry(r.Context(), key)
+		return entry, "", exists, err
+	}
+	if err := r.Context().Err(); err != nil {
+		return Entry{}, "", false, err
+	}
+
+	w.Header().Add("Vary", "Accept-Encoding")
+	acceptEncoding := r.Header.Get("Accept-Encoding")
+	bareJSON := r.Pattern == "/api/v2/keys/{key}"
+	entry, encoding, exists, err := cc.GetEntryEncoded(key, bareJSON, func(encoding string) bool {
+		return acceptsEncoding(acceptEncoding, encoding)
+	})
+	s.noteAccess(r.Context(), key, entry.Value, err)
+	return entry, encoding, exists, err
+}
+
+// acceptsEncoding reports whether an Accept-Encoding header allows coding.
+// A coding listed by name takes precedence over "*".
+func acceptsEncoding(header, coding string) bool {
+	wildcard := false
+	for _, part := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(part, ";")
+		name = strings.TrimSpace(name)
+
+		q := 1.0
+		if k, v, ok := strings.Cut(strings.TrimSpace(params), "="); ok && strings.EqualFold(strings.TrimSpace(k), "q") {
+			if f, err := strconv.ParseFloat(strings.TrimSpace(v), 64); err == nil {
+				q = f
+			}
+		}
+
+		switch {
+		case strings.EqualFold(name, coding):
+			return q > 0
+		case name == "*":
+			wildcard = q > 0
+		}
+	}
+	return wildcard
+}
+
+// headKey answers with the headers a GET would produce, without the body.
+func (s *Server) headKey(w http.ResponseWriter, r *http.Request, key string) {
+	entry, encoding, exists, err := s.readEntry(w, r, key)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if !exists {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	setEntryHeaders(w, entry, time.Now())
+	setEncodedETag(w, entry, encoding)
+	if notModified(r, entry) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	if raw, ok := asRawValue(entry.Value); ok {
+		setRawHeaders(w, raw)
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	body, err := json.Marshal(CacheResponse{Success: true, Message: fmt.Sprintf("Found key '%s'", key), Data: entry.Value})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	// json.Encoder, used for the GET body, appends a newline.
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)+1))
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *Server) putKey(w http.ResponseWriter, r *http.Request, key string) {
+	ttl, err := queryDuration(r, "ttl", 0)
+	if err != nil {
+		s.sendError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	value, ok := s.readValue(w, r)
+	if !ok {
+		return
+	}
+
+	var entry Entry
+	var created bool
+	if ttl > 0 {
+		entry, created, err = s.upsertWithTTL(r.Context(), key, value, ttl, writePrecondition(r))
+	} else {
+		entry, created, err = s.upsert(r.Context(), key, value, writePrecondition(r))
+	}
+	if err != nil {
+		s.sendCacheError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	setEntryHeaders(w, entry, time.Now())
+	if created {
+		w.Header().Set("Location", "/api/v2/keys/"+url.PathEscape(key))
+		s.sendSuccessStatus(w, http.StatusCreated, fmt.Sprintf("Created key '%s'", key), describeValue(value))
+		return
+	}
+	s.sendSuccess(w, fmt.Sprintf("Replaced key '%s'", key), describeValue(value))
+}
+
+func (s *Server) deleteKey(w http.ResponseWriter, r *http.Request, key string) {
+	existed, err := s.remove(r.Context(), key, writePrecondition(r))
+	if err != nil {
+		s.sendCacheError(w, err, http.StatusBadRequest)
+		return
+	}
+	if !existed {
+		s.sendError(w, fmt.Sprintf("Key '%s' not found", key), http.StatusNotFound)
+		return
+	}
+	s.sendSuccess(w, fmt.Sprintf("Successfully deleted key '%s'", key), nil)
+}
+
+// contextUpserter and contextRemover are implemented by caches whose writes
+// may wait, such as ReplicatedCache, so the request context bounds them.
+type contextUpserter interface {
+	UpsertContext(ctx context.Context, key string, value interface{}) (bool, error)
+}
+
+type contextRemover interface {
+	RemoveContext(ctx context.Context, key string) (bool, error)
+}
+
+func (s *Server) getEntry(ctx context.Context, key string) (entry Entry, exists bool, err error) {
+	defer func() { s.noteAccess(ctx, key, entry.Value, err) }()
+	return s.lookup(ctx, key)
+}
+
+// lookup is getEntry without noting the access, for writes that note their
+// own.
+func (s *Server) lookup(ctx context.Context, key string) (Entry, bool, error) {
+	if err := ctx.Err(); err != nil {
+		return Entry{}, false, err
+	}
+	if g, ok := s.cache.(EntryGetter); ok {
+		return g.GetEntry(key)
+	}
+	if cc, ok := s.cache.(ContextCache); ok {
+		value, exists, err := cc.GetContext(ctx, key)
+		return Entry{Value: value}, exists, err
+	}
+	value, exists, err := s.cache.Get(key)
+	return Entry{Value: value}, exists, err
+}
+
+// upsert writes key if cond (which may be nil) holds. Caches that cannot
+// check the condition atomically with the write get a lookup first; the
+// check and the created flag may then be stale under concurrent writes. A
+// replicated cache refuses conditions, as its replicas' ETags differ.
+func (s *Server) upsert(ctx context.Context, key string, value interface{}, cond Precondition) (entry Entry, created bool, err error) {
+	defer func() { s.noteAccess(ctx, key, value, err) }()
+	if cw, ok := s.cache.(ConditionalWriter); ok {
+		if err := ctx.Err(); err != nil {
+			return Entry{}, false, err
+		}
+		return cw.UpsertIf(key, value, cond)
+	}
+	if _, ok := s.cache.(*ReplicatedCache); ok && cond != nil {
+		return Entry{}, false, ErrConditionalUnsupported
+	}
+
+	current, exists, err := s.lookup(ctx, key)
+	if err != nil {
+		return Entry{}, false, err
+	}
+	if cond != nil && !cond(current, exists) {
+		return current, false, ErrPreconditionFailed
+	}
+	created = !exists
+	switch c := s.cache.(type) {
+	case contextUpserter:
+		created, err = c.UpsertContext(ctx, key, value)
+	case Upserter:
+		created, err = c.Upsert(key, value)
+	case ContextCache:
+		err = c.SetContext(ctx, key, value)
+	default:
+		err = s.cache.Set(key, value)
+	}
+	if err != nil {
+		return Entry{}, false, err
+	}
+	entry, _, err = s.lookup(ctx, key)
+	return entry, created, err
+}
+
+func (s *Server) upsertWithTTL(ctx context.Context, key string, value interface{}, ttl time.Duration, cond Precondition) (entry Entry, created bool, err error) {
+	defer func() { s.noteAccess(ctx, key, value, err) }()
+	ew, ok := s.cache.(ExpiringWriter)
+	if !ok {
+		return Entry{}, false, ErrTTLUnsupported
+	}
+	if err := ctx.Err(); err != nil {
+		return Entry{}, false, err
+	}
+	return ew.UpsertWithTTL(ctx, key, value, ttl, cond)
+}
+
+// restoreEntry installs an entry handed over by another node. Caches that
+// cannot restore entries get a plain write of the time it had left, under a
+// version of their own.
+func (s *Server) restoreEntry(ctx context.Context, key string, e Entry) (bool, error) {
+	if er, ok := s.cache.(EntryRestorer); ok {
+		if err := ctx.Err(); err != nil {
+			return false, err
+		}
+		restored, err := er.RestoreEntry(key, e)
+		if !errors.Is(err, ErrRestoreUnsupported) {
+			return restored, err
+		}
+	}
+
+	var err error
+	if _, ok := s.cache.(ExpiringWriter); ok && !e.Expires.IsZero() {
+		ttl := time.Until(e.Expires)
+		if ttl <= 0 {
+			return false, nil
+		}
+		_, _, err = s.upsertWithTTL(ctx, key, e.Value, ttl, nil)
+	} else {
+		_, _, err = s.upsert(ctx, key, e.Value, nil)
+	}
+	return err == nil, err
+}
+
+func (s *Server) remove(ctx context.Context, key string, cond Precondition) (existed bool, err error) {
+	defer func() { s.noteAccess(ctx, key, nil, err) }()
+	if cw, ok := s.cache.(ConditionalWriter); ok {
+		if err := ctx.Err(); err != nil {
+			return false, err
+		}
+		return cw.RemoveIf(key, cond)
+	}
+	if _, ok := s.cache.(*ReplicatedCache); ok && cond != nil {
+		return false, ErrConditionalUnsupported
+	}
+
+	current, exists, err := s.lookup(ctx, key)
+	if err != nil {
+		return false, err
+	}
+	if cond != nil && !cond(current, exists) {
+		return false, ErrPreconditionFailed
+	}
+	switch c := s.cache.(type) {
+	case contextRemover:
+		return c.RemoveContext(ctx, key)
+	case Remover:
+		return c.Remove(key)
+	case ContextCache:
+		return exists, c.DeleteContext(ctx, key)
+	}
+	return exists, s.cache.Delete(key)
+}
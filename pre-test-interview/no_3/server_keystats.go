@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const defaultTopKeys = 10
+
+// SetKeyStatsWindow sets how far back /api/cache/hotkeys and
+// /api/cache/bigkeys can look; zero turns the tracking off.
+func (s *Server) SetKeyStatsWindow(d time.Duration) {
+	s.keyStats = nil
+	if d > 0 {
+		s.keyStats = newKeyStats(d)
+	}
+}
+
+// keyAccess is what a request's handler last did with the cache: the key,
+// and the value read or written, nil for deletes and misses.
+type keyAccess struct {
+	reached bool
+	key     string
+	value   interface{}
+}
+
+type keyAccessContextKey struct{}
+
+// withKeyAccess returns r with a keyAccess for noteAccess to fill in.
+func withKeyAccess(r *http.Request) (*http.Request, *keyAccess) {
+	access := &keyAccess{}
+	return r.WithContext(context.WithValue(r.Context(), keyAccessContextKey{}, access)), access
+}
+
+// noteAccess records on ctx's keyAccess that key was read or written, if
+// err shows the cache served the call.
+func (s *Server) noteAccess(ctx context.Context, key string, value interface{}, err error) {
+	if s.keyStats == nil || err != nil {
+		return
+	}
+	if access, ok := ctx.Value(keyAccessContextKey{}).(*keyAccess); ok {
+		*access = keyAccess{reached: true, key: key, value: value}
+	}
+}
+
+// trackKey feeds s.keyStats from a finished request on a single key, if it
+// reached the cache: requests turned away before, such as by auth or the
+// rate limit, do not make a key hot. The size is valueSize of the value
+// stored, or of the compressed bytes when they were served as they are.
+func (s *Server) trackKey(r *http.Request, access *keyAccess) {
+	key := requestKey(r)
+	if key == "" || !access.reached || access.key != key {
+		return
+	}
+	var size int64
+	if access.value != nil {
+		size = int64(valueSize(access.value))
+	}
+	s.keyStats.record(key, size)
+}
+
+// keyStatsQuery reads ?window= and ?limit=. On failure it writes the error
+// response and returns false.
+func (s *Server) keyStatsQuery(w http.ResponseWriter, r *http.Request) (time.Duration, int, bool) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		s.sendError(w, "Method not allowed. Use GET", http.StatusMethodNotAllowed)
+		return 0, 0, false
+	}
+	if !s.authorize(w, r, AccessRead, "") {
+		return 0, 0, false
+	}
+	window, err := queryDuration(r, "window", s.keyStats.window)
+	if err != nil || window > s.keyStats.window {
+		s.sendError(w, fmt.Sprintf("'window' must be a positive duration up to %s", s.keyStats.window), http.StatusBadRequest)
+		return 0, 0, false
+	}
+	limit, err := queryInt(r, "limit", defaultTopKeys)
+	if err != nil || limit < 1 || limit > trackedKeys {
+		s.sendError(w, fmt.Sprintf("'limit' must be between 1 and %d", trackedKeys), http.StatusBadRequest)
+		return 0, 0, false
+	}
+	return window, limit, true
+}
+
+// handleHotKeys lists the keys requested most on this node in the window,
+// by estimated count.
+func (s *Server) handleHotKeys(w http.ResponseWriter, r *http.Request) {
+	window, limit, ok := s.keyStatsQuery(w, r)
+	if !ok {
+		return
+	}
+	keys, accesses := s.keyStats.hot(window, limit)
+	s.sendSuccess(w, fmt.Sprintf("Most accessed keys in the last %s", window), map[string]interface{}{
+		"window_seconds": ceilSeconds(window),
+		"accesses":       accesses,
+		"keys":           keys,
+	})
+}
+
+// handleBigKeys lists the keys with the largest values read or written on
+// this node in the window.
+func (s *Server) handleBigKeys(w http.ResponseWriter, r *http.Request) {
+	window, limit, ok := s.keyStatsQuery(w, r)
+	if !ok {
+		return
+	}
+	s.sendSuccess(w, fmt.Sprintf("Largest values in the last %s", window), map[string]interface{}{
+		"window_seconds": ceilSeconds(window),
+		"keys":           s.keyStats.big(window, limit),
+	})
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	lockOwnerHeader = "X-Lock-Owner"
+	lockMethods     = "GET, POST, PATCH, DELETE"
+	defaultLockTTL  = 30 * time.Second
+	// maxLockWait caps a blocking acquire, so a long poll ends well before
+	// proxies give up on the connection.
+	maxLockWait = time.Minute
+)
+
+// handleLocks lists the locks currently held, without their owner tokens.
+func (s *Server) handleLocks(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		s.sendError(w, "Method not allowed. Use GET", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.authorize(w, r, AccessRead, "") {
+		return
+	}
+	locks := s.locks.List()
+	s.sendSuccess(w, fmt.Sprintf("%d lock(s) held", len(locks)), locks)
+}
+
+// handleLock serves /api/v2/locks/{name}: GET shows the lock, POST acquires
+// it, and PATCH renews and DELETE releases it given the owner token in
+// X-Lock-Owner. Lock names share the access grants of cache keys.
+func (s *Server) handleLock(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	if !s.resourceRequest(w, r, name, lockMethods) {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		l, held := s.locks.Get(name)
+		if !held {
+			s.sendError(w, fmt.Sprintf("Lock '%s' is not held", name), http.StatusNotFound)
+			return
+		}
+		s.sendSuccess(w, fmt.Sprintf("Lock '%s' is held", name), l)
+	case http.MethodPost:
+		s.acquireLock(w, r, name)
+	case http.MethodPatch:
+		owner, ttl, ok := s.lockOwnerRequest(w, r)
+		if !ok {
+			return
+		}
+		l, err := s.locks.Renew(r.Context(), name, owner, ttl)
+		if err != nil {
+			s.sendCacheError(w, err, http.StatusBadRequest)
+			return
+		}
+		l.Owner = ""
+		s.sendSuccess(w, fmt.Sprintf("Renewed lock '%s'", name), l)
+	case http.MethodDelete:
+		owner, _, ok := s.lockOwnerRequest(w, r)
+		if !ok {
+			return
+		}
+		if err := s.locks.Release(r.Context(), name, owner); err != nil {
+			s.sendCacheError(w, err, http.StatusBadRequest)
+			return
+		}
+		s.sendSuccess(w, fmt.Sprintf("Released lock '%s'", name), nil)
+	}
+}
+
+// acquireLock takes the lock for ?ttl= (default 30s). With ?wait= it blocks
+// until the lock is free or the wait, at most a minute, is over.
+func (s *Server) acquireLock(w http.ResponseWriter, r *http.Request, name string) {
+	ttl, err := queryDuration(r, "ttl", defaultLockTTL)
+	if err != nil {
+		s.sendError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	wait, err := queryDuration(r, "wait", 0)
+	if err != nil {
+		s.sendError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if wait > maxLockWait {
+		wait = maxLockWait
+	}
+	holder := r.URL.Query().Get("holder")
+
+	var l Lock
+	if wait > 0 {
+		ctx, cancel := context.WithTimeout(r.Context(), wait)
+		defer cancel()
+		l, err = s.locks.AcquireWait(ctx, name, holder, ttl)
+		if errors.Is(err, context.DeadlineExceeded) && r.Context().Err() == nil {
+			err = ErrLockHeld
+		}
+	} else {
+		l, err = s.locks.Acquire(r.Context(), name, holder, ttl)
+	}
+
+	if errors.Is(err, ErrLockHeld) {
+		message := fmt.Sprintf("Lock '%s' is held", name)
+		if current, held := s.locks.Get(name); held {
+			if current.Holder != "" {
+				message += " by " + current.Holder
+			}
+			w.Header().Set("Retry-After", strconv.Itoa(ceilSeconds(time.Until(current.Expires))))
+		}
+		s.sendError(w, message, http.StatusConflict)
+		return
+	}
+	if err != nil {
+		s.sendCacheError(w, err, http.StatusBadRequest)
+		return
+	}
+	s.sendSuccess(w, fmt.Sprintf("Acquired lock '%s'", name), l)
+}
+
+// lockOwnerRequest reads the owner token and, for renewals, ?ttl=.
+func (s *Server) lockOwnerRequest(w http.ResponseWriter, r *http.Request) (string, time.Duration, bool) {
+	owner := r.Header.Get(lockOwnerHeader)
+	if owner == "" {
+		s.sendError(w, "The "+lockOwnerHeader+" header with the owner token from acquire is required", http.StatusBadRequest)
+		return "", 0, false
+	}
+	ttl, err := queryDuration(r, "ttl", defaultLockTTL)
+	if err != nil {
+		s.sendError(w, err.Error(), http.StatusBadRequest)
+		return "", 0, false
+	}
+	return owner, ttl, true
+}
+
+func queryDuration(r *http.Request, name string, def time.Duration) (time.Duration, error) {
+	v := r.URL.Query().Get(name)
+	if v == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("'%s' must be a positive duration such as 30s", name)
+	}
+	return d, nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// SetAccessLog logs every request to logger; nil turns the access log off.
+func (s *Server) SetAccessLog(logger *slog.Logger) {
+	s.accessLog = logger
+}
+
+// logRequests wraps the routes with the access log. Clients are logged by
+// IP address and the ID of their API key, never the key itself. Health
+// checks and Raft traffic between peers are logged at debug level, as they
+// would otherwise drown out everything else.
+func (s *Server) logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.accessLog == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+
+		level := slog.LevelInfo
+		if r.URL.Path == "/health" || strings.HasPrefix(r.URL.Path, "/raft/") {
+			level = slog.LevelDebug
+		}
+		// The route is the pattern matched, not the path, so keys only
+		// appear as "key", where they can be redacted.
+		attrs := []slog.Attr{
+			slog.String("method", r.Method),
+			slog.String("route", r.Pattern),
+		}
+		if key := requestKey(r); key != "" {
+			attrs = append(attrs, slog.String("key", key))
+		}
+		attrs = append(attrs,
+			slog.Int("status", rec.status),
+			slog.Duration("latency", time.Since(start)),
+			slog.Int64("bytes", rec.bytes),
+			slog.String("client", clientIP(r)),
+		)
+		if s.auth != nil {
+			if key, ok := s.auth.Authenticate(requestToken(r)); ok {
+				attrs = append(attrs, slog.String("api_key", key.ID))
+			}
+		}
+		s.accessLog.LogAttrs(r.Context(), level, "request", attrs...)
+	})
+}
+
+// requestKey returns the cache key a request is about, from the path or,
+// for the /api/cache endpoints, the query or form.
+func requestKey(r *http.Request) string {
+	if key := r.PathValue("key"); key != "" {
+		return key
+	}
+	if !strings.HasPrefix(r.URL.Path, "/api/cache/") {
+		return ""
+	}
+	if r.Form != nil {
+		return r.Form.Get("key")
+	}
+	return r.URL.Query().Get("key")
+}
+
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// statusRecorder notes the status and size of a response.
+type statusRecorder struct {
+	http.ResponseWriter
+	status      int
+	bytes       int64
+	wroteHeader bool
+}
+
+func (w *statusRecorder) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.status, w.wroteHeader = status, true
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusRecorder) Write(p []byte) (int, error) {
+	w.wroteHeader = true
+	n, err := w.ResponseWriter.Write(p)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (w *statusRecorder) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
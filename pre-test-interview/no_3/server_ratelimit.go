@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SetRateLimiter limits each client's reads and writes. Clients are told
+// apart by API key when auth is on and by IP address otherwise.
+func (s *Server) SetRateLimiter(limiter *RateLimiter) {
+	s.limiter = limiter
+}
+
+// rateLimitClient returns who r counts against and the limit that applies.
+// Unknown or missing API keys fall back to the client's IP, so guessing keys
+// is throttled too.
+func (s *Server) rateLimitClient(r *http.Request, write bool) (string, RateLimit) {
+	read, writeLimit := s.limiter.Limits()
+	limit := read
+	if write {
+		limit = writeLimit
+	}
+
+	if s.auth != nil {
+		if key, ok := s.auth.Authenticate(requestToken(r)); ok {
+			override := key.ReadLimit
+			if write {
+				override = key.WriteLimit
+			}
+			if override != nil {
+				limit = *override
+			}
+			return "key:" + key.ID, limit
+		}
+	}
+
+	return "ip:" + clientIP(r), limit
+}
+
+// rateLimit wraps the routes with the limiter. Health checks and Raft
+// traffic between peers are never limited.
+func (s *Server) rateLimit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.limiter == nil || r.URL.Path == "/health" || strings.HasPrefix(r.URL.Path, "/raft/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		write := r.Method != http.MethodGet && r.Method != http.MethodHead && r.Method != http.MethodOptions
+		client, limit := s.rateLimitClient(r, write)
+		d := s.limiter.Allow(client, limit, write)
+		setRateLimitHeaders(w, d)
+		if !d.allowed {
+			w.Header().Set("Retry-After", strconv.Itoa(ceilSeconds(d.retryAfter)))
+			kind := "read"
+			if write {
+				kind = "write"
+			}
+			s.sendError(w, fmt.Sprintf("Rate limit of %s %ss exceeded", d.limit, kind), http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// setRateLimitHeaders writes the RateLimit-* fields of the IETF
+// "RateLimit header fields for HTTP" draft.
+func setRateLimitHeaders(w http.ResponseWriter, d rateDecision) {
+	if d.limit.unlimited() {
+		return
+	}
+	h := w.Header()
+	h.Set("RateLimit-Limit", strconv.Itoa(d.limit.Limit))
+	h.Set("RateLimit-Remaining", strconv.Itoa(d.remaining))
+	h.Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(d.reset)))
+	h.Set("RateLimit-Policy", fmt.Sprintf("%d;w=%d", d.limit.Limit, ceilSeconds(d.limit.Window)))
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int((d + time.Second - 1) / time.Second)
+}
@@ -0,0 +1,418 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestServer(t *testing.T, cache Cache) *httptest.Server {
+	t.Helper()
+	ts := httptest.NewServer(NewServer(cache, nil).setupRoutes())
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+func doRequest(t *testing.T, method, url, contentType, body string) (*http.Response, CacheResponse) {
+	t.Helper()
+
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("Failed to build request: %v", err)
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var decoded CacheResponse
+	data, _ := io.ReadAll(resp.Body)
+	if len(data) > 0 {
+		json.Unmarshal(data, &decoded)
+	}
+	return resp, decoded
+}
+
+func TestServer_KeyResourceLifecycle(t *testing.T) {
+	ts := newTestServer(t, NewSimpleCache())
+	url := ts.URL + "/api/v2/keys/name"
+
+	resp, _ := doRequest(t, http.MethodPut, url, "application/json", `"Alice"`)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("Expected 201 on create, got %d", resp.StatusCode)
+	}
+	if loc := resp.Header.Get("Location"); loc != "/api/v2/keys/name" {
+		t.Errorf("Expected Location header, got %q", loc)
+	}
+
+	resp, _ = doRequest(t, http.MethodPut, url, "application/json", `"Bob"`)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected 200 on replace, got %d", resp.StatusCode)
+	}
+
+	resp, body := doRequest(t, http.MethodGet, url, "", "")
+	if resp.StatusCode != http.StatusOK || body.Data != "Bob" {
+		t.Fatalf("Expected Bob, got %d %+v", resp.StatusCode, body)
+	}
+
+	resp, _ = doRequest(t, http.MethodHead, url, "", "")
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Length") == "" {
+		t.Errorf("Expected 200 with Content-Length on HEAD, got %d %v", resp.StatusCode, resp.Header)
+	}
+
+	resp, _ = doRequest(t, http.MethodDelete, url, "", "")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected 200 on delete, got %d", resp.StatusCode)
+	}
+
+	resp, _ = doRequest(t, http.MethodDelete, url, "", "")
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected 404 deleting a missing key, got %d", resp.StatusCode)
+	}
+	resp, _ = doRequest(t, http.MethodHead, url, "", "")
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected 404 on HEAD of a missing key, got %d", resp.StatusCode)
+	}
+}
+
+func TestServer_KeyResourceEscapedKey(t *testing.T) {
+	cache := NewSimpleCache()
+	ts := newTestServer(t, cache)
+
+	resp, _ := doRequest(t, http.MethodPut, ts.URL+"/api/v2/keys/users%2F42%20x", "application/json", `{"id":42}`)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("Expected 201, got %d", resp.StatusCode)
+	}
+	if _, exists, _ := cache.Get("users/42 x"); !exists {
+		t.Error("Expected the key to be stored unescaped")
+	}
+
+	resp, _ = doRequest(t, http.MethodGet, ts.URL+"/api/v2/keys/users/42", "", "")
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected 404 for an unescaped slash, got %d", resp.StatusCode)
+	}
+}
+
+func TestServer_KeyResourceMethodNotAllowed(t *testing.T) {
+	ts := newTestServer(t, NewSimpleCache())
+
+	resp, body := doRequest(t, http.MethodPost, ts.URL+"/api/v2/keys/name", "", "")
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Fatalf("Expected 405, got %d", resp.StatusCode)
+	}
+	if allow := resp.Header.Get("Allow"); allow != keyMethods {
+		t.Errorf("Expected Allow %q, got %q", keyMethods, allow)
+	}
+	if body.Success {
+		t.Error("Expected an error envelope")
+	}
+
+	resp, _ = doRequest(t, http.MethodPut, ts.URL+"/api/cache/set?key=name", "", "")
+	if resp.StatusCode != http.StatusMethodNotAllowed || resp.Header.Get("Allow") != http.MethodPost {
+		t.Errorf("Expected legacy 405 with Allow: POST, got %d %q", resp.StatusCode, resp.Header.Get("Allow"))
+	}
+}
+
+func TestServer_LegacyRoutesShareStorage(t *testing.T) {
+	ts := newTestServer(t, NewSimpleCache())
+
+	resp, _ := doRequest(t, http.MethodPost, ts.URL+"/api/cache/set?key=age", "application/x-www-form-urlencoded", "value=30")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected 200 from legacy set, got %d", resp.StatusCode)
+	}
+
+	resp, body := doRequest(t, http.MethodGet, ts.URL+"/api/v2/keys/age", "", "")
+	if resp.StatusCode != http.StatusOK || body.Data != "30" {
+		t.Fatalf("Expected value from legacy set, got %d %+v", resp.StatusCode, body)
+	}
+
+	resp, body = doRequest(t, http.MethodGet, ts.URL+"/api/cache/get?key=age", "", "")
+	if resp.StatusCode != http.StatusOK || body.Data != "30" {
+		t.Fatalf("Expected legacy get to keep working, got %d %+v", resp.StatusCode, body)
+	}
+}
+
+func TestServer_ConditionalGet(t *testing.T) {
+	cache, err := NewTTLCache(time.Minute)
+	if err != nil {
+		t.Fatalf("Failed to create TTLCache: %v", err)
+	}
+	defer cache.Close()
+	ts := newTestServer(t, cache)
+	url := ts.URL + "/api/v2/keys/doc"
+
+	resp, _ := doRequest(t, http.MethodPut, url, "application/json", `{"v":1}`)
+	etag := resp.Header.Get("ETag")
+	if etag == "" {
+		t.Fatal("Expected an ETag on write")
+	}
+
+	resp, _ = doRequest(t, http.MethodGet, url, "", "")
+	if resp.Header.Get("ETag") != etag {
+		t.Errorf("Expected ETag %s on read, got %s", etag, resp.Header.Get("ETag"))
+	}
+	if cc := resp.Header.Get("Cache-Control"); !strings.HasPrefix(cc, "max-age=") || cc == "max-age=0" {
+		t.Errorf("Expected max-age from the remaining TTL, got %q", cc)
+	}
+	if resp.Header.Get("Expires") == "" || resp.Header.Get("Last-Modified") == "" {
+		t.Errorf("Expected Expires and Last-Modified headers, got %v", resp.Header)
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, url, nil)
+	req.Header.Set("If-None-Match", etag)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotModified {
+		t.Errorf("Expected 304 for a matching If-None-Match, got %d", resp.StatusCode)
+	}
+
+	req, _ = http.NewRequest(http.MethodGet, ts.URL+"/api/cache/get?key=doc", nil)
+	req.Header.Set("If-Modified-Since", time.Now().Add(time.Minute).UTC().Format(http.TimeFormat))
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotModified {
+		t.Errorf("Expected 304 for If-Modified-Since on the legacy route, got %d", resp.StatusCode)
+	}
+
+	doRequest(t, http.MethodPut, url, "application/json", `{"v":2}`)
+	req, _ = http.NewRequest(http.MethodGet, url, nil)
+	req.Header.Set("If-None-Match", etag)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected 200 after the value changed, got %d", resp.StatusCode)
+	}
+}
+
+func TestServer_ConditionalWrite(t *testing.T) {
+	ts := newTestServer(t, NewSimpleCache())
+	url := ts.URL + "/api/v2/keys/counter"
+
+	put := func(ifMatch, ifNoneMatch, body string) *http.Response {
+		req, _ := http.NewRequest(http.MethodPut, url, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		if ifMatch != "" {
+			req.Header.Set("If-Match", ifMatch)
+		}
+		if ifNoneMatch != "" {
+			req.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	if resp := put("*", "", "1"); resp.StatusCode != http.StatusPreconditionFailed {
+		t.Errorf("Expected 412 for If-Match: * on a missing key, got %d", resp.StatusCode)
+	}
+	resp := put("", "*", "1")
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("Expected 201 for create-only write, got %d", resp.StatusCode)
+	}
+	etag := resp.Header.Get("ETag")
+	if resp := put("", "*", "2"); resp.StatusCode != http.StatusPreconditionFailed {
+		t.Errorf("Expected 412 for If-None-Match: * on an existing key, got %d", resp.StatusCode)
+	}
+
+	resp = put(etag, "", "2")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected 200 for a matching If-Match, got %d", resp.StatusCode)
+	}
+	if resp := put(etag, "", "3"); resp.StatusCode != http.StatusPreconditionFailed {
+		t.Errorf("Expected 412 for a stale If-Match, got %d", resp.StatusCode)
+	}
+
+	req, _ := http.NewRequest(http.MethodDelete, url, nil)
+	req.Header.Set("If-Match", etag)
+	delResp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	delResp.Body.Close()
+	if delResp.StatusCode != http.StatusPreconditionFailed {
+		t.Errorf("Expected 412 deleting with a stale If-Match, got %d", delResp.StatusCode)
+	}
+}
+
+func TestServer_RawValueRoundTrip(t *testing.T) {
+	cache := NewSimpleCache()
+	ts := newTestServer(t, cache)
+	url := ts.URL + "/api/v2/keys/blob"
+	payload := []byte{0x1f, 0x8b, 0x00, 0xff, 'x', '\n'}
+
+	req, _ := http.NewRequest(http.MethodPut, url, bytes.NewReader(payload))
+	req.Header.Set("Content-Type", "image/x-test; q=1")
+	req.Header.Set("Content-Encoding", "gzip")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("Expected 201, got %d", resp.StatusCode)
+	}
+
+	// Asking for the encoding explicitly stops the client from decoding it.
+	req, _ = http.NewRequest(http.MethodGet, url, nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !bytes.Equal(body, payload) {
+		t.Errorf("Expected the stored bytes back, got %v", body)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "image/x-test; q=1" {
+		t.Errorf("Expected the stored Content-Type, got %q", ct)
+	}
+	if ce := resp.Header.Get("Content-Encoding"); ce != "gzip" {
+		t.Errorf("Expected the stored Content-Encoding, got %q", ce)
+	}
+
+	snapshot, err := cache.Snapshot()
+	if err != nil {
+		t.Fatalf("Snapshot failed: %v", err)
+	}
+	restored := NewSimpleCache()
+	if err := restored.Restore(snapshot); err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+	value, _, _ := restored.Get("blob")
+	if raw, ok := value.(RawValue); !ok || !bytes.Equal(raw.Data, payload) || raw.ContentEncoding != "gzip" {
+		t.Errorf("Expected the raw value to survive a snapshot, got %#v", value)
+	}
+}
+
+func TestServer_ValueTooLarge(t *testing.T) {
+	server := NewServer(NewSimpleCache(), nil)
+	server.SetMaxValueSize(8)
+	ts := httptest.NewServer(server.setupRoutes())
+	defer ts.Close()
+
+	resp, _ := doRequest(t, http.MethodPut, ts.URL+"/api/v2/keys/big", "text/plain", "more than eight bytes")
+	if resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected 413 for a raw body, got %d", resp.StatusCode)
+	}
+	resp, _ = doRequest(t, http.MethodPost, ts.URL+"/api/cache/set?key=big", "application/json", `"more than eight bytes"`)
+	if resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected 413 for a JSON body, got %d", resp.StatusCode)
+	}
+	resp, _ = doRequest(t, http.MethodPut, ts.URL+"/api/v2/keys/small", "text/plain", "tiny")
+	if resp.StatusCode != http.StatusCreated {
+		t.Errorf("Expected 201 within the limit, got %d", resp.StatusCode)
+	}
+}
+
+func TestShutdownServer_DrainsRequestsThenPersists(t *testing.T) {
+	cache, err := NewTTLCache(time.Minute)
+	if err != nil {
+		t.Fatalf("Failed to create TTLCache: %v", err)
+	}
+	server := NewServer(cache, cache)
+
+	started := make(chan struct{})
+	mux := server.setupRoutes()
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("slow") != "" {
+			close(started)
+			time.Sleep(100 * time.Millisecond)
+		}
+		mux.ServeHTTP(w, r)
+	})
+
+	ts := httptest.NewServer(handler)
+	defer ts.Close()
+
+	done := make(chan int)
+	go func() {
+		resp, err := http.Post(ts.URL+"/api/cache/set?key=late&slow=1", "application/json", strings.NewReader(`"v"`))
+		if err != nil {
+			done <- 0
+			return
+		}
+		resp.Body.Close()
+		done <- resp.StatusCode
+	}()
+	<-started
+
+	cfg := defaultServerConfig()
+	cfg.SnapshotPath = filepath.Join(t.TempDir(), "snapshot.json")
+	if err := shutdownServer(ts.Config, server, cache, cfg, nil); err != nil {
+		t.Fatalf("Shutdown failed: %v", err)
+	}
+	if status := <-done; status != http.StatusOK {
+		t.Errorf("Expected the in-flight request to complete, got %d", status)
+	}
+	if !cache.IsClosed() {
+		t.Error("Expected the cache to be closed")
+	}
+
+	restored := NewSimpleCache()
+	if err := loadCacheSnapshot(cfg.SnapshotPath, restored, nil); err != nil {
+		t.Fatalf("Failed to load snapshot: %v", err)
+	}
+	if _, exists, _ := restored.Get("late"); !exists {
+		t.Error("Expected the snapshot to include the write that finished during shutdown")
+	}
+}
+
+func TestServer_ReplicatedRefusesConditionalWrites(t *testing.T) {
+	cluster := newRaftTestCluster(t, 1, 0)
+	rc := cluster.caches[cluster.waitLeader()]
+	ts := newTestServer(t, rc)
+
+	if resp, _ := doRequest(t, http.MethodPut, ts.URL+"/api/v2/keys/user", "application/json", `"Ada"`); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("Expected 201 for a plain write, got %d", resp.StatusCode)
+	}
+
+	// Replicas assign their own versions, so a precondition could only be
+	// checked against one of them, apart from the write.
+	for _, method := range []string{http.MethodPut, http.MethodDelete} {
+		req, _ := http.NewRequest(method, ts.URL+"/api/v2/keys/user", strings.NewReader(`"Grace"`))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("If-Match", "*")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNotImplemented {
+			t.Errorf("Expected 501 for a conditional %s, got %d", method, resp.StatusCode)
+		}
+	}
+	if _, _, err := rc.UpsertWithTTL(context.Background(), "user", "Grace", time.Hour, writePrecondition(&http.Request{Header: http.Header{"If-Match": {"*"}}})); !errors.Is(err, ErrConditionalUnsupported) {
+		t.Errorf("Expected ErrConditionalUnsupported, got %v", err)
+	}
+	if resp, _ := doRequest(t, http.MethodPost, ts.URL+"/api/cache/import?on_conflict=skip", "application/x-ndjson", `{"key":"a","value":1}`); resp.StatusCode != http.StatusNotImplemented {
+		t.Errorf("Expected 501 for an import that skips existing keys, got %d", resp.StatusCode)
+	}
+	if value, _, _ := rc.Get("user"); value != "Ada" {
+		t.Errorf("Expected the value to be unchanged, got %v", value)
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// importLineSlack is the room an NDJSON line of an import has beyond the
+// value size limit, for the key, base64 and escaping.
+const importLineSlack = 64 << 10
+
+// handleExport streams the live entries on this node, with keys starting
+// with ?prefix=, sorted by key, as NDJSON or with ?format=csv as CSV.
+func (s *Server) handleExport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		s.sendError(w, "Method not allowed. Use GET", http.StatusMethodNotAllowed)
+		return
+	}
+	prefix := r.URL.Query().Get("prefix")
+	if !s.authorize(w, r, AccessRead, prefix) {
+		return
+	}
+	format, err := transferFormat(r.URL.Query().Get("format"), "")
+	if err != nil {
+		s.sendError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	l, ok := s.cache.(KeyLister)
+	if !ok {
+		s.sendError(w, "This cache cannot list its keys", http.StatusNotImplemented)
+		return
+	}
+
+	var keys []string
+	for _, key := range l.Keys() {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	w.Header().Set("Content-Type", transferContentTypes[format])
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="cache-export.%s"`, format))
+	out := newRecordWriter(w, format)
+	now := time.Now()
+	for _, key := range keys {
+		entry, exists, err := s.getEntry(r.Context(), key)
+		if err == nil && (!exists || entry.Stale) {
+			continue
+		}
+		var rec transferRecord
+		if err == nil {
+			rec, err = newTransferRecord(key, entry.Value, entry.Expires, now)
+		}
+		if err == nil {
+			err = out.Write(rec)
+		}
+		if err != nil {
+			if r.Context().Err() == nil {
+				slog.Error("Export failed", "key", key, "error", err)
+			}
+			// The status is out; cut the response short so the client
+			// cannot take it for a whole export.
+			panic(http.ErrAbortHandler)
+		}
+	}
+	out.Flush()
+}
+
+// handleImport stores the entries of an NDJSON or CSV body as written by
+// handleExport, one line at a time. ?on_conflict= decides what happens to
+// keys that exist: overwrite (the default), skip, or fail, which stops the
+// import; the last two are conditional writes, refused under Raft. Invalid
+// lines are skipped and listed in the report.
+func (s *Server) handleImport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		s.sendError(w, "Method not allowed. Use POST", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.authorize(w, r, AccessAdmin, "") {
+		return
+	}
+	format, err := transferFormat(r.URL.Query().Get("format"), r.Header.Get("Content-Type"))
+	if err != nil {
+		s.sendError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	onConflict := r.URL.Query().Get("on_conflict")
+	if onConflict == "" {
+		onConflict = onConflictOverwrite
+	}
+	if !contains([]string{onConflictOverwrite, onConflictSkip, onConflictFail}, onConflict) {
+		s.sendError(w, "'on_conflict' must be overwrite, skip or fail", http.StatusBadRequest)
+		return
+	}
+	if _, ok := s.cache.(*ReplicatedCache); ok && onConflict != onConflictOverwrite {
+		s.sendCacheError(w, ErrConditionalUnsupported, http.StatusNotImplemented)
+		return
+	}
+
+	records := newRecordReader(r.Body, format, int(2*s.maxValueSize)+importLineSlack)
+	report, err := importRecords(r.Context(), records, s.importEntry, onConflict, s.maxValueSize)
+	switch {
+	case errors.Is(err, ErrImportConflict):
+		s.sendImportError(w, http.StatusConflict, err.Error(), report)
+	case err != nil:
+		s.sendImportError(w, http.StatusBadRequest, "Reading the import failed: "+err.Error(), report)
+	case report.Failed > 0:
+		s.sendImportError(w, http.StatusUnprocessableEntity, fmt.Sprintf("%d lines were rejected; the others were imported", report.Failed), report)
+	default:
+		s.sendSuccess(w, fmt.Sprintf("Imported %d entries, skipped %d", report.Imported, report.Skipped), report)
+	}
+}
+
+// importEntry is the importFunc of handleImport. Caches without per-key
+// TTLs store the value with their own.
+func (s *Server) importEntry(ctx context.Context, key string, value interface{}, ttl time.Duration, overwrite bool) (bool, error) {
+	var cond Precondition
+	if !overwrite {
+		cond = func(_ Entry, exists bool) bool { return !exists }
+	}
+	var err error
+	if _, ok := s.cache.(ExpiringWriter); ok && ttl > 0 {
+		_, _, err = s.upsertWithTTL(ctx, key, value, ttl, cond)
+	} else {
+		_, _, err = s.upsert(ctx, key, value, cond)
+	}
+	if errors.Is(err, ErrPreconditionFailed) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// sendImportError reports an import that did not fully succeed, with what
+// it did.
+func (s *Server) sendImportError(w http.ResponseWriter, statusCode int, message string, report importReport) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(CacheResponse{Success: false, Error: message, Data: report})
+}
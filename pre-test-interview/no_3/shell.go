@@ -0,0 +1,535 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// shellBackend is what the shell runs commands against: a cache in this
+// process or a server over HTTP.
+type shellBackend interface {
+	Get(ctx context.Context, key string) (interface{}, bool, error)
+	// Set stores text as JSON if it parses as JSON, otherwise as a string.
+	Set(ctx context.Context, key, text string, ttl time.Duration) error
+	Del(ctx context.Context, key string) (bool, error)
+	Keys(ctx context.Context, prefix string) ([]string, error)
+	Stats(ctx context.Context) (interface{}, error)
+}
+
+type localBackend struct {
+	cache Cache
+}
+
+func (b localBackend) Get(ctx context.Context, key string) (interface{}, bool, error) {
+	if cc, ok := b.cache.(ContextCache); ok {
+		return cc.GetContext(ctx, key)
+	}
+	return b.cache.Get(key)
+}
+
+func (b localBackend) Set(ctx context.Context, key, text string, ttl time.Duration) error {
+	var value interface{} = text
+	if json.Valid([]byte(text)) {
+		json.Unmarshal([]byte(text), &value)
+	}
+	if ttl > 0 {
+		ew, ok := b.cache.(ExpiringWriter)
+		if !ok {
+			return ErrTTLUnsupported
+		}
+		_, _, err := ew.UpsertWithTTL(ctx, key, value, ttl, nil)
+		return err
+	}
+	return b.cache.Set(key, value)
+}
+
+func (b localBackend) Del(ctx context.Context, key string) (bool, error) {
+	if r, ok := b.cache.(Remover); ok {
+		return r.Remove(key)
+	}
+	_, exists, err := b.cache.Get(key)
+	if err != nil || !exists {
+		return false, err
+	}
+	return true, b.cache.Delete(key)
+}
+
+func (b localBackend) Keys(ctx context.Context, prefix string) ([]string, error) {
+	l, ok := b.cache.(KeyLister)
+	if !ok {
+		return nil, errors.New("this cache cannot list its keys")
+	}
+	keys := []string{}
+	for _, key := range l.Keys() {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func (b localBackend) Stats(ctx context.Context) (interface{}, error) {
+	stats := map[string]interface{}{"type": fmt.Sprintf("%T", b.cache)}
+	if l, ok := b.cache.(KeyLister); ok {
+		stats["keys"] = len(l.Keys())
+	}
+	return stats, nil
+}
+
+type remoteBackend struct {
+	client *cacheClient
+}
+
+func (b remoteBackend) Get(ctx context.Context, key string) (interface{}, bool, error) {
+	entry, status, err := b.client.fetch(ctx, key, "")
+	if err != nil || status == http.StatusNotFound {
+		return nil, false, err
+	}
+	return entry.Value, true, nil
+}
+
+func (b remoteBackend) Set(ctx context.Context, key, text string, ttl time.Duration) error {
+	_, err := b.client.put(ctx, key, []byte(text), guessContentType([]byte(text)), ttl)
+	return err
+}
+
+func (b remoteBackend) Del(ctx context.Context, key string) (bool, error) {
+	return b.client.remove(ctx, key)
+}
+
+func (b remoteBackend) Keys(ctx context.Context, prefix string) ([]string, error) {
+	return b.client.listKeys(ctx, prefix)
+}
+
+func (b remoteBackend) Stats(ctx context.Context) (interface{}, error) {
+	return b.client.serverStats(ctx)
+}
+
+// shellCommand is one command of the shell. Names are matched without
+// regard to case.
+type shellCommand struct {
+	usage   string
+	summary string
+	minArgs int
+	maxArgs int // -1 for no limit
+	run     func(sh *shell, ctx context.Context, args []string) error
+}
+
+var errShellQuit = errors.New("quit")
+
+var shellCommands map[string]shellCommand
+
+func init() {
+	shellCommands = map[string]shellCommand{
+		"get":     {"GET key", "print a value", 1, 1, (*shell).get},
+		"set":     {"SET key value [EX seconds]", "store a value, as JSON if it parses", 2, 4, (*shell).set},
+		"del":     {"DEL key [key ...]", "delete keys, printing how many existed", 1, -1, (*shell).del},
+		"keys":    {"KEYS [prefix]", "list keys, sorted", 0, 1, (*shell).keys},
+		"stats":   {"STATS", "show statistics", 0, 0, (*shell).stats},
+		"history": {"HISTORY", "list the commands entered", 0, 0, (*shell).showHistory},
+		"help":    {"HELP [command]", "describe the commands", 0, 1, (*shell).help},
+		"quit":    {"QUIT", "leave the shell (or Ctrl-D)", 0, 0, (*shell).quit},
+		"exit":    {"EXIT", "leave the shell (or Ctrl-D)", 0, 0, (*shell).quit},
+	}
+}
+
+const maxRecentKeys = 200
+
+// shell is the `go run . shell` REPL. It remembers the keys it has seen so
+// Tab can complete them.
+type shell struct {
+	backend shellBackend
+	out     io.Writer
+	editor  *lineEditor
+	recent  []string
+}
+
+func newShell(backend shellBackend, out io.Writer) *shell {
+	return &shell{backend: backend, out: out}
+}
+
+// runShell implements `go run . shell`.
+func runShell(args []string) {
+	fs := flag.NewFlagSet("shell", flag.ContinueOnError)
+	server := fs.String("server", "", "base URL of a server to use instead of an in-process cache")
+	apiKey := fs.String("api-key", os.Getenv("CACHE_API_KEY"), "API key for -server (env CACHE_API_KEY)")
+	cacheType := fs.String("type", cacheTypeTTL, "in-process cache type, ttl or simple")
+	ttl := fs.Duration("ttl", 5*time.Minute, "entry lifetime of the in-process ttl cache")
+	historyPath := fs.String("history", defaultHistoryPath(), "file to keep command history in; empty for none")
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return
+		}
+		os.Exit(exitError)
+	}
+
+	var backend shellBackend
+	prompt := "cache> "
+	if *server != "" {
+		backend = remoteBackend{&cacheClient{
+			base:   strings.TrimSuffix(*server, "/"),
+			apiKey: *apiKey,
+			http:   &http.Client{Timeout: 30 * time.Second, CheckRedirect: keepKeyOnSameHost},
+		}}
+		if u, err := url.Parse(*server); err == nil && u.Host != "" {
+			prompt = u.Host + "> "
+		}
+	} else {
+		cfg := defaultServerConfig()
+		cfg.CacheType, cfg.TTL = *cacheType, *ttl
+		cache, closer, err := newCacheFromConfig(cfg)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "error:", err)
+			os.Exit(exitError)
+		}
+		if closer != nil {
+			defer closer.Close()
+		}
+		backend = localBackend{cache}
+	}
+
+	sh := newShell(backend, os.Stdout)
+	if err := sh.loop(os.Stdin, prompt, *historyPath); err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		os.Exit(exitError)
+	}
+}
+
+func defaultHistoryPath() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".cache_shell_history")
+}
+
+// loop reads and runs commands until EOF or QUIT. On a terminal it edits
+// lines in raw mode, switching back for each command so Ctrl-C interrupts
+// it; otherwise, as with piped input, it runs each line without a prompt.
+func (sh *shell) loop(in *os.File, prompt, historyPath string) error {
+	fd := in.Fd()
+	if !isTerminal(fd) {
+		scanner := bufio.NewScanner(in)
+		for scanner.Scan() {
+			if errors.Is(sh.execute(scanner.Text()), errShellQuit) {
+				return nil
+			}
+		}
+		return scanner.Err()
+	}
+
+	sh.editor = newLineEditor(in, sh.out, sh.complete)
+	sh.loadHistory(historyPath)
+	defer sh.saveHistory(historyPath)
+	fmt.Fprintln(sh.out, `Type HELP for the commands, Tab to complete and Ctrl-D to leave.`)
+	for {
+		restore, err := makeRaw(fd)
+		if err != nil {
+			return err
+		}
+		line, err := sh.editor.ReadLine(prompt)
+		restore()
+		switch {
+		case errors.Is(err, errInterrupted):
+			continue
+		case errors.Is(err, io.EOF):
+			return nil
+		case err != nil:
+			return err
+		}
+		sh.editor.AddHistory(line)
+		if errors.Is(sh.execute(line), errShellQuit) {
+			return nil
+		}
+	}
+}
+
+func (sh *shell) loadHistory(path string) {
+	if path == "" {
+		return
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		sh.editor.AddHistory(line)
+	}
+}
+
+func (sh *shell) saveHistory(path string) {
+	if path == "" || len(sh.editor.history) == 0 {
+		return
+	}
+	os.WriteFile(path, []byte(strings.Join(sh.editor.history, "\n")+"\n"), 0o600)
+}
+
+// execute runs one command line, printing its result and how long it took.
+// It returns errShellQuit for QUIT and the command's error otherwise.
+func (sh *shell) execute(line string) error {
+	words, err := splitShellWords(line)
+	if err != nil {
+		fmt.Fprintf(sh.out, "(error) %v\n", err)
+		return err
+	}
+	if len(words) == 0 {
+		return nil
+	}
+	name, args := strings.ToLower(words[0]), words[1:]
+	cmd, ok := shellCommands[name]
+	if !ok {
+		err := fmt.Errorf("unknown command '%s', try HELP", words[0])
+		fmt.Fprintf(sh.out, "(error) %v\n", err)
+		return err
+	}
+	if len(args) < cmd.minArgs || (cmd.maxArgs >= 0 && len(args) > cmd.maxArgs) {
+		err := fmt.Errorf("usage: %s", cmd.usage)
+		fmt.Fprintf(sh.out, "(error) %v\n", err)
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	start := time.Now()
+	err = cmd.run(sh, ctx, args)
+	if errors.Is(err, errShellQuit) {
+		return err
+	}
+	if err != nil {
+		fmt.Fprintf(sh.out, "(error) %v\n", err)
+	}
+	fmt.Fprintf(sh.out, "(%v)\n", time.Since(start).Round(time.Microsecond))
+	return err
+}
+
+// splitShellWords splits a line into words at spaces. Double quotes allow
+// spaces and backslash escapes inside a word; single quotes take
+// everything literally.
+func splitShellWords(line string) ([]string, error) {
+	var words []string
+	var word strings.Builder
+	inWord := false
+	var quote rune
+	escaped := false
+	for _, r := range line {
+		switch {
+		case escaped:
+			word.WriteRune(r)
+			escaped = false
+		case quote == '"' && r == '\\':
+			escaped = true
+		case quote != 0 && r == quote:
+			quote = 0
+		case quote != 0:
+			word.WriteRune(r)
+		case r == '"' || r == '\'':
+			quote, inWord = r, true
+		case r == ' ' || r == '\t':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteRune(r)
+			inWord = true
+		}
+	}
+	if quote != 0 || escaped {
+		return nil, errors.New("unbalanced quotes")
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words, nil
+}
+
+// complete offers command names for the first word and recently seen keys
+// for the others.
+func (sh *shell) complete(before string) []string {
+	start := strings.LastIndexAny(before, " \t") + 1
+	word := before[start:]
+	var candidates []string
+	if strings.TrimSpace(before[:start]) == "" {
+		for name := range shellCommands {
+			if strings.HasPrefix(name, strings.ToLower(word)) {
+				candidates = append(candidates, name)
+			}
+		}
+		sort.Strings(candidates)
+		return candidates
+	}
+	for _, key := range sh.recent {
+		if strings.HasPrefix(key, word) {
+			candidates = append(candidates, key)
+		}
+	}
+	return candidates
+}
+
+// sawKeys moves keys to the front of the recently seen list.
+func (sh *shell) sawKeys(keys ...string) {
+	for _, key := range keys {
+		for i, k := range sh.recent {
+			if k == key {
+				sh.recent = append(sh.recent[:i], sh.recent[i+1:]...)
+				break
+			}
+		}
+		sh.recent = append([]string{key}, sh.recent...)
+	}
+	if len(sh.recent) > maxRecentKeys {
+		sh.recent = sh.recent[:maxRecentKeys]
+	}
+}
+
+// formatShellValue renders a value the way redis-cli does: strings quoted,
+// nothing as (nil), and JSON structures indented.
+func formatShellValue(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return "(nil)"
+	case string:
+		return strconv.Quote(v)
+	case []byte:
+		if utf8.Valid(v) {
+			return strconv.Quote(string(v))
+		}
+		return fmt.Sprintf("(binary, %d bytes)", len(v))
+	case RawValue:
+		return formatShellValue(v.Data)
+	}
+	data, err := json.MarshalIndent(value, "", "  ")
+	if err != nil {
+		return fmt.Sprintf("%v", value)
+	}
+	return string(data)
+}
+
+func (sh *shell) get(ctx context.Context, args []string) error {
+	sh.sawKeys(args[0])
+	value, exists, err := sh.backend.Get(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	if !exists {
+		value = nil
+	}
+	fmt.Fprintln(sh.out, formatShellValue(value))
+	return nil
+}
+
+func (sh *shell) set(ctx context.Context, args []string) error {
+	var ttl time.Duration
+	switch len(args) {
+	case 2:
+	case 4:
+		seconds, err := strconv.Atoi(args[3])
+		if !strings.EqualFold(args[2], "EX") || err != nil || seconds <= 0 {
+			return fmt.Errorf("usage: %s", shellCommands["set"].usage)
+		}
+		ttl = time.Duration(seconds) * time.Second
+	default:
+		return fmt.Errorf("usage: %s", shellCommands["set"].usage)
+	}
+	sh.sawKeys(args[0])
+	if err := sh.backend.Set(ctx, args[0], args[1], ttl); err != nil {
+		return err
+	}
+	fmt.Fprintln(sh.out, "OK")
+	return nil
+}
+
+func (sh *shell) del(ctx context.Context, args []string) error {
+	deleted := 0
+	for _, key := range args {
+		existed, err := sh.backend.Del(ctx, key)
+		if err != nil {
+			return err
+		}
+		if existed {
+			deleted++
+		}
+	}
+	fmt.Fprintf(sh.out, "(integer) %d\n", deleted)
+	return nil
+}
+
+func (sh *shell) keys(ctx context.Context, args []string) error {
+	prefix := ""
+	if len(args) == 1 {
+		prefix = args[0]
+	}
+	keys, err := sh.backend.Keys(ctx, prefix)
+	if err != nil {
+		return err
+	}
+	if len(keys) == 0 {
+		fmt.Fprintln(sh.out, "(empty list)")
+		return nil
+	}
+	for i, key := range keys {
+		fmt.Fprintf(sh.out, "%d) %s\n", i+1, strconv.Quote(key))
+	}
+	if len(keys) > maxRecentKeys {
+		keys = keys[:maxRecentKeys]
+	}
+	sh.sawKeys(keys...)
+	return nil
+}
+
+func (sh *shell) stats(ctx context.Context, args []string) error {
+	stats, err := sh.backend.Stats(ctx)
+	if err != nil {
+		return err
+	}
+	return printStatsTable(sh.out, stats)
+}
+
+func (sh *shell) showHistory(ctx context.Context, args []string) error {
+	if sh.editor == nil {
+		return nil
+	}
+	for i, line := range sh.editor.history {
+		fmt.Fprintf(sh.out, "%4d  %s\n", i+1, line)
+	}
+	return nil
+}
+
+func (sh *shell) help(ctx context.Context, args []string) error {
+	names := make([]string, 0, len(shellCommands))
+	for name := range shellCommands {
+		if len(args) == 0 || strings.EqualFold(args[0], name) {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return fmt.Errorf("unknown command '%s'", args[0])
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		cmd := shellCommands[name]
+		fmt.Fprintf(sh.out, "%-28s %s\n", cmd.usage, cmd.summary)
+	}
+	return nil
+}
+
+func (sh *shell) quit(ctx context.Context, args []string) error {
+	return errShellQuit
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestShell_Commands(t *testing.T) {
+	cache, err := NewTTLCache(time.Minute)
+	if err != nil {
+		t.Fatalf("Failed to create TTLCache: %v", err)
+	}
+	defer cache.Close()
+	simple := NewSimpleCache()
+	ts := newTestServer(t, simple)
+
+	for name, backend := range map[string]shellBackend{
+		"local":  localBackend{cache},
+		"remote": remoteBackend{&cacheClient{base: ts.URL, http: ts.Client()}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			var out bytes.Buffer
+			sh := newShell(backend, &out)
+			run := func(line string) string {
+				t.Helper()
+				out.Reset()
+				sh.execute(line)
+				return out.String()
+			}
+
+			if got := run(`SET user:1 "Ada Lovelace"`); !strings.HasPrefix(got, "OK\n(") {
+				t.Errorf("Expected OK and a timing, got %q", got)
+			}
+			if got := run("get user:1"); !strings.HasPrefix(got, `"Ada Lovelace"`) {
+				t.Errorf("Expected the quoted string, got %q", got)
+			}
+			run(`set user:2 '{"langs": ["go"]}'`)
+			if got := run("GET user:2"); !strings.Contains(got, "{\n  \"langs\": [\n    \"go\"\n  ]\n}") {
+				t.Errorf("Expected pretty-printed JSON, got %q", got)
+			}
+			if got := run("keys user:"); !strings.HasPrefix(got, "1) \"user:1\"\n2) \"user:2\"\n") {
+				t.Errorf("Expected the numbered keys, got %q", got)
+			}
+			if got := run("del user:1 nope"); !strings.HasPrefix(got, "(integer) 1") {
+				t.Errorf("Expected one key deleted, got %q", got)
+			}
+			if got := run("get user:1"); !strings.HasPrefix(got, "(nil)") {
+				t.Errorf("Expected (nil) for a missing key, got %q", got)
+			}
+			if got := run("get"); !strings.HasPrefix(got, "(error) usage: GET key") {
+				t.Errorf("Expected the usage, got %q", got)
+			}
+			if got := run("frobnicate"); !strings.HasPrefix(got, "(error) unknown command") {
+				t.Errorf("Expected an unknown command error, got %q", got)
+			}
+			if err := sh.execute("quit"); !errors.Is(err, errShellQuit) {
+				t.Errorf("Expected QUIT to end the shell, got %v", err)
+			}
+		})
+	}
+
+	var out bytes.Buffer
+	sh := newShell(localBackend{cache}, &out)
+	sh.execute("set session abc EX 3600")
+	if entry, _, _ := cache.GetEntry("session"); entry.TTL(time.Now()) < 59*time.Minute {
+		t.Errorf("Expected EX to set the TTL, got %v", entry.TTL(time.Now()))
+	}
+}
+
+func TestShell_Completion(t *testing.T) {
+	sh := newShell(localBackend{NewSimpleCache()}, io.Discard)
+	sh.sawKeys("user:1", "user:2", "order:9")
+
+	if got := sh.complete("ke"); !reflect.DeepEqual(got, []string{"keys"}) {
+		t.Errorf("Expected the command name, got %v", got)
+	}
+	if got := sh.complete("GET us"); !reflect.DeepEqual(got, []string{"user:2", "user:1"}) {
+		t.Errorf("Expected the recent user keys, most recent first, got %v", got)
+	}
+}
+
+func TestLineEditor(t *testing.T) {
+	complete := func(before string) []string {
+		return newShell(nil, io.Discard).complete(before)
+	}
+	read := func(input string, history ...string) (string, error) {
+		e := newLineEditor(strings.NewReader(input), io.Discard, complete)
+		for _, h := range history {
+			e.AddHistory(h)
+		}
+		return e.ReadLine("> ")
+	}
+
+	tests := []struct {
+		name    string
+		input   string
+		history []string
+		want    string
+		err     error
+	}{
+		{"typing", "get a\r", nil, "get a", nil},
+		{"backspace and cursor keys", "get ab\x7f\x1b[Dx\r", nil, "get xa", nil},
+		{"Ctrl-A and Ctrl-K", "abc\x01\x0bget\r", nil, "get", nil},
+		{"Ctrl-W", "set key value\x17\r", nil, "set key ", nil},
+		{"history", "\x1b[A\x1b[A\r", []string{"get a", "get b"}, "get a", nil},
+		{"history back to the draft", "ke\x1b[A\x1b[B\r", []string{"get a"}, "ke", nil},
+		{"tab completes a command", "hi\t\r", nil, "history ", nil},
+		{"tab completes a common prefix", "e\t\r", nil, "exit ", nil},
+		{"Ctrl-C", "get\x03", nil, "", errInterrupted},
+		{"Ctrl-D on an empty line", "\x04", nil, "", io.EOF},
+		{"Ctrl-D deletes otherwise", "ab\x01\x04\r", nil, "b", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := read(tt.input, tt.history...)
+			if got != tt.want || !errors.Is(err, tt.err) {
+				t.Errorf("Expected %q, %v, got %q, %v", tt.want, tt.err, got, err)
+			}
+		})
+	}
+}
+
+func TestSplitShellWords(t *testing.T) {
+	got, err := splitShellWords(`set  "a b" 'c "d"' e\f "g\"h"`)
+	want := []string{"set", "a b", `c "d"`, `e\f`, `g"h`}
+	if err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected %q, got %q, %v", want, got, err)
+	}
+	if _, err := splitShellWords(`get "open`); err == nil {
+		t.Error("Expected an error for unbalanced quotes")
+	}
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Snapshotter is implemented by caches whose contents can be serialised and
+// restored, e.g. for Raft log compaction. Values round-trip through JSON, so
+// a restored cache holds JSON-decoded values (numbers become float64); raw
+// values keep their bytes and headers.
+type Snapshotter interface {
+	Snapshot() ([]byte, error)
+	Restore(data []byte) error
+}
+
+type snapshotEntry struct {
+	Key        string          `json:"key"`
+	Kind       string          `json:"kind,omitempty"`
+	Value      json.RawMessage `json:"value"`
+	ExpiresAt  *time.Time      `json:"expires_at,omitempty"`
+	Version    uint64          `json:"version,omitempty"`
+	ModifiedAt *time.Time      `json:"modified_at,omitempty"`
+}
+
+func encodeSnapshotEntry(key string, e Entry) (snapshotEntry, error) {
+	kind, raw, err := encodeValue(e.Value)
+	if err != nil {
+		return snapshotEntry{}, fmt.Errorf("snapshot key '%s': %w", key, err)
+	}
+	entry := snapshotEntry{Key: key, Kind: kind, Value: raw, Version: e.Version}
+	if !e.Expires.IsZero() {
+		expires := e.Expires
+		entry.ExpiresAt = &expires
+	}
+	if !e.Modified.IsZero() {
+		modified := e.Modified
+		entry.ModifiedAt = &modified
+	}
+	return entry, nil
+}
+
+// restoredEntry rebuilds the metadata of a snapshot entry, keeping its
+// version when the snapshot carries one so validators survive a restore.
+func restoredEntry(e snapshotEntry, versions versionCounter, now time.Time) (Entry, error) {
+	value, err := decodeValue(e.Kind, e.Value)
+	if err != nil {
+		return Entry{}, fmt.Errorf("snapshot key '%s': %w", e.Key, err)
+	}
+	entry := Entry{Value: value, Version: e.Version, Modified: now}
+	if entry.Version == 0 {
+		entry.Version = versions.next()
+	} else {
+		versions.observe(entry.Version)
+	}
+	if e.ModifiedAt != nil {
+		entry.Modified = *e.ModifiedAt
+	}
+	if e.ExpiresAt != nil {
+		entry.Expires = *e.ExpiresAt
+	}
+	return entry, nil
+}
+
+// restoredOrder rebuilds the write order of restored entries from their
+// modification times.
+func restoredOrder(entries []snapshotEntry) *writeOrder {
+	sorted := make([]snapshotEntry, len(entries))
+	copy(sorted, entries)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return modifiedAt(sorted[i]).Before(modifiedAt(sorted[j]))
+	})
+	order := newWriteOrder()
+	for _, e := range sorted {
+		order.touch(e.Key)
+	}
+	return order
+}
+
+func modifiedAt(e snapshotEntry) time.Time {
+	if e.ModifiedAt == nil {
+		return time.Time{}
+	}
+	return *e.ModifiedAt
+}
+
+func decodeSnapshot(data []byte) ([]snapshotEntry, error) {
+	var entries []snapshotEntry
+	if len(data) == 0 {
+		return entries, nil
+	}
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("invalid snapshot: %w", err)
+	}
+	return entries, nil
+}
+
+func (c *SimpleCache) Snapshot() ([]byte, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	entries := make([]snapshotEntry, 0, len(c.data))
+	for key, e := range c.data {
+		entry, err := encodeSnapshotEntry(key, e)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return json.Marshal(entries)
+}
+
+func (c *SimpleCache) Restore(data []byte) error {
+	entries, err := decodeSnapshot(data)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	restored := make(map[string]Entry, len(entries))
+	for _, e := range entries {
+		entry, err := restoredEntry(e, c.versions, now)
+		if err != nil {
+			return err
+		}
+		entry.Expires = time.Time{}
+		restored[e.Key] = entry
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.data = restored
+	c.order = restoredOrder(entries)
+	if c.maxEntries > 0 {
+		c.evictTo(c.maxEntries)
+	}
+	return nil
+}
+
+func (c *TTLCache) Snapshot() ([]byte, error) {
+	if err := c.life.enter(context.Background()); err != nil {
+		return nil, err
+	}
+	defer c.life.exit()
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	now := c.clock.Now()
+	entries := make([]snapshotEntry, 0, len(c.data))
+	for key, item := range c.data {
+		if now.After(item.expires) {
+			continue
+		}
+		entry, err := encodeSnapshotEntry(key, item.entry())
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return json.Marshal(entries)
+}
+
+func (c *TTLCache) Restore(data []byte) error {
+	if err := c.life.enter(context.Background()); err != nil {
+		return err
+	}
+	defer c.life.exit()
+
+	entries, err := decodeSnapshot(data)
+	if err != nil {
+		return err
+	}
+
+	c.mu.RLock()
+	ttl := c.ttl
+	c.mu.RUnlock()
+
+	now := c.clock.Now()
+	restored := make(map[string]cacheItem, len(entries))
+	kept := entries[:0]
+	for _, e := range entries {
+		entry, err := restoredEntry(e, c.versions, now)
+		if err != nil {
+			return err
+		}
+		if entry.Expires.IsZero() {
+			entry.Expires = now.Add(ttl)
+		}
+		if now.After(entry.Expires) {
+			continue
+		}
+		restored[e.Key] = cacheItem{
+			value:    entry.Value,
+			expires:  entry.Expires,
+			version:  entry.Version,
+			modified: entry.Modified,
+		}
+		kept = append(kept, e)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.data = restored
+	c.order = restoredOrder(kept)
+	if c.maxEntries > 0 {
+		c.evictTo(c.maxEntries)
+	}
+	return nil
+}
@@ -71,6 +71,36 @@ echo ""
 echo "Getting temporary data immediately..."
 curl -s "$BASE_URL/api/cache/get?key=temp" | jq '.'
 
+echo ""
+echo "🧭 Testing resource API (v2):"
+echo "Creating a key (expect 201)..."
+curl -s -o /dev/null -w "%{http_code}\n" -X PUT "$BASE_URL/api/v2/keys/city" \
+     -H "Content-Type: application/json" \
+     -d '"Jakarta"'
+
+echo "Replacing the key (expect 200)..."
+curl -s -o /dev/null -w "%{http_code}\n" -X PUT "$BASE_URL/api/v2/keys/city" \
+     -H "Content-Type: application/json" \
+     -d '"Bandung"'
+
+echo "Reading a key with a slash in its name..."
+curl -s -X PUT "$BASE_URL/api/v2/keys/users%2F42" \
+     -H "Content-Type: application/json" \
+     -d '{"name":"Bob"}' > /dev/null
+curl -s "$BASE_URL/api/v2/keys/users%2F42" | jq '.'
+
+echo "Storing a raw text body and reading it back unchanged..."
+curl -s -o /dev/null -X PUT "$BASE_URL/api/v2/keys/note" \
+     -H "Content-Type: text/plain; charset=utf-8" \
+     --data-binary 'hello, raw world'
+curl -s -i "$BASE_URL/api/v2/keys/note" | grep -i "^content-type\|hello"
+
+echo "Unsupported method (expect 405 with Allow header)..."
+curl -s -i -X POST "$BASE_URL/api/v2/keys/city" | grep -i "^allow"
+
+echo "Deleting the key..."
+curl -s -X DELETE "$BASE_URL/api/v2/keys/city" | jq '.'
+
 echo ""
 echo "💡 Try these additional commands manually:"
 echo "curl -X POST '$BASE_URL/api/cache/set?key=test' -d 'value=hello'"
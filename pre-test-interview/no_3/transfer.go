@@ -0,0 +1,755 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Formats of bulk export and import.
+const (
+	formatNDJSON = "ndjson"
+	formatCSV    = "csv"
+)
+
+var transferContentTypes = map[string]string{
+	formatNDJSON: "application/x-ndjson",
+	formatCSV:    "text/csv; charset=utf-8",
+}
+
+// What an import does with a key that already exists.
+const (
+	onConflictOverwrite = "overwrite"
+	onConflictSkip      = "skip"
+	onConflictFail      = "fail"
+)
+
+// maxImportErrors caps the rejected lines listed in an import report.
+const maxImportErrors = 100
+
+var csvColumns = []string{"key", "kind", "value", "ttl_seconds"}
+
+var ErrImportConflict = errors.New("key already exists")
+
+// transferRecord is one entry of an export: the key, the value as
+// encodeValue writes it, and the whole seconds it has left, zero if it
+// never expires. In CSV the value is a column of JSON text.
+type transferRecord struct {
+	Key   string          `json:"key"`
+	Kind  string          `json:"kind,omitempty"`
+	Value json.RawMessage `json:"value"`
+	TTL   int             `json:"ttl_seconds,omitempty"`
+}
+
+func newTransferRecord(key string, value interface{}, expires, now time.Time) (transferRecord, error) {
+	kind, raw, err := encodeValue(value)
+	if err != nil {
+		return transferRecord{}, fmt.Errorf("key '%s': %w", key, err)
+	}
+	rec := transferRecord{Key: key, Kind: kind, Value: raw}
+	if !expires.IsZero() {
+		rec.TTL = ceilSeconds(expires.Sub(now))
+	}
+	return rec, nil
+}
+
+// decode validates a record and returns the value and lifetime to store.
+// Values over maxSize bytes are rejected unless it is zero.
+func (r transferRecord) decode(maxSize int64) (interface{}, time.Duration, error) {
+	if r.Key == "" {
+		return nil, 0, errors.New("key is required")
+	}
+	if len(r.Value) == 0 || string(r.Value) == "null" {
+		return nil, 0, errors.New("value is required")
+	}
+	// The encoded forms of the cache wrappers are not for import.
+	if r.Kind == valueKindCompressed || r.Kind == valueKindSealed {
+		return nil, 0, fmt.Errorf("unknown value kind '%s'", r.Kind)
+	}
+	value, err := decodeValue(r.Kind, r.Value)
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid value: %w", err)
+	}
+	if r.TTL < 0 {
+		return nil, 0, errors.New("ttl_seconds must not be negative")
+	}
+	if maxSize > 0 && int64(valueSize(value)) > maxSize {
+		return nil, 0, fmt.Errorf("value exceeds the %d byte limit", maxSize)
+	}
+	return value, time.Duration(r.TTL) * time.Second, nil
+}
+
+// transferFormat returns format if it is given, or else the one named by
+// contentType, NDJSON by default.
+func transferFormat(format, contentType string) (string, error) {
+	switch format {
+	case formatNDJSON, formatCSV:
+		return format, nil
+	case "":
+		if strings.HasPrefix(contentType, "text/csv") {
+			return formatCSV, nil
+		}
+		return formatNDJSON, nil
+	}
+	return "", errors.New("'format' must be ndjson or csv")
+}
+
+type recordWriter interface {
+	Write(rec transferRecord) error
+	Flush() error
+}
+
+func newRecordWriter(w io.Writer, format string) recordWriter {
+	if format == formatCSV {
+		cw := csv.NewWriter(w)
+		cw.Write(csvColumns)
+		return &csvRecordWriter{w: cw}
+	}
+	buf := bufio.NewWriter(w)
+	enc := json.NewEncoder(buf)
+	enc.SetEscapeHTML(false)
+	return &ndjsonRecordWriter{buf: buf, enc: enc}
+}
+
+type ndjsonRecordWriter struct {
+	buf *bufio.Writer
+	enc *json.Encoder
+}
+
+func (w *ndjsonRecordWriter) Write(rec transferRecord) error {
+	return w.enc.Encode(rec)
+}
+
+func (w *ndjsonRecordWriter) Flush() error {
+	return w.buf.Flush()
+}
+
+type csvRecordWriter struct {
+	w *csv.Writer
+}
+
+func (w *csvRecordWriter) Write(rec transferRecord) error {
+	ttl := ""
+	if rec.TTL > 0 {
+		ttl = strconv.Itoa(rec.TTL)
+	}
+	return w.w.Write([]string{rec.Key, rec.Kind, string(rec.Value), ttl})
+}
+
+func (w *csvRecordWriter) Flush() error {
+	w.w.Flush()
+	return w.w.Error()
+}
+
+// recordReader reads the records of an import and the line each started
+// on. An invalidLineError is about that line alone, and reading can go on;
+// any other error ends the import.
+type recordReader interface {
+	Read() (transferRecord, int, error)
+}
+
+type invalidLineError struct {
+	err error
+}
+
+func (e invalidLineError) Error() string {
+	return e.err.Error()
+}
+
+// newRecordReader reads format from r. NDJSON lines over maxLine bytes are
+// rejected, unless it is zero.
+func newRecordReader(r io.Reader, format string, maxLine int) recordReader {
+	if format == formatCSV {
+		cr := csv.NewReader(r)
+		cr.FieldsPerRecord = -1
+		return &csvRecordReader{r: cr}
+	}
+	return &ndjsonRecordReader{r: bufio.NewReader(r), max: maxLine}
+}
+
+type ndjsonRecordReader struct {
+	r    *bufio.Reader
+	line int
+	max  int
+}
+
+func (r *ndjsonRecordReader) Read() (transferRecord, int, error) {
+	for {
+		data, err := r.readLine()
+		if err != nil {
+			return transferRecord{}, r.line, err
+		}
+		data = bytes.TrimSpace(data)
+		if len(data) == 0 {
+			continue
+		}
+		var rec transferRecord
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&rec); err != nil {
+			return rec, r.line, invalidLineError{fmt.Errorf("invalid JSON: %w", err)}
+		}
+		return rec, r.line, nil
+	}
+}
+
+// readLine returns the next line. A line over the limit is skipped and
+// reported.
+func (r *ndjsonRecordReader) readLine() ([]byte, error) {
+	r.line++
+	var line []byte
+	tooLong := false
+	for {
+		chunk, err := r.r.ReadSlice('\n')
+		if !tooLong && r.max > 0 && len(line)+len(chunk) > r.max {
+			tooLong, line = true, nil
+		}
+		if !tooLong {
+			line = append(line, chunk...)
+		}
+		if errors.Is(err, bufio.ErrBufferFull) {
+			continue
+		}
+		if err != nil && (!errors.Is(err, io.EOF) || (len(line) == 0 && !tooLong)) {
+			return nil, err
+		}
+		if tooLong {
+			return nil, invalidLineError{fmt.Errorf("line is longer than %d bytes", r.max)}
+		}
+		return line, nil
+	}
+}
+
+type csvRecordReader struct {
+	r       *csv.Reader
+	columns map[string]int
+}
+
+func (r *csvRecordReader) Read() (transferRecord, int, error) {
+	if r.columns == nil {
+		header, err := r.r.Read()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return transferRecord{}, 0, err
+			}
+			return transferRecord{}, 1, fmt.Errorf("reading the CSV header: %w", err)
+		}
+		r.columns = map[string]int{}
+		for i, name := range header {
+			name = strings.ToLower(strings.TrimSpace(name))
+			if !contains(csvColumns, name) {
+				return transferRecord{}, 1, fmt.Errorf("unknown CSV column '%s'; expected %s", name, strings.Join(csvColumns, ", "))
+			}
+			r.columns[name] = i
+		}
+		if _, ok := r.columns["key"]; !ok {
+			return transferRecord{}, 1, errors.New("the CSV header has no key column")
+		}
+		if _, ok := r.columns["value"]; !ok {
+			return transferRecord{}, 1, errors.New("the CSV header has no value column")
+		}
+	}
+
+	fields, err := r.r.Read()
+	if err != nil {
+		var parseErr *csv.ParseError
+		if errors.As(err, &parseErr) {
+			return transferRecord{}, parseErr.StartLine, invalidLineError{parseErr.Err}
+		}
+		return transferRecord{}, 0, err
+	}
+	line, _ := r.r.FieldPos(0)
+	field := func(name string) string {
+		if i, ok := r.columns[name]; ok && i < len(fields) {
+			return fields[i]
+		}
+		return ""
+	}
+
+	rec := transferRecord{Key: field("key"), Kind: field("kind"), Value: json.RawMessage(field("value"))}
+	if len(fields) != len(r.columns) {
+		return rec, line, invalidLineError{fmt.Errorf("expected %d fields, got %d", len(r.columns), len(fields))}
+	}
+	if ttl := field("ttl_seconds"); ttl != "" {
+		n, err := strconv.Atoi(ttl)
+		if err != nil {
+			return rec, line, invalidLineError{errors.New("ttl_seconds must be an integer")}
+		}
+		rec.TTL = n
+	}
+	return rec, line, nil
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// importFunc stores an imported entry; without overwrite only if the key
+// does not exist. It reports whether it stored the entry.
+type importFunc func(ctx context.Context, key string, value interface{}, ttl time.Duration, overwrite bool) (bool, error)
+
+// importReport is the outcome of an import. Errors lists the first
+// maxImportErrors lines rejected, and Failed counts them all.
+type importReport struct {
+	Imported int           `json:"imported"`
+	Skipped  int           `json:"skipped"`
+	Failed   int           `json:"failed"`
+	Errors   []importError `json:"errors,omitempty"`
+}
+
+type importError struct {
+	Line  int    `json:"line"`
+	Key   string `json:"key,omitempty"`
+	Error string `json:"error"`
+}
+
+// importRecords stores the records read through put. Lines that are
+// invalid or fail to store are reported and skipped. With onConflictFail
+// the first key that exists ends the import with ErrImportConflict; the
+// entries stored before it are kept.
+func importRecords(ctx context.Context, records recordReader, put importFunc, onConflict string, maxSize int64) (importReport, error) {
+	var report importReport
+	reject := func(line int, key string, err error) {
+		report.Failed++
+		if len(report.Errors) < maxImportErrors {
+			report.Errors = append(report.Errors, importError{Line: line, Key: key, Error: err.Error()})
+		}
+	}
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return report, err
+		}
+		rec, line, err := records.Read()
+		var invalid invalidLineError
+		switch {
+		case errors.Is(err, io.EOF):
+			return report, nil
+		case errors.As(err, &invalid):
+			reject(line, rec.Key, err)
+			continue
+		case err != nil:
+			return report, fmt.Errorf("line %d: %w", line, err)
+		}
+
+		value, ttl, err := rec.decode(maxSize)
+		if err != nil {
+			reject(line, rec.Key, err)
+			continue
+		}
+		stored, err := put(ctx, rec.Key, value, ttl, onConflict == onConflictOverwrite)
+		switch {
+		case err != nil:
+			reject(line, rec.Key, err)
+		case stored:
+			report.Imported++
+		case onConflict == onConflictFail:
+			reject(line, rec.Key, ErrImportConflict)
+			return report, fmt.Errorf("line %d: %w: '%s'", line, ErrImportConflict, rec.Key)
+		default:
+			report.Skipped++
+		}
+	}
+}
+
+// snapshotFile is a snapshot file opened by the offline export and import.
+type snapshotFile struct {
+	path    string
+	keyring *Keyring
+	entries map[string]snapshotEntry
+}
+
+// openSnapshotFile reads a snapshot saved by the server. A missing file is
+// an empty snapshot if create is set.
+func openSnapshotFile(path string, keyring *Keyring, create bool) (*snapshotFile, error) {
+	f := &snapshotFile{path: path, keyring: keyring, entries: map[string]snapshotEntry{}}
+	data, err := os.ReadFile(path)
+	if create && errors.Is(err, os.ErrNotExist) {
+		return f, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	data, err = keyring.Open(snapshotPurpose, data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	entries, err := decodeSnapshot(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	for _, e := range entries {
+		f.entries[e.Key] = e
+	}
+	return f, nil
+}
+
+func (f *snapshotFile) live(e snapshotEntry, now time.Time) bool {
+	return e.ExpiresAt == nil || now.Before(*e.ExpiresAt)
+}
+
+// value decodes an entry's value as the server would serve it, undoing
+// the encryption and compression of its cache wrappers.
+func (f *snapshotFile) value(e snapshotEntry) (interface{}, error) {
+	value, err := decodeValue(e.Kind, e.Value)
+	if err != nil {
+		return nil, fmt.Errorf("key '%s': %w", e.Key, err)
+	}
+	value, err = NewEncryptedCache(nil, f.keyring).open(e.Key, value)
+	if err != nil {
+		return nil, err
+	}
+	return decompressValue(value)
+}
+
+// export writes the live entries with keys starting with prefix, sorted by
+// key, and returns how many it wrote.
+func (f *snapshotFile) export(w recordWriter, prefix string, now time.Time) (int, error) {
+	var keys []string
+	for key, e := range f.entries {
+		if strings.HasPrefix(key, prefix) && f.live(e, now) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		e := f.entries[key]
+		value, err := f.value(e)
+		if err != nil {
+			return 0, err
+		}
+		var expires time.Time
+		if e.ExpiresAt != nil {
+			expires = *e.ExpiresAt
+		}
+		rec, err := newTransferRecord(key, value, expires, now)
+		if err != nil {
+			return 0, err
+		}
+		if err := w.Write(rec); err != nil {
+			return 0, err
+		}
+	}
+	return len(keys), w.Flush()
+}
+
+// put is the importFunc of the offline import. Entries without a TTL get
+// the cache's when the server loads them.
+func (f *snapshotFile) put(_ context.Context, key string, value interface{}, ttl time.Duration, overwrite bool) (bool, error) {
+	now := time.Now()
+	if current, ok := f.entries[key]; ok && !overwrite && f.live(current, now) {
+		return false, nil
+	}
+	e := Entry{Value: value, Modified: now}
+	if ttl > 0 {
+		e.Expires = now.Add(ttl)
+	}
+	entry, err := encodeSnapshotEntry(key, e)
+	if err != nil {
+		return false, err
+	}
+	f.entries[key] = entry
+	return true, nil
+}
+
+func (f *snapshotFile) save() error {
+	entries := make([]snapshotEntry, 0, len(f.entries))
+	for _, e := range f.entries {
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Key < entries[j].Key })
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+	data, err = f.keyring.Seal(snapshotPurpose, data)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(f.path, data)
+}
+
+// exitRejected is the exit code of an import that rejected some lines.
+const exitRejected = 1
+
+const exportUsage = `Usage: go run . export [flags] [FILE]
+
+Writes every live entry, with its remaining TTL, to FILE or stdout: from a
+running server, or with -snapshot from a snapshot file with no server.
+
+Flags:
+`
+
+const importUsage = `Usage: go run . import [flags] [FILE]
+
+Reads entries written by export from FILE or stdin and stores them on a
+running server or, with -snapshot, in a snapshot file, created if missing.
+Stop the server using a snapshot file before importing into it: the server
+overwrites the file when it shuts down.
+
+Exits 1 if some lines were rejected and 2 on other failures.
+
+Flags:
+`
+
+// transferFlags are the flags export and import share.
+type transferFlags struct {
+	server   string
+	apiKey   string
+	snapshot string
+	format   string
+	keyFile  string
+}
+
+func (t *transferFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(&t.server, "server", envOr("CACHE_SERVER", "http://localhost:8080"), "base URL of the server (env CACHE_SERVER)")
+	fs.StringVar(&t.apiKey, "api-key", os.Getenv("CACHE_API_KEY"), "API key sent as X-API-Key (env CACHE_API_KEY)")
+	fs.StringVar(&t.snapshot, "snapshot", "", "use this snapshot file instead of a server")
+	fs.StringVar(&t.format, "format", "", "ndjson or csv (default csv for a .csv FILE, otherwise ndjson)")
+	fs.StringVar(&t.keyFile, "encryption-key-file", "", "keys of an encrypted snapshot, as for the server (or env CACHE_ENCRYPTION_KEYS)")
+}
+
+func (t *transferFlags) fileFormat(file string) (string, error) {
+	if t.format == "" && strings.HasSuffix(strings.ToLower(file), ".csv") {
+		return formatCSV, nil
+	}
+	return transferFormat(t.format, "")
+}
+
+func (t *transferFlags) keyring() (*Keyring, error) {
+	if t.keyFile != "" {
+		return LoadKeyringFile(t.keyFile)
+	}
+	if keys := os.Getenv("CACHE_ENCRYPTION_KEYS"); keys != "" {
+		return ParseKeyring(keys)
+	}
+	return nil, nil
+}
+
+// client talks to the server without a timeout, as transfers of a whole
+// cache take as long as they take.
+func (t *transferFlags) client() *cacheClient {
+	return &cacheClient{base: strings.TrimSuffix(t.server, "/"), apiKey: t.apiKey, http: &http.Client{CheckRedirect: keepKeyOnSameHost}}
+}
+
+// stream sends a request with a streamed body and returns the response,
+// which the caller must close.
+func (c *cacheClient) stream(ctx context.Context, method, path string, body io.Reader, contentType string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, c.base+path, body)
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if c.apiKey != "" {
+		req.Header.Set(apiKeyHeader, c.apiKey)
+	}
+	return c.http.Do(req)
+}
+
+// runExport runs `go run . export` and returns its exit code.
+func runExport(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	var t transferFlags
+	t.register(fs)
+	prefix := fs.String("prefix", "", "only keys starting with this")
+	fs.Usage = func() {
+		fmt.Fprint(stderr, exportUsage)
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return exitOK
+		}
+		return exitError
+	}
+	if fs.NArg() > 1 {
+		fs.Usage()
+		return exitError
+	}
+
+	err := func() error {
+		format, err := t.fileFormat(fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		out := stdout
+		if file := fs.Arg(0); file != "" && file != "-" {
+			f, err := os.Create(file)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			out = f
+		}
+
+		if t.snapshot != "" {
+			keyring, err := t.keyring()
+			if err != nil {
+				return err
+			}
+			snapshot, err := openSnapshotFile(t.snapshot, keyring, false)
+			if err != nil {
+				return err
+			}
+			n, err := snapshot.export(newRecordWriter(out, format), *prefix, time.Now())
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(stderr, "Exported %d entries\n", n)
+			return nil
+		}
+
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+		defer stop()
+		query := url.Values{"format": {format}, "prefix": {*prefix}}
+		resp, err := t.client().stream(ctx, http.MethodGet, "/api/cache/export?"+query.Encode(), nil, "")
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			body, _ := io.ReadAll(resp.Body)
+			return responseError(resp, body)
+		}
+		_, err = io.Copy(out, resp.Body)
+		return err
+	}()
+	if err != nil {
+		fmt.Fprintln(stderr, "error:", err)
+		return exitError
+	}
+	return exitOK
+}
+
+// runImport runs `go run . import` and returns its exit code.
+func runImport(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	var t transferFlags
+	t.register(fs)
+	onConflict := fs.String("on-conflict", onConflictOverwrite, "what to do with keys that exist: overwrite, skip, or fail to stop the import")
+	fs.Usage = func() {
+		fmt.Fprint(stderr, importUsage)
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return exitOK
+		}
+		return exitError
+	}
+	if fs.NArg() > 1 {
+		fs.Usage()
+		return exitError
+	}
+
+	report, err := func() (importReport, error) {
+		if !contains([]string{onConflictOverwrite, onConflictSkip, onConflictFail}, *onConflict) {
+			return importReport{}, errors.New("-on-conflict must be overwrite, skip or fail")
+		}
+		format, err := t.fileFormat(fs.Arg(0))
+		if err != nil {
+			return importReport{}, err
+		}
+		in := stdin
+		if file := fs.Arg(0); file != "" && file != "-" {
+			f, err := os.Open(file)
+			if err != nil {
+				return importReport{}, err
+			}
+			defer f.Close()
+			in = f
+		}
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+		defer stop()
+
+		if t.snapshot != "" {
+			keyring, err := t.keyring()
+			if err != nil {
+				return importReport{}, err
+			}
+			snapshot, err := openSnapshotFile(t.snapshot, keyring, true)
+			if err != nil {
+				return importReport{}, err
+			}
+			// Like the server, keep what was imported before a stop.
+			report, err := importRecords(ctx, newRecordReader(in, format, 0), snapshot.put, *onConflict, 0)
+			if report.Imported > 0 {
+				if saveErr := snapshot.save(); saveErr != nil {
+					return report, saveErr
+				}
+			}
+			return report, err
+		}
+
+		query := url.Values{"format": {format}, "on_conflict": {*onConflict}}
+		resp, err := t.client().stream(ctx, http.MethodPost, "/api/cache/import?"+query.Encode(), in, transferContentTypes[format])
+		if err != nil {
+			return importReport{}, err
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return importReport{}, err
+		}
+		var envelope struct {
+			CacheResponse
+			Data *importReport `json:"data"`
+		}
+		if json.Unmarshal(body, &envelope) != nil || envelope.Data == nil {
+			return importReport{}, responseError(resp, body)
+		}
+		// 422 only means some lines were rejected.
+		if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusUnprocessableEntity {
+			return *envelope.Data, responseError(resp, body)
+		}
+		return *envelope.Data, nil
+	}()
+
+	printImportReport(stdout, report)
+	switch {
+	case err != nil:
+		fmt.Fprintln(stderr, "error:", err)
+		return exitError
+	case report.Failed > 0:
+		return exitRejected
+	}
+	return exitOK
+}
+
+func printImportReport(w io.Writer, report importReport) {
+	fmt.Fprintf(w, "Imported %d, skipped %d, rejected %d\n", report.Imported, report.Skipped, report.Failed)
+	for _, e := range report.Errors {
+		if e.Key != "" {
+			fmt.Fprintf(w, "  line %d (%s): %s\n", e.Line, e.Key, e.Error)
+		} else {
+			fmt.Fprintf(w, "  line %d: %s\n", e.Line, e.Error)
+		}
+	}
+	if more := report.Failed - len(report.Errors); more > 0 {
+		fmt.Fprintf(w, "  ... and %d more\n", more)
+	}
+}
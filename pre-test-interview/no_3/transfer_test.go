@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func exportFrom(t *testing.T, url, query string) (*http.Response, string) {
+	t.Helper()
+	resp, err := http.Get(url + "/api/cache/export?" + query)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	return resp, string(body)
+}
+
+func importReportOf(t *testing.T, body CacheResponse) importReport {
+	t.Helper()
+	var report importReport
+	data, _ := json.Marshal(body.Data)
+	if err := json.Unmarshal(data, &report); err != nil {
+		t.Fatalf("Expected an import report, got %s", data)
+	}
+	return report
+}
+
+func TestTransfer_RoundTrip(t *testing.T) {
+	source, _ := NewTTLCache(time.Hour)
+	defer source.Close()
+	source.Set("doc", map[string]interface{}{"name": "Ada", "tags": []interface{}{"x"}})
+	source.Set("note", "line one\nline, \"two\"")
+	source.Set("page", RawValue{Data: []byte{0xff, 0x00, 'h'}, ContentType: "application/octet-stream"})
+	source.Set("tags", SetValue{"go": {}, "cache": {}})
+	source.Set("queue", ListValue{"a", "b"})
+	source.UpsertWithTTL(context.Background(), "short", "soon gone", 10*time.Minute, nil)
+	ts := newTestServer(t, source)
+
+	for _, format := range []string{formatNDJSON, formatCSV} {
+		t.Run(format, func(t *testing.T) {
+			resp, export := exportFrom(t, ts.URL, "format="+format)
+			if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != transferContentTypes[format] {
+				t.Fatalf("Expected an export, got %d %q", resp.StatusCode, resp.Header.Get("Content-Type"))
+			}
+
+			dest, _ := NewTTLCache(time.Hour)
+			defer dest.Close()
+			destURL := newTestServer(t, dest).URL
+			resp, body := doRequest(t, http.MethodPost, destURL+"/api/cache/import", transferContentTypes[format], export)
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("Expected the import to succeed, got %d: %s", resp.StatusCode, body.Error)
+			}
+			if report := importReportOf(t, body); report.Imported != 6 || report.Failed != 0 {
+				t.Errorf("Unexpected report %+v", report)
+			}
+
+			for _, key := range []string{"doc", "note", "page", "tags", "queue", "short"} {
+				want, _, _ := source.Get(key)
+				if got, _, _ := dest.Get(key); !reflect.DeepEqual(got, want) {
+					t.Errorf("%s: expected %#v, got %#v", key, want, got)
+				}
+			}
+			if entry, _, _ := dest.GetEntry("short"); entry.TTL(time.Now()) > 10*time.Minute || entry.TTL(time.Now()) < 9*time.Minute {
+				t.Errorf("Expected the remaining TTL to carry over, got %v", entry.TTL(time.Now()))
+			}
+		})
+	}
+
+	_, export := exportFrom(t, ts.URL, "prefix=ta")
+	if lines := strings.Split(strings.TrimSpace(export), "\n"); len(lines) != 1 || !strings.Contains(lines[0], `"key":"tags","kind":"set"`) {
+		t.Errorf("Expected only the tags set, got %q", export)
+	}
+	if resp, _ := exportFrom(t, ts.URL, "format=xml"); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an unknown format, got %d", resp.StatusCode)
+	}
+}
+
+func TestTransfer_ImportConflictsAndErrors(t *testing.T) {
+	body := strings.Join([]string{
+		`{"key":"a","value":"new"}`,
+		`{"key":"b","value":`,
+		``,
+		`{"value":1}`,
+		`{"key":"c","kind":"sealed","value":{}}`,
+		`{"key":"d","value":1,"ttl_seconds":-1}`,
+		`{"key":"e","value":1,"extra":true}`,
+		`{"key":"f","value":[1,2]}`,
+	}, "\n")
+
+	run := func(onConflict string) (*http.Response, importReport, *SimpleCache) {
+		t.Helper()
+		cache := NewSimpleCache()
+		cache.Set("a", "old")
+		resp, decoded := doRequest(t, http.MethodPost, newTestServer(t, cache).URL+"/api/cache/import?on_conflict="+onConflict, "application/x-ndjson", body)
+		return resp, importReportOf(t, decoded), cache
+	}
+
+	resp, report, cache := run(onConflictOverwrite)
+	if resp.StatusCode != http.StatusUnprocessableEntity || report.Imported != 2 || report.Failed != 5 {
+		t.Fatalf("Expected 2 imported and 5 rejected, got %d %+v", resp.StatusCode, report)
+	}
+	var lines []int
+	for _, e := range report.Errors {
+		lines = append(lines, e.Line)
+	}
+	if !reflect.DeepEqual(lines, []int{2, 4, 5, 6, 7}) || report.Errors[3].Key != "d" {
+		t.Errorf("Unexpected errors %+v", report.Errors)
+	}
+	if value, _, _ := cache.Get("a"); value != "new" {
+		t.Errorf("Expected a to be overwritten, got %v", value)
+	}
+
+	_, report, cache = run(onConflictSkip)
+	if report.Imported != 1 || report.Skipped != 1 {
+		t.Errorf("Expected a to be skipped, got %+v", report)
+	}
+	if value, _, _ := cache.Get("a"); value != "old" {
+		t.Errorf("Expected a to be kept, got %v", value)
+	}
+
+	resp, report, cache = run(onConflictFail)
+	if resp.StatusCode != http.StatusConflict || report.Imported != 0 || report.Errors[0].Key != "a" {
+		t.Errorf("Expected the import to stop at a, got %d %+v", resp.StatusCode, report)
+	}
+	if _, exists, _ := cache.Get("f"); exists {
+		t.Error("Expected nothing after the conflict to be imported")
+	}
+
+	csvBody := "value,key,ttl_seconds\n\"[1]\",x,\n2,y,soon\n3,z,60,extra\n"
+	resp, decoded := doRequest(t, http.MethodPost, newTestServer(t, NewSimpleCache()).URL+"/api/cache/import", "text/csv", csvBody)
+	if report := importReportOf(t, decoded); resp.StatusCode != http.StatusUnprocessableEntity || report.Imported != 1 || report.Failed != 2 || report.Errors[0].Line != 3 {
+		t.Errorf("Expected columns by name and rejected lines 3 and 4, got %d %+v", resp.StatusCode, report)
+	}
+	resp, _ = doRequest(t, http.MethodPost, newTestServer(t, NewSimpleCache()).URL+"/api/cache/import", "text/csv", "key,owner\n")
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an unknown column, got %d", resp.StatusCode)
+	}
+}
+
+func TestTransfer_OfflineSnapshot(t *testing.T) {
+	key := bytes.Repeat([]byte("k"), 32)
+	t.Setenv("CACHE_ENCRYPTION_KEYS", "k1:"+base64.StdEncoding.EncodeToString(key))
+	keyring, _ := ParseKeyring(os.Getenv("CACHE_ENCRYPTION_KEYS"))
+	dir := t.TempDir()
+
+	source, _ := NewTTLCache(time.Hour)
+	defer source.Close()
+	encrypted := NewEncryptedCache(source, keyring)
+	encrypted.Set("user:1", map[string]interface{}{"name": "Ada"})
+	encrypted.Set("tags", SetValue{"go": {}})
+	snapshot := filepath.Join(dir, "cache.snapshot")
+	if err := saveCacheSnapshot(snapshot, encrypted, keyring); err != nil {
+		t.Fatalf("Failed to save the snapshot: %v", err)
+	}
+
+	exported := filepath.Join(dir, "export.csv")
+	var stderr bytes.Buffer
+	if code := runExport([]string{"-snapshot", snapshot, exported}, io.Discard, &stderr); code != exitOK {
+		t.Fatalf("Export exited %d: %s", code, stderr.String())
+	}
+	data, _ := os.ReadFile(exported)
+	if !strings.HasPrefix(string(data), "key,kind,value,ttl_seconds\n") || !strings.Contains(string(data), `user:1,,"{""name"":""Ada""}",3600`) {
+		t.Errorf("Expected decrypted CSV with the TTL, got %q", data)
+	}
+
+	target := filepath.Join(dir, "new.snapshot")
+	in := strings.NewReader(string(data) + "broken,,{,\n")
+	var stdout bytes.Buffer
+	if code := runImport([]string{"-snapshot", target, "-format", "csv"}, in, &stdout, io.Discard); code != exitRejected {
+		t.Errorf("Expected exit %d for a rejected line, got %d: %s", exitRejected, code, stdout.String())
+	}
+	if !strings.Contains(stdout.String(), "Imported 2, skipped 0, rejected 1") || !strings.Contains(stdout.String(), "line 4 (broken)") {
+		t.Errorf("Unexpected report %q", stdout.String())
+	}
+
+	restored, _ := NewTTLCache(time.Hour)
+	defer restored.Close()
+	if err := loadCacheSnapshot(target, restored, keyring); err != nil {
+		t.Fatalf("Expected the server to load the new snapshot: %v", err)
+	}
+	if tags, _, _ := restored.Get("tags"); !reflect.DeepEqual(tags, SetValue{"go": {}}) {
+		t.Errorf("Expected the set, got %#v", tags)
+	}
+	if entry, _, _ := restored.GetEntry("user:1"); entry.TTL(time.Now()) < 59*time.Minute {
+		t.Errorf("Expected the TTL kept, got %v", entry.TTL(time.Now()))
+	}
+
+	if code := runImport([]string{"-snapshot", target, "-on-conflict", "fail", exported}, nil, io.Discard, io.Discard); code != exitError {
+		t.Errorf("Expected exit %d on a conflict, got %d", exitError, code)
+	}
+	t.Setenv("CACHE_ENCRYPTION_KEYS", "")
+	if code := runExport([]string{"-snapshot", snapshot}, io.Discard, io.Discard); code != exitError {
+		t.Errorf("Expected an encrypted snapshot to need its keys, got exit %d", code)
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// RawValue is an opaque body stored exactly as it was received, along with
+// the headers needed to serve it back unchanged.
+type RawValue struct {
+	Data            []byte `json:"data"`
+	ContentType     string `json:"content_type,omitempty"`
+	ContentEncoding string `json:"content_encoding,omitempty"`
+}
+
+func asRawValue(value interface{}) (RawValue, bool) {
+	switch v := value.(type) {
+	case RawValue:
+		return v, true
+	case *RawValue:
+		if v != nil {
+			return *v, true
+		}
+	}
+	return RawValue{}, false
+}
+
+// rawValueInfo stands in for a raw value in JSON responses, which cannot
+// carry the bytes themselves.
+type rawValueInfo struct {
+	Size            int    `json:"size"`
+	ContentType     string `json:"content_type,omitempty"`
+	ContentEncoding string `json:"content_encoding,omitempty"`
+}
+
+func describeValue(value interface{}) interface{} {
+	if raw, ok := asRawValue(value); ok {
+		return rawValueInfo{Size: len(raw.Data), ContentType: raw.ContentType, ContentEncoding: raw.ContentEncoding}
+	}
+	return value
+}
+
+// valueType names what a value holds for listings: a collection kind, raw,
+// string or json.
+func valueType(value interface{}) string {
+	if _, ok := asRawValue(value); ok {
+		return valueKindRaw
+	}
+	if kind, ok := collectionKind(value); ok {
+		return kind
+	}
+	if _, ok := value.(string); ok {
+		return "string"
+	}
+	return "json"
+}
+
+// valueSize estimates the bytes a value holds: the body of a raw value, the
+// text of a string or of a collection's members, or else its JSON encoding.
+func valueSize(value interface{}) int {
+	if raw, ok := asRawValue(value); ok {
+		return len(raw.Data)
+	}
+	n := 0
+	switch v := value.(type) {
+	case string:
+		return len(v)
+	case ListValue:
+		for _, item := range v {
+			n += len(item)
+		}
+	case HashValue:
+		for field, item := range v {
+			n += len(field) + len(item)
+		}
+	case SetValue:
+		for member := range v {
+			n += len(member)
+		}
+	case SortedSetValue:
+		for _, m := range v.members {
+			n += len(m.Member) + 8
+		}
+	default:
+		data, _ := json.Marshal(v)
+		n = len(data)
+	}
+	return n
+}
+
+const (
+	valueKindJSON       = ""
+	valueKindRaw        = "raw"
+	valueKindCompressed = "compressed"
+	valueKindSealed     = "sealed"
+	valueKindList       = "list"
+	valueKindHash       = "hash"
+	valueKindSet        = "set"
+	valueKindSortedSet  = "zset"
+)
+
+// encodeValue serialises a cached value for snapshots and replication. The
+// kind records Go types that plain JSON would not bring back.
+func encodeValue(value interface{}) (string, json.RawMessage, error) {
+	kind := valueKindJSON
+	if raw, ok := asRawValue(value); ok {
+		kind, value = valueKindRaw, raw
+	}
+	switch value.(type) {
+	case compressedValue:
+		kind = valueKindCompressed
+	case sealedValue:
+		kind = valueKindSealed
+	default:
+		if k, ok := collectionKind(value); ok {
+			kind = k
+		}
+	}
+	raw, err := json.Marshal(value)
+	return kind, raw, err
+}
+
+func decodeValue(kind string, raw json.RawMessage) (interface{}, error) {
+	switch kind {
+	case valueKindJSON:
+		var value interface{}
+		if err := json.Unmarshal(raw, &value); err != nil {
+			return nil, err
+		}
+		return value, nil
+	case valueKindRaw:
+		var value RawValue
+		if err := json.Unmarshal(raw, &value); err != nil {
+			return nil, err
+		}
+		return value, nil
+	case valueKindCompressed:
+		var value compressedValue
+		if err := json.Unmarshal(raw, &value); err != nil {
+			return nil, err
+		}
+		return value, nil
+	case valueKindSealed:
+		var value sealedValue
+		if err := json.Unmarshal(raw, &value); err != nil {
+			return nil, err
+		}
+		return value, nil
+	case valueKindList, valueKindHash, valueKindSet, valueKindSortedSet:
+		return decodeCollection(kind, raw)
+	}
+	return nil, fmt.Errorf("unknown value kind '%s'", kind)
+}
@@ -0,0 +1,389 @@
+"use strict";
+
+// The page and its API share /admin/, so the browser sends the basic auth
+// credentials it prompted for with every request, the event stream included.
+const api = "/admin/api";
+const $ = id => document.getElementById(id);
+
+function el(tag, attrs, ...children) {
+    const e = document.createElement(tag);
+    for (const [k, v] of Object.entries(attrs || {})) {
+        if (k === "class") e.className = v; else e.setAttribute(k, v);
+    }
+    for (const c of children) e.append(c);
+    return e;
+}
+
+function formatBytes(n) {
+    const units = ["B", "KiB", "MiB", "GiB"];
+    let i = 0;
+    while (n >= 1024 && i < units.length - 1) { n /= 1024; i++; }
+    return (i ? n.toFixed(1) : n) + " " + units[i];
+}
+
+function formatNumber(n) {
+    if (n >= 1e6) return (n / 1e6).toFixed(1) + "M";
+    if (n >= 1e4) return (n / 1e3).toFixed(1) + "k";
+    return String(Math.round(n * 10) / 10);
+}
+
+function formatTTL(seconds) {
+    if (!seconds) return "never";
+    const h = Math.floor(seconds / 3600), m = Math.floor(seconds % 3600 / 60), s = seconds % 60;
+    return (h ? h + "h" : "") + (h || m ? m + "m" : "") + s + "s";
+}
+
+function entryURL(key) {
+    return api + "/entries/" + encodeURIComponent(key);
+}
+
+// ---- Live stats
+
+const maxPoints = 120;
+const series = {requests: [], errors: [], hits: [], keys: [], heap: []};
+let lastSample = null;
+
+function push(name, value) {
+    const values = series[name];
+    values.push(value);
+    if (values.length > maxPoints) values.shift();
+}
+
+// drawChart plots each line right-aligned, newest sample at the right edge.
+// Lines share a scale unless they set their own max; NaN leaves a gap.
+function drawChart(canvas, lines) {
+    const ctx = canvas.getContext("2d");
+    const w = canvas.width, h = canvas.height, top = 16, bottom = 4;
+    ctx.clearRect(0, 0, w, h);
+
+    let shared = 1;
+    for (const line of lines) {
+        if (line.max === undefined) for (const v of line.values) if (v > shared) shared = v;
+    }
+    const labels = [];
+    for (const line of lines) {
+        const max = line.max === undefined ? shared : Math.max(line.max, 1);
+        labels.push(line.label(max));
+        ctx.strokeStyle = line.color;
+        ctx.lineWidth = 1.5;
+        ctx.beginPath();
+        let drawing = false;
+        line.values.forEach((v, i) => {
+            if (Number.isNaN(v)) { drawing = false; return; }
+            const x = w - (line.values.length - 1 - i) * (w / (maxPoints - 1));
+            const y = h - bottom - (v / max) * (h - top - bottom);
+            if (drawing) ctx.lineTo(x, y); else ctx.moveTo(x, y);
+            drawing = true;
+        });
+        ctx.stroke();
+    }
+    ctx.fillStyle = "#888";
+    ctx.font = "11px Arial";
+    ctx.fillText("max " + [...new Set(labels)].join(" / "), 4, 11);
+}
+
+function onStats(sample) {
+    $("tile-keys").textContent = formatNumber(sample.keys);
+    $("tile-heap").textContent = formatBytes(sample.heap_bytes);
+    $("tile-goroutines").textContent = sample.goroutines;
+    const reads = sample.hits + sample.misses;
+    $("tile-hits").textContent = reads ? (100 * sample.hits / reads).toFixed(1) + "%" : "-";
+
+    if (lastSample) {
+        const dt = (Date.parse(sample.time) - Date.parse(lastSample.time)) / 1000 || 1;
+        const rps = (sample.requests - lastSample.requests) / dt;
+        const hits = sample.hits - lastSample.hits, misses = sample.misses - lastSample.misses;
+        $("tile-rps").textContent = formatNumber(rps);
+        push("requests", rps);
+        push("errors", (sample.errors - lastSample.errors) / dt);
+        push("hits", hits + misses ? 100 * hits / (hits + misses) : NaN);
+    }
+    push("keys", sample.keys);
+    push("heap", sample.heap_bytes / (1 << 20));
+    lastSample = sample;
+
+    drawChart($("chart-requests"), [
+        {values: series.requests, color: "#007acc", label: formatNumber},
+        {values: series.errors, color: "#c62828", label: formatNumber},
+    ]);
+    drawChart($("chart-hits"), [
+        {values: series.hits, color: "#007acc", max: 100, label: () => "100%"},
+    ]);
+    drawChart($("chart-keys"), [
+        {values: series.keys, color: "#007acc", max: Math.max(...series.keys), label: formatNumber},
+        {values: series.heap, color: "#c62828", max: Math.max(...series.heap), label: m => m.toFixed(1) + " MiB"},
+    ]);
+}
+
+function setStatus(state, text) {
+    $("status").className = "status " + state;
+    $("status").textContent = text;
+}
+
+function connectStats() {
+    const source = new EventSource(api + "/events");
+    source.addEventListener("stats", e => onStats(JSON.parse(e.data)));
+    source.onopen = () => setStatus("live", "live");
+    // EventSource reconnects by itself, for instance after a restart.
+    source.onerror = () => setStatus("down", "reconnecting...");
+}
+
+// ---- Key browser
+
+// pages holds the cursor and offset of every page up to the current one, so
+// Previous can go back; the server only pages forwards.
+let pages = [{after: "", offset: 0}];
+let nextCursor = "";
+let selectedKey = null;
+
+async function loadPage() {
+    const page = pages[pages.length - 1];
+    const params = new URLSearchParams({q: $("query").value, limit: $("limit").value, after: page.after});
+    const tbody = $("entries");
+    let body;
+    try {
+        const resp = await fetch(api + "/entries?" + params, {cache: "no-store"});
+        body = await resp.json();
+    } catch (e) {
+        body = {success: false, error: String(e)};
+    }
+    if (!body.success) {
+        tbody.replaceChildren(el("tr", {}, el("td", {colspan: "4", class: "muted"}, body.error)));
+        return;
+    }
+
+    const {total, entries, next} = body.data;
+    tbody.replaceChildren(...entries.map(entry => {
+        const row = el("tr", {},
+            el("td", {class: "key"}, entry.key),
+            el("td", {}, entry.type),
+            el("td", {}, formatBytes(entry.size)),
+            el("td", {}, formatTTL(entry.ttl_seconds) + (entry.stale ? " (stale)" : "")));
+        if (entry.key === selectedKey) row.classList.add("selected");
+        row.addEventListener("click", () => inspect(entry));
+        return row;
+    }));
+    if (!entries.length) {
+        tbody.append(el("tr", {}, el("td", {colspan: "4", class: "muted"}, "No keys found.")));
+    }
+    $("page-info").textContent = entries.length
+        ? (page.offset + 1) + "-" + (page.offset + entries.length) + " of " + total
+        : total + " keys";
+    $("prev").disabled = pages.length === 1;
+    $("next").disabled = !next;
+    nextCursor = next;
+    page.count = entries.length;
+}
+
+function resetPages() {
+    pages = [{after: "", offset: 0}];
+    loadPage();
+}
+
+let searchTimer;
+$("query").addEventListener("input", () => {
+    clearTimeout(searchTimer);
+    searchTimer = setTimeout(resetPages, 250);
+});
+$("search").addEventListener("submit", e => { e.preventDefault(); resetPages(); });
+$("limit").addEventListener("change", resetPages);
+$("next").addEventListener("click", () => {
+    const page = pages[pages.length - 1];
+    pages.push({after: nextCursor, offset: page.offset + page.count});
+    loadPage();
+});
+$("prev").addEventListener("click", () => {
+    pages.pop();
+    loadPage();
+});
+
+// ---- Inspector
+
+const collections = ["list", "hash", "set", "zset"];
+
+// current is the entry being edited: its key, ETag, and how its value is
+// sent back. It is null for a new key.
+let current = null;
+let blobURL = null;
+
+function isText(contentType) {
+    return /^text\/|[/+](json|xml|javascript|csv|yaml)\b/.test(contentType);
+}
+
+function showResult(text) {
+    $("inspect-result").textContent = text;
+}
+
+function openEditor(title, meta) {
+    $("inspector").hidden = false;
+    $("inspect-title").textContent = title;
+    $("inspect-meta").textContent = meta;
+    $("value-view").replaceChildren();
+    $("edit-value").value = "";
+    $("edit-value").hidden = false;
+    $("edit-value").readOnly = false;
+    $("save").disabled = false;
+    showResult("");
+    if (blobURL) {
+        URL.revokeObjectURL(blobURL);
+        blobURL = null;
+    }
+}
+
+async function inspect(entry) {
+    selectedKey = entry.key;
+    for (const row of $("entries").children) {
+        row.classList.toggle("selected", row.firstChild.textContent === entry.key);
+    }
+
+    const resp = await fetch(entryURL(entry.key), {cache: "no-store"});
+    if (resp.status === 404) {
+        showResult("The key no longer exists.");
+        loadPage();
+        return;
+    }
+    current = {key: entry.key, etag: resp.headers.get("ETag"), mode: "json"};
+    openEditor(entry.key, entry.type + ", " + formatBytes(entry.size) + ", expires " +
+        (entry.expires_at ? new Date(entry.expires_at).toLocaleString() + " (" + formatTTL(entry.ttl_seconds) + ")" : "never"));
+    $("key-field").hidden = true;
+    $("mode-field").hidden = true;
+    $("edit-ttl").value = entry.ttl_seconds ? entry.ttl_seconds + "s" : "";
+
+    if (entry.type === "raw") {
+        const contentType = resp.headers.get("Content-Type") || "";
+        const encoding = resp.headers.get("Content-Encoding");
+        const blob = await resp.blob();
+        if (isText(contentType) && !encoding) {
+            current.mode = "raw";
+            current.contentType = contentType;
+            $("edit-value").value = await blob.text();
+            $("value-view").append(el("p", {class: "muted"}, "Stored as " + contentType + "."));
+            return;
+        }
+        blobURL = URL.createObjectURL(blob);
+        $("edit-value").hidden = true;
+        $("save").disabled = true;
+        $("value-view").append(el("p", {class: "muted"},
+            "Binary value, " + (contentType || "no content type") + (encoding ? ", " + encoding : "") + ". ",
+            el("a", {href: blobURL, download: entry.key}, "Download")));
+        if (contentType.startsWith("image/")) $("value-view").append(el("img", {src: blobURL, alt: entry.key}));
+        return;
+    }
+
+    const body = await resp.json();
+    if (collections.includes(entry.type)) {
+        $("edit-value").hidden = true;
+        $("save").disabled = true;
+        $("value-view").append(
+            el("pre", {}, JSON.stringify(body.data, null, 2)),
+            el("p", {class: "muted"}, "Collections change through their own endpoints; see the API documentation."));
+        return;
+    }
+    if (entry.type === "string") {
+        current.mode = "string";
+        $("edit-value").value = body.data;
+    } else {
+        $("edit-value").value = JSON.stringify(body.data, null, 2);
+    }
+}
+
+$("new-key").addEventListener("click", () => {
+    current = null;
+    selectedKey = null;
+    openEditor("New key", "The value is stored as JSON, or as a string.");
+    $("key-field").hidden = false;
+    $("mode-field").hidden = false;
+    $("edit-key").value = "";
+    $("edit-ttl").value = "";
+    $("edit-key").focus();
+});
+
+async function send(method, url, init) {
+    try {
+        const resp = await fetch(url, {method, cache: "no-store", ...init});
+        const body = await resp.json();
+        if (resp.status === 412) {
+            return {ok: false, text: "The value changed since it was loaded. Reload it before saving."};
+        }
+        return {ok: body.success, text: body.success ? body.message : body.error};
+    } catch (e) {
+        return {ok: false, text: "Request failed: " + e};
+    }
+}
+
+$("save").addEventListener("click", async () => {
+    const key = current ? current.key : $("edit-key").value;
+    if (!key) {
+        showResult("A key is required.");
+        return;
+    }
+    const mode = current ? current.mode : $("edit-mode").value;
+    const text = $("edit-value").value;
+    let body = text, contentType = "application/json";
+    if (mode === "raw") {
+        contentType = current.contentType;
+    } else if (mode === "string") {
+        body = JSON.stringify(text);
+    } else {
+        try {
+            JSON.parse(text);
+        } catch (e) {
+            showResult("Invalid JSON: " + e.message);
+            return;
+        }
+    }
+
+    const headers = {"Content-Type": contentType};
+    // Never overwrite a change made since the value was loaded, nor an
+    // existing key from the new key form.
+    if (current && current.etag) headers["If-Match"] = current.etag;
+    if (!current) headers["If-None-Match"] = "*";
+    const ttl = $("edit-ttl").value.trim();
+    const result = await send("PUT", entryURL(key) + (ttl ? "?ttl=" + encodeURIComponent(ttl) : ""), {headers, body});
+    showResult(result.text);
+    if (result.ok) await refresh(key);
+});
+
+$("set-ttl").addEventListener("click", async () => {
+    if (!current) {
+        showResult("Save the key first.");
+        return;
+    }
+    const ttl = $("edit-ttl").value.trim();
+    if (!ttl) {
+        showResult("Enter a TTL such as 10m.");
+        return;
+    }
+    const result = await send("PATCH", entryURL(current.key) + "?ttl=" + encodeURIComponent(ttl));
+    showResult(result.text);
+    if (result.ok) await refresh(current.key);
+});
+
+$("delete").addEventListener("click", async () => {
+    if (!current || !confirm("Delete '" + current.key + "'?")) return;
+    const result = await send("DELETE", entryURL(current.key));
+    if (result.ok) {
+        current = null;
+        selectedKey = null;
+        $("inspector").hidden = true;
+    } else {
+        showResult(result.text);
+    }
+    loadPage();
+});
+
+// refresh reloads the listing and the edited key after a change.
+async function refresh(key) {
+    await loadPage();
+    const message = $("inspect-result").textContent;
+    const resp = await fetch(api + "/entries?" + new URLSearchParams({q: key, limit: "500"}), {cache: "no-store"});
+    const body = await resp.json();
+    const entry = body.success && body.data.entries.find(e => e.key === key);
+    if (entry) {
+        await inspect(entry);
+        showResult(message);
+    }
+}
+
+connectStats();
+loadPage();